@@ -1,12 +1,15 @@
 package authenticator
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
-	"os"
 	"time"
 
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/health"
+
 	cfclient "github.com/cloudfoundry-community/go-cfclient"
+	"golang.org/x/oauth2"
 )
 
 type Authenticator interface {
@@ -14,17 +17,28 @@ type Authenticator interface {
 }
 
 type BasicAuthenticator struct {
-	cfURL      string
-	httpClient *http.Client
+	cfURL             string
+	skipSslValidation bool
+	userAgent         string
+	httpClient        *http.Client
+	uaaHealth         *health.Tracker
 }
 
-func NewBasicAuthenticator(cfURL string, httpClient *http.Client) *BasicAuthenticator {
+// NewBasicAuthenticator logs users in with UAA. It records whether UAA is
+// working in uaaHealth, which can be nil.
+func NewBasicAuthenticator(
+	cfURL string,
+	skipSslValidation bool,
+	userAgent string,
+	httpClient *http.Client,
+	uaaHealth *health.Tracker,
+) *BasicAuthenticator {
 	if httpClient == nil {
 		httpClient = &http.Client{
 			Timeout: 10 * time.Second,
 		}
 	}
-	return &BasicAuthenticator{cfURL, httpClient}
+	return &BasicAuthenticator{cfURL, skipSslValidation, userAgent, httpClient, uaaHealth}
 }
 
 func (a *BasicAuthenticator) Authenticate(username, password string) (User, error) {
@@ -32,14 +46,28 @@ func (a *BasicAuthenticator) Authenticate(username, password string) (User, erro
 		ApiAddress:        a.cfURL,
 		Username:          username,
 		Password:          password,
-		SkipSslValidation: os.Getenv("CF_SKIP_SSL_VALIDATION") == "true",
-		UserAgent:         os.Getenv("CF_USER_AGENT"),
+		SkipSslValidation: a.skipSslValidation,
+		UserAgent:         a.userAgent,
 		HttpClient:        a.httpClient,
 	})
 	if err != nil {
+		if !isRejectedCredentials(err) {
+			a.uaaHealth.RecordError(err)
+		}
 		return nil, fmt.Errorf("error authenticating user: %v", err)
 	}
+	a.uaaHealth.RecordSuccess()
 	return &BasicUser{cfClient, username}, nil
 }
 
+// isRejectedCredentials says whether UAA turned down the user's credentials,
+// as opposed to failing to answer
+func isRejectedCredentials(err error) bool {
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) && retrieveErr.Response != nil {
+		return retrieveErr.Response.StatusCode >= 400 && retrieveErr.Response.StatusCode < 500
+	}
+	return false
+}
+
 var _ Authenticator = (*BasicAuthenticator)(nil)
@@ -3,8 +3,10 @@ package authenticator_test
 import (
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/alphagov/paas-prometheus-endpoints/pkg/authenticator"
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/health"
 	"github.com/alphagov/paas-prometheus-endpoints/pkg/testsupport"
 
 	"code.cloudfoundry.org/lager"
@@ -15,8 +17,10 @@ import (
 
 var _ = Describe("Authenticator", func() {
 	var basicAuthenticator *authenticator.BasicAuthenticator
+	var uaaHealth *health.Tracker
 
 	BeforeEach(func() {
+		uaaHealth = health.NewTracker("uaa")
 		httpmock.Reset()
 		httpclient := &http.Client{Transport: &http.Transport{}}
 		httpmock.ActivateNonDefault(httpclient)
@@ -25,7 +29,7 @@ var _ = Describe("Authenticator", func() {
 		logger := lager.NewLogger("authenticator-test")
 		logger.RegisterSink(lager.NewWriterSink(GinkgoWriter, lager.INFO))
 
-		basicAuthenticator = authenticator.NewBasicAuthenticator(testsupport.CfApiUrl, httpclient)
+		basicAuthenticator = authenticator.NewBasicAuthenticator(testsupport.CfApiUrl, false, "", httpclient, uaaHealth)
 	})
 
 	Context("BasicAuthenticator", func() {
@@ -35,6 +39,7 @@ var _ = Describe("Authenticator", func() {
 			user, err := basicAuthenticator.Authenticate("user", "pass")
 			Expect(err).ToNot(HaveOccurred())
 			Expect(user.Username()).To(Equal("user"))
+			Expect(uaaHealth.LastSuccess()).To(BeTemporally("~", time.Now(), time.Second))
 
 			httpmockInfo := httpmock.GetCallCountInfo()
 			Expect(httpmockInfo[fmt.Sprintf("GET %s/v2/info", testsupport.CfApiUrl)]).Should(Equal(1))
@@ -48,11 +53,24 @@ var _ = Describe("Authenticator", func() {
 			user, err := basicAuthenticator.Authenticate("user", "pass")
 			Expect(err).To(HaveOccurred())
 			Expect(user).To(BeNil())
+			Expect(uaaHealth.LastError()).NotTo(HaveOccurred())
 
 			httpmockInfo := httpmock.GetCallCountInfo()
 			Expect(httpmockInfo[fmt.Sprintf("GET %s/v2/info", testsupport.CfApiUrl)]).Should(Equal(1))
 			Expect(httpmockInfo[fmt.Sprintf("POST %s/oauth/token", testsupport.UaaApiUrl)]).Should(Equal(1))
 			Expect(httpmockInfo).To(HaveLen(2))
 		})
+
+		It("records UAA as unhealthy if it cannot be reached", func() {
+			httpmock.RegisterResponder(
+				"POST",
+				fmt.Sprintf("%s/oauth/token", testsupport.UaaApiUrl),
+				httpmock.NewStringResponder(502, "Bad Gateway"),
+			)
+
+			_, err := basicAuthenticator.Authenticate("user", "pass")
+			Expect(err).To(HaveOccurred())
+			Expect(uaaHealth.LastError()).To(HaveOccurred())
+		})
 	})
 })
@@ -0,0 +1,219 @@
+package cf_v3
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
+)
+
+// TimestampFormat is the format the v3 API uses for timestamps and expects
+// in timestamp filters
+const TimestampFormat = time.RFC3339
+
+// guidsPerRequest keeps the URLs of requests filtered by GUID a sensible
+// length
+const guidsPerRequest = 100
+
+type Organization struct {
+	Guid      string `json:"guid"`
+	Name      string `json:"name"`
+	CreatedAt string `json:"created_at"`
+	UpdatedAt string `json:"updated_at"`
+	Suspended bool   `json:"suspended"`
+}
+
+// ToV2 converts the org to the type the rest of the app uses
+func (o Organization) ToV2() cfclient.Org {
+	status := "active"
+	if o.Suspended {
+		status = "suspended"
+	}
+	return cfclient.Org{
+		Guid:      o.Guid,
+		Name:      o.Name,
+		CreatedAt: o.CreatedAt,
+		UpdatedAt: o.UpdatedAt,
+		Status:    status,
+	}
+}
+
+type Space struct {
+	Guid          string `json:"guid"`
+	Name          string `json:"name"`
+	CreatedAt     string `json:"created_at"`
+	UpdatedAt     string `json:"updated_at"`
+	Relationships struct {
+		Organization struct {
+			Data struct {
+				Guid string `json:"guid"`
+			} `json:"data"`
+		} `json:"organization"`
+	} `json:"relationships"`
+}
+
+// ToV2 converts the space to the type the rest of the app uses
+func (s Space) ToV2() cfclient.Space {
+	return cfclient.Space{
+		Guid:             s.Guid,
+		Name:             s.Name,
+		CreatedAt:        s.CreatedAt,
+		UpdatedAt:        s.UpdatedAt,
+		OrganizationGuid: s.Relationships.Organization.Data.Guid,
+	}
+}
+
+type AuditEvent struct {
+	Guid      string `json:"guid"`
+	Type      string `json:"type"`
+	CreatedAt string `json:"created_at"`
+	Target    struct {
+		Guid string `json:"guid"`
+		Type string `json:"type"`
+		Name string `json:"name"`
+	} `json:"target"`
+}
+
+type listResponse[T any] struct {
+	Pagination struct {
+		Next *cfclient.Link `json:"next"`
+	} `json:"pagination"`
+	Resources []T `json:"resources"`
+}
+
+// ListResources fetches every page of a v3 list endpoint
+func ListResources[T any](
+	cfClient cfclient.CloudFoundryClient,
+	path string,
+	query url.Values,
+) ([]T, error) {
+	resources := []T{}
+	requestURL := path
+	if len(query) > 0 {
+		requestURL = fmt.Sprintf("%s?%s", path, query.Encode())
+	}
+
+	for requestURL != "" {
+		resp, err := cfClient.DoRequest(cfClient.NewRequest("GET", requestURL))
+		if err != nil {
+			return nil, fmt.Errorf("error requesting %s: %v", path, err)
+		}
+
+		var page listResponse[T]
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error decoding %s: %v", path, err)
+		}
+		resources = append(resources, page.Resources...)
+
+		requestURL = ""
+		if page.Pagination.Next != nil && page.Pagination.Next.Href != "" {
+			nextURL, err := url.Parse(page.Pagination.Next.Href)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing next page of %s: %v", path, err)
+			}
+			requestURL = nextURL.RequestURI()
+		}
+	}
+
+	return resources, nil
+}
+
+// ListUpdatedSince lists the resources at a v3 list endpoint, for example
+// "/v3/spaces", which have been created or renamed since the given time
+func ListUpdatedSince[T any](cfClient cfclient.CloudFoundryClient, path string, since time.Time) ([]T, error) {
+	return ListResources[T](cfClient, path, url.Values{
+		"updated_ats[gt]": {since.UTC().Format(TimestampFormat)},
+		"per_page":        {"5000"},
+	})
+}
+
+// ListByGuids lists the resources at a v3 list endpoint with the given
+// GUIDs. GUIDs which do not exist are left out.
+func ListByGuids[T any](cfClient cfclient.CloudFoundryClient, path string, guids []string) ([]T, error) {
+	resources := []T{}
+	for start := 0; start < len(guids); start += guidsPerRequest {
+		end := start + guidsPerRequest
+		if end > len(guids) {
+			end = len(guids)
+		}
+		page, err := ListResources[T](cfClient, path, url.Values{
+			"guids":    {strings.Join(guids[start:end], ",")},
+			"per_page": {"5000"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		resources = append(resources, page...)
+	}
+	return resources, nil
+}
+
+// ListDeletedSince returns the GUIDs of the resources which audit events say
+// have been deleted since the given time. The event type is something like
+// "audit.space.delete-request".
+func ListDeletedSince(cfClient cfclient.CloudFoundryClient, eventType string, since time.Time) ([]string, error) {
+	events, err := ListResources[AuditEvent](cfClient, "/v3/audit_events", url.Values{
+		"types":           {eventType},
+		"created_ats[gt]": {since.UTC().Format(TimestampFormat)},
+		"per_page":        {"5000"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	guids := []string{}
+	for _, event := range events {
+		guids = append(guids, event.Target.Guid)
+	}
+	return guids, nil
+}
+
+// ApplyChanges returns a copy of resources with the updated ones merged in
+// and the deleted ones removed. It does not modify resources, so it is safe
+// to use on a value that readers might be using.
+func ApplyChanges[T any](
+	resources []T,
+	guidOf func(T) string,
+	updated []T,
+	merge func(existing T, update T) T,
+	deletedGuids []string,
+) []T {
+	deleted := map[string]bool{}
+	for _, guid := range deletedGuids {
+		deleted[guid] = true
+	}
+	updatesByGuid := map[string]T{}
+	updateOrder := []string{}
+	for _, resource := range updated {
+		guid := guidOf(resource)
+		if _, ok := updatesByGuid[guid]; !ok {
+			updateOrder = append(updateOrder, guid)
+		}
+		updatesByGuid[guid] = resource
+	}
+
+	result := make([]T, 0, len(resources)+len(updated))
+	for _, resource := range resources {
+		guid := guidOf(resource)
+		if deleted[guid] {
+			continue
+		}
+		if update, ok := updatesByGuid[guid]; ok {
+			resource = merge(resource, update)
+			delete(updatesByGuid, guid)
+		}
+		result = append(result, resource)
+	}
+	for _, guid := range updateOrder {
+		update, ok := updatesByGuid[guid]
+		if !ok || deleted[guid] {
+			continue
+		}
+		result = append(result, update)
+	}
+	return result
+}
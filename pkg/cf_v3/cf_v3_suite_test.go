@@ -0,0 +1,13 @@
+package cf_v3_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestCfV3(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "CfV3 Suite")
+}
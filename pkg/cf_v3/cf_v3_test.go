@@ -0,0 +1,161 @@
+package cf_v3_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/cf_v3"
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/testsupport"
+
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
+	"github.com/jarcoal/httpmock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ListResources", func() {
+	var cfClient *cfclient.Client
+
+	BeforeEach(func() {
+		httpmock.Reset()
+		httpclient := &http.Client{Transport: &http.Transport{}}
+		httpmock.ActivateNonDefault(httpclient)
+		testsupport.SetupCfV2InfoHttpmock()
+		testsupport.SetupSuccessfulUaaOauthLoginHttpmock()
+
+		var err error
+		cfClient, err = cfclient.NewClient(&cfclient.Config{
+			ApiAddress: testsupport.CfApiUrl,
+			HttpClient: httpclient,
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("follows the pagination links", func() {
+		httpmock.RegisterResponderWithQuery(
+			"GET",
+			fmt.Sprintf("%s/v3/organizations", testsupport.CfApiUrl),
+			url.Values{"names": {"a,b"}},
+			httpmock.NewJsonResponderOrPanic(200, map[string]interface{}{
+				"pagination": map[string]interface{}{
+					"next": map[string]interface{}{
+						"href": fmt.Sprintf("%s/v3/organizations?names=a,b&page=2", testsupport.CfApiUrl),
+					},
+				},
+				"resources": []map[string]interface{}{{"guid": "org-a", "name": "a"}},
+			}),
+		)
+		httpmock.RegisterResponderWithQuery(
+			"GET",
+			fmt.Sprintf("%s/v3/organizations", testsupport.CfApiUrl),
+			url.Values{"names": {"a,b"}, "page": {"2"}},
+			httpmock.NewJsonResponderOrPanic(200, map[string]interface{}{
+				"pagination": map[string]interface{}{"next": nil},
+				"resources":  []map[string]interface{}{{"guid": "org-b", "name": "b", "suspended": true}},
+			}),
+		)
+
+		orgs, err := cf_v3.ListResources[cf_v3.Organization](cfClient, "/v3/organizations", url.Values{"names": {"a,b"}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(orgs).To(Equal([]cf_v3.Organization{
+			{Guid: "org-a", Name: "a"},
+			{Guid: "org-b", Name: "b", Suspended: true},
+		}))
+	})
+
+	It("returns an error if the API fails", func() {
+		testsupport.SetupCfApiOutageHttpmock("/v3/spaces", nil)
+		_, err := cf_v3.ListResources[cf_v3.Space](cfClient, "/v3/spaces", nil)
+		Expect(err).To(MatchError(ContainSubstring("error requesting /v3/spaces")))
+	})
+})
+
+var _ = Describe("ListByGuids", func() {
+	var cfClient *cfclient.Client
+
+	BeforeEach(func() {
+		httpmock.Reset()
+		httpclient := &http.Client{Transport: &http.Transport{}}
+		httpmock.ActivateNonDefault(httpclient)
+		testsupport.SetupCfV2InfoHttpmock()
+		testsupport.SetupSuccessfulUaaOauthLoginHttpmock()
+
+		var err error
+		cfClient, err = cfclient.NewClient(&cfclient.Config{
+			ApiAddress: testsupport.CfApiUrl,
+			HttpClient: httpclient,
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("fetches the spaces in batches, leaving out ones which do not exist", func() {
+		resources := []map[string]interface{}{}
+		guids := []string{}
+		for i := 0; i < 150; i++ {
+			guid := fmt.Sprintf("space-%d", i)
+			guids = append(guids, guid)
+			resources = append(resources, map[string]interface{}{
+				"guid": guid,
+				"name": fmt.Sprintf("space %d", i),
+				"relationships": map[string]interface{}{
+					"organization": map[string]interface{}{
+						"data": map[string]interface{}{"guid": "org-guid"},
+					},
+				},
+			})
+		}
+		testsupport.SetupCfV3ListByGuidsHttpmock("/v3/spaces", resources)
+
+		spaces, err := cf_v3.ListByGuids[cf_v3.Space](cfClient, "/v3/spaces", append(guids, "deleted-space"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(spaces).To(HaveLen(150))
+		Expect(spaces[149].ToV2()).To(Equal(cfclient.Space{
+			Guid:             "space-149",
+			Name:             "space 149",
+			OrganizationGuid: "org-guid",
+		}))
+		Expect(httpmock.GetCallCountInfo()["GET http://cf.api/v3/spaces"]).To(Equal(2))
+	})
+
+	It("makes no requests if there are no GUIDs", func() {
+		spaces, err := cf_v3.ListByGuids[cf_v3.Space](cfClient, "/v3/spaces", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(spaces).To(BeEmpty())
+		Expect(httpmock.GetCallCountInfo()["GET http://cf.api/v3/spaces"]).To(Equal(0))
+	})
+})
+
+var _ = Describe("ApplyChanges", func() {
+	type resource struct {
+		guid    string
+		name    string
+		details string
+	}
+	guidOf := func(r resource) string { return r.guid }
+	merge := func(existing resource, update resource) resource {
+		existing.name = update.name
+		return existing
+	}
+
+	It("merges updates, appends new resources and removes deleted ones without modifying the input", func() {
+		resources := []resource{
+			{"1", "one", "kept"},
+			{"2", "two", "kept"},
+			{"3", "three", "kept"},
+		}
+		result := cf_v3.ApplyChanges(
+			resources,
+			guidOf,
+			[]resource{{"2", "TWO", ""}, {"4", "four", ""}, {"5", "five", ""}},
+			merge,
+			[]string{"3", "5"},
+		)
+		Expect(result).To(Equal([]resource{
+			{"1", "one", "kept"},
+			{"2", "TWO", "kept"},
+			{"4", "four", ""},
+		}))
+		Expect(resources[1].name).To(Equal("two"))
+	})
+})
@@ -1,98 +1,338 @@
 package config
 
 import (
+	"fmt"
 	"net/http"
 	"os"
-	"strconv"
+	"regexp"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/logging"
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/tls_config"
+
 	"code.cloudfoundry.org/lager"
 	cfclient "github.com/cloudfoundry-community/go-cfclient"
 )
 
 type Config struct {
-	DeployEnv  string
-	AWSRegion  string
-	Logger     lager.Logger
+	DeployEnv string
+	AWSRegion string
+	// AWSAccessKeyID and AWSSecretAccessKey are optional. If they are not
+	// set, the AWS SDK finds credentials in its usual places.
+	AWSAccessKeyID     string
+	AWSSecretAccessKey string
+	Logger             lager.Logger
+	LogLevel           lager.LogLevel
+	LogFormat          string
+	// LogSink changes the log level while the app is running
+	LogSink    *lager.ReconfigurableSink
 	ListenPort uint
 
-	CFClientConfig *cfclient.Config
-	ServiceName    string
+	// TLSListenPort serves the app over TLS too, if it is set. The plain
+	// HTTP port then only serves the health checks.
+	TLSListenPort   uint
+	TLSCertFile     string
+	TLSKeyFile      string
+	TLSClientCAFile string
+	TLSMinVersion   uint16
+	// TLSReloadInterval is how often to check the certificate files for
+	// changes
+	TLSReloadInterval time.Duration
+
+	CFClientConfig       *cfclient.Config
+	ServiceNames         []string
+	ServiceBroker        string
+	ExcludedServicePlans *regexp.Regexp
+
+	// ScopeToServiceInstances only fetches the spaces and orgs which have
+	// instances of the service, found with an index of every instance
+	ScopeToServiceInstances bool
+
+	ServicePlanUpdateSchedule   time.Duration
+	InstanceIndexUpdateSchedule time.Duration
+	SpaceUpdateSchedule         time.Duration
+	OrgUpdateSchedule           time.Duration
+	// ReplicationGroupUpdateSchedule is how often the Redis exporter
+	// refreshes its copy of the ElastiCache replication groups
+	ReplicationGroupUpdateSchedule time.Duration
+	// EventUpdateSchedule is how often the Redis exporter asks ElastiCache
+	// for new events
+	EventUpdateSchedule time.Duration
+	FullSyncSchedule    time.Duration
+	MaxDataStaleness    time.Duration
+	FetcherMinBackoff   time.Duration
+	FetcherMaxBackoff   time.Duration
+	CacheDir            string
+
+	// RedisMetricSource is where the Redis exporter gets its metrics:
+	// "cloudwatch", or "info" to run INFO on each node
+	RedisMetricSource string
+	// RedisSecretsManagerPath is where the elasticache broker keeps each
+	// instance's auth token
+	RedisSecretsManagerPath string
+	RedisTimeout            time.Duration
+	// RedisMetricCatalogueFile lists the CloudWatch metrics to fetch, instead
+	// of the built-in list
+	RedisMetricCatalogueFile string
+
+	// CloudWatchMaxParallelBatches is how many batches of 500 queries a
+	// scrape fetches at once
+	CloudWatchMaxParallelBatches uint
+	// CloudWatchRequestsPerSecond limits the GetMetricData calls made by all
+	// scrapes together, to stay under the account's limit. 0 means no limit.
+	CloudWatchRequestsPerSecond uint
+	// CloudWatchMaxThrottlingRetries is how many times to try a throttled
+	// GetMetricData call again
+	CloudWatchMaxThrottlingRetries uint
+	// CloudWatchDatapoints is "window" for one datapoint covering the whole
+	// window, "all" for every datapoint in it or "latest" for the newest
+	CloudWatchDatapoints string
+	// CloudWatchWindow is how much time the metrics cover, ending
+	// CloudWatchLag before the scrape
+	CloudWatchWindow time.Duration
+	CloudWatchLag    time.Duration
+	// CloudWatchPeriod is how long each datapoint covers, unless
+	// CloudWatchDatapoints is "window"
+	CloudWatchPeriod time.Duration
+
+	// Metrics are the names of the metrics to export. Empty means all of
+	// them.
+	Metrics []string
 
-	ServicePlanUpdateSchedule time.Duration
-	SpaceUpdateSchedule time.Duration
-	OrgUpdateSchedule time.Duration
+	MinScrapeInterval time.Duration
+
+	UserDailyQueryBudget   uint
+	UserMonthlyQueryBudget uint
+	OrgDailyQueryBudget    uint
+	OrgMonthlyQueryBudget  uint
+	// BudgetInstances is the number of instances of the app. Each instance
+	// keeps its own usage, so enforces this share of each budget.
+	BudgetInstances uint
+
+	AuthTimeout time.Duration
+
+	InternalMetricsUsername string
+	InternalMetricsPassword string
+
+	resolved map[string]string
+	origins  map[string]string
 }
 
-func NewConfigFromEnv(defaultServiceName string) Config {
-	return Config{
-		DeployEnv:  GetEnvWithDefaultString("DEPLOY_ENV", "dev"),
-		AWSRegion:  os.Getenv("AWS_REGION"),
-		Logger:     getDefaultLogger(),
-		ListenPort: GetEnvWithDefaultInt("PORT", 9299),
+// Load reads the configuration from a YAML or JSON file, if path is not
+// empty, with environment variables taking precedence over the file. It
+// returns a *ValidationError listing every problem it finds. knownMetrics
+// are the metric names the app can export, or nil to accept any.
+func Load(path string, defaultServiceName string, knownMetrics []string) (Config, error) {
+	cfg, err := parse(path, defaultServiceName, knownMetrics)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Logger, cfg.LogSink, err = logging.NewLogger("prometheus-endpoint", os.Stdout, cfg.LogLevel, cfg.LogFormat)
+	if err != nil {
+		return cfg, fmt.Errorf("error creating logger: %v", err)
+	}
+	return cfg, nil
+}
+
+// parse reads and validates the configuration like Load, without creating a
+// logger, so that it can be read again without replacing the app's logger
+func parse(path string, defaultServiceName string, knownMetrics []string) (Config, error) {
+	l := newLoader(path)
+
+	logLevel, err := logging.ParseLevel(l.string("log_level", "LOG_LEVEL", "info"))
+	if err != nil {
+		l.problem("log_level", "LOG_LEVEL", "%v", err)
+		logLevel = lager.INFO
+	}
+	logFormat := l.string("log_format", "LOG_FORMAT", logging.FormatJSON)
+	if !contains(logging.Formats, logFormat) {
+		l.problem("log_format", "LOG_FORMAT", "%q is not one of %s", logFormat, strings.Join(logging.Formats, ", "))
+		logFormat = logging.FormatJSON
+	}
+
+	cfg := Config{
+		DeployEnv: l.string("deploy_env", "DEPLOY_ENV", "dev"),
+		AWSRegion: l.string("aws_region", "AWS_REGION", ""),
+
+		AWSAccessKeyID:     l.string("aws_access_key_id", "AWS_ACCESS_KEY_ID", ""),
+		AWSSecretAccessKey: l.string("aws_secret_access_key", "AWS_SECRET_ACCESS_KEY", ""),
+		LogLevel:           logLevel,
+		LogFormat:          logFormat,
+		ListenPort:         l.uint("listen_port", "PORT", 9299),
 
 		CFClientConfig: &cfclient.Config{
-			ApiAddress:        os.Getenv("CF_API_ADDRESS"),
-			Username:          os.Getenv("CF_USERNAME"),
-			Password:          os.Getenv("CF_PASSWORD"),
-			ClientID:          os.Getenv("CF_CLIENT_ID"),
-			ClientSecret:      os.Getenv("CF_CLIENT_SECRET"),
-			SkipSslValidation: os.Getenv("CF_SKIP_SSL_VALIDATION") == "true",
-			Token:             os.Getenv("CF_TOKEN"),
-			UserAgent:         os.Getenv("CF_USER_AGENT"),
+			ApiAddress:        l.url("cf.api_address", "CF_API_ADDRESS"),
+			Username:          l.string("cf.username", "CF_USERNAME", ""),
+			Password:          l.string("cf.password", "CF_PASSWORD", ""),
+			ClientID:          l.string("cf.client_id", "CF_CLIENT_ID", ""),
+			ClientSecret:      l.string("cf.client_secret", "CF_CLIENT_SECRET", ""),
+			SkipSslValidation: l.bool("cf.skip_ssl_validation", "CF_SKIP_SSL_VALIDATION", false),
+			Token:             l.string("cf.token", "CF_TOKEN", ""),
+			UserAgent:         l.string("cf.user_agent", "CF_USER_AGENT", ""),
 			HttpClient: &http.Client{
-				Timeout: 30 * time.Second,
+				Timeout: l.positiveDuration("cf.timeout", "CF_TIMEOUT", 30*time.Second),
 			},
 		},
-		ServiceName: GetEnvWithDefaultString("SERVICE_NAME", defaultServiceName),
+		ServiceNames:         l.stringList("service.names", "SERVICE_NAME", []string{defaultServiceName}),
+		ServiceBroker:        l.string("service.broker", "SERVICE_BROKER", ""),
+		ExcludedServicePlans: l.regexp("service.excluded_plans", "EXCLUDED_SERVICE_PLANS"),
+
+		ScopeToServiceInstances: l.bool("service.scope_to_service_instances", "SCOPE_TO_SERVICE_INSTANCES", false),
+
+		ServicePlanUpdateSchedule:      l.positiveDuration("fetchers.service_plan_update_schedule", "SERVICE_PLAN_UPDATE_SCHEDULE", 15*time.Minute),
+		InstanceIndexUpdateSchedule:    l.positiveDuration("fetchers.instance_index_update_schedule", "INSTANCE_INDEX_UPDATE_SCHEDULE", 1*time.Minute),
+		SpaceUpdateSchedule:            l.positiveDuration("fetchers.space_update_schedule", "SPACE_UPDATE_SCHEDULE", 1*time.Minute),
+		OrgUpdateSchedule:              l.positiveDuration("fetchers.org_update_schedule", "ORG_UPDATE_SCHEDULE", 1*time.Minute),
+		ReplicationGroupUpdateSchedule: l.positiveDuration("fetchers.replication_group_update_schedule", "REPLICATION_GROUP_UPDATE_SCHEDULE", 1*time.Minute),
+		EventUpdateSchedule:            l.positiveDuration("fetchers.event_update_schedule", "EVENT_UPDATE_SCHEDULE", 1*time.Minute),
+		FullSyncSchedule:               l.duration("fetchers.full_sync_schedule", "FULL_SYNC_SCHEDULE", 1*time.Hour),
+		MaxDataStaleness:               l.duration("fetchers.max_data_staleness", "MAX_DATA_STALENESS", 2*time.Hour),
+		FetcherMinBackoff:              l.duration("fetchers.min_backoff", "FETCHER_MIN_BACKOFF", 0),
+		FetcherMaxBackoff:              l.duration("fetchers.max_backoff", "FETCHER_MAX_BACKOFF", 0),
+		CacheDir:                       l.string("fetchers.cache_dir", "CACHE_DIR", ""),
 
-		ServicePlanUpdateSchedule: GetEnvWithDefaultDuration("SERVICE_PLAN_UPDATE_SCHEDULE", 15*time.Minute),
-		SpaceUpdateSchedule: GetEnvWithDefaultDuration("SPACE_UPDATE_SCHEDULE", 15*time.Minute),
-		OrgUpdateSchedule: GetEnvWithDefaultDuration("ORG_UPDATE_SCHEDULE", 15*time.Minute),
+		RedisMetricSource:        l.string("redis.metric_source", "REDIS_METRIC_SOURCE", "cloudwatch"),
+		RedisSecretsManagerPath:  strings.TrimRight(l.string("redis.secrets_manager_path", "REDIS_SECRETS_MANAGER_PATH", ""), "/"),
+		RedisTimeout:             l.positiveDuration("redis.timeout", "REDIS_TIMEOUT", 5*time.Second),
+		RedisMetricCatalogueFile: l.string("redis.metric_catalogue_file", "REDIS_METRIC_CATALOGUE_FILE", ""),
+
+		CloudWatchMaxParallelBatches:   l.uint("cloudwatch.max_parallel_batches", "CLOUDWATCH_MAX_PARALLEL_BATCHES", 4),
+		CloudWatchRequestsPerSecond:    l.uint("cloudwatch.requests_per_second", "CLOUDWATCH_REQUESTS_PER_SECOND", 50),
+		CloudWatchMaxThrottlingRetries: l.uint("cloudwatch.max_throttling_retries", "CLOUDWATCH_MAX_THROTTLING_RETRIES", 5),
+		CloudWatchDatapoints:           l.string("cloudwatch.datapoints", "CLOUDWATCH_DATAPOINTS", "window"),
+		CloudWatchWindow:               l.positiveDuration("cloudwatch.window", "CLOUDWATCH_WINDOW", 5*time.Minute),
+		CloudWatchLag:                  l.duration("cloudwatch.lag", "CLOUDWATCH_LAG", 2*time.Minute),
+		CloudWatchPeriod:               l.positiveDuration("cloudwatch.period", "CLOUDWATCH_PERIOD", 1*time.Minute),
+
+		Metrics: l.stringList("metrics", "METRICS", nil),
+
+		MinScrapeInterval: l.duration("scrape.min_interval", "MIN_SCRAPE_INTERVAL", 0),
+
+		UserDailyQueryBudget:   l.uint("budgets.user_daily", "USER_DAILY_QUERY_BUDGET", 0),
+		UserMonthlyQueryBudget: l.uint("budgets.user_monthly", "USER_MONTHLY_QUERY_BUDGET", 0),
+		OrgDailyQueryBudget:    l.uint("budgets.org_daily", "ORG_DAILY_QUERY_BUDGET", 0),
+		OrgMonthlyQueryBudget:  l.uint("budgets.org_monthly", "ORG_MONTHLY_QUERY_BUDGET", 0),
+		BudgetInstances:        l.uint("budgets.instances", "BUDGET_INSTANCES", 1),
+
+		AuthTimeout: l.positiveDuration("auth.timeout", "AUTH_TIMEOUT", 10*time.Second),
+
+		TLSListenPort:     l.uint("tls.listen_port", "TLS_PORT", 0),
+		TLSCertFile:       l.string("tls.cert_file", "TLS_CERT_FILE", ""),
+		TLSKeyFile:        l.string("tls.key_file", "TLS_KEY_FILE", ""),
+		TLSClientCAFile:   l.string("tls.client_ca_file", "TLS_CLIENT_CA_FILE", ""),
+		TLSReloadInterval: l.positiveDuration("tls.reload_interval", "TLS_RELOAD_INTERVAL", 1*time.Minute),
+
+		InternalMetricsUsername: l.string("internal_metrics.username", "INTERNAL_METRICS_USERNAME", ""),
+		InternalMetricsPassword: l.string("internal_metrics.password", "INTERNAL_METRICS_PASSWORD", ""),
 	}
-}
 
-func GetEnvWithDefaultDuration(k string, def time.Duration) time.Duration {
-	v := GetEnvWithDefaultString(k, "")
-	if v == "" {
-		return def
+	cf := cfg.CFClientConfig
+	if !(cf.Username != "" && cf.Password != "") && !(cf.ClientID != "" && cf.ClientSecret != "") && cf.Token == "" {
+		l.problems = append(l.problems, "cf: set a username and password, a client_id and client_secret, or a token")
+	}
+	if cfg.ListenPort == 0 || cfg.ListenPort > 65535 {
+		l.problem("listen_port", "PORT", "%d is not a port number", cfg.ListenPort)
 	}
-	d, err := time.ParseDuration(v)
+	tlsMinVersion := l.string("tls.min_version", "TLS_MIN_VERSION", "1.2")
+	cfg.TLSMinVersion, err = tls_config.ParseMinVersion(tlsMinVersion)
 	if err != nil {
-		panic(err)
+		l.problem("tls.min_version", "TLS_MIN_VERSION", "%v", err)
 	}
-	return d
-}
-
-func GetEnvWithDefaultString(k string, def string) string {
-	v := os.Getenv(k)
-	if v == "" {
-		return def
+	if cfg.TLSListenPort != 0 || cfg.TLSCertFile != "" || cfg.TLSKeyFile != "" || cfg.TLSClientCAFile != "" {
+		if cfg.TLSListenPort == 0 || cfg.TLSCertFile == "" || cfg.TLSKeyFile == "" {
+			l.problems = append(l.problems, "tls: set the listen_port, cert_file and key_file to serve TLS, or none of them")
+		}
+		if cfg.TLSListenPort > 65535 || (cfg.TLSListenPort != 0 && cfg.TLSListenPort == cfg.ListenPort) {
+			l.problem("tls.listen_port", "TLS_PORT", "%d is not a port number other than listen_port", cfg.TLSListenPort)
+		}
+		for _, file := range []struct{ key, env, path string }{
+			{"tls.cert_file", "TLS_CERT_FILE", cfg.TLSCertFile},
+			{"tls.key_file", "TLS_KEY_FILE", cfg.TLSKeyFile},
+			{"tls.client_ca_file", "TLS_CLIENT_CA_FILE", cfg.TLSClientCAFile},
+		} {
+			if file.path == "" {
+				continue
+			}
+			if _, err := os.Stat(file.path); err != nil {
+				l.problem(file.key, file.env, "%v", err)
+			}
+		}
+	}
+	switch cfg.RedisMetricSource {
+	case "cloudwatch":
+	case "info":
+		if cfg.RedisSecretsManagerPath == "" {
+			l.problem("redis.secrets_manager_path", "REDIS_SECRETS_MANAGER_PATH", "must be set when redis.metric_source is info")
+		}
+	default:
+		l.problem("redis.metric_source", "REDIS_METRIC_SOURCE", "%q is not one of cloudwatch or info", cfg.RedisMetricSource)
+	}
+	switch cfg.CloudWatchDatapoints {
+	case "window", "all", "latest":
+	default:
+		l.problem("cloudwatch.datapoints", "CLOUDWATCH_DATAPOINTS", "%q is not one of window, all, latest", cfg.CloudWatchDatapoints)
 	}
-	return v
+	// CloudWatch only has standard resolution ElastiCache metrics, in whole
+	// minutes
+	if cfg.CloudWatchWindow%time.Minute != 0 {
+		l.problem("cloudwatch.window", "CLOUDWATCH_WINDOW", "must be a whole number of minutes")
+	}
+	if cfg.CloudWatchPeriod%time.Minute != 0 {
+		l.problem("cloudwatch.period", "CLOUDWATCH_PERIOD", "must be a whole number of minutes")
+	} else if cfg.CloudWatchDatapoints != "window" && cfg.CloudWatchPeriod > 0 && cfg.CloudWatchWindow%cfg.CloudWatchPeriod != 0 {
+		l.problem("cloudwatch.window", "CLOUDWATCH_WINDOW", "must be a whole number of periods (cloudwatch.period)")
+	}
+	if cfg.BudgetInstances == 0 {
+		l.problem("budgets.instances", "BUDGET_INSTANCES", "must be at least 1")
+	}
+	if cfg.CloudWatchMaxParallelBatches == 0 {
+		l.problem("cloudwatch.max_parallel_batches", "CLOUDWATCH_MAX_PARALLEL_BATCHES", "must be at least 1")
+	}
+	if cfg.FetcherMaxBackoff > 0 && cfg.FetcherMaxBackoff < cfg.FetcherMinBackoff {
+		l.problem("fetchers.max_backoff", "FETCHER_MAX_BACKOFF", "must not be less than fetchers.min_backoff")
+	}
+	if (cfg.InternalMetricsUsername == "") != (cfg.InternalMetricsPassword == "") {
+		l.problems = append(l.problems, "internal_metrics: set both the username and the password, or neither")
+	}
+	if (cfg.AWSAccessKeyID == "") != (cfg.AWSSecretAccessKey == "") {
+		l.problems = append(l.problems, "aws: set both aws_access_key_id and aws_secret_access_key, or neither")
+	}
+	if knownMetrics != nil {
+		for _, metric := range cfg.Metrics {
+			if !contains(knownMetrics, metric) {
+				l.problem("metrics", "METRICS", "%q is not one of %s", metric, strings.Join(knownMetrics, ", "))
+			}
+		}
+	}
+	l.checkUnknownKeys()
+
+	cfg.resolved = l.resolved
+	cfg.origins = l.origins
+
+	return cfg, l.err()
 }
 
-func GetEnvWithDefaultInt(k string, def uint) uint {
-	v := os.Getenv(k)
-	if v == "" {
-		return def
+// SettingOrigins lists the settings which came from each source, such as
+// "environment" or "vcap-services:<service name>", so that where a setting
+// came from can be logged without logging its value
+func (c Config) SettingOrigins() map[string][]string {
+	settingsByOrigin := map[string][]string{}
+	for key, origin := range c.origins {
+		settingsByOrigin[origin] = append(settingsByOrigin[origin], key)
 	}
-	d, err := strconv.ParseUint(v, 10, 32)
-	if err != nil {
-		panic(err)
+	for _, keys := range settingsByOrigin {
+		sort.Strings(keys)
 	}
-	return uint(d)
+	return settingsByOrigin
 }
 
-func getDefaultLogger() lager.Logger {
-	logger := lager.NewLogger("prometheus-endpoint")
-	logLevel := lager.INFO
-	// FIXME: Allow choices other than INFO and DEBUG`
-	if strings.ToLower(os.Getenv("LOG_LEVEL")) == "debug" {
-		logLevel = lager.DEBUG
+func contains(list []string, item string) bool {
+	for _, i := range list {
+		if i == item {
+			return true
+		}
 	}
-	logger.RegisterSink(lager.NewWriterSink(os.Stdout, logLevel))
-
-	return logger
+	return false
 }
@@ -0,0 +1,421 @@
+package config_test
+
+import (
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/config"
+
+	"code.cloudfoundry.org/lager"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Config", func() {
+	var dir string
+
+	writeFile := func(name, contents string) string {
+		path := filepath.Join(dir, name)
+		Expect(os.WriteFile(path, []byte(contents), 0o600)).To(Succeed())
+		return path
+	}
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		for _, env := range []string{
+			"CF_API_ADDRESS", "CF_USERNAME", "CF_PASSWORD", "CF_CLIENT_ID", "CF_CLIENT_SECRET", "CF_TOKEN",
+			"LOG_LEVEL", "LOG_FORMAT", "PORT", "SERVICE_NAME", "MIN_SCRAPE_INTERVAL", "SPACE_UPDATE_SCHEDULE",
+			"USER_DAILY_QUERY_BUDGET", "INTERNAL_METRICS_USERNAME", "INTERNAL_METRICS_PASSWORD", "METRICS",
+			"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "VCAP_SERVICES", "CONFIG_SERVICE_NAME",
+			"TLS_PORT", "TLS_CERT_FILE", "TLS_KEY_FILE", "TLS_CLIENT_CA_FILE", "TLS_MIN_VERSION",
+		} {
+			GinkgoT().Setenv(env, "")
+		}
+	})
+
+	It("loads settings from a YAML file", func() {
+		path := writeFile("config.yml", `
+log_level: debug
+listen_port: 8080
+cf:
+  api_address: https://api.example.com
+  client_id: exporter
+  client_secret: secret
+service:
+  names: [redis, redis-tls]
+fetchers:
+  space_update_schedule: 5m
+  min_backoff: 1s
+  max_backoff: 1m
+metrics: [cpu_utilization]
+budgets:
+  user_daily: 100
+`)
+		cfg, err := config.Load(path, "redis", []string{"cpu_utilization", "evictions"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.LogLevel).To(Equal(lager.DEBUG))
+		Expect(cfg.ListenPort).To(Equal(uint(8080)))
+		Expect(cfg.CFClientConfig.ApiAddress).To(Equal("https://api.example.com"))
+		Expect(cfg.ServiceNames).To(Equal([]string{"redis", "redis-tls"}))
+		Expect(cfg.SpaceUpdateSchedule).To(Equal(5 * time.Minute))
+		Expect(cfg.OrgUpdateSchedule).To(Equal(1 * time.Minute))
+		Expect(cfg.FetcherMinBackoff).To(Equal(1 * time.Second))
+		Expect(cfg.FetcherMaxBackoff).To(Equal(1 * time.Minute))
+		Expect(cfg.Metrics).To(Equal([]string{"cpu_utilization"}))
+		Expect(cfg.UserDailyQueryBudget).To(Equal(uint(100)))
+	})
+
+	It("loads settings from a JSON file", func() {
+		path := writeFile("config.json", `{
+  "cf": {"api_address": "https://api.example.com", "token": "a-token"},
+  "scrape": {"min_interval": "30s"}
+}`)
+		cfg, err := config.Load(path, "postgres", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.CFClientConfig.Token).To(Equal("a-token"))
+		Expect(cfg.ServiceNames).To(Equal([]string{"postgres"}))
+		Expect(cfg.MinScrapeInterval).To(Equal(30 * time.Second))
+	})
+
+	It("lets environment variables override the file", func() {
+		path := writeFile("config.yml", `
+listen_port: 8080
+cf:
+  api_address: https://api.example.com
+  token: a-token
+`)
+		GinkgoT().Setenv("PORT", "9000")
+		GinkgoT().Setenv("SERVICE_NAME", "redis,redis-tls")
+		cfg, err := config.Load(path, "redis", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.ListenPort).To(Equal(uint(9000)))
+		Expect(cfg.ServiceNames).To(Equal([]string{"redis", "redis-tls"}))
+	})
+
+	It("works with only environment variables", func() {
+		GinkgoT().Setenv("CF_API_ADDRESS", "https://api.example.com")
+		GinkgoT().Setenv("CF_USERNAME", "user")
+		GinkgoT().Setenv("CF_PASSWORD", "pass")
+		cfg, err := config.Load("", "redis", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.CFClientConfig.Username).To(Equal("user"))
+		Expect(cfg.ListenPort).To(Equal(uint(9299)))
+	})
+
+	It("reports every problem at once", func() {
+		path := writeFile("config.yml", `
+log_level: loud
+listen_port: 70000
+cf:
+  api_address: not-a-url
+fetchers:
+  space_update_schedule: 0s
+  min_backoff: 1m
+  max_backoff: 1s
+  sapce_update_schedule: 1m
+service:
+  excluded_plans: "("
+metrics: [made_up]
+internal_metrics:
+  username: admin
+cloudwatch:
+  max_parallel_batches: 0
+  datapoints: sometimes
+  period: 90s
+`)
+		_, err := config.Load(path, "redis", []string{"cpu_utilization"})
+		Expect(err).To(HaveOccurred())
+		validationErr, ok := err.(*config.ValidationError)
+		Expect(ok).To(BeTrue())
+		Expect(validationErr.Problems).To(ConsistOf(
+			ContainSubstring("log_level (LOG_LEVEL)"),
+			ContainSubstring("listen_port (PORT)"),
+			ContainSubstring("cf.api_address (CF_API_ADDRESS)"),
+			ContainSubstring("cf: set a username and password"),
+			ContainSubstring("fetchers.space_update_schedule (SPACE_UPDATE_SCHEDULE): must be more than zero"),
+			ContainSubstring("fetchers.max_backoff (FETCHER_MAX_BACKOFF)"),
+			ContainSubstring("fetchers.sapce_update_schedule: unknown setting"),
+			ContainSubstring("service.excluded_plans (EXCLUDED_SERVICE_PLANS)"),
+			ContainSubstring(`"made_up" is not one of cpu_utilization`),
+			ContainSubstring("internal_metrics: set both"),
+			ContainSubstring("cloudwatch.max_parallel_batches (CLOUDWATCH_MAX_PARALLEL_BATCHES): must be at least 1"),
+			ContainSubstring(`cloudwatch.datapoints (CLOUDWATCH_DATAPOINTS): "sometimes" is not one of window, all, latest`),
+			ContainSubstring("cloudwatch.period (CLOUDWATCH_PERIOD): must be a whole number of minutes"),
+		))
+		Expect(err.Error()).To(HavePrefix("the configuration has 13 problem(s):"))
+	})
+
+	It("only splits the CloudWatch window into whole periods", func() {
+		GinkgoT().Setenv("CF_API_ADDRESS", "https://api.example.com")
+		GinkgoT().Setenv("CF_TOKEN", "a-token")
+		GinkgoT().Setenv("CLOUDWATCH_WINDOW", "5m")
+		GinkgoT().Setenv("CLOUDWATCH_PERIOD", "2m")
+		_, err := config.Load("", "redis", nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		GinkgoT().Setenv("CLOUDWATCH_DATAPOINTS", "all")
+		_, err = config.Load("", "redis", nil)
+		Expect(err).To(MatchError(ContainSubstring("cloudwatch.window (CLOUDWATCH_WINDOW): must be a whole number of periods")))
+	})
+
+	It("builds a logger in the chosen format", func() {
+		GinkgoT().Setenv("CF_API_ADDRESS", "https://api.example.com")
+		GinkgoT().Setenv("CF_TOKEN", "a-token")
+		GinkgoT().Setenv("LOG_FORMAT", "text")
+		GinkgoT().Setenv("LOG_LEVEL", "ERROR")
+		cfg, err := config.Load("", "redis", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.LogFormat).To(Equal("text"))
+		Expect(cfg.LogSink.GetMinLevel()).To(Equal(lager.ERROR))
+
+		GinkgoT().Setenv("LOG_FORMAT", "xml")
+		_, err = config.Load("", "redis", nil)
+		Expect(err).To(MatchError(ContainSubstring(`log_format (LOG_FORMAT): "xml" is not one of json, text`)))
+	})
+
+	It("checks the TLS settings together", func() {
+		GinkgoT().Setenv("CF_API_ADDRESS", "https://api.example.com")
+		GinkgoT().Setenv("CF_TOKEN", "a-token")
+		certFile := writeFile("tls.crt", "certificate")
+		keyFile := writeFile("tls.key", "key")
+
+		GinkgoT().Setenv("TLS_PORT", "9443")
+		GinkgoT().Setenv("TLS_CERT_FILE", certFile)
+		GinkgoT().Setenv("TLS_KEY_FILE", keyFile)
+		GinkgoT().Setenv("TLS_MIN_VERSION", "1.3")
+		cfg, err := config.Load("", "redis", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.TLSListenPort).To(Equal(uint(9443)))
+		Expect(cfg.TLSMinVersion).To(Equal(uint16(tls.VersionTLS13)))
+
+		GinkgoT().Setenv("TLS_PORT", "9299")
+		GinkgoT().Setenv("TLS_KEY_FILE", "")
+		GinkgoT().Setenv("TLS_CLIENT_CA_FILE", filepath.Join(dir, "missing.crt"))
+		GinkgoT().Setenv("TLS_MIN_VERSION", "1.0")
+		_, err = config.Load("", "redis", nil)
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*config.ValidationError).Problems).To(ConsistOf(
+			ContainSubstring("tls: set the listen_port, cert_file and key_file"),
+			ContainSubstring("tls.listen_port (TLS_PORT): 9299 is not a port number other than listen_port"),
+			ContainSubstring("tls.client_ca_file (TLS_CLIENT_CA_FILE)"),
+			ContainSubstring("tls.min_version (TLS_MIN_VERSION)"),
+		))
+	})
+
+	It("reports a file which cannot be parsed", func() {
+		path := writeFile("config.yml", "cf: [")
+		_, err := config.Load(path, "redis", nil)
+		Expect(err).To(MatchError(ContainSubstring("error parsing config file")))
+	})
+})
+
+// vcapServices is what Cloud Foundry sets VCAP_SERVICES to for an app bound
+// to a tagged user-provided service, an untagged one and a database
+const vcapServices = `{
+  "user-provided": [
+    {
+      "name": "exporter-secrets",
+      "label": "user-provided",
+      "tags": ["prometheus-endpoint-config"],
+      "credentials": {
+        "CF_CLIENT_SECRET": "secret-from-vcap",
+        "AWS_ACCESS_KEY_ID": "AKIAEXAMPLE",
+        "AWS_SECRET_ACCESS_KEY": "aws-secret-from-vcap",
+        "budgets": {"user_daily": 20}
+      }
+    },
+    {
+      "name": "exporter-settings",
+      "label": "user-provided",
+      "tags": [],
+      "credentials": {
+        "SERVICE_BROKER": "named-broker"
+      }
+    }
+  ],
+  "postgres": [
+    {
+      "name": "some-database",
+      "label": "postgres",
+      "tags": ["postgres"],
+      "credentials": {
+        "CF_CLIENT_SECRET": "not-this-one",
+        "password": "database-password"
+      }
+    }
+  ]
+}`
+
+var _ = Describe("Config from VCAP_SERVICES", func() {
+	BeforeEach(func() {
+		for _, env := range []string{
+			"CF_API_ADDRESS", "CF_USERNAME", "CF_PASSWORD", "CF_CLIENT_ID", "CF_CLIENT_SECRET", "CF_TOKEN",
+			"SERVICE_BROKER", "USER_DAILY_QUERY_BUDGET", "AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY",
+			"CONFIG_SERVICE_NAME",
+		} {
+			GinkgoT().Setenv(env, "")
+		}
+		GinkgoT().Setenv("CF_API_ADDRESS", "https://api.example.com")
+		GinkgoT().Setenv("CF_CLIENT_ID", "exporter")
+		GinkgoT().Setenv("VCAP_SERVICES", vcapServices)
+	})
+
+	It("reads settings from services with the config tag", func() {
+		cfg, err := config.Load("", "redis", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.CFClientConfig.ClientSecret).To(Equal("secret-from-vcap"))
+		Expect(cfg.AWSAccessKeyID).To(Equal("AKIAEXAMPLE"))
+		Expect(cfg.AWSSecretAccessKey).To(Equal("aws-secret-from-vcap"))
+		Expect(cfg.UserDailyQueryBudget).To(Equal(uint(20)))
+		Expect(cfg.ServiceBroker).To(BeEmpty())
+	})
+
+	It("also reads settings from the service named CONFIG_SERVICE_NAME", func() {
+		GinkgoT().Setenv("CONFIG_SERVICE_NAME", "exporter-settings")
+		cfg, err := config.Load("", "redis", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.ServiceBroker).To(Equal("named-broker"))
+		Expect(cfg.CFClientConfig.ClientSecret).To(Equal("secret-from-vcap"))
+	})
+
+	It("prefers environment variables, and prefers VCAP_SERVICES to the config file", func() {
+		path := filepath.Join(GinkgoT().TempDir(), "config.yml")
+		Expect(os.WriteFile(path, []byte(`
+cf:
+  client_secret: secret-from-file
+budgets:
+  user_daily: 10
+  org_daily: 30
+`), 0o600)).To(Succeed())
+		GinkgoT().Setenv("AWS_ACCESS_KEY_ID", "AKIAFROMENV")
+
+		cfg, err := config.Load(path, "redis", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.AWSAccessKeyID).To(Equal("AKIAFROMENV"))
+		Expect(cfg.CFClientConfig.ClientSecret).To(Equal("secret-from-vcap"))
+		Expect(cfg.UserDailyQueryBudget).To(Equal(uint(20)))
+		Expect(cfg.OrgDailyQueryBudget).To(Equal(uint(30)))
+
+		origins := cfg.SettingOrigins()
+		Expect(origins["environment"]).To(ConsistOf("cf.api_address", "cf.client_id", "aws_access_key_id"))
+		Expect(origins["vcap-services:exporter-secrets"]).To(ConsistOf(
+			"cf.client_secret", "aws_secret_access_key", "budgets.user_daily",
+		))
+		Expect(origins["config-file"]).To(ConsistOf("budgets.org_daily"))
+		Expect(origins["default"]).To(ContainElement("listen_port"))
+	})
+
+	It("reports services which disagree about a setting", func() {
+		GinkgoT().Setenv("VCAP_SERVICES", `{"user-provided": [
+  {"name": "first", "tags": ["prometheus-endpoint-config"], "credentials": {"CF_CLIENT_SECRET": "one"}},
+  {"name": "second", "tags": ["prometheus-endpoint-config"], "credentials": {"CF_CLIENT_SECRET": "two"}}
+]}`)
+		_, err := config.Load("", "redis", nil)
+		Expect(err).To(MatchError(ContainSubstring("CF_CLIENT_SECRET: set differently by the first and second services")))
+	})
+
+	It("reports VCAP_SERVICES which cannot be parsed", func() {
+		GinkgoT().Setenv("VCAP_SERVICES", "{")
+		_, err := config.Load("", "redis", nil)
+		Expect(err).To(MatchError(ContainSubstring("error parsing VCAP_SERVICES")))
+	})
+})
+
+var _ = Describe("Reloader", func() {
+	var dir string
+	var path string
+
+	writeConfig := func(contents string) {
+		Expect(os.WriteFile(path, []byte(contents), 0o600)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		path = filepath.Join(dir, "config.yml")
+		for _, env := range []string{
+			"CF_API_ADDRESS", "CF_USERNAME", "CF_PASSWORD", "CF_CLIENT_ID", "CF_CLIENT_SECRET", "CF_TOKEN",
+			"LOG_LEVEL", "PORT", "MIN_SCRAPE_INTERVAL", "USER_DAILY_QUERY_BUDGET",
+			"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "VCAP_SERVICES", "CONFIG_SERVICE_NAME",
+		} {
+			GinkgoT().Setenv(env, "")
+		}
+		writeConfig(`
+listen_port: 8080
+cf:
+  api_address: https://api.example.com
+  token: a-token
+scrape:
+  min_interval: 10s
+`)
+	})
+
+	It("applies the settings which are safe to change and ignores the rest", func() {
+		initial, err := config.Load(path, "redis", nil)
+		Expect(err).NotTo(HaveOccurred())
+		reloader := config.NewReloader(path, "redis", nil, initial)
+		var notified config.Config
+		reloader.OnReload(func(cfg config.Config) {
+			notified = cfg
+		})
+
+		writeConfig(`
+log_level: debug
+listen_port: 9090
+cf:
+  api_address: https://api.example.com
+  token: a-token
+scrape:
+  min_interval: 1m
+budgets:
+  user_daily: 50
+`)
+		Expect(reloader.Reload()).To(Succeed())
+
+		current := reloader.Current()
+		Expect(current.LogLevel).To(Equal(lager.DEBUG))
+		Expect(current.MinScrapeInterval).To(Equal(1 * time.Minute))
+		Expect(current.UserDailyQueryBudget).To(Equal(uint(50)))
+		Expect(current.ListenPort).To(Equal(uint(8080)))
+		Expect(notified.MinScrapeInterval).To(Equal(1 * time.Minute))
+	})
+
+	It("keeps the logger and changes the level of the one it has", func() {
+		initial, err := config.Load(path, "redis", nil)
+		Expect(err).NotTo(HaveOccurred())
+		reloader := config.NewReloader(path, "redis", nil, initial)
+
+		writeConfig(`
+log_level: error
+cf:
+  api_address: https://api.example.com
+  token: a-token
+`)
+		Expect(reloader.Reload()).To(Succeed())
+
+		current := reloader.Current()
+		Expect(current.Logger).To(BeIdenticalTo(initial.Logger))
+		Expect(current.LogSink).To(BeIdenticalTo(initial.LogSink))
+		Expect(initial.LogSink.GetMinLevel()).To(Equal(lager.ERROR))
+	})
+
+	It("keeps the current settings if the new ones are invalid", func() {
+		initial, err := config.Load(path, "redis", nil)
+		Expect(err).NotTo(HaveOccurred())
+		reloader := config.NewReloader(path, "redis", nil, initial)
+		reloader.OnReload(func(cfg config.Config) {
+			Fail("listeners should not be called")
+		})
+
+		writeConfig(`
+cf:
+  api_address: https://api.example.com
+  token: a-token
+scrape:
+  min_interval: soon
+`)
+		Expect(reloader.Reload()).To(BeAssignableToTypeOf(&config.ValidationError{}))
+		Expect(reloader.Current().MinScrapeInterval).To(Equal(10 * time.Second))
+	})
+})
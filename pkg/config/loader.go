@@ -0,0 +1,319 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ValidationError lists every problem found with the configuration, so they
+// can all be fixed at once
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf(
+		"the configuration has %d problem(s):\n  %s",
+		len(e.Problems), strings.Join(e.Problems, "\n  "),
+	)
+}
+
+// VCAPServicesTag marks the bound services whose credentials hold settings
+const VCAPServicesTag = "prometheus-endpoint-config"
+
+const (
+	originEnvironment = "environment"
+	originConfigFile  = "config-file"
+	originDefault     = "default"
+)
+
+// loader reads each setting from its environment variable, then from the
+// credentials of a bound service in VCAP_SERVICES, then from the config file.
+// It collects the problems with them instead of stopping at the first.
+type loader struct {
+	file     map[string]string
+	vcap     map[string]vcapSetting
+	used     map[string]bool
+	resolved map[string]string
+	origins  map[string]string
+	problems []string
+}
+
+type vcapSetting struct {
+	value   string
+	service string
+}
+
+func newLoader(path string) *loader {
+	l := &loader{
+		file:     map[string]string{},
+		vcap:     map[string]vcapSetting{},
+		used:     map[string]bool{},
+		resolved: map[string]string{},
+		origins:  map[string]string{},
+	}
+	l.readVCAPServices()
+	if path == "" {
+		return l
+	}
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		l.problems = append(l.problems, fmt.Sprintf("error reading config file: %v", err))
+		return l
+	}
+	// JSON is a subset of YAML, so this reads both
+	var tree map[interface{}]interface{}
+	err = yaml.Unmarshal(contents, &tree)
+	if err != nil {
+		l.problems = append(l.problems, fmt.Sprintf("error parsing config file %s: %v", path, err))
+		return l
+	}
+	flatten(l.file, "", tree)
+	return l
+}
+
+type vcapService struct {
+	Name        string                      `yaml:"name"`
+	Tags        []string                    `yaml:"tags"`
+	Credentials map[interface{}]interface{} `yaml:"credentials"`
+}
+
+// readVCAPServices reads settings from the credentials of the services bound
+// to the app which are named CONFIG_SERVICE_NAME or tagged VCAPServicesTag.
+// Credentials can use either a setting's environment variable name, like
+// CF_CLIENT_SECRET, or its name in the config file, like cf.client_secret, so
+// secrets can be rotated by binding a new user-provided service.
+func (l *loader) readVCAPServices() {
+	vcapServices := os.Getenv("VCAP_SERVICES")
+	if vcapServices == "" {
+		return
+	}
+	var servicesByLabel map[string][]vcapService
+	err := yaml.Unmarshal([]byte(vcapServices), &servicesByLabel)
+	if err != nil {
+		l.problems = append(l.problems, fmt.Sprintf("error parsing VCAP_SERVICES: %v", err))
+		return
+	}
+
+	configServiceName := os.Getenv("CONFIG_SERVICE_NAME")
+	services := []vcapService{}
+	for _, servicesWithLabel := range servicesByLabel {
+		for _, service := range servicesWithLabel {
+			if (configServiceName != "" && service.Name == configServiceName) || hasTag(service, VCAPServicesTag) {
+				services = append(services, service)
+			}
+		}
+	}
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Name < services[j].Name
+	})
+
+	for _, service := range services {
+		credentials := map[string]string{}
+		flatten(credentials, "", service.Credentials)
+		for key, value := range credentials {
+			if existing, ok := l.vcap[key]; ok && existing.value != value {
+				l.problems = append(l.problems, fmt.Sprintf(
+					"%s: set differently by the %s and %s services in VCAP_SERVICES",
+					key, existing.service, service.Name,
+				))
+				continue
+			}
+			l.vcap[key] = vcapSetting{value: value, service: service.Name}
+		}
+	}
+}
+
+func hasTag(service vcapService, tag string) bool {
+	for _, t := range service.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// flatten turns nested sections into dotted keys like "cf.api_address" and
+// lists into comma-separated strings, the same as their environment variables
+func flatten(into map[string]string, prefix string, tree map[interface{}]interface{}) {
+	for rawKey, value := range tree {
+		key := fmt.Sprint(rawKey)
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		switch value := value.(type) {
+		case map[interface{}]interface{}:
+			flatten(into, key, value)
+		case []interface{}:
+			items := []string{}
+			for _, item := range value {
+				items = append(items, fmt.Sprint(item))
+			}
+			into[key] = strings.Join(items, ",")
+		case nil:
+			into[key] = ""
+		default:
+			into[key] = fmt.Sprint(value)
+		}
+	}
+}
+
+func (l *loader) raw(key, env string) (string, bool) {
+	l.used[key] = true
+	if v := os.Getenv(env); v != "" {
+		l.resolved[key] = v
+		l.origins[key] = originEnvironment
+		return v, true
+	}
+	for _, name := range []string{env, key} {
+		if setting, ok := l.vcap[name]; ok && setting.value != "" {
+			l.resolved[key] = setting.value
+			l.origins[key] = "vcap-services:" + setting.service
+			return setting.value, true
+		}
+	}
+	if v, ok := l.file[key]; ok && v != "" {
+		l.resolved[key] = v
+		l.origins[key] = originConfigFile
+		return v, true
+	}
+	l.origins[key] = originDefault
+	return "", false
+}
+
+func (l *loader) problem(key, env, format string, args ...interface{}) {
+	l.problems = append(l.problems, fmt.Sprintf("%s (%s): %s", key, env, fmt.Sprintf(format, args...)))
+}
+
+func (l *loader) string(key, env string, def string) string {
+	v, ok := l.raw(key, env)
+	if !ok {
+		return def
+	}
+	return v
+}
+
+func (l *loader) stringList(key, env string, def []string) []string {
+	v, ok := l.raw(key, env)
+	if !ok {
+		return def
+	}
+	list := []string{}
+	for _, item := range strings.Split(v, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func (l *loader) bool(key, env string, def bool) bool {
+	v, ok := l.raw(key, env)
+	if !ok {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		l.problem(key, env, "%q is not true or false", v)
+		return def
+	}
+	return b
+}
+
+func (l *loader) uint(key, env string, def uint) uint {
+	v, ok := l.raw(key, env)
+	if !ok {
+		return def
+	}
+	i, err := strconv.ParseUint(v, 10, 32)
+	if err != nil {
+		l.problem(key, env, "%q is not a whole number of zero or more", v)
+		return def
+	}
+	return uint(i)
+}
+
+func (l *loader) duration(key, env string, def time.Duration) time.Duration {
+	v, ok := l.raw(key, env)
+	if !ok {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		l.problem(key, env, "%q is not a duration like 90s or 5m", v)
+		return def
+	}
+	if d < 0 {
+		l.problem(key, env, "%q must not be negative", v)
+		return def
+	}
+	return d
+}
+
+// positiveDuration is for schedules, where zero would mean a busy loop
+func (l *loader) positiveDuration(key, env string, def time.Duration) time.Duration {
+	d := l.duration(key, env, def)
+	if d == 0 {
+		l.problem(key, env, "must be more than zero")
+		return def
+	}
+	return d
+}
+
+func (l *loader) regexp(key, env string) *regexp.Regexp {
+	v, ok := l.raw(key, env)
+	if !ok {
+		return nil
+	}
+	r, err := regexp.Compile(v)
+	if err != nil {
+		l.problem(key, env, "%q is not a valid regular expression: %v", v, err)
+		return nil
+	}
+	return r
+}
+
+func (l *loader) url(key, env string) string {
+	v, ok := l.raw(key, env)
+	if !ok {
+		l.problem(key, env, "must be set")
+		return ""
+	}
+	u, err := url.Parse(v)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		l.problem(key, env, "%q is not an http or https URL", v)
+	}
+	return v
+}
+
+// checkUnknownKeys reports settings in the config file which were never
+// read, which are most likely typos
+func (l *loader) checkUnknownKeys() {
+	unknown := []string{}
+	for key := range l.file {
+		if !l.used[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	for _, key := range unknown {
+		l.problems = append(l.problems, fmt.Sprintf("%s: unknown setting in config file", key))
+	}
+}
+
+func (l *loader) err() error {
+	if len(l.problems) == 0 {
+		return nil
+	}
+	return &ValidationError{Problems: l.problems}
+}
@@ -0,0 +1,156 @@
+package config
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// reloadableSettings can be changed without restarting the app. Changes to
+// any other setting are logged and ignored until the next restart.
+var reloadableSettings = map[string]bool{
+	"log_level":                 true,
+	"scrape.min_interval":       true,
+	"budgets.user_daily":        true,
+	"budgets.user_monthly":      true,
+	"budgets.org_daily":         true,
+	"budgets.org_monthly":       true,
+	"budgets.instances":         true,
+	"internal_metrics.username": true,
+	"internal_metrics.password": true,
+}
+
+// Reloader re-reads the configuration on SIGHUP and applies the settings
+// which are safe to change while the app is running
+type Reloader struct {
+	path               string
+	defaultServiceName string
+	knownMetrics       []string
+	logger             lager.Logger
+
+	mu        sync.Mutex
+	current   Config
+	listeners []func(Config)
+}
+
+func NewReloader(path string, defaultServiceName string, knownMetrics []string, initial Config) *Reloader {
+	return &Reloader{
+		path:               path,
+		defaultServiceName: defaultServiceName,
+		knownMetrics:       knownMetrics,
+		logger:             initial.Logger.Session("config-reloader"),
+		current:            initial,
+	}
+}
+
+// Current returns the configuration with any reloaded settings applied
+func (r *Reloader) Current() Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.current
+}
+
+// OnReload registers a function to call with the new configuration after a
+// successful reload
+func (r *Reloader) OnReload(listener func(Config)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.listeners = append(r.listeners, listener)
+}
+
+// Reload reads the configuration again. If it is invalid nothing changes.
+// The app's logger is kept, and only its level changes.
+func (r *Reloader) Reload() error {
+	loaded, err := parse(r.path, r.defaultServiceName, r.knownMetrics)
+	if err != nil {
+		r.logger.Error("err-reloading-config", err)
+		return err
+	}
+
+	r.mu.Lock()
+	cfg := r.current
+	applied, ignored := changedSettings(cfg.resolved, loaded.resolved)
+	cfg.LogLevel = loaded.LogLevel
+	cfg.MinScrapeInterval = loaded.MinScrapeInterval
+	cfg.UserDailyQueryBudget = loaded.UserDailyQueryBudget
+	cfg.UserMonthlyQueryBudget = loaded.UserMonthlyQueryBudget
+	cfg.OrgDailyQueryBudget = loaded.OrgDailyQueryBudget
+	cfg.OrgMonthlyQueryBudget = loaded.OrgMonthlyQueryBudget
+	cfg.InternalMetricsUsername = loaded.InternalMetricsUsername
+	cfg.InternalMetricsPassword = loaded.InternalMetricsPassword
+	resolved := map[string]string{}
+	for key, value := range cfg.resolved {
+		if !reloadableSettings[key] {
+			resolved[key] = value
+		}
+	}
+	for key, value := range loaded.resolved {
+		if reloadableSettings[key] {
+			resolved[key] = value
+		}
+	}
+	cfg.resolved = resolved
+	r.current = cfg
+	listeners := r.listeners
+	r.mu.Unlock()
+
+	if cfg.LogSink != nil {
+		cfg.LogSink.SetMinLevel(cfg.LogLevel)
+	}
+	for _, listener := range listeners {
+		listener(cfg)
+	}
+	r.logger.Info("reloaded-config", lager.Data{
+		"applied":               applied,
+		"ignored-until-restart": ignored,
+	})
+	return nil
+}
+
+// Run reloads the configuration whenever the process gets SIGHUP, until the
+// context is cancelled
+func (r *Reloader) Run(ctx context.Context) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+	defer signal.Stop(sigChan)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigChan:
+			r.logger.Info("received-sighup")
+			r.Reload()
+		}
+	}
+}
+
+// changedSettings returns the names, never the values, of the settings which
+// differ, split into those which can be reloaded and those which cannot
+func changedSettings(old, new map[string]string) (applied []string, ignored []string) {
+	applied, ignored = []string{}, []string{}
+	keys := map[string]bool{}
+	for key := range old {
+		keys[key] = true
+	}
+	for key := range new {
+		keys[key] = true
+	}
+	for key := range keys {
+		if old[key] == new[key] {
+			continue
+		}
+		if reloadableSettings[key] {
+			applied = append(applied, key)
+		} else {
+			ignored = append(ignored, key)
+		}
+	}
+	sort.Strings(applied)
+	sort.Strings(ignored)
+	return applied, ignored
+}
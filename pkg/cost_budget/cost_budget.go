@@ -0,0 +1,376 @@
+package cost_budget
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/internal_metrics"
+
+	"code.cloudfoundry.org/lager"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const RemainingMetricName = "paas_exporter_cost_budget_remaining"
+
+// Limits are the number of billable queries allowed in each period. Zero
+// means there is no limit for that period.
+type Limits struct {
+	Daily   uint64
+	Monthly uint64
+}
+
+func (l Limits) enabled() bool {
+	return l.Daily > 0 || l.Monthly > 0
+}
+
+// PerInstance is each instance's share of the limits, when the given number
+// of instances of the app enforce them separately. A share is never less than
+// one query, so that dividing a limit doesn't turn it off.
+func (l Limits) PerInstance(instances uint64) Limits {
+	if instances <= 1 {
+		return l
+	}
+	share := func(limit uint64) uint64 {
+		if limit == 0 {
+			return 0
+		}
+		return max(limit/instances, 1)
+	}
+	return Limits{Daily: share(l.Daily), Monthly: share(l.Monthly)}
+}
+
+type ExceededError struct {
+	Scope  string
+	Name   string
+	Period string
+	Limit  uint64
+}
+
+func (e *ExceededError) Error() string {
+	return fmt.Sprintf(
+		"the %s cost budget for %s '%s' has been used up (%d queries), please scrape less often",
+		e.Period, e.Scope, e.Name, e.Limit,
+	)
+}
+
+type usage struct {
+	Day          string `json:"day"`
+	DayQueries   uint64 `json:"day_queries"`
+	Month        string `json:"month"`
+	MonthQueries uint64 `json:"month_queries"`
+}
+
+func (u *usage) rollOver(now time.Time) {
+	day := now.Format("2006-01-02")
+	if u.Day != day {
+		u.Day = day
+		u.DayQueries = 0
+	}
+	month := now.Format("2006-01")
+	if u.Month != month {
+		u.Month = month
+		u.MonthQueries = 0
+	}
+}
+
+// Tracker accounts for the CloudWatch queries made on behalf of each user
+// and each org, and enforces their daily and monthly budgets. Each instance
+// of the app keeps its own usage. A nil *Tracker enforces no budgets.
+type Tracker struct {
+	userLimits Limits
+	orgLimits  Limits
+	// users are keyed by a hash of the username, so that usernames aren't
+	// saved to disk
+	users    map[string]*usage
+	orgs     map[string]*usage
+	month    string
+	changed  bool
+	now      func() time.Time
+	path     string
+	registry *internal_metrics.Registry
+	logger   lager.Logger
+	mu       sync.Mutex
+	// saveMu stops saves overlapping, without holding up Check and Record
+	// while the file is written
+	saveMu sync.Mutex
+}
+
+// NewTracker loads the usage so far from path, if it is set and the file
+// exists. A file which can't be read is logged and the usage starts again.
+func NewTracker(
+	userLimits Limits,
+	orgLimits Limits,
+	path string,
+	registry *internal_metrics.Registry,
+	logger lager.Logger,
+) *Tracker {
+	logger = logger.Session("cost-budget-tracker")
+	t := &Tracker{
+		userLimits: userLimits,
+		orgLimits:  orgLimits,
+		users:      map[string]*usage{},
+		orgs:       map[string]*usage{},
+		now:        func() time.Time { return time.Now().UTC() },
+		path:       path,
+		registry:   registry,
+		logger:     logger,
+	}
+	if path == "" {
+		return t
+	}
+	file, err := readUsageFile(path)
+	if err != nil {
+		t.logger.Error("err-reading-usage", err)
+		return t
+	}
+	if file != nil {
+		t.month = file.Month
+		t.users = file.Users
+		t.orgs = file.Orgs
+		t.logger.Info("restored-usage", lager.Data{
+			"number-of-users": len(t.users),
+			"number-of-orgs":  len(t.orgs),
+		})
+	}
+	return t
+}
+
+// SetLimits changes the budgets, for example when the configuration is
+// reloaded. Usage so far in the current periods is kept.
+func (t *Tracker) SetLimits(userLimits Limits, orgLimits Limits) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.userLimits = userLimits
+	t.orgLimits = orgLimits
+	t.logger.Info("changed-limits", lager.Data{
+		"user-limits": userLimits,
+		"org-limits":  orgLimits,
+	})
+}
+
+// SetClock replaces the source of the current time, for testing
+func (t *Tracker) SetClock(now func() time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.now = now
+}
+
+// Check returns an *ExceededError if the user or any of the orgs has used up
+// one of its budgets
+func (t *Tracker) Check(username string, orgGuids []string) error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+
+	err := checkUsage(t.getUsage(t.users, userKey(username), now), t.userLimits, "user", username)
+	if err == nil {
+		for _, orgGuid := range orgGuids {
+			err = checkUsage(t.getUsage(t.orgs, orgGuid, now), t.orgLimits, "org", orgGuid)
+			if err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		exceededErr := err.(*ExceededError)
+		// Usernames are personal, so only orgs are named in the logs
+		data := lager.Data{
+			"scope":  exceededErr.Scope,
+			"period": exceededErr.Period,
+		}
+		if exceededErr.Scope == "org" {
+			data["org-guid"] = exceededErr.Name
+		}
+		t.logger.Info("budget-exceeded", data)
+		t.registry.AddCounter(
+			"paas_exporter_cost_budget_exceeded_total",
+			"Number of scrapes refused or replayed because a cost budget was used up",
+			internal_metrics.Labels{"scope": exceededErr.Scope, "period": exceededErr.Period},
+			1,
+		)
+	}
+	return err
+}
+
+// Record adds the number of queries made in each org to the user's and the
+// orgs' usage
+func (t *Tracker) Record(username string, queriesByOrg map[string]uint64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+
+	total := uint64(0)
+	for orgGuid, queries := range queriesByOrg {
+		total += queries
+		orgUsage := t.getUsage(t.orgs, orgGuid, now)
+		orgUsage.DayQueries += queries
+		orgUsage.MonthQueries += queries
+		t.recordUsageMetrics("org", orgGuid, orgUsage, queries)
+	}
+
+	userUsage := t.getUsage(t.users, userKey(username), now)
+	userUsage.DayQueries += total
+	userUsage.MonthQueries += total
+	t.recordUsageMetrics("user", username, userUsage, total)
+	t.changed = true
+
+	t.logger.Debug("recorded-usage", lager.Data{
+		"username":       username,
+		"queries":        total,
+		"queries-by-org": queriesByOrg,
+	})
+}
+
+// RemainingMetricFamily describes how much of each budget is left for the
+// user and the orgs, for showing to the tenant. It returns nil if no budgets
+// are configured.
+func (t *Tracker) RemainingMetricFamily(username string, orgGuids []string) *dto.MetricFamily {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.userLimits.enabled() && !t.orgLimits.enabled() {
+		return nil
+	}
+	now := t.now()
+
+	metrics := []*dto.Metric{}
+	metrics = append(metrics, remainingMetrics(t.getUsage(t.users, userKey(username), now), t.userLimits, "user", "")...)
+
+	sortedOrgGuids := append([]string{}, orgGuids...)
+	sort.Strings(sortedOrgGuids)
+	for _, orgGuid := range sortedOrgGuids {
+		metrics = append(metrics, remainingMetrics(t.getUsage(t.orgs, orgGuid, now), t.orgLimits, "org", orgGuid)...)
+	}
+
+	name := RemainingMetricName
+	help := "Number of CloudWatch queries left in the cost budget for the current period"
+	metricType := dto.MetricType_GAUGE
+	return &dto.MetricFamily{
+		Name:   &name,
+		Help:   &help,
+		Type:   &metricType,
+		Metric: metrics,
+	}
+}
+
+func (t *Tracker) getUsage(usages map[string]*usage, key string, now time.Time) *usage {
+	t.forgetOldUsage(now)
+	u, ok := usages[key]
+	if !ok {
+		u = &usage{}
+		usages[key] = u
+	}
+	u.rollOver(now)
+	return u
+}
+
+// forgetOldUsage forgets every user's and org's usage when the month
+// changes, as none of it counts any more, so that users and orgs which stop
+// scraping don't pile up
+func (t *Tracker) forgetOldUsage(now time.Time) {
+	month := now.Format("2006-01")
+	if t.month == month {
+		return
+	}
+	if t.month != "" {
+		t.logger.Info("forgot-old-usage", lager.Data{
+			"number-of-users": len(t.users),
+			"number-of-orgs":  len(t.orgs),
+		})
+	}
+	t.month = month
+	t.changed = true
+	clear(t.users)
+	clear(t.orgs)
+}
+
+// recordUsageMetrics reports spend to operators. Usernames are personal, so
+// the queries made by users are only counted all together.
+func (t *Tracker) recordUsageMetrics(scope string, name string, u *usage, queries uint64) {
+	labels := internal_metrics.Labels{"scope": scope}
+	if scope != "user" {
+		labels["name"] = name
+	}
+	t.registry.AddCounter(
+		"paas_exporter_cost_queries_total",
+		"Number of billable CloudWatch queries made",
+		labels,
+		float64(queries),
+	)
+	if scope == "user" {
+		return
+	}
+	t.registry.SetGauge(
+		"paas_exporter_cost_queries_today",
+		"Number of billable CloudWatch queries made so far today",
+		labels,
+		float64(u.DayQueries),
+	)
+	t.registry.SetGauge(
+		"paas_exporter_cost_queries_this_month",
+		"Number of billable CloudWatch queries made so far this month",
+		labels,
+		float64(u.MonthQueries),
+	)
+}
+
+func checkUsage(u *usage, limits Limits, scope string, name string) error {
+	if limits.Daily > 0 && u.DayQueries >= limits.Daily {
+		return &ExceededError{Scope: scope, Name: name, Period: "daily", Limit: limits.Daily}
+	}
+	if limits.Monthly > 0 && u.MonthQueries >= limits.Monthly {
+		return &ExceededError{Scope: scope, Name: name, Period: "monthly", Limit: limits.Monthly}
+	}
+	return nil
+}
+
+func remainingMetrics(u *usage, limits Limits, scope string, orgGuid string) []*dto.Metric {
+	metrics := []*dto.Metric{}
+	periods := []struct {
+		name  string
+		limit uint64
+		used  uint64
+	}{
+		{"daily", limits.Daily, u.DayQueries},
+		{"monthly", limits.Monthly, u.MonthQueries},
+	}
+	for _, period := range periods {
+		if period.limit == 0 {
+			continue
+		}
+		remaining := float64(0)
+		if period.used < period.limit {
+			remaining = float64(period.limit - period.used)
+		}
+		labels := []*dto.LabelPair{
+			labelPair("period", period.name),
+			labelPair("scope", scope),
+		}
+		if orgGuid != "" {
+			labels = append(labels, labelPair("org_guid", orgGuid))
+		}
+		metrics = append(metrics, &dto.Metric{
+			Label: labels,
+			Gauge: &dto.Gauge{Value: &remaining},
+		})
+	}
+	return metrics
+}
+
+func labelPair(name, value string) *dto.LabelPair {
+	return &dto.LabelPair{Name: &name, Value: &value}
+}
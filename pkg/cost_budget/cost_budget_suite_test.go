@@ -0,0 +1,13 @@
+package cost_budget_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestCostBudget(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "CostBudget Suite")
+}
@@ -0,0 +1,202 @@
+package cost_budget_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/cost_budget"
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/internal_metrics"
+
+	"code.cloudfoundry.org/lager"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Tracker", func() {
+	var logger lager.Logger
+	var registry *internal_metrics.Registry
+	var now time.Time
+
+	BeforeEach(func() {
+		logger = lager.NewLogger("cost-budget-test")
+		logger.RegisterSink(lager.NewWriterSink(GinkgoWriter, lager.INFO))
+		registry = internal_metrics.NewRegistry()
+		now = time.Date(2020, 7, 31, 12, 0, 0, 0, time.UTC)
+	})
+
+	newTrackerSavedTo := func(userLimits, orgLimits cost_budget.Limits, path string) *cost_budget.Tracker {
+		tracker := cost_budget.NewTracker(userLimits, orgLimits, path, registry, logger)
+		tracker.SetClock(func() time.Time { return now })
+		return tracker
+	}
+
+	newTracker := func(userLimits, orgLimits cost_budget.Limits) *cost_budget.Tracker {
+		return newTrackerSavedTo(userLimits, orgLimits, "")
+	}
+
+	It("allows everything when no budgets are configured", func() {
+		tracker := newTracker(cost_budget.Limits{}, cost_budget.Limits{})
+		tracker.Record("user-1", map[string]uint64{"org-1": 1000000})
+		Expect(tracker.Check("user-1", []string{"org-1"})).To(Succeed())
+		Expect(tracker.RemainingMetricFamily("user-1", []string{"org-1"})).To(BeNil())
+	})
+
+	It("refuses a user who has used up their daily budget until the next day", func() {
+		tracker := newTracker(cost_budget.Limits{Daily: 100}, cost_budget.Limits{})
+		tracker.Record("user-1", map[string]uint64{"org-1": 60})
+		Expect(tracker.Check("user-1", nil)).To(Succeed())
+
+		tracker.Record("user-1", map[string]uint64{"org-1": 40})
+		err := tracker.Check("user-1", nil)
+		Expect(err).To(MatchError(&cost_budget.ExceededError{
+			Scope: "user", Name: "user-1", Period: "daily", Limit: 100,
+		}))
+		Expect(tracker.Check("user-2", nil)).To(Succeed())
+
+		now = now.Add(12 * time.Hour)
+		Expect(tracker.Check("user-1", nil)).To(Succeed())
+	})
+
+	It("refuses any user of an org which has used up its monthly budget", func() {
+		tracker := newTracker(cost_budget.Limits{}, cost_budget.Limits{Monthly: 100})
+		tracker.Record("user-1", map[string]uint64{"org-1": 80, "org-2": 30})
+		tracker.Record("user-2", map[string]uint64{"org-1": 20})
+
+		Expect(tracker.Check("user-3", []string{"org-2"})).To(Succeed())
+		Expect(tracker.Check("user-3", []string{"org-2", "org-1"})).To(MatchError(&cost_budget.ExceededError{
+			Scope: "org", Name: "org-1", Period: "monthly", Limit: 100,
+		}))
+
+		now = now.Add(24 * time.Hour)
+		Expect(tracker.Check("user-3", []string{"org-1"})).To(Succeed())
+	})
+
+	It("applies new limits without forgetting usage so far", func() {
+		tracker := newTracker(cost_budget.Limits{}, cost_budget.Limits{})
+		tracker.Record("user-1", map[string]uint64{"org-1": 60})
+		Expect(tracker.Check("user-1", nil)).To(Succeed())
+
+		tracker.SetLimits(cost_budget.Limits{Daily: 50}, cost_budget.Limits{})
+		Expect(tracker.Check("user-1", nil)).To(MatchError(ContainSubstring("daily cost budget")))
+		Expect(tracker.RemainingMetricFamily("user-1", nil)).NotTo(BeNil())
+
+		tracker.SetLimits(cost_budget.Limits{}, cost_budget.Limits{})
+		Expect(tracker.Check("user-1", nil)).To(Succeed())
+	})
+
+	It("describes the remaining budget for the tenant", func() {
+		tracker := newTracker(cost_budget.Limits{Daily: 100, Monthly: 1000}, cost_budget.Limits{Daily: 50})
+		tracker.Record("user-1", map[string]uint64{"org-1": 30})
+
+		metricFamily := tracker.RemainingMetricFamily("user-1", []string{"org-1"})
+		Expect(metricFamily.GetName()).To(Equal(cost_budget.RemainingMetricName))
+		Expect(metricFamily.Metric).To(HaveLen(3))
+		Expect(metricFamily.Metric[0].Gauge.GetValue()).To(Equal(70.0))
+		Expect(metricFamily.Metric[1].Gauge.GetValue()).To(Equal(970.0))
+		Expect(metricFamily.Metric[2].Gauge.GetValue()).To(Equal(20.0))
+	})
+
+	It("reports spend to operators via internal metrics", func() {
+		tracker := newTracker(cost_budget.Limits{Daily: 10}, cost_budget.Limits{})
+		tracker.Record("user-1", map[string]uint64{"org-1": 10})
+		Expect(tracker.Check("user-1", nil)).NotTo(Succeed())
+
+		metricFamilies := registry.Gather()
+		Expect(metricFamilies).To(HaveKey("paas_exporter_cost_queries_total"))
+		Expect(metricFamilies).To(HaveKey("paas_exporter_cost_queries_today"))
+		Expect(metricFamilies).To(HaveKey("paas_exporter_cost_budget_exceeded_total"))
+		Expect(metricFamilies["paas_exporter_cost_budget_exceeded_total"].Metric[0].Counter.GetValue()).To(Equal(1.0))
+	})
+
+	It("doesn't name users in the internal metrics", func() {
+		tracker := newTracker(cost_budget.Limits{Daily: 100}, cost_budget.Limits{})
+		tracker.Record("user-1", map[string]uint64{"org-1": 10})
+		tracker.Record("user-2", map[string]uint64{"org-1": 5})
+
+		labelsByScope := map[string][]map[string]string{}
+		for _, metricFamily := range registry.Gather() {
+			for _, metric := range metricFamily.Metric {
+				labels := map[string]string{}
+				for _, label := range metric.Label {
+					labels[label.GetName()] = label.GetValue()
+				}
+				labelsByScope[labels["scope"]] = append(labelsByScope[labels["scope"]], labels)
+			}
+		}
+		Expect(labelsByScope["user"]).To(Equal([]map[string]string{{"scope": "user"}}))
+		Expect(labelsByScope["org"]).To(ContainElement(map[string]string{"scope": "org", "name": "org-1"}))
+	})
+
+	It("forgets the usage of users and orgs when the month changes", func() {
+		output := &bytes.Buffer{}
+		logger.RegisterSink(lager.NewWriterSink(output, lager.INFO))
+		tracker := newTracker(cost_budget.Limits{Monthly: 100}, cost_budget.Limits{Monthly: 100})
+		tracker.Record("user-1", map[string]uint64{"org-1": 100})
+		Expect(tracker.Check("user-1", []string{"org-1"})).NotTo(Succeed())
+
+		now = now.Add(24 * time.Hour)
+		Expect(tracker.Check("user-2", nil)).To(Succeed())
+		Expect(output.String()).To(ContainSubstring(`"number-of-orgs":1,"number-of-users":1`))
+		Expect(tracker.Check("user-1", []string{"org-1"})).To(Succeed())
+	})
+
+	It("only names orgs in the logs", func() {
+		output := &bytes.Buffer{}
+		logger.RegisterSink(lager.NewWriterSink(output, lager.INFO))
+		tracker := newTracker(cost_budget.Limits{Daily: 10}, cost_budget.Limits{Daily: 10})
+		tracker.Record("user-1", map[string]uint64{"org-1": 10})
+		Expect(tracker.Check("user-1", nil)).NotTo(Succeed())
+		tracker.Record("user-2", map[string]uint64{"org-2": 5})
+		tracker.Record("user-3", map[string]uint64{"org-2": 5})
+		Expect(tracker.Check("user-2", []string{"org-2"})).NotTo(Succeed())
+
+		Expect(output.String()).To(ContainSubstring(`"period":"daily","scope":"user"`))
+		Expect(output.String()).To(ContainSubstring(`"org-guid":"org-2","period":"daily","scope":"org"`))
+		Expect(output.String()).NotTo(ContainSubstring("user-1"))
+		Expect(output.String()).NotTo(ContainSubstring("user-2"))
+	})
+
+	It("carries on from the saved usage after a restart", func() {
+		path := filepath.Join(GinkgoT().TempDir(), "usage.json")
+		tracker := newTrackerSavedTo(cost_budget.Limits{Daily: 100}, cost_budget.Limits{Monthly: 100}, path)
+		tracker.Record("user-1", map[string]uint64{"org-1": 100})
+		Expect(tracker.Save()).To(Succeed())
+
+		contents, err := os.ReadFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(contents)).NotTo(ContainSubstring("user-1"))
+
+		restarted := newTrackerSavedTo(cost_budget.Limits{Daily: 100}, cost_budget.Limits{Monthly: 100}, path)
+		Expect(restarted.Check("user-1", nil)).To(MatchError(&cost_budget.ExceededError{
+			Scope: "user", Name: "user-1", Period: "daily", Limit: 100,
+		}))
+		Expect(restarted.Check("user-2", []string{"org-1"})).To(MatchError(&cost_budget.ExceededError{
+			Scope: "org", Name: "org-1", Period: "monthly", Limit: 100,
+		}))
+
+		now = now.Add(24 * time.Hour)
+		Expect(restarted.Check("user-1", []string{"org-1"})).To(Succeed())
+	})
+
+	It("starts again if the saved usage can't be read", func() {
+		path := filepath.Join(GinkgoT().TempDir(), "usage.json")
+		Expect(os.WriteFile(path, []byte("{"), 0644)).To(Succeed())
+		tracker := newTrackerSavedTo(cost_budget.Limits{Daily: 100}, cost_budget.Limits{}, path)
+		Expect(tracker.Check("user-1", nil)).To(Succeed())
+	})
+})
+
+var _ = Describe("Limits", func() {
+	It("divides the limits between the instances of the app", func() {
+		limits := cost_budget.Limits{Daily: 100, Monthly: 3001}
+		Expect(limits.PerInstance(1)).To(Equal(limits))
+		Expect(limits.PerInstance(2)).To(Equal(cost_budget.Limits{Daily: 50, Monthly: 1500}))
+	})
+
+	It("never turns a limit off or on by dividing it", func() {
+		limits := cost_budget.Limits{Daily: 1}
+		Expect(limits.PerInstance(3)).To(Equal(cost_budget.Limits{Daily: 1}))
+	})
+})
@@ -0,0 +1,123 @@
+package cost_budget
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/store"
+)
+
+// SaveInterval is how often the usage is saved, if it has changed. Queries
+// made since the last save are forgotten if the app restarts.
+const SaveInterval = time.Minute
+
+// usageFileVersion changes whenever the layout of the file changes
+const usageFileVersion = 1
+
+type usageFile struct {
+	Version int               `json:"version"`
+	Month   string            `json:"month"`
+	Users   map[string]*usage `json:"users"`
+	Orgs    map[string]*usage `json:"orgs"`
+}
+
+// Run saves the usage every interval, and once more when the context is
+// cancelled
+func (t *Tracker) Run(ctx context.Context, interval time.Duration) {
+	if t == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := t.Save(); err != nil {
+				t.logger.Error("err-saving-usage", err)
+			}
+			return
+		case <-ticker.C:
+			if err := t.Save(); err != nil {
+				t.logger.Error("err-saving-usage", err)
+			}
+		}
+	}
+}
+
+// Save writes the usage to the file if it has changed
+func (t *Tracker) Save() error {
+	t.saveMu.Lock()
+	defer t.saveMu.Unlock()
+
+	t.mu.Lock()
+	if t.path == "" || !t.changed {
+		t.mu.Unlock()
+		return nil
+	}
+	file := usageFile{
+		Version: usageFileVersion,
+		Month:   t.month,
+		Users:   copyUsages(t.users),
+		Orgs:    copyUsages(t.orgs),
+	}
+	t.changed = false
+	t.mu.Unlock()
+
+	contents, err := json.Marshal(file)
+	if err == nil {
+		err = store.WriteFile(t.path, contents)
+	}
+	if err != nil {
+		t.mu.Lock()
+		t.changed = true
+		t.mu.Unlock()
+		return fmt.Errorf("error saving usage: %v", err)
+	}
+	return nil
+}
+
+func copyUsages(usages map[string]*usage) map[string]*usage {
+	copied := make(map[string]*usage, len(usages))
+	for key, u := range usages {
+		c := *u
+		copied[key] = &c
+	}
+	return copied
+}
+
+// readUsageFile returns nil and no error if there is no file
+func readUsageFile(path string) (*usageFile, error) {
+	contents, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading usage file: %v", err)
+	}
+	var file usageFile
+	err = json.Unmarshal(contents, &file)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing usage file: %v", err)
+	}
+	if file.Version != usageFileVersion {
+		return nil, fmt.Errorf("usage file is version %d, expected version %d", file.Version, usageFileVersion)
+	}
+	if file.Users == nil {
+		file.Users = map[string]*usage{}
+	}
+	if file.Orgs == nil {
+		file.Orgs = map[string]*usage{}
+	}
+	return &file, nil
+}
+
+// userKey is how a user's usage is keyed, so that usernames aren't saved
+func userKey(username string) string {
+	sum := sha256.Sum256([]byte(username))
+	return hex.EncodeToString(sum[:])
+}
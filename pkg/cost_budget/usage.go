@@ -0,0 +1,24 @@
+package cost_budget
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+const usageContextKey = "cost_budget_usage"
+
+// RecordUsage notes that a metric fetcher has made billable queries on
+// behalf of an org while handling the request
+func RecordUsage(c *gin.Context, orgGuid string, queries uint64) {
+	queriesByOrg := UsageFromContext(c)
+	queriesByOrg[orgGuid] += queries
+	c.Set(usageContextKey, queriesByOrg)
+}
+
+// UsageFromContext returns the billable queries recorded so far while
+// handling the request, by org GUID
+func UsageFromContext(c *gin.Context) map[string]uint64 {
+	if v, ok := c.Get(usageContextKey); ok {
+		return v.(map[string]uint64)
+	}
+	return map[string]uint64{}
+}
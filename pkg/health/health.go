@@ -0,0 +1,121 @@
+package health
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Dependency is something the app needs to keep working, such as one of the
+// background stores of CF data
+type Dependency interface {
+	Name() string
+	LastSuccess() time.Time
+	LastError() error
+}
+
+type dependencyStatus struct {
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// HealthEndpoint reports whether the app is running. It always succeeds, but
+// says the app is degraded if any dependency's last refresh failed, in which
+// case the app is serving the last good data it has.
+func HealthEndpoint(dependencies []Dependency) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		message := "online"
+		statuses := map[string]dependencyStatus{}
+		for _, dependency := range dependencies {
+			status := dependencyStatus{}
+			if lastSuccess := dependency.LastSuccess(); !lastSuccess.IsZero() {
+				status.LastSuccess = &lastSuccess
+			}
+			if err := dependency.LastError(); err != nil {
+				message = "degraded"
+				status.Error = err.Error()
+			}
+			statuses[dependency.Name()] = status
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message":      message,
+			"dependencies": statuses,
+		})
+	}
+}
+
+// ReadyEndpoint reports whether the app is ready to serve scrapes. It
+// responds with 503 Service Unavailable until every store has fetched its
+// data for the first time.
+func ReadyEndpoint(stores []Dependency) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		waitingFor := notYetSynced(stores)
+		if len(waitingFor) > 0 {
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"message":     "not ready",
+				"waiting_for": waitingFor,
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"message": "ready",
+		})
+	}
+}
+
+type dependencyDetails struct {
+	LastSuccess         *time.Time `json:"last_success,omitempty"`
+	SecondsSinceSuccess *float64   `json:"seconds_since_success,omitempty"`
+	Error               string     `json:"error,omitempty"`
+}
+
+// HealthDetailsEndpoint describes every dependency in detail, grouped by
+// what kind of dependency it is (for example "cf-api" or "aws"). The app is
+// ready once every dependency in the stores group has synced.
+func HealthDetailsEndpoint(stores []Dependency, others map[string][]Dependency) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		now := time.Now()
+		message := "online"
+		groups := map[string]map[string]dependencyDetails{}
+		addGroup := func(kind string, dependencies []Dependency) {
+			if _, ok := groups[kind]; !ok {
+				groups[kind] = map[string]dependencyDetails{}
+			}
+			for _, dependency := range dependencies {
+				details := dependencyDetails{}
+				if lastSuccess := dependency.LastSuccess(); !lastSuccess.IsZero() {
+					secondsSinceSuccess := now.Sub(lastSuccess).Seconds()
+					details.LastSuccess = &lastSuccess
+					details.SecondsSinceSuccess = &secondsSinceSuccess
+				}
+				if err := dependency.LastError(); err != nil {
+					message = "degraded"
+					details.Error = err.Error()
+				}
+				groups[kind][dependency.Name()] = details
+			}
+		}
+		addGroup("cf-api", stores)
+		for kind, dependencies := range others {
+			addGroup(kind, dependencies)
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message":      message,
+			"ready":        len(notYetSynced(stores)) == 0,
+			"dependencies": groups,
+		})
+	}
+}
+
+func notYetSynced(stores []Dependency) []string {
+	waitingFor := []string{}
+	for _, store := range stores {
+		if store.LastSuccess().IsZero() {
+			waitingFor = append(waitingFor, store.Name())
+		}
+	}
+	return waitingFor
+}
@@ -0,0 +1,183 @@
+package health_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/health"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+type MockDependency struct {
+	MockName        string
+	MockLastSuccess time.Time
+	MockLastError   error
+}
+
+func (d *MockDependency) Name() string {
+	return d.MockName
+}
+
+func (d *MockDependency) LastSuccess() time.Time {
+	return d.MockLastSuccess
+}
+
+func (d *MockDependency) LastError() error {
+	return d.MockLastError
+}
+
+var _ health.Dependency = (*MockDependency)(nil)
+
+var _ = Describe("HealthEndpoint", func() {
+	var orgs *MockDependency
+	var spaces *MockDependency
+	var router *gin.Engine
+
+	BeforeEach(func() {
+		orgs = &MockDependency{MockName: "orgs"}
+		spaces = &MockDependency{MockName: "spaces"}
+
+		router = gin.Default()
+		router.GET("/health", health.HealthEndpoint([]health.Dependency{orgs, spaces}))
+	})
+
+	It("says the app is online when every dependency is fine", func() {
+		orgs.MockLastSuccess = time.Date(2020, 7, 31, 12, 0, 0, 0, time.UTC)
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/health", nil)
+		router.ServeHTTP(w, req)
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(w.Body.String()).To(MatchJSON(`{
+			"message": "online",
+			"dependencies": {
+				"orgs": {"last_success": "2020-07-31T12:00:00Z"},
+				"spaces": {}
+			}
+		}`))
+	})
+
+	It("says the app is degraded when a dependency's last refresh failed", func() {
+		orgs.MockLastSuccess = time.Date(2020, 7, 31, 12, 0, 0, 0, time.UTC)
+		orgs.MockLastError = fmt.Errorf("cf api is down")
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/health", nil)
+		router.ServeHTTP(w, req)
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(w.Body.String()).To(MatchJSON(`{
+			"message": "degraded",
+			"dependencies": {
+				"orgs": {"last_success": "2020-07-31T12:00:00Z", "error": "cf api is down"},
+				"spaces": {}
+			}
+		}`))
+	})
+})
+
+var _ = Describe("ReadyEndpoint", func() {
+	var orgs *MockDependency
+	var spaces *MockDependency
+	var router *gin.Engine
+
+	BeforeEach(func() {
+		orgs = &MockDependency{MockName: "orgs"}
+		spaces = &MockDependency{MockName: "spaces"}
+
+		router = gin.Default()
+		router.GET("/ready", health.ReadyEndpoint([]health.Dependency{orgs, spaces}))
+	})
+
+	It("is not ready until every store has synced", func() {
+		orgs.MockLastSuccess = time.Now()
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/ready", nil)
+		router.ServeHTTP(w, req)
+		Expect(w.Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(w.Body.String()).To(MatchJSON(`{"message": "not ready", "waiting_for": ["spaces"]}`))
+	})
+
+	It("is ready once every store has synced, even if a later refresh failed", func() {
+		orgs.MockLastSuccess = time.Now()
+		spaces.MockLastSuccess = time.Now()
+		spaces.MockLastError = fmt.Errorf("cf api is down")
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/ready", nil)
+		router.ServeHTTP(w, req)
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(w.Body.String()).To(MatchJSON(`{"message": "ready"}`))
+	})
+})
+
+var _ = Describe("HealthDetailsEndpoint", func() {
+	It("describes every dependency, grouped by kind", func() {
+		lastSuccess := time.Now().Add(-time.Minute)
+		orgs := &MockDependency{MockName: "orgs", MockLastSuccess: lastSuccess}
+		uaa := health.NewTracker("uaa")
+		uaa.RecordSuccess()
+		cloudwatch := health.NewTracker("cloudwatch")
+		cloudwatch.RecordError(fmt.Errorf("throttled"))
+
+		router := gin.Default()
+		router.GET("/health/details", health.HealthDetailsEndpoint(
+			[]health.Dependency{orgs},
+			map[string][]health.Dependency{
+				"uaa": {uaa},
+				"aws": {cloudwatch},
+			},
+		))
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/health/details", nil)
+		router.ServeHTTP(w, req)
+		Expect(w.Code).To(Equal(http.StatusOK))
+
+		var body struct {
+			Message      string `json:"message"`
+			Ready        bool   `json:"ready"`
+			Dependencies map[string]map[string]struct {
+				LastSuccess         *time.Time `json:"last_success"`
+				SecondsSinceSuccess float64    `json:"seconds_since_success"`
+				Error               string     `json:"error"`
+			} `json:"dependencies"`
+		}
+		Expect(json.Unmarshal(w.Body.Bytes(), &body)).To(Succeed())
+		Expect(body.Message).To(Equal("degraded"))
+		Expect(body.Ready).To(BeTrue())
+		Expect(body.Dependencies).To(HaveKey("cf-api"))
+		Expect(body.Dependencies["cf-api"]["orgs"].SecondsSinceSuccess).To(BeNumerically("~", 60, 1))
+		Expect(body.Dependencies["uaa"]["uaa"].LastSuccess).NotTo(BeNil())
+		Expect(body.Dependencies["aws"]["cloudwatch"].LastSuccess).To(BeNil())
+		Expect(body.Dependencies["aws"]["cloudwatch"].Error).To(Equal("throttled"))
+	})
+})
+
+var _ = Describe("Tracker", func() {
+	It("clears the last error when a call succeeds", func() {
+		tracker := health.NewTracker("uaa")
+		tracker.Record(fmt.Errorf("boom"))
+		Expect(tracker.LastError()).To(MatchError("boom"))
+		Expect(tracker.LastSuccess().IsZero()).To(BeTrue())
+
+		tracker.Record(nil)
+		Expect(tracker.LastError()).NotTo(HaveOccurred())
+		Expect(tracker.LastSuccess()).To(BeTemporally("~", time.Now(), time.Second))
+	})
+
+	It("ignores everything when nil", func() {
+		var tracker *health.Tracker
+		tracker.RecordSuccess()
+		tracker.RecordError(fmt.Errorf("boom"))
+		Expect(tracker.Name()).To(BeEmpty())
+		Expect(tracker.LastSuccess().IsZero()).To(BeTrue())
+		Expect(tracker.LastError()).NotTo(HaveOccurred())
+	})
+})
@@ -0,0 +1,75 @@
+package health
+
+import (
+	"sync"
+	"time"
+)
+
+// Tracker is a Dependency which is told how calls to it went, for
+// dependencies such as UAA and AWS which are called while handling requests
+// rather than refreshed in the background. A nil *Tracker ignores everything.
+type Tracker struct {
+	name        string
+	lastSuccess time.Time
+	lastError   error
+	mu          sync.Mutex
+}
+
+func NewTracker(name string) *Tracker {
+	return &Tracker{name: name}
+}
+
+func (t *Tracker) Name() string {
+	if t == nil {
+		return ""
+	}
+	return t.name
+}
+
+func (t *Tracker) RecordSuccess() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lastSuccess = time.Now()
+	t.lastError = nil
+}
+
+func (t *Tracker) RecordError(err error) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lastError = err
+}
+
+// Record records a success if err is nil and an error otherwise
+func (t *Tracker) Record(err error) {
+	if err != nil {
+		t.RecordError(err)
+	} else {
+		t.RecordSuccess()
+	}
+}
+
+func (t *Tracker) LastSuccess() time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.lastSuccess
+}
+
+func (t *Tracker) LastError() error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.lastError
+}
+
+var _ Dependency = (*Tracker)(nil)
@@ -0,0 +1,126 @@
+package instance_index
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/service_plans_fetcher"
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/store"
+
+	"code.cloudfoundry.org/lager"
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
+)
+
+type InstanceIndexStore interface {
+	// GetServiceInstances returns every instance of the store's service
+	// plans, whoever owns it
+	GetServiceInstances() []cfclient.ServiceInstance
+	// GetServiceInstance returns an instance by its GUID, if it is one of
+	// the store's
+	GetServiceInstance(guid string) (cfclient.ServiceInstance, bool)
+	// GetSpaceGuids returns the GUIDs of the spaces which have instances,
+	// and false if the index has not been built yet
+	GetSpaceGuids() ([]string, bool)
+}
+
+// instanceIndex has exported fields so that it can be saved to disk
+type instanceIndex struct {
+	ServiceInstances []cfclient.ServiceInstance
+	InstancesByGuid  map[string]cfclient.ServiceInstance
+	SpaceGuids       []string
+}
+
+// InstanceIndexFetcher keeps a list of every instance of the configured
+// services on the platform, fetched with the app's own CF user. It tells the
+// spaces and orgs fetchers which spaces and orgs are worth fetching.
+type InstanceIndexFetcher struct {
+	*store.Store[instanceIndex]
+	servicePlansStore service_plans_fetcher.ServicePlansStore
+	logger            lager.Logger
+	cfClient          cfclient.CloudFoundryClient
+}
+
+func NewInstanceIndexFetcher(
+	servicePlansStore service_plans_fetcher.ServicePlansStore,
+	storeOptions store.Options,
+	logger lager.Logger,
+	cfClient cfclient.CloudFoundryClient,
+) *InstanceIndexFetcher {
+	logger = logger.Session("instance-index-fetcher")
+	fetcher := &InstanceIndexFetcher{
+		servicePlansStore: servicePlansStore,
+		logger:            logger,
+		cfClient:          cfClient,
+	}
+	storeOptions.Name = "instance-index"
+	fetcher.Store = store.New(fetcher.fetchInstanceIndex, storeOptions, logger)
+	return fetcher
+}
+
+func (fetcher *InstanceIndexFetcher) GetServiceInstances() []cfclient.ServiceInstance {
+	index, _ := fetcher.Get()
+	return index.ServiceInstances
+}
+
+func (fetcher *InstanceIndexFetcher) GetServiceInstance(guid string) (cfclient.ServiceInstance, bool) {
+	index, _ := fetcher.Get()
+	serviceInstance, ok := index.InstancesByGuid[guid]
+	return serviceInstance, ok
+}
+
+func (fetcher *InstanceIndexFetcher) GetSpaceGuids() ([]string, bool) {
+	index, ok := fetcher.Get()
+	return index.SpaceGuids, ok
+}
+
+func (fetcher *InstanceIndexFetcher) fetchInstanceIndex(ctx context.Context) (instanceIndex, error) {
+	servicePlans := fetcher.servicePlansStore.GetServicePlans()
+	if servicePlans == nil {
+		return instanceIndex{}, fmt.Errorf("the service plans have not been fetched yet")
+	}
+
+	serviceInstances := []cfclient.ServiceInstance{}
+	if len(servicePlans) > 0 {
+		servicePlanGuids := make([]string, len(servicePlans))
+		for i, servicePlan := range servicePlans {
+			servicePlanGuids[i] = servicePlan.Guid
+		}
+		q := url.Values{}
+		q.Add("q", fmt.Sprintf("service_plan_guid IN %s", strings.Join(servicePlanGuids, ",")))
+		var err error
+		serviceInstances, err = fetcher.cfClient.ListServiceInstancesByQuery(q)
+		if err != nil {
+			return instanceIndex{}, fmt.Errorf("error fetching service instances: %v", err)
+		}
+		if serviceInstances == nil {
+			return instanceIndex{}, fmt.Errorf("list of service instances was nil")
+		}
+	}
+
+	index := instanceIndex{
+		ServiceInstances: serviceInstances,
+		InstancesByGuid:  map[string]cfclient.ServiceInstance{},
+		SpaceGuids:       []string{},
+	}
+	seenSpaces := map[string]bool{}
+	for _, serviceInstance := range serviceInstances {
+		index.InstancesByGuid[serviceInstance.Guid] = serviceInstance
+		if serviceInstance.SpaceGuid != "" && !seenSpaces[serviceInstance.SpaceGuid] {
+			seenSpaces[serviceInstance.SpaceGuid] = true
+			index.SpaceGuids = append(index.SpaceGuids, serviceInstance.SpaceGuid)
+		}
+	}
+	sort.Strings(index.SpaceGuids)
+
+	fetcher.logger.Info("updated-instance-index", lager.Data{
+		"number-of-service-instances": len(serviceInstances),
+		"number-of-spaces":            len(index.SpaceGuids),
+	})
+
+	return index, nil
+}
+
+var _ InstanceIndexStore = (*InstanceIndexFetcher)(nil)
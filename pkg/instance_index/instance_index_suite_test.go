@@ -0,0 +1,13 @@
+package instance_index_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestInstanceIndex(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Instance Index Suite")
+}
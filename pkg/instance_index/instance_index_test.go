@@ -0,0 +1,119 @@
+package instance_index_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/instance_index"
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/store"
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/testsupport"
+
+	"code.cloudfoundry.org/lager"
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
+	"github.com/jarcoal/httpmock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+type fakeServicePlansStore struct {
+	servicePlans []cfclient.ServicePlan
+}
+
+func (f *fakeServicePlansStore) GetServices() []cfclient.Service {
+	return nil
+}
+
+func (f *fakeServicePlansStore) GetServicePlans() []cfclient.ServicePlan {
+	return f.servicePlans
+}
+
+func (f *fakeServicePlansStore) GetServiceForPlan(planGuid string) (cfclient.Service, bool) {
+	return cfclient.Service{}, false
+}
+
+var _ = Describe("InstanceIndexFetcher", func() {
+	var logger lager.Logger
+	var cfClient *cfclient.Client
+	var servicePlansStore *fakeServicePlansStore
+	var fetcher *instance_index.InstanceIndexFetcher
+
+	BeforeEach(func() {
+		httpmock.Reset()
+		httpclient := &http.Client{Transport: &http.Transport{}}
+		httpmock.ActivateNonDefault(httpclient)
+		testsupport.SetupCfV2InfoHttpmock()
+		testsupport.SetupSuccessfulUaaOauthLoginHttpmock()
+
+		logger = lager.NewLogger("instance-index-test")
+		logger.RegisterSink(lager.NewWriterSink(GinkgoWriter, lager.INFO))
+
+		var err error
+		cfClient, err = cfclient.NewClient(&cfclient.Config{
+			ApiAddress: testsupport.CfApiUrl,
+			HttpClient: httpclient,
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		servicePlansStore = &fakeServicePlansStore{}
+		fetcher = instance_index.NewInstanceIndexFetcher(servicePlansStore, store.Options{}, logger, cfClient)
+	})
+
+	It("waits for the service plans to be fetched", func() {
+		err := fetcher.Refresh(context.Background())
+		Expect(err).To(MatchError(ContainSubstring("service plans have not been fetched yet")))
+		_, ok := fetcher.GetSpaceGuids()
+		Expect(ok).To(BeFalse())
+	})
+
+	It("indexes every instance of the service plans and the spaces they are in", func() {
+		servicePlansStore.servicePlans = []cfclient.ServicePlan{{Guid: "plan-1-guid"}, {Guid: "plan-2-guid"}}
+		mockCfServiceInstancesApiResponse("service_plan_guid IN plan-1-guid,plan-2-guid", []cfclient.ServiceInstance{
+			{Guid: "instance-1-guid", SpaceGuid: "space-b-guid", ServicePlanGuid: "plan-1-guid"},
+			{Guid: "instance-2-guid", SpaceGuid: "space-a-guid", ServicePlanGuid: "plan-2-guid"},
+			{Guid: "instance-3-guid", SpaceGuid: "space-b-guid", ServicePlanGuid: "plan-2-guid"},
+		})
+
+		Expect(fetcher.Refresh(context.Background())).To(Succeed())
+		Expect(fetcher.GetServiceInstances()).To(HaveLen(3))
+		spaceGuids, ok := fetcher.GetSpaceGuids()
+		Expect(ok).To(BeTrue())
+		Expect(spaceGuids).To(Equal([]string{"space-a-guid", "space-b-guid"}))
+		instance, ok := fetcher.GetServiceInstance("instance-2-guid")
+		Expect(ok).To(BeTrue())
+		Expect(instance.SpaceGuid).To(Equal("space-a-guid"))
+	})
+
+	It("has an empty index if the service has no plans", func() {
+		servicePlansStore.servicePlans = []cfclient.ServicePlan{}
+
+		Expect(fetcher.Refresh(context.Background())).To(Succeed())
+		spaceGuids, ok := fetcher.GetSpaceGuids()
+		Expect(ok).To(BeTrue())
+		Expect(spaceGuids).To(BeEmpty())
+		Expect(httpmock.GetCallCountInfo()["GET http://cf.api/v2/service_instances"]).To(Equal(0))
+	})
+})
+
+func mockCfServiceInstancesApiResponse(expectedQ string, serviceInstances []cfclient.ServiceInstance) {
+	resources := make([]cfclient.ServiceInstanceResource, len(serviceInstances))
+	for i, serviceInstance := range serviceInstances {
+		guid := serviceInstance.Guid
+		serviceInstance.Guid = ""
+		resources[i] = cfclient.ServiceInstanceResource{
+			Meta:   cfclient.Meta{Guid: guid},
+			Entity: serviceInstance,
+		}
+	}
+	httpmock.RegisterResponderWithQuery(
+		"GET",
+		fmt.Sprintf("%s/v2/service_instances", testsupport.CfApiUrl),
+		url.Values{"q": []string{expectedQ}},
+		httpmock.NewJsonResponderOrPanic(200, cfclient.ServiceInstancesResponse{
+			Count:     len(resources),
+			Pages:     1,
+			Resources: resources,
+		}),
+	)
+}
@@ -0,0 +1,59 @@
+package internal_metrics
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"net/http"
+	"sort"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/common/expfmt"
+)
+
+func InternalMetricsEndpoint(registry *Registry, logger lager.Logger) gin.HandlerFunc {
+	logger = logger.Session("internal-metrics-endpoint")
+
+	return func(c *gin.Context) {
+		metricFamilies := registry.Gather()
+		names := make([]string, 0, len(metricFamilies))
+		for name := range metricFamilies {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		output := &bytes.Buffer{}
+		for _, name := range names {
+			_, err := expfmt.MetricFamilyToText(output, metricFamilies[name])
+			if err != nil {
+				logger.Error("error-rendering-metrics", err, lager.Data{
+					"metric-family-name": name,
+				})
+				continue
+			}
+		}
+		c.Data(http.StatusOK, "text/plain; version=0.0.4", output.Bytes())
+	}
+}
+
+// BasicAuth protects the internal endpoints with credentials which can
+// change while the app is running. While no password is set it responds as
+// if the endpoints did not exist.
+func BasicAuth(credentials func() (username, password string)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		expectedUsername, expectedPassword := credentials()
+		if expectedPassword == "" {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		username, password, ok := c.Request.BasicAuth()
+		usernameMatches := subtle.ConstantTimeCompare([]byte(username), []byte(expectedUsername)) == 1
+		passwordMatches := subtle.ConstantTimeCompare([]byte(password), []byte(expectedPassword)) == 1
+		if !ok || !usernameMatches || !passwordMatches {
+			c.Header("WWW-Authenticate", `Basic realm="Authorization Required"`)
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,49 @@
+package internal_metrics_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/internal_metrics"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("BasicAuth", func() {
+	var username, password string
+	var router *gin.Engine
+
+	BeforeEach(func() {
+		username, password = "operator", "secret"
+		router = gin.New()
+		router.Use(internal_metrics.BasicAuth(func() (string, string) { return username, password }))
+		router.GET("/internal/metrics", func(c *gin.Context) { c.String(http.StatusOK, "metrics") })
+	})
+
+	get := func(user, pass string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/internal/metrics", nil)
+		if user != "" {
+			req.SetBasicAuth(user, pass)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	It("only lets in requests with the current credentials", func() {
+		Expect(get("operator", "secret").Code).To(Equal(http.StatusOK))
+		Expect(get("operator", "wrong").Code).To(Equal(http.StatusUnauthorized))
+		Expect(get("", "").Code).To(Equal(http.StatusUnauthorized))
+
+		password = "new-secret"
+		Expect(get("operator", "secret").Code).To(Equal(http.StatusUnauthorized))
+		Expect(get("operator", "new-secret").Code).To(Equal(http.StatusOK))
+	})
+
+	It("hides the endpoints while no password is set", func() {
+		password = ""
+		Expect(get("operator", "").Code).To(Equal(http.StatusNotFound))
+	})
+})
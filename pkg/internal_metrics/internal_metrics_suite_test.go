@@ -0,0 +1,13 @@
+package internal_metrics_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestInternalMetrics(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "InternalMetrics Suite")
+}
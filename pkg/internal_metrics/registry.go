@@ -0,0 +1,137 @@
+package internal_metrics
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Labels are the label names and values identifying a single series
+type Labels = map[string]string
+
+// Registry holds metrics about the exporter itself, for operators rather than
+// tenants. A nil *Registry is valid and discards everything recorded to it.
+type Registry struct {
+	families map[string]*family
+	mu       sync.Mutex
+}
+
+type family struct {
+	help       string
+	metricType dto.MetricType
+	series     map[string]*series
+}
+
+type series struct {
+	labels []*dto.LabelPair
+	value  float64
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		families: map[string]*family{},
+	}
+}
+
+func (r *Registry) SetGauge(name, help string, labels Labels, value float64) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.getSeries(name, help, dto.MetricType_GAUGE, labels).value = value
+}
+
+func (r *Registry) AddCounter(name, help string, labels Labels, delta float64) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.getSeries(name, help, dto.MetricType_COUNTER, labels).value += delta
+}
+
+// Gather returns a copy of every metric recorded so far
+func (r *Registry) Gather() map[string]*dto.MetricFamily {
+	metricFamilies := map[string]*dto.MetricFamily{}
+	if r == nil {
+		return metricFamilies
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for name, f := range r.families {
+		keys := make([]string, 0, len(f.series))
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		metrics := make([]*dto.Metric, 0, len(keys))
+		for _, key := range keys {
+			s := f.series[key]
+			value := s.value
+			metric := &dto.Metric{Label: s.labels}
+			if f.metricType == dto.MetricType_COUNTER {
+				metric.Counter = &dto.Counter{Value: &value}
+			} else {
+				metric.Gauge = &dto.Gauge{Value: &value}
+			}
+			metrics = append(metrics, metric)
+		}
+
+		metricName := name
+		help := f.help
+		metricType := f.metricType
+		metricFamilies[name] = &dto.MetricFamily{
+			Name:   &metricName,
+			Help:   &help,
+			Type:   &metricType,
+			Metric: metrics,
+		}
+	}
+	return metricFamilies
+}
+
+func (r *Registry) getSeries(name, help string, metricType dto.MetricType, labels Labels) *series {
+	f, ok := r.families[name]
+	if !ok {
+		f = &family{
+			help:       help,
+			metricType: metricType,
+			series:     map[string]*series{},
+		}
+		r.families[name] = f
+	}
+
+	key, labelPairs := labelsKey(labels)
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labels: labelPairs}
+		f.series[key] = s
+	}
+	return s
+}
+
+func labelsKey(labels Labels) (string, []*dto.LabelPair) {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	key := strings.Builder{}
+	labelPairs := make([]*dto.LabelPair, len(names))
+	for i, name := range names {
+		labelName := name
+		labelValue := labels[name]
+		labelPairs[i] = &dto.LabelPair{Name: &labelName, Value: &labelValue}
+		key.WriteString(name)
+		key.WriteString("\x00")
+		key.WriteString(labelValue)
+		key.WriteString("\x00")
+	}
+	return key.String(), labelPairs
+}
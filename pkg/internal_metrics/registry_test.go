@@ -0,0 +1,71 @@
+package internal_metrics_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/internal_metrics"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/gin-gonic/gin"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Registry", func() {
+	var registry *internal_metrics.Registry
+
+	BeforeEach(func() {
+		registry = internal_metrics.NewRegistry()
+	})
+
+	It("keeps the latest value of a gauge", func() {
+		registry.SetGauge("some_gauge", "A gauge", internal_metrics.Labels{"a": "b"}, 1)
+		registry.SetGauge("some_gauge", "A gauge", internal_metrics.Labels{"a": "b"}, 3)
+
+		metricFamilies := registry.Gather()
+		Expect(metricFamilies).To(HaveKey("some_gauge"))
+		Expect(metricFamilies["some_gauge"].Metric).To(HaveLen(1))
+		Expect(metricFamilies["some_gauge"].Metric[0].Gauge.GetValue()).To(Equal(3.0))
+	})
+
+	It("accumulates counters separately for each set of labels", func() {
+		registry.AddCounter("some_total", "A counter", internal_metrics.Labels{"a": "b"}, 1)
+		registry.AddCounter("some_total", "A counter", internal_metrics.Labels{"a": "b"}, 2)
+		registry.AddCounter("some_total", "A counter", internal_metrics.Labels{"a": "c"}, 5)
+
+		metricFamilies := registry.Gather()
+		Expect(metricFamilies["some_total"].Metric).To(HaveLen(2))
+		Expect(metricFamilies["some_total"].Metric[0].Counter.GetValue()).To(Equal(3.0))
+		Expect(metricFamilies["some_total"].Metric[1].Counter.GetValue()).To(Equal(5.0))
+	})
+
+	It("ignores metrics recorded to a nil registry", func() {
+		var nilRegistry *internal_metrics.Registry
+		nilRegistry.SetGauge("some_gauge", "A gauge", nil, 1)
+		Expect(nilRegistry.Gather()).To(BeEmpty())
+	})
+
+	It("renders metrics in Prometheus format", func() {
+		logger := lager.NewLogger("internal-metrics-test")
+		logger.RegisterSink(lager.NewWriterSink(GinkgoWriter, lager.INFO))
+
+		registry.AddCounter("b_total", "Second", internal_metrics.Labels{"x": "y"}, 2)
+		registry.SetGauge("a_gauge", "First", nil, 1)
+
+		router := gin.Default()
+		router.GET("/internal/metrics", internal_metrics.InternalMetricsEndpoint(registry, logger))
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/internal/metrics", nil)
+		router.ServeHTTP(w, req)
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(w.Body.String()).To(Equal(`# HELP a_gauge First
+# TYPE a_gauge gauge
+a_gauge 1
+# HELP b_total Second
+# TYPE b_total counter
+b_total{x="y"} 2
+`))
+	})
+})
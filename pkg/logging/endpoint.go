@@ -0,0 +1,30 @@
+package logging
+
+import (
+	"net/http"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/gin-gonic/gin"
+)
+
+// LogLevelEndpoint reports the log level on GET, and changes it on PUT with a
+// level parameter, like PUT /internal/log-level?level=debug. The change lasts
+// until the app restarts or its config is reloaded.
+func LogLevelEndpoint(sink *lager.ReconfigurableSink, logger lager.Logger) gin.HandlerFunc {
+	logger = logger.Session("log-level-endpoint")
+	return func(c *gin.Context) {
+		if c.Request.Method == http.MethodPut {
+			level, err := ParseLevel(c.Query("level"))
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			logger.Info("changing-log-level", lager.Data{
+				"from": sink.GetMinLevel().String(),
+				"to":   level.String(),
+			})
+			sink.SetMinLevel(level)
+		}
+		c.JSON(http.StatusOK, gin.H{"level": sink.GetMinLevel().String()})
+	}
+}
@@ -0,0 +1,73 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"code.cloudfoundry.org/lager"
+)
+
+const (
+	// FormatJSON is lager's usual one JSON object per line
+	FormatJSON = "json"
+	// FormatText is one human-readable line per message, for local
+	// development
+	FormatText = "text"
+)
+
+// Formats are the log formats NewLogger accepts
+var Formats = []string{FormatJSON, FormatText}
+
+// sensitiveKeys match the keys of log data whose values are replaced with
+// *REDACTED*, at any depth
+var sensitiveKeys = []string{
+	"(?i)pass",
+	"(?i)pwd",
+	"(?i)secret",
+	"(?i)token",
+	"(?i)username",
+	"(?i)authorization",
+}
+
+// ParseLevel turns a level name like "debug" into a lager.LogLevel. Names are
+// not case sensitive.
+func ParseLevel(name string) (lager.LogLevel, error) {
+	level, err := lager.LogLevelFromString(strings.ToLower(name))
+	if err != nil {
+		return level, fmt.Errorf("%q is not one of debug, info, error or fatal", name)
+	}
+	return level, nil
+}
+
+// NewLogger returns a logger which writes messages of at least minLevel to
+// writer in the given format, with sensitive data redacted. The returned sink
+// can change the level while the app is running.
+func NewLogger(
+	component string,
+	writer io.Writer,
+	minLevel lager.LogLevel,
+	format string,
+) (lager.Logger, *lager.ReconfigurableSink, error) {
+	var sink lager.Sink
+	switch format {
+	case FormatJSON, "":
+		sink = lager.NewWriterSink(writer, lager.DEBUG)
+	case FormatText:
+		sink = NewTextSink(writer)
+	default:
+		return nil, nil, fmt.Errorf("unknown log format %q", format)
+	}
+
+	sink, err := lager.NewRedactingSink(sink, sensitiveKeys, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The level is checked before redacting, so that skipped debug messages
+	// cost nothing
+	reconfigurableSink := lager.NewReconfigurableSink(sink, minLevel)
+
+	logger := lager.NewLogger(component)
+	logger.RegisterSink(reconfigurableSink)
+	return logger, reconfigurableSink, nil
+}
@@ -0,0 +1,142 @@
+package logging_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/logging"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/gin-gonic/gin"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("NewLogger", func() {
+	var output *bytes.Buffer
+
+	BeforeEach(func() {
+		output = &bytes.Buffer{}
+	})
+
+	It("writes JSON at the chosen level and above", func() {
+		logger, _, err := logging.NewLogger("test", output, lager.INFO, logging.FormatJSON)
+		Expect(err).NotTo(HaveOccurred())
+		logger.Debug("hidden")
+		logger.Info("shown", lager.Data{"count": 3})
+		logger.Error("err-shown", fmt.Errorf("oops"))
+
+		lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+		Expect(lines).To(HaveLen(2))
+		var entry map[string]interface{}
+		Expect(json.Unmarshal([]byte(lines[0]), &entry)).To(Succeed())
+		Expect(entry["message"]).To(Equal("test.shown"))
+		Expect(entry["data"]).To(HaveKeyWithValue("count", float64(3)))
+	})
+
+	It("can only show errors", func() {
+		logger, _, err := logging.NewLogger("test", output, lager.ERROR, logging.FormatJSON)
+		Expect(err).NotTo(HaveOccurred())
+		logger.Info("hidden")
+		logger.Error("err-shown", fmt.Errorf("oops"))
+		Expect(output.String()).NotTo(ContainSubstring("hidden"))
+		Expect(output.String()).To(ContainSubstring("err-shown"))
+	})
+
+	It("writes human-readable lines in text format", func() {
+		logger, _, err := logging.NewLogger("test", output, lager.DEBUG, logging.FormatText)
+		Expect(err).NotTo(HaveOccurred())
+		logger.Session("fetcher").Info("updated", lager.Data{
+			"number": 2,
+			"name":   "two words",
+			"guids":  []string{"a", "b"},
+		})
+		Expect(output.String()).To(MatchRegexp(
+			`^\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{3}Z INFO  test\.fetcher\.updated guids=\["a","b"\] name="two words" number=2 session=1\n$`,
+		))
+	})
+
+	It("redacts sensitive data in every format", func() {
+		for _, format := range logging.Formats {
+			output.Reset()
+			logger, _, err := logging.NewLogger("test", output, lager.DEBUG, format)
+			Expect(err).NotTo(HaveOccurred())
+			logger.Info("authenticated", lager.Data{
+				"username": "someone@example.com",
+				"request": map[string]interface{}{
+					"client_secret": "hunter2",
+					"Password":      "hunter3",
+				},
+				"space-guid": "space-guid",
+			})
+			Expect(output.String()).NotTo(ContainSubstring("someone@example.com"), format)
+			Expect(output.String()).NotTo(ContainSubstring("hunter"), format)
+			Expect(output.String()).To(ContainSubstring("REDACTED"), format)
+			Expect(output.String()).To(ContainSubstring("space-guid"), format)
+		}
+	})
+
+	It("rejects an unknown format", func() {
+		_, _, err := logging.NewLogger("test", output, lager.INFO, "xml")
+		Expect(err).To(MatchError(ContainSubstring("unknown log format")))
+	})
+
+	It("parses level names whatever their case", func() {
+		Expect(logging.ParseLevel("FATAL")).To(Equal(lager.FATAL))
+		_, err := logging.ParseLevel("loud")
+		Expect(err).To(MatchError(ContainSubstring("not one of debug, info, error or fatal")))
+	})
+})
+
+var _ = Describe("LogLevelEndpoint", func() {
+	var output *bytes.Buffer
+	var logger lager.Logger
+	var sink *lager.ReconfigurableSink
+	var router *gin.Engine
+
+	BeforeEach(func() {
+		gin.SetMode(gin.TestMode)
+		output = &bytes.Buffer{}
+		var err error
+		logger, sink, err = logging.NewLogger("test", output, lager.INFO, logging.FormatJSON)
+		Expect(err).NotTo(HaveOccurred())
+		router = gin.New()
+		router.GET("/log-level", logging.LogLevelEndpoint(sink, logger))
+		router.PUT("/log-level", logging.LogLevelEndpoint(sink, logger))
+	})
+
+	request := func(method, url string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, url, nil)
+		Expect(err).NotTo(HaveOccurred())
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	It("reports the current level", func() {
+		rec := request("GET", "/log-level")
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(rec.Body.String()).To(MatchJSON(`{"level":"info"}`))
+	})
+
+	It("changes the level", func() {
+		rec := request("PUT", "/log-level?level=debug")
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(rec.Body.String()).To(MatchJSON(`{"level":"debug"}`))
+		Expect(sink.GetMinLevel()).To(Equal(lager.DEBUG))
+		Expect(output.String()).To(ContainSubstring("changing-log-level"))
+
+		logger.Debug("now-shown")
+		Expect(output.String()).To(ContainSubstring("now-shown"))
+	})
+
+	It("rejects an unknown level", func() {
+		rec := request("PUT", "/log-level?level=loud")
+		Expect(rec.Code).To(Equal(http.StatusBadRequest))
+		Expect(sink.GetMinLevel()).To(Equal(lager.INFO))
+	})
+})
@@ -0,0 +1,82 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// TextSink writes each message as one line like
+//
+//	2006-01-02T15:04:05.000Z INFO  redis-exporter.spaces-fetcher.updated-spaces number-of-spaces=3
+//
+// Values which are not plain strings or numbers are written as JSON.
+type TextSink struct {
+	writer io.Writer
+	mu     sync.Mutex
+}
+
+func NewTextSink(writer io.Writer) *TextSink {
+	return &TextSink{writer: writer}
+}
+
+func (sink *TextSink) Log(log lager.LogFormat) {
+	var line strings.Builder
+	line.WriteString(formatTimestamp(log.Timestamp))
+	line.WriteString(" ")
+	line.WriteString(fmt.Sprintf("%-5s", strings.ToUpper(log.LogLevel.String())))
+	line.WriteString(" ")
+	line.WriteString(log.Message)
+
+	keys := make([]string, 0, len(log.Data))
+	for key := range log.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		line.WriteString(" ")
+		line.WriteString(key)
+		line.WriteString("=")
+		line.WriteString(formatValue(log.Data[key]))
+	}
+	line.WriteString("\n")
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	sink.writer.Write([]byte(line.String()))
+}
+
+// formatTimestamp turns lager's seconds since the epoch into RFC 3339
+func formatTimestamp(timestamp string) string {
+	seconds, err := strconv.ParseFloat(timestamp, 64)
+	if err != nil {
+		return timestamp
+	}
+	return time.Unix(0, int64(seconds*1e9)).UTC().Format("2006-01-02T15:04:05.000Z07:00")
+}
+
+func formatValue(value interface{}) string {
+	switch value := value.(type) {
+	case string:
+		if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+			return strconv.Quote(value)
+		}
+		return value
+	case fmt.Stringer:
+		return strconv.Quote(value.String())
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return strconv.Quote(fmt.Sprint(value))
+	}
+	return string(encoded)
+}
+
+var _ lager.Sink = (*TextSink)(nil)
@@ -4,11 +4,11 @@ import (
 	"bytes"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/alphagov/paas-prometheus-endpoints/pkg/authenticator"
-	"github.com/alphagov/paas-prometheus-endpoints/pkg/service_plans_fetcher"
-	"github.com/alphagov/paas-prometheus-endpoints/pkg/spaces_fetcher"
-	"github.com/alphagov/paas-prometheus-endpoints/pkg/orgs_fetcher"
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/cost_budget"
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/topology"
 
 	cfclient "github.com/cloudfoundry-community/go-cfclient"
 
@@ -17,18 +17,65 @@ import (
 )
 
 func MetricEndpoint(
-	servicePlansStore service_plans_fetcher.ServicePlansStore,
-	spacesStore spaces_fetcher.SpacesStore,
-	orgsStore orgs_fetcher.OrgsStore,
+	topologyStore topology.TopologyStore,
 	serviceMetricsFetcher ServiceMetricFetcher,
+	costTracker *cost_budget.Tracker,
+	minScrapeInterval func() time.Duration,
 	logger lager.Logger,
 ) gin.HandlerFunc {
 	logger = logger.Session("metric-endpoint")
+	cache := newResponseCache()
 
 	return func(c *gin.Context) {
 		user := c.MustGet("authenticated_user").(authenticator.User)
+		lsession := logger.WithData(lager.Data{"username": user.Username()})
 
-		metrics, err := GetMetricsForUser(user, servicePlansStore, spacesStore, orgsStore, serviceMetricsFetcher, c, logger)
+		target, err := getScrapeTargetForUser(user, topologyStore.Topology(), topologyStore, lsession)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+				"message": err.Error(),
+			})
+			return
+		}
+
+		// Replays cost nothing, so a scrape which comes too soon is replayed
+		// without checking the budgets. The cache is kept in memory by each
+		// instance of the app, so a scrape which reaches a different instance
+		// from the last one is fetched again.
+		instanceSetKey := serviceInstanceSetKey(target.serviceInstances)
+		previousResponse, hasPreviousResponse := cache.get(user.Username(), instanceSetKey)
+		if interval := minScrapeInterval(); hasPreviousResponse && time.Since(previousResponse.fetchedAt) < interval {
+			lsession.Info("replaying-response-scraped-too-soon", lager.Data{
+				"instance-set":        instanceSetKey,
+				"seconds-since-fetch": time.Since(previousResponse.fetchedAt).Seconds(),
+				"min-scrape-interval": interval.String(),
+			})
+			respondWithMetrics(c, previousResponse, replayScrapedTooSoon, costTracker, user, target, lsession)
+			return
+		}
+
+		err = costTracker.Check(user.Username(), target.orgGuids)
+		if budgetErr, ok := err.(*cost_budget.ExceededError); ok {
+			if hasPreviousResponse {
+				lsession.Info("replaying-response-budget-exceeded", lager.Data{
+					"instance-set": instanceSetKey,
+				})
+				c.Header("X-Cost-Budget-Exceeded", budgetErr.Error())
+				respondWithMetrics(c, previousResponse, replayBudgetExceeded, costTracker, user, target, lsession)
+				return
+			}
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+				"message": budgetErr.Error(),
+			})
+			return
+		}
+
+		lsession.Info("fetching-fresh-metrics", lager.Data{
+			"instance-set":                instanceSetKey,
+			"number-of-service-instances": len(target.serviceInstances),
+			"topology-version":            target.topologyVersion,
+		})
+		metrics, err := fetchMetricsForScrapeTarget(user, target, serviceMetricsFetcher, costTracker, c, lsession)
 		if err != nil {
 			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
 				"message": err.Error(),
@@ -37,61 +84,186 @@ func MetricEndpoint(
 		}
 
 		output := &bytes.Buffer{}
-		contentLength := renderMetricsInPromFormat(metrics, output, logger)
-		c.DataFromReader(
-			http.StatusOK,
-			int64(contentLength),
-			"text/plain; version=0.0.4",
-			output,
-			nil,
-		)
+		renderMetricsInPromFormat(metrics, output, lsession)
+		freshResponse := cachedResponse{
+			body:      output.Bytes(),
+			fetchedAt: time.Now(),
+		}
+		cache.put(user.Username(), instanceSetKey, freshResponse)
+		respondWithMetrics(c, freshResponse, notReplayed, costTracker, user, target, lsession)
 	}
 }
 
-func GetMetricsForUser(
+// scrapeTarget is everything needed to fetch metrics for a user's service
+// instances
+type scrapeTarget struct {
+	topologyVersion  uint64
+	services         []cfclient.Service
+	servicePlans     []cfclient.ServicePlan
+	spacesByGuid     map[string]cfclient.Space
+	orgsByGuid       map[string]cfclient.Org
+	serviceInstances []cfclient.ServiceInstance
+	orgGuids         []string
+}
+
+func getScrapeTargetForUser(
 	user authenticator.User,
-	servicePlansStore service_plans_fetcher.ServicePlansStore,
-	spacesStore spaces_fetcher.SpacesStore,
-	orgsStore orgs_fetcher.OrgsStore,
-	serviceMetricsFetcher ServiceMetricFetcher,
-	c *gin.Context,
+	snapshot *topology.Snapshot,
+	topologyStore topology.TopologyStore,
 	logger lager.Logger,
-) (Metrics, error) {
-	service := servicePlansStore.GetService()
-	if service == nil {
-		logger.Error("err-service-not-found", nil)
+) (*scrapeTarget, error) {
+	if len(snapshot.Services) == 0 {
+		logger.Error("err-service-not-found", nil, lager.Data{"topology-version": snapshot.Version})
 		return nil, fmt.Errorf("an error occurred when trying to fetch the service")
 	}
 
-	servicePlans := servicePlansStore.GetServicePlans()
-	servicePlanGUIDs := make([]string, len(servicePlans))
-	for i, servicePlan := range servicePlans {
+	servicePlanGUIDs := make([]string, len(snapshot.ServicePlans))
+	for i, servicePlan := range snapshot.ServicePlans {
 		servicePlanGUIDs[i] = servicePlan.Guid
 	}
 
-	spaces := spacesStore.GetSpaces()
-	spacesByGuid := map[string]cfclient.Space{}
-	for _, space := range spaces {
-		spacesByGuid[space.Guid] = space
-	}
-
-	orgs := orgsStore.GetOrgs()
-	orgsByGuid := map[string]cfclient.Org{}
-	for _, org := range orgs {
-		orgsByGuid[org.Guid] = org
-	}
-
 	serviceInstances, err := user.ListServiceInstancesMatchingPlanGUIDs(servicePlanGUIDs)
 	if err != nil {
 		logger.Error("err-listing-service-instances", err)
 		return nil, fmt.Errorf("an error occurred when trying to list your service instances")
 	}
+	spacesByGuid, orgsByGuid := lookUpMissingSpacesAndOrgs(serviceInstances, snapshot, topologyStore, logger)
+
+	return &scrapeTarget{
+		topologyVersion:  snapshot.Version,
+		services:         snapshot.Services,
+		servicePlans:     snapshot.ServicePlans,
+		spacesByGuid:     spacesByGuid,
+		orgsByGuid:       orgsByGuid,
+		serviceInstances: serviceInstances,
+		orgGuids:         orgGuidsOfServiceInstances(serviceInstances, spacesByGuid),
+	}, nil
+}
 
-	metrics, err := serviceMetricsFetcher.FetchMetrics(c, user, serviceInstances, spacesByGuid, orgsByGuid, servicePlans, *service)
+// lookUpMissingSpacesAndOrgs adds the spaces and orgs of any service
+// instances which the snapshot does not know about yet, so that their
+// metrics are not missing labels. The snapshot itself is shared and is never
+// modified, so the maps are copied before anything is added to them. The
+// metrics are still served if a lookup fails.
+func lookUpMissingSpacesAndOrgs(
+	serviceInstances []cfclient.ServiceInstance,
+	snapshot *topology.Snapshot,
+	topologyStore topology.TopologyStore,
+	logger lager.Logger,
+) (map[string]cfclient.Space, map[string]cfclient.Org) {
+	spacesByGuid := snapshot.SpacesByGuid
+	orgsByGuid := snapshot.OrgsByGuid
+	copiedSpaces, copiedOrgs := false, false
+
+	for _, serviceInstance := range serviceInstances {
+		spaceGuid := serviceInstance.SpaceGuid
+		if spaceGuid == "" {
+			continue
+		}
+		space, ok := spacesByGuid[spaceGuid]
+		if !ok {
+			var err error
+			space, err = topologyStore.LookupSpace(spaceGuid)
+			if err != nil {
+				logger.Error("err-looking-up-missing-space", err, lager.Data{"space-guid": spaceGuid})
+				continue
+			}
+			if !copiedSpaces {
+				spacesByGuid = copyMap(spacesByGuid)
+				copiedSpaces = true
+			}
+			spacesByGuid[spaceGuid] = space
+		}
+
+		orgGuid := space.OrganizationGuid
+		if _, ok := orgsByGuid[orgGuid]; orgGuid == "" || ok {
+			continue
+		}
+		org, err := topologyStore.LookupOrg(orgGuid)
+		if err != nil {
+			logger.Error("err-looking-up-missing-org", err, lager.Data{"org-guid": orgGuid})
+			continue
+		}
+		if !copiedOrgs {
+			orgsByGuid = copyMap(orgsByGuid)
+			copiedOrgs = true
+		}
+		orgsByGuid[orgGuid] = org
+	}
+	return spacesByGuid, orgsByGuid
+}
+
+func copyMap[V any](m map[string]V) map[string]V {
+	copied := make(map[string]V, len(m)+1)
+	for k, v := range m {
+		copied[k] = v
+	}
+	return copied
+}
+
+func fetchMetricsForScrapeTarget(
+	user authenticator.User,
+	target *scrapeTarget,
+	serviceMetricsFetcher ServiceMetricFetcher,
+	costTracker *cost_budget.Tracker,
+	c *gin.Context,
+	logger lager.Logger,
+) (Metrics, error) {
+	metrics, err := serviceMetricsFetcher.FetchMetrics(
+		c, user, target.serviceInstances, target.spacesByGuid, target.orgsByGuid, target.servicePlans, target.services,
+	)
+	costTracker.Record(user.Username(), cost_budget.UsageFromContext(c))
 	if err != nil {
 		logger.Error("err-fetching-service-metrics", err)
 		return nil, fmt.Errorf("an error occurred when fetching metrics for your service instances")
 	}
-
 	return metrics, nil
 }
+
+func respondWithMetrics(
+	c *gin.Context,
+	response cachedResponse,
+	replayReason string,
+	costTracker *cost_budget.Tracker,
+	user authenticator.User,
+	target *scrapeTarget,
+	logger lager.Logger,
+) {
+	selfMetrics := selfMetricsForResponse(response, replayReason)
+	if remaining := costTracker.RemainingMetricFamily(user.Username(), target.orgGuids); remaining != nil {
+		selfMetrics[cost_budget.RemainingMetricName] = remaining
+	}
+
+	output := bytes.NewBuffer(append([]byte{}, response.body...))
+	renderMetricsInPromFormat(selfMetrics, output, logger)
+
+	if replayReason != notReplayed {
+		c.Header("X-Response-Replayed", "true")
+		c.Header("X-Response-Replayed-Reason", replayReason)
+		c.Header("X-Response-Fetched-At", response.fetchedAt.UTC().Format(time.RFC3339))
+	}
+	c.DataFromReader(
+		http.StatusOK,
+		int64(output.Len()),
+		metricsContentType,
+		output,
+		nil,
+	)
+}
+
+func orgGuidsOfServiceInstances(
+	serviceInstances []cfclient.ServiceInstance,
+	spacesByGuid map[string]cfclient.Space,
+) []string {
+	orgGuids := []string{}
+	seen := map[string]bool{}
+	for _, serviceInstance := range serviceInstances {
+		orgGuid := spacesByGuid[serviceInstance.SpaceGuid].OrganizationGuid
+		if orgGuid == "" || seen[orgGuid] {
+			continue
+		}
+		seen[orgGuid] = true
+		orgGuids = append(orgGuids, orgGuid)
+	}
+	return orgGuids
+}
@@ -1,14 +1,18 @@
 package metric_endpoint_test
 
 import (
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"time"
 
 	"github.com/alphagov/paas-prometheus-endpoints/pkg/authenticator"
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/cost_budget"
 	"github.com/alphagov/paas-prometheus-endpoints/pkg/metric_endpoint"
 	"github.com/alphagov/paas-prometheus-endpoints/pkg/orgs_fetcher"
 	"github.com/alphagov/paas-prometheus-endpoints/pkg/service_plans_fetcher"
 	"github.com/alphagov/paas-prometheus-endpoints/pkg/spaces_fetcher"
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/topology"
 
 	"code.cloudfoundry.org/lager"
 	cfclient "github.com/cloudfoundry-community/go-cfclient"
@@ -19,12 +23,25 @@ import (
 )
 
 type MockServicePlansStore struct {
-	MockService      *cfclient.Service
+	MockServices     []cfclient.Service
 	MockServicePlans []cfclient.ServicePlan
 }
 
-func (m *MockServicePlansStore) GetService() *cfclient.Service {
-	return m.MockService
+func (m *MockServicePlansStore) GetServices() []cfclient.Service {
+	return m.MockServices
+}
+
+func (m *MockServicePlansStore) GetServiceForPlan(planGuid string) (cfclient.Service, bool) {
+	for _, servicePlan := range m.MockServicePlans {
+		if servicePlan.Guid == planGuid {
+			for _, service := range m.MockServices {
+				if service.Guid == servicePlan.ServiceGuid {
+					return service, true
+				}
+			}
+		}
+	}
+	return cfclient.Service{}, false
 }
 
 func (m *MockServicePlansStore) GetServicePlans() []cfclient.ServicePlan {
@@ -34,25 +51,73 @@ func (m *MockServicePlansStore) GetServicePlans() []cfclient.ServicePlan {
 var _ service_plans_fetcher.ServicePlansStore = (*MockServicePlansStore)(nil)
 
 type MockOrgsStore struct {
-	MockOrgs []cfclient.Org
+	MockOrgs       []cfclient.Org
+	MockLookupOrgs map[string]cfclient.Org
 }
 
 func (m *MockOrgsStore) GetOrgs() []cfclient.Org {
 	return m.MockOrgs
 }
 
+func (m *MockOrgsStore) LookupOrg(guid string) (cfclient.Org, error) {
+	org, ok := m.MockLookupOrgs[guid]
+	if !ok {
+		return cfclient.Org{}, fmt.Errorf("org %s not found", guid)
+	}
+	return org, nil
+}
+
 var _ orgs_fetcher.OrgsStore = (*MockOrgsStore)(nil)
 
 type MockSpacesStore struct {
-	MockSpaces []cfclient.Space
+	MockSpaces       []cfclient.Space
+	MockLookupSpaces map[string]cfclient.Space
 }
 
 func (m *MockSpacesStore) GetSpaces() []cfclient.Space {
 	return m.MockSpaces
 }
 
+func (m *MockSpacesStore) LookupSpace(guid string) (cfclient.Space, error) {
+	space, ok := m.MockLookupSpaces[guid]
+	if !ok {
+		return cfclient.Space{}, fmt.Errorf("space %s not found", guid)
+	}
+	return space, nil
+}
+
 var _ spaces_fetcher.SpacesStore = (*MockSpacesStore)(nil)
 
+// MockTopologyStore builds a new snapshot from the mock stores each time, so
+// tests can change the stores after the endpoint has been created
+type MockTopologyStore struct {
+	ServicePlansStore *MockServicePlansStore
+	SpacesStore       *MockSpacesStore
+	OrgsStore         *MockOrgsStore
+	LastSnapshot      *topology.Snapshot
+}
+
+func (m *MockTopologyStore) Topology() *topology.Snapshot {
+	m.LastSnapshot = topology.NewSnapshot(
+		1,
+		m.ServicePlansStore.GetServices(),
+		m.ServicePlansStore.GetServicePlans(),
+		m.SpacesStore.GetSpaces(),
+		m.OrgsStore.GetOrgs(),
+	)
+	return m.LastSnapshot
+}
+
+func (m *MockTopologyStore) LookupSpace(guid string) (cfclient.Space, error) {
+	return m.SpacesStore.LookupSpace(guid)
+}
+
+func (m *MockTopologyStore) LookupOrg(guid string) (cfclient.Org, error) {
+	return m.OrgsStore.LookupOrg(guid)
+}
+
+var _ topology.TopologyStore = (*MockTopologyStore)(nil)
+
 type MockMetricFetcher struct {
 	FetchMetricsCallback func(
 		_ *gin.Context,
@@ -61,7 +126,7 @@ type MockMetricFetcher struct {
 		_ map[string]cfclient.Space,
 		_ map[string]cfclient.Org,
 		_ []cfclient.ServicePlan,
-		_ cfclient.Service,
+		_ []cfclient.Service,
 	) (metric_endpoint.Metrics, error)
 }
 
@@ -72,9 +137,9 @@ func (f *MockMetricFetcher) FetchMetrics(
 	spaces map[string]cfclient.Space,
 	orgs map[string]cfclient.Org,
 	servicePlans []cfclient.ServicePlan,
-	service cfclient.Service,
+	services []cfclient.Service,
 ) (metric_endpoint.Metrics, error) {
-	return f.FetchMetricsCallback(c, user, serviceInstances, spaces, orgs, servicePlans, service)
+	return f.FetchMetricsCallback(c, user, serviceInstances, spaces, orgs, servicePlans, services)
 }
 
 var _ = Describe("Metric Endpoint", func() {
@@ -84,7 +149,10 @@ var _ = Describe("Metric Endpoint", func() {
 	var mockServicePlansStore *MockServicePlansStore
 	var mockSpacesStore *MockSpacesStore
 	var mockOrgsStore *MockOrgsStore
+	var mockTopologyStore *MockTopologyStore
 	var mockMetricFetcher *MockMetricFetcher
+	var costTracker *cost_budget.Tracker
+	var minScrapeInterval time.Duration
 
 	BeforeEach(func() {
 		logger = lager.NewLogger("metric-endpoint-test")
@@ -93,21 +161,36 @@ var _ = Describe("Metric Endpoint", func() {
 		mockServicePlansStore = &MockServicePlansStore{}
 		mockSpacesStore = &MockSpacesStore{}
 		mockOrgsStore = &MockOrgsStore{}
+		mockTopologyStore = &MockTopologyStore{
+			ServicePlansStore: mockServicePlansStore,
+			SpacesStore:       mockSpacesStore,
+			OrgsStore:         mockOrgsStore,
+		}
 		mockUser = &authenticator.MockUser{
 			MockUsername: "mock-user",
 		}
 		mockMetricFetcher = &MockMetricFetcher{}
+		costTracker = nil
+		minScrapeInterval = 0
+	})
 
+	JustBeforeEach(func() {
 		router = gin.Default()
 		router.Use(func(c *gin.Context) {
 			c.Set("authenticated_user", mockUser)
 			c.Next()
 		})
-		router.GET("/metrics", metric_endpoint.MetricEndpoint(mockServicePlansStore, mockSpacesStore, mockOrgsStore, mockMetricFetcher, logger))
+		router.GET("/metrics", metric_endpoint.MetricEndpoint(
+			mockTopologyStore,
+			mockMetricFetcher,
+			costTracker,
+			func() time.Duration { return minScrapeInterval },
+			logger,
+		))
 	})
 
 	It("errors if it doesn't know what CF service to get metrics for", func() {
-		mockServicePlansStore.MockService = nil
+		mockServicePlansStore.MockServices = nil
 
 		w := httptest.NewRecorder()
 		req, _ := http.NewRequest("GET", "/metrics", nil)
@@ -117,7 +200,7 @@ var _ = Describe("Metric Endpoint", func() {
 	})
 
 	It("fetches metrics for the user's service instances of the right CF service", func() {
-		mockServicePlansStore.MockService = &cfclient.Service{Guid: "fake-service-1-guid"}
+		mockServicePlansStore.MockServices = []cfclient.Service{{Guid: "fake-service-1-guid"}}
 		mockServicePlansStore.MockServicePlans = []cfclient.ServicePlan{
 			{Guid: "fake-service-1-plan-1-guid"},
 			{Guid: "fake-service-1-plan-2-guid"},
@@ -144,9 +227,9 @@ var _ = Describe("Metric Endpoint", func() {
 			spaces map[string]cfclient.Space,
 			orgs map[string]cfclient.Org,
 			servicePlans []cfclient.ServicePlan,
-			service cfclient.Service,
+			services []cfclient.Service,
 		) (metric_endpoint.Metrics, error) {
-			Expect(service).To(Equal(*mockServicePlansStore.MockService))
+			Expect(services).To(Equal(mockServicePlansStore.MockServices))
 			Expect(servicePlans).To(Equal(mockServicePlansStore.MockServicePlans))
 			Expect(serviceInstances).To(ConsistOf(
 				mockUser.MockServiceInstances[0],
@@ -163,7 +246,7 @@ var _ = Describe("Metric Endpoint", func() {
 	})
 
 	It("renders metrics in Prometheus format", func() {
-		mockServicePlansStore.MockService = &cfclient.Service{Guid: "fake-service-1-guid"}
+		mockServicePlansStore.MockServices = []cfclient.Service{{Guid: "fake-service-1-guid"}}
 		mockServicePlansStore.MockServicePlans = []cfclient.ServicePlan{
 			{Guid: "fake-service-1-plan-1-guid"},
 			{Guid: "fake-service-1-plan-2-guid"},
@@ -190,7 +273,7 @@ var _ = Describe("Metric Endpoint", func() {
 			spaces map[string]cfclient.Space,
 			orgs map[string]cfclient.Org,
 			servicePlans []cfclient.ServicePlan,
-			service cfclient.Service,
+			services []cfclient.Service,
 		) (metric_endpoint.Metrics, error) {
 			serviceInstanceName := "service_instance_name"
 			metrics := []*dto.Metric{}
@@ -222,9 +305,255 @@ var _ = Describe("Metric Endpoint", func() {
 		req, _ := http.NewRequest("GET", "/metrics", nil)
 		router.ServeHTTP(w, req)
 		Expect(w.Code).To(Equal(http.StatusOK))
-		Expect(w.Body.String()).To(Equal(`# TYPE service_instance_index gauge
+		Expect(w.Body.String()).To(HavePrefix(`# TYPE service_instance_index gauge
 service_instance_index{service_instance_name="service-instance-1"} 0
 service_instance_index{service_instance_name="service-instance-2"} 1
 `))
+		Expect(w.Body.String()).To(ContainSubstring("\npaas_exporter_response_replayed 0\n"))
+	})
+
+	It("looks up spaces and orgs which the stores do not know about yet", func() {
+		mockServicePlansStore.MockServices = []cfclient.Service{{Guid: "fake-service-1-guid"}}
+		mockServicePlansStore.MockServicePlans = []cfclient.ServicePlan{
+			{Guid: "fake-service-1-plan-1-guid"},
+		}
+		mockSpacesStore.MockSpaces = []cfclient.Space{
+			{Guid: "known-space-guid", Name: "known-space", OrganizationGuid: "known-org-guid"},
+		}
+		mockSpacesStore.MockLookupSpaces = map[string]cfclient.Space{
+			"new-space-guid": {Guid: "new-space-guid", Name: "new-space", OrganizationGuid: "new-org-guid"},
+		}
+		mockOrgsStore.MockOrgs = []cfclient.Org{
+			{Guid: "known-org-guid", Name: "known-org"},
+		}
+		mockOrgsStore.MockLookupOrgs = map[string]cfclient.Org{
+			"new-org-guid": {Guid: "new-org-guid", Name: "new-org"},
+		}
+		mockUser.MockServiceInstances = []cfclient.ServiceInstance{
+			{
+				Name:            "service-instance-1",
+				ServicePlanGuid: "fake-service-1-plan-1-guid",
+				SpaceGuid:       "known-space-guid",
+			},
+			{
+				Name:            "service-instance-2",
+				ServicePlanGuid: "fake-service-1-plan-1-guid",
+				SpaceGuid:       "new-space-guid",
+			},
+			{
+				Name:            "service-instance-3",
+				ServicePlanGuid: "fake-service-1-plan-1-guid",
+				SpaceGuid:       "deleted-space-guid",
+			},
+		}
+
+		mockMetricFetcher.FetchMetricsCallback = func(
+			_ *gin.Context,
+			_ authenticator.User,
+			_ []cfclient.ServiceInstance,
+			spaces map[string]cfclient.Space,
+			orgs map[string]cfclient.Org,
+			_ []cfclient.ServicePlan,
+			_ []cfclient.Service,
+		) (metric_endpoint.Metrics, error) {
+			Expect(spaces).To(HaveKeyWithValue("new-space-guid", mockSpacesStore.MockLookupSpaces["new-space-guid"]))
+			Expect(spaces).NotTo(HaveKey("deleted-space-guid"))
+			Expect(orgs).To(HaveKey("known-org-guid"))
+			Expect(orgs).To(HaveKeyWithValue("new-org-guid", mockOrgsStore.MockLookupOrgs["new-org-guid"]))
+			return nil, nil
+		}
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/metrics", nil)
+		router.ServeHTTP(w, req)
+		Expect(w.Code).To(Equal(http.StatusOK))
+
+		By("leaving the shared snapshot unchanged")
+		Expect(mockTopologyStore.LastSnapshot.SpacesByGuid).NotTo(HaveKey("new-space-guid"))
+		Expect(mockTopologyStore.LastSnapshot.OrgsByGuid).NotTo(HaveKey("new-org-guid"))
+	})
+
+	Context("when the user has a cost budget", func() {
+		BeforeEach(func() {
+			costTracker = cost_budget.NewTracker(
+				cost_budget.Limits{Daily: 10},
+				cost_budget.Limits{},
+				"",
+				nil,
+				logger,
+			)
+			mockServicePlansStore.MockServices = []cfclient.Service{{Guid: "fake-service-1-guid"}}
+			mockServicePlansStore.MockServicePlans = []cfclient.ServicePlan{
+				{Guid: "fake-service-1-plan-1-guid"},
+			}
+			mockSpacesStore.MockSpaces = []cfclient.Space{
+				{Guid: "fake-space-1-guid", OrganizationGuid: "fake-org-1-guid"},
+			}
+			mockUser.MockServiceInstances = []cfclient.ServiceInstance{
+				{
+					Name:            "service-instance-1",
+					ServicePlanGuid: "fake-service-1-plan-1-guid",
+					SpaceGuid:       "fake-space-1-guid",
+				},
+			}
+			mockMetricFetcher.FetchMetricsCallback = func(
+				c *gin.Context,
+				_ authenticator.User,
+				_ []cfclient.ServiceInstance,
+				_ map[string]cfclient.Space,
+				_ map[string]cfclient.Org,
+				_ []cfclient.ServicePlan,
+				_ []cfclient.Service,
+			) (metric_endpoint.Metrics, error) {
+				cost_budget.RecordUsage(c, "fake-org-1-guid", 6)
+				return metric_endpoint.Metrics{}, nil
+			}
+		})
+
+		It("tells the user how much of their budget remains", func() {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/metrics", nil)
+			router.ServeHTTP(w, req)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(w.Body.String()).To(ContainSubstring(`paas_exporter_cost_budget_remaining{period="daily",scope="user"} 4`))
+		})
+
+		It("replays the last response once the budget has been used up", func() {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/metrics", nil)
+			router.ServeHTTP(w, req)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			firstBody := w.Body.String()
+
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			Expect(w.Code).To(Equal(http.StatusOK))
+
+			mockMetricFetcher.FetchMetricsCallback = nil
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(w.Header().Get("X-Cost-Budget-Exceeded")).To(ContainSubstring("daily cost budget"))
+			Expect(w.Header().Get("X-Response-Replayed-Reason")).To(Equal("cost_budget_exceeded"))
+			Expect(w.Body.String()).To(ContainSubstring("\npaas_exporter_response_replayed{reason=\"cost_budget_exceeded\"} 1\n"))
+			Expect(w.Body.String()).NotTo(Equal(firstBody))
+			Expect(w.Body.String()).To(ContainSubstring(`paas_exporter_cost_budget_remaining{period="daily",scope="user"} 0`))
+		})
+
+		It("responds with 429 Too Many Requests when there is nothing to replay", func() {
+			costTracker.Record("mock-user", map[string]uint64{"fake-org-1-guid": 10})
+			mockMetricFetcher.FetchMetricsCallback = nil
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/metrics", nil)
+			router.ServeHTTP(w, req)
+			Expect(w.Code).To(Equal(http.StatusTooManyRequests))
+			Expect(w.Body.String()).To(MatchJSON(`{"message": "the daily cost budget for user 'mock-user' has been used up (10 queries), please scrape less often"}`))
+		})
+	})
+
+	Context("when there is a minimum scrape interval", func() {
+		var fetchCount int
+
+		BeforeEach(func() {
+			minScrapeInterval = time.Hour
+			fetchCount = 0
+
+			mockServicePlansStore.MockServices = []cfclient.Service{{Guid: "fake-service-1-guid"}}
+			mockServicePlansStore.MockServicePlans = []cfclient.ServicePlan{
+				{Guid: "fake-service-1-plan-1-guid"},
+			}
+			mockUser.MockServiceInstances = []cfclient.ServiceInstance{
+				{
+					Guid:            "service-instance-1-guid",
+					Name:            "service-instance-1",
+					ServicePlanGuid: "fake-service-1-plan-1-guid",
+				},
+			}
+			mockMetricFetcher.FetchMetricsCallback = func(
+				_ *gin.Context,
+				_ authenticator.User,
+				serviceInstances []cfclient.ServiceInstance,
+				_ map[string]cfclient.Space,
+				_ map[string]cfclient.Org,
+				_ []cfclient.ServicePlan,
+				_ []cfclient.Service,
+			) (metric_endpoint.Metrics, error) {
+				fetchCount += 1
+				value := float64(fetchCount)
+				timestamp := int64(1596196800000 + fetchCount)
+				return metric_endpoint.Metrics{
+					"fetch_count": &dto.MetricFamily{
+						Name: strPtr("fetch_count"),
+						Type: typePtr(dto.MetricType_GAUGE),
+						Metric: []*dto.Metric{
+							{Gauge: &dto.Gauge{Value: &value}, TimestampMs: &timestamp},
+						},
+					},
+				}, nil
+			}
+		})
+
+		It("replays the previous response, with its original timestamps, when scraped too soon", func() {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/metrics", nil)
+			router.ServeHTTP(w, req)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(w.Header().Get("X-Response-Replayed")).To(BeEmpty())
+			Expect(w.Body.String()).To(ContainSubstring("\nfetch_count 1 1596196800001\n"))
+
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(w.Header().Get("X-Response-Replayed")).To(Equal("true"))
+			Expect(w.Header().Get("X-Response-Fetched-At")).NotTo(BeEmpty())
+			Expect(w.Body.String()).To(ContainSubstring("\nfetch_count 1 1596196800001\n"))
+			Expect(w.Header().Get("X-Response-Replayed-Reason")).To(Equal("scraped_too_soon"))
+			Expect(w.Body.String()).To(ContainSubstring("\npaas_exporter_response_replayed{reason=\"scraped_too_soon\"} 1\n"))
+			Expect(fetchCount).To(Equal(1))
+		})
+
+		It("uses the interval in force at the time of each scrape", func() {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/metrics", nil)
+			router.ServeHTTP(w, req)
+			Expect(w.Code).To(Equal(http.StatusOK))
+
+			minScrapeInterval = 0
+
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(w.Header().Get("X-Response-Replayed")).To(BeEmpty())
+			Expect(fetchCount).To(Equal(2))
+		})
+
+		It("fetches fresh metrics when the user's service instances change", func() {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/metrics", nil)
+			router.ServeHTTP(w, req)
+			Expect(w.Code).To(Equal(http.StatusOK))
+
+			mockUser.MockServiceInstances = append(mockUser.MockServiceInstances, cfclient.ServiceInstance{
+				Guid:            "service-instance-2-guid",
+				Name:            "service-instance-2",
+				ServicePlanGuid: "fake-service-1-plan-1-guid",
+			})
+
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(w.Header().Get("X-Response-Replayed")).To(BeEmpty())
+			Expect(w.Body.String()).To(ContainSubstring("\nfetch_count 2 1596196800002\n"))
+			Expect(fetchCount).To(Equal(2))
+		})
 	})
 })
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func typePtr(t dto.MetricType) *dto.MetricType {
+	return &t
+}
@@ -22,10 +22,46 @@ type ServiceMetricFetcher interface {
 		spacesByGuid map[string]cfclient.Space,
 		orgsByGuid map[string]cfclient.Org,
 		servicePlans []cfclient.ServicePlan,
-		service cfclient.Service,
+		services []cfclient.Service,
 	) (Metrics, error)
 }
 
+// Why a response is a replay of an earlier one, for the reason label of
+// paas_exporter_response_replayed
+const (
+	notReplayed          = ""
+	replayScrapedTooSoon = "scraped_too_soon"
+	replayBudgetExceeded = "cost_budget_exceeded"
+)
+
+// selfMetricsForResponse describes the response itself, so tenants can tell
+// when they have been sent a replay of an earlier response, and why
+func selfMetricsForResponse(response cachedResponse, replayReason string) Metrics {
+	replayedValue := float64(0)
+	replayed := &dto.Metric{Gauge: &dto.Gauge{Value: &replayedValue}}
+	if replayReason != notReplayed {
+		replayedValue = 1
+		replayed.Label = []*dto.LabelPair{{Name: derefS("reason"), Value: derefS(replayReason)}}
+	}
+	fetchedAtValue := float64(response.fetchedAt.UnixNano()) / 1e9
+	return Metrics{
+		"paas_exporter_response_replayed": &dto.MetricFamily{
+			Name:   derefS("paas_exporter_response_replayed"),
+			Help:   derefS("Whether this response is a replay of an earlier one, with the reason: scraped_too_soon or cost_budget_exceeded"),
+			Type:   derefT(dto.MetricType_GAUGE),
+			Metric: []*dto.Metric{replayed},
+		},
+		"paas_exporter_response_fetched_timestamp_seconds": &dto.MetricFamily{
+			Name: derefS("paas_exporter_response_fetched_timestamp_seconds"),
+			Help: derefS("When the metrics in this response were fetched"),
+			Type: derefT(dto.MetricType_GAUGE),
+			Metric: []*dto.Metric{
+				{Gauge: &dto.Gauge{Value: &fetchedAtValue}},
+			},
+		},
+	}
+}
+
 func renderMetricsInPromFormat(metrics Metrics, out io.Writer, logger lager.Logger) int {
 	totalBytesWritten := 0
 	for _, metricFamily := range metrics {
@@ -41,3 +77,11 @@ func renderMetricsInPromFormat(metrics Metrics, out io.Writer, logger lager.Logg
 	}
 	return totalBytesWritten
 }
+
+func derefS(s string) *string {
+	return &s
+}
+
+func derefT(i dto.MetricType) *dto.MetricType {
+	return &i
+}
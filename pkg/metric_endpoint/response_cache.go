@@ -0,0 +1,130 @@
+package metric_endpoint
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
+)
+
+const metricsContentType = "text/plain; version=0.0.4"
+
+// Responses older than this are of no use to anyone so are forgotten
+const responseCacheRetention = 24 * time.Hour
+
+// responseCacheSweepInterval is how often every user's responses are checked
+// for ones older than responseCacheRetention
+const responseCacheSweepInterval = time.Minute
+
+// responseCacheMaxBytes bounds the size of all the cached responses together.
+// The oldest responses are forgotten first to keep under it.
+const responseCacheMaxBytes = 64 * 1024 * 1024
+
+type cachedResponse struct {
+	body      []byte
+	fetchedAt time.Time
+}
+
+// responseCache remembers the last response rendered for each set of service
+// instances each user has, so it can be served again when they cannot have a
+// fresh one
+type responseCache struct {
+	responses map[string]map[string]cachedResponse
+	bytes     int
+	maxBytes  int
+	lastSweep time.Time
+	mu        sync.Mutex
+}
+
+func newResponseCache() *responseCache {
+	return &responseCache{
+		responses: map[string]map[string]cachedResponse{},
+		maxBytes:  responseCacheMaxBytes,
+	}
+}
+
+func (rc *responseCache) get(username string, instanceSetKey string) (cachedResponse, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	response, ok := rc.responses[username][instanceSetKey]
+	return response, ok
+}
+
+func (rc *responseCache) put(username string, instanceSetKey string, response cachedResponse) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	rc.remove(username, instanceSetKey)
+	userResponses, ok := rc.responses[username]
+	if !ok {
+		userResponses = map[string]cachedResponse{}
+		rc.responses[username] = userResponses
+	}
+	userResponses[instanceSetKey] = response
+	rc.bytes += len(response.body)
+
+	if response.fetchedAt.Sub(rc.lastSweep) >= responseCacheSweepInterval {
+		rc.lastSweep = response.fetchedAt
+		for username, userResponses := range rc.responses {
+			for key, userResponse := range userResponses {
+				if response.fetchedAt.Sub(userResponse.fetchedAt) > responseCacheRetention {
+					rc.remove(username, key)
+				}
+			}
+		}
+	}
+	if rc.bytes > rc.maxBytes {
+		rc.removeOldest()
+	}
+}
+
+// remove forgets a response, and the user once they have none left
+func (rc *responseCache) remove(username string, instanceSetKey string) {
+	userResponses := rc.responses[username]
+	response, ok := userResponses[instanceSetKey]
+	if !ok {
+		return
+	}
+	rc.bytes -= len(response.body)
+	delete(userResponses, instanceSetKey)
+	if len(userResponses) == 0 {
+		delete(rc.responses, username)
+	}
+}
+
+// removeOldest forgets the oldest responses until the rest fit in maxBytes
+func (rc *responseCache) removeOldest() {
+	type entry struct {
+		username       string
+		instanceSetKey string
+		fetchedAt      time.Time
+	}
+	entries := []entry{}
+	for username, userResponses := range rc.responses {
+		for key, response := range userResponses {
+			entries = append(entries, entry{username, key, response.fetchedAt})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].fetchedAt.Before(entries[j].fetchedAt) })
+	for _, e := range entries {
+		if rc.bytes <= rc.maxBytes {
+			return
+		}
+		rc.remove(e.username, e.instanceSetKey)
+	}
+}
+
+// serviceInstanceSetKey identifies a set of service instances regardless of
+// the order they were listed in
+func serviceInstanceSetKey(serviceInstances []cfclient.ServiceInstance) string {
+	guids := make([]string, len(serviceInstances))
+	for i, serviceInstance := range serviceInstances {
+		guids[i] = serviceInstance.Guid
+	}
+	sort.Strings(guids)
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(strings.Join(guids, ","))))[:16]
+}
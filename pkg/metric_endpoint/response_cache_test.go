@@ -0,0 +1,46 @@
+package metric_endpoint
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("responseCache", func() {
+	var cache *responseCache
+	var now time.Time
+
+	BeforeEach(func() {
+		cache = newResponseCache()
+		now = time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	})
+
+	It("forgets every user's old responses, not just those of the user it is given one by", func() {
+		cache.put("user-1", "instances-1", cachedResponse{body: []byte("one"), fetchedAt: now})
+		cache.put("user-2", "instances-2", cachedResponse{body: []byte("two"), fetchedAt: now.Add(time.Hour)})
+
+		cache.put("user-2", "instances-2", cachedResponse{body: []byte("two"), fetchedAt: now.Add(25 * time.Hour)})
+		_, ok := cache.get("user-1", "instances-1")
+		Expect(ok).To(BeFalse())
+		Expect(cache.responses).NotTo(HaveKey("user-1"))
+		Expect(cache.bytes).To(Equal(3))
+	})
+
+	It("forgets the oldest responses once they take up too much space", func() {
+		cache.maxBytes = 10
+		cache.put("user-1", "instances-1", cachedResponse{body: []byte("1234"), fetchedAt: now})
+		cache.put("user-2", "instances-2", cachedResponse{body: []byte("1234"), fetchedAt: now.Add(time.Second)})
+		cache.put("user-1", "instances-1", cachedResponse{body: []byte("1234"), fetchedAt: now.Add(2 * time.Second)})
+		Expect(cache.bytes).To(Equal(8))
+
+		cache.put("user-3", "instances-3", cachedResponse{body: []byte("1234"), fetchedAt: now.Add(3 * time.Second)})
+		_, ok := cache.get("user-2", "instances-2")
+		Expect(ok).To(BeFalse())
+		_, ok = cache.get("user-1", "instances-1")
+		Expect(ok).To(BeTrue())
+		_, ok = cache.get("user-3", "instances-3")
+		Expect(ok).To(BeTrue())
+		Expect(cache.bytes).To(Equal(8))
+	})
+})
@@ -1,10 +1,8 @@
 package orgs_fetcher
 
 import (
-	"context"
-	"fmt"
-	"sync"
-	"time"
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/cf_v3"
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/store"
 
 	"code.cloudfoundry.org/lager"
 	cfclient "github.com/cloudfoundry-community/go-cfclient"
@@ -12,82 +10,76 @@ import (
 
 type OrgsStore interface {
 	GetOrgs() []cfclient.Org
+	// LookupOrg fetches an org which is missing from the store, for example
+	// because it was only just created, and adds it to the store
+	LookupOrg(guid string) (cfclient.Org, error)
+}
+
+// OrgGuidsSource says which orgs a scoped OrgsFetcher fetches, for example
+// a spaces_fetcher.SpacesFetcher. It returns false until it knows.
+type OrgGuidsSource interface {
+	GetOrgGuids() ([]string, bool)
+}
+
+// orgType is how orgs are fetched from the Cloud Controller
+var orgType = store.CFResourceType[cf_v3.Organization, cfclient.Org]{
+	Singular:        "org",
+	Plural:          "orgs",
+	Path:            "/v3/organizations",
+	DeleteEventType: "audit.organization.delete-request",
+	ListAll: func(cfClient cfclient.CloudFoundryClient) ([]cfclient.Org, error) {
+		return cfClient.ListOrgs()
+	},
+	Get: func(cfClient cfclient.CloudFoundryClient, guid string) (cfclient.Org, error) {
+		return cfClient.GetOrgByGuid(guid)
+	},
+	GuidOf: func(org cfclient.Org) string { return org.Guid },
+	ToV2:   cf_v3.Organization.ToV2,
+	Merge: func(existing cfclient.Org, update cfclient.Org) cfclient.Org {
+		existing.Name = update.Name
+		existing.UpdatedAt = update.UpdatedAt
+		existing.Status = update.Status
+		return existing
+	},
 }
 
 type OrgsFetcher struct {
-	Orgs     []cfclient.Org
-	schedule time.Duration
-	logger   lager.Logger
-	cfClient cfclient.CloudFoundryClient
-	mu       sync.Mutex
+	*store.CFResources[cf_v3.Organization, cfclient.Org]
 }
 
+// NewOrgsFetcher fetches every org on the platform
 func NewOrgsFetcher(
-	schedule time.Duration,
+	storeOptions store.Options,
 	logger lager.Logger,
 	cfClient cfclient.CloudFoundryClient,
 ) *OrgsFetcher {
-	logger = logger.Session("orgs-fetcher")
-	return &OrgsFetcher{
-		schedule:    schedule,
-		logger:      logger,
-		cfClient:    cfClient,
-	}
+	return NewScopedOrgsFetcher(nil, storeOptions, logger, cfClient)
 }
 
-func (fetcher *OrgsFetcher) GetOrgs() []cfclient.Org {
-	fetcher.mu.Lock()
-	defer fetcher.mu.Unlock()
-	return fetcher.Orgs
-}
-
-func (fetcher *OrgsFetcher) Run(ctx context.Context) error {
-	loggerSession := fetcher.logger.Session("run")
-
-	loggerSession.Info("start")
-	defer loggerSession.Info("end")
-
-	err := fetcher.updateOrgs()
-	if err != nil {
-		return fmt.Errorf("error initialising list of orgs: %v", err)
+// NewScopedOrgsFetcher only fetches the orgs whose GUIDs the source returns,
+// or every org if the source is nil
+func NewScopedOrgsFetcher(
+	orgGuidsSource OrgGuidsSource,
+	storeOptions store.Options,
+	logger lager.Logger,
+	cfClient cfclient.CloudFoundryClient,
+) *OrgsFetcher {
+	var guidsSource func() ([]string, bool)
+	if orgGuidsSource != nil {
+		guidsSource = orgGuidsSource.GetOrgGuids
 	}
-
-	for {
-		select {
-		case <-ctx.Done():
-			loggerSession.Info("done")
-			return nil
-		case <-time.After(fetcher.schedule):
-			err = fetcher.updateOrgs()
-			if err != nil {
-				return fmt.Errorf("error updating list of orgs: %v", err)
-			}
-		}
+	return &OrgsFetcher{
+		store.NewCFResources(orgType, guidsSource, storeOptions, logger, cfClient),
 	}
 }
 
-func (fetcher *OrgsFetcher) updateOrgs() error {
-	// FIXME: Relax this locking so it is short-lived
-	fetcher.mu.Lock()
-	defer fetcher.mu.Unlock()
-
-	orgs, err := fetcher.cfClient.ListOrgs()
-	if err != nil {
-		return fmt.Errorf("error fetching orgs: %v", err)
-	}
-	if orgs == nil {
-		return fmt.Errorf("list of orgs was nil")
-	}
-
-	fetcher.logger.Info("updated-orgs", lager.Data{
-		"number-of-orgs": len(orgs),
-	})
-	fetcher.logger.Debug("updated-orgs-list", lager.Data{
-		"orgs": orgs,
-	})
+func (fetcher *OrgsFetcher) GetOrgs() []cfclient.Org {
+	orgs, _ := fetcher.Get()
+	return orgs
+}
 
-	fetcher.Orgs = orgs
-	return nil
+func (fetcher *OrgsFetcher) LookupOrg(guid string) (cfclient.Org, error) {
+	return fetcher.Lookup(guid)
 }
 
 var _ OrgsStore = (*OrgsFetcher)(nil)
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/alphagov/paas-prometheus-endpoints/pkg/orgs_fetcher"
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/store"
 	"github.com/alphagov/paas-prometheus-endpoints/pkg/testsupport"
 
 	"code.cloudfoundry.org/lager"
@@ -17,9 +18,19 @@ import (
 	. "github.com/onsi/gomega/gstruct"
 )
 
+type fakeOrgGuidsSource struct {
+	orgGuids []string
+	known    bool
+}
+
+func (f *fakeOrgGuidsSource) GetOrgGuids() ([]string, bool) {
+	return f.orgGuids, f.known
+}
+
 var _ = Describe("OrgsFetcher", func() {
 	var orgsFetcher *orgs_fetcher.OrgsFetcher
-	var fetchSchedule time.Duration
+	var logger lager.Logger
+	var cfClient *cfclient.Client
 
 	BeforeEach(func() {
 		httpmock.Reset()
@@ -30,37 +41,38 @@ var _ = Describe("OrgsFetcher", func() {
 
 		mockCfOrgsApiResponse([]cfclient.Org{
 			{
-				Guid: "fake-org-1-guid",
-				Name: "cf-org-1",
+				Guid:   "fake-org-1-guid",
+				Name:   "cf-org-1",
+				Status: "active",
 			},
 			{
-				Guid: "fake-org-2-guid",
-				Name: "cf-org-2",
+				Guid:   "fake-org-2-guid",
+				Name:   "cf-org-2",
+				Status: "active",
 			},
 		})
 
-		logger := lager.NewLogger("orgs-fetcher-test")
+		logger = lager.NewLogger("orgs-fetcher-test")
 		logger.RegisterSink(lager.NewWriterSink(GinkgoWriter, lager.INFO))
 
-		cfClient, err := cfclient.NewClient(&cfclient.Config{
+		var err error
+		cfClient, err = cfclient.NewClient(&cfclient.Config{
 			ApiAddress: testsupport.CfApiUrl,
 			HttpClient: httpclient,
 		})
 		Expect(err).NotTo(HaveOccurred())
 
-		fetchSchedule = 400 * time.Millisecond
 		orgsFetcher = orgs_fetcher.NewOrgsFetcher(
-			fetchSchedule,
+			store.Options{Schedule: time.Hour, FullSyncSchedule: time.Hour},
 			logger,
 			cfClient,
 		)
 	})
 
 	It("provides org metadata from the Cloud Controller API", func() {
-		ctx, cancel := context.WithTimeout(context.Background(), fetchSchedule*2)
-		defer cancel()
-		go orgsFetcher.Run(ctx)
-		Eventually(orgsFetcher.GetOrgs).Should(ConsistOf(
+		Expect(orgsFetcher.Refresh(context.Background())).To(Succeed())
+		Expect(orgsFetcher.Name()).To(Equal("orgs"))
+		Expect(orgsFetcher.GetOrgs()).To(ConsistOf(
 			MatchFields(IgnoreExtras, Fields{
 				"Guid": Equal("fake-org-1-guid"),
 				"Name": Equal("cf-org-1"),
@@ -72,64 +84,78 @@ var _ = Describe("OrgsFetcher", func() {
 		))
 	})
 
-	It("periodically updates the orgs from the Cloud Controller API", func() {
-		ctx, cancel := context.WithTimeout(context.Background(), fetchSchedule*4)
-		defer cancel()
-		go orgsFetcher.Run(ctx)
-		Eventually(orgsFetcher.GetOrgs).Should(ConsistOf(
-			MatchFields(IgnoreExtras, Fields{
-				"Guid": Equal("fake-org-1-guid"),
-				"Name": Equal("cf-org-1"),
-			}),
-			MatchFields(IgnoreExtras, Fields{
-				"Guid": Equal("fake-org-2-guid"),
-				"Name": Equal("cf-org-2"),
-			}),
-		))
-
+	It("follows orgs being suspended, and keeps the fields the v3 API doesn't give", func() {
 		mockCfOrgsApiResponse([]cfclient.Org{
 			{
-				Guid: "fake-org-1-guid",
-				Name: "cf-org-1",
+				Guid:                "fake-org-1-guid",
+				Name:                "cf-org-1",
+				Status:              "active",
+				QuotaDefinitionGuid: "fake-quota-guid",
 			},
+		})
+		Expect(orgsFetcher.Refresh(context.Background())).To(Succeed())
+
+		testsupport.SetupCfV3ListHttpmock("/v3/organizations", []map[string]interface{}{
 			{
-				Guid: "fake-org-3-guid",
-				Name: "cf-org-3",
+				"guid":       "fake-org-1-guid",
+				"name":       "cf-org-1-renamed",
+				"updated_at": "2020-01-02T03:04:05Z",
+				"suspended":  true,
 			},
 		})
+		testsupport.SetupCfV3ListHttpmock("/v3/audit_events", []map[string]interface{}{})
+		Expect(orgsFetcher.Refresh(context.Background())).To(Succeed())
+		Expect(orgsFetcher.GetOrgs()).To(ConsistOf(MatchFields(IgnoreExtras, Fields{
+			"Guid":                Equal("fake-org-1-guid"),
+			"Name":                Equal("cf-org-1-renamed"),
+			"UpdatedAt":           Equal("2020-01-02T03:04:05Z"),
+			"Status":              Equal("suspended"),
+			"QuotaDefinitionGuid": Equal("fake-quota-guid"),
+		})))
+		Expect(httpmock.GetCallCountInfo()["GET http://cf.api/v2/organizations"]).To(Equal(1))
+	})
 
-		Eventually(orgsFetcher.GetOrgs).Should(ConsistOf(
-			MatchFields(IgnoreExtras, Fields{
-				"Guid": Equal("fake-org-1-guid"),
-				"Name": Equal("cf-org-1"),
-			}),
-			MatchFields(IgnoreExtras, Fields{
-				"Guid": Equal("fake-org-3-guid"),
-				"Name": Equal("cf-org-3"),
-			}),
+	It("looks up an org which is missing from the v2 API", func() {
+		Expect(orgsFetcher.Refresh(context.Background())).To(Succeed())
+		httpmock.RegisterResponder(
+			"GET",
+			fmt.Sprintf("%s/v2/organizations/fake-org-3-guid", testsupport.CfApiUrl),
+			httpmock.NewJsonResponderOrPanic(200, wrapOrgsForResponse([]cfclient.Org{
+				{
+					Guid:   "fake-org-3-guid",
+					Name:   "cf-org-3",
+					Status: "suspended",
+				},
+			}).Resources[0]),
+		)
+
+		org, err := orgsFetcher.LookupOrg("fake-org-3-guid")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(org.Status).To(Equal("suspended"))
+		Expect(orgsFetcher.GetOrgs()).To(HaveLen(3))
+	})
+
+	It("fetches only the orgs its source asks for from the v3 API", func() {
+		scopedFetcher := orgs_fetcher.NewScopedOrgsFetcher(
+			&fakeOrgGuidsSource{orgGuids: []string{"fake-org-1-guid", "fake-org-2-guid"}, known: true},
+			store.Options{Schedule: time.Hour, FullSyncSchedule: time.Hour},
+			logger,
+			cfClient,
+		)
+		testsupport.SetupCfV3ListByGuidsHttpmock("/v3/organizations", []map[string]interface{}{
+			{"guid": "fake-org-1-guid", "name": "cf-org-1"},
+			{"guid": "fake-org-2-guid", "name": "cf-org-2", "suspended": true},
+		})
+
+		Expect(scopedFetcher.Refresh(context.Background())).To(Succeed())
+		Expect(scopedFetcher.GetOrgs()).To(ConsistOf(
+			MatchFields(IgnoreExtras, Fields{"Guid": Equal("fake-org-1-guid"), "Status": Equal("active")}),
+			MatchFields(IgnoreExtras, Fields{"Guid": Equal("fake-org-2-guid"), "Status": Equal("suspended")}),
 		))
-		ctx.Done()
+		Expect(httpmock.GetCallCountInfo()["GET http://cf.api/v2/organizations"]).To(Equal(0))
 	})
 })
 
-func wrapOrgForResponse(org cfclient.Org) cfclient.OrgResponse {
-	meta := cfclient.Meta{
-		Guid:      org.Guid,
-		CreatedAt: org.CreatedAt,
-	}
-	org.Guid = ""
-	org.CreatedAt = ""
-	return cfclient.OrgResponse{
-		Pages: 1,
-		Resources: []cfclient.OrgResource{
-			{
-				Meta:   meta,
-				Entity: org,
-			},
-		},
-	}
-}
-
 func mockCfOrgsApiResponse(orgs []cfclient.Org) {
 	mockURL := fmt.Sprintf("%s/v2/organizations", testsupport.CfApiUrl)
 	resp := httpmock.NewJsonResponderOrPanic(
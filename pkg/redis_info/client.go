@@ -0,0 +1,128 @@
+package redis_info
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrAuth is returned when a node rejects the auth token
+type ErrAuth struct {
+	Message string
+}
+
+func (e *ErrAuth) Error() string {
+	return fmt.Sprintf("redis rejected the auth token: %s", e.Message)
+}
+
+// Fetch connects to a Redis node, authenticates if authToken is not empty,
+// and returns the output of INFO all. It uses TLS if tlsConfig is not nil.
+// Only the small part of the Redis protocol which this needs is implemented.
+func Fetch(
+	ctx context.Context,
+	address string,
+	authToken string,
+	tlsConfig *tls.Config,
+	timeout time.Duration,
+) (Info, error) {
+	netDialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	var err error
+	if tlsConfig != nil {
+		tlsDialer := &tls.Dialer{NetDialer: netDialer, Config: tlsConfig}
+		conn, err = tlsDialer.DialContext(ctx, "tcp", address)
+	} else {
+		conn, err = netDialer.DialContext(ctx, "tcp", address)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to %s: %v", address, err)
+	}
+	defer conn.Close()
+	err = conn.SetDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+
+	if authToken != "" {
+		reply, err := command(conn, reader, "AUTH", authToken)
+		if err != nil {
+			if replyErr, ok := err.(*replyError); ok {
+				return nil, &ErrAuth{Message: replyErr.message}
+			}
+			return nil, fmt.Errorf("error authenticating with %s: %v", address, err)
+		}
+		if reply != "OK" {
+			return nil, fmt.Errorf("unexpected reply to AUTH from %s: %q", address, reply)
+		}
+	}
+
+	reply, err := command(conn, reader, "INFO", "all")
+	if err != nil {
+		return nil, fmt.Errorf("error running INFO on %s: %v", address, err)
+	}
+	return Parse(reply), nil
+}
+
+// replyError is an error reply from Redis, like "-ERR unknown command"
+type replyError struct {
+	message string
+}
+
+func (e *replyError) Error() string {
+	return e.message
+}
+
+// command sends a command as an array of bulk strings and reads a simple
+// string, error or bulk string reply
+func command(writer io.Writer, reader *bufio.Reader, args ...string) (string, error) {
+	var request strings.Builder
+	fmt.Fprintf(&request, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&request, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := io.WriteString(writer, request.String())
+	if err != nil {
+		return "", err
+	}
+
+	line, err := readLine(reader)
+	if err != nil {
+		return "", err
+	}
+	if line == "" {
+		return "", fmt.Errorf("empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return "", &replyError{message: line[1:]}
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil || length < 0 {
+			return "", fmt.Errorf("invalid bulk string length %q", line[1:])
+		}
+		body := make([]byte, length+2)
+		_, err = io.ReadFull(reader, body)
+		if err != nil {
+			return "", err
+		}
+		return string(body[:length]), nil
+	}
+	return "", fmt.Errorf("unexpected reply %q", line)
+}
+
+func readLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
@@ -0,0 +1,168 @@
+package redis_info
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Info is the output of INFO, by section and then by field. Section names are
+// lower case, like "memory".
+type Info map[string]map[string]string
+
+// Parse reads the output of INFO
+func Parse(text string) Info {
+	info := Info{}
+	section := ""
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			section = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(line, "#")))
+			continue
+		}
+		field, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		if info[section] == nil {
+			info[section] = map[string]string{}
+		}
+		info[section][field] = value
+	}
+	return info
+}
+
+// Sample is one value from INFO, named and labelled for Prometheus
+type Sample struct {
+	Name   string
+	Labels map[string]string
+	Value  float64
+	// Counter is true for values which only go up while the node is running
+	Counter bool
+}
+
+// sampledSections are the sections whose numeric fields become samples with
+// the same names, like used_memory and connected_clients
+var sampledSections = []string{"memory", "clients", "stats", "replication", "persistence"}
+
+// counterFields are the fields in sampledSections which are counters, as
+// well as those starting with total_
+var counterFields = map[string]bool{
+	"keyspace_hits":        true,
+	"keyspace_misses":      true,
+	"expired_keys":         true,
+	"evicted_keys":         true,
+	"rejected_connections": true,
+	"sync_full":            true,
+	"sync_partial_ok":      true,
+	"sync_partial_err":     true,
+}
+
+var invalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// Samples turns the memory, clients, stats, replication, persistence,
+// keyspace and commandstats sections into samples, in a stable order. Text
+// fields are left out, apart from a few which say whether something is
+// working. Fields which describe other hosts, like the replicas' addresses,
+// are always left out.
+func (info Info) Samples() []Sample {
+	samples := []Sample{}
+	for _, section := range sampledSections {
+		for _, field := range sortedKeys(info[section]) {
+			value := info[section][field]
+			if strings.Contains(value, "=") {
+				continue
+			}
+			name := sanitise(field)
+			switch {
+			case field == "role":
+				samples = append(samples, Sample{Name: "replication_role", Labels: map[string]string{"role": value}, Value: 1})
+			case value == "up" || value == "down":
+				samples = append(samples, Sample{Name: strings.TrimSuffix(name, "_status") + "_up", Value: boolValue(value == "up")})
+			case value == "ok" || value == "err":
+				samples = append(samples, Sample{Name: strings.TrimSuffix(name, "_status") + "_ok", Value: boolValue(value == "ok")})
+			default:
+				number, err := strconv.ParseFloat(value, 64)
+				if err != nil {
+					continue
+				}
+				samples = append(samples, Sample{
+					Name:    name,
+					Value:   number,
+					Counter: strings.HasPrefix(field, "total_") || counterFields[field],
+				})
+			}
+		}
+	}
+
+	// db0:keys=1,expires=0,avg_ttl=0
+	for _, db := range sortedKeys(info["keyspace"]) {
+		for _, stat := range parseStats(info["keyspace"][db]) {
+			samples = append(samples, Sample{
+				Name:   "keyspace_" + sanitise(stat.name),
+				Labels: map[string]string{"db": db},
+				Value:  stat.value,
+			})
+		}
+	}
+
+	// cmdstat_get:calls=2,usec=10,usec_per_call=5.00,rejected_calls=0,failed_calls=0
+	for _, field := range sortedKeys(info["commandstats"]) {
+		command := strings.TrimPrefix(field, "cmdstat_")
+		for _, stat := range parseStats(info["commandstats"][field]) {
+			samples = append(samples, Sample{
+				Name:    "commandstats_" + sanitise(stat.name),
+				Labels:  map[string]string{"command": command},
+				Value:   stat.value,
+				Counter: stat.name != "usec_per_call",
+			})
+		}
+	}
+	return samples
+}
+
+type stat struct {
+	name  string
+	value float64
+}
+
+// parseStats reads the numbers from a value like "keys=1,expires=0"
+func parseStats(value string) []stat {
+	stats := []stat{}
+	for _, pair := range strings.Split(value, ",") {
+		name, number, ok := strings.Cut(pair, "=")
+		if !ok {
+			continue
+		}
+		v, err := strconv.ParseFloat(number, 64)
+		if err != nil {
+			continue
+		}
+		stats = append(stats, stat{name: name, value: v})
+	}
+	return stats
+}
+
+func sanitise(name string) string {
+	return strings.ToLower(invalidNameChars.ReplaceAllString(name, "_"))
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
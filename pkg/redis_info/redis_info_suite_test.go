@@ -0,0 +1,13 @@
+package redis_info_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestRedisInfo(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "RedisInfo Suite")
+}
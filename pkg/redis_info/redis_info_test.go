@@ -0,0 +1,233 @@
+package redis_info_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/redis_info"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+const infoAll = "# Server\r\n" +
+	"redis_version:6.2.6\r\n" +
+	"uptime_in_seconds:1000\r\n" +
+	"\r\n" +
+	"# Clients\r\n" +
+	"connected_clients:3\r\n" +
+	"blocked_clients:0\r\n" +
+	"\r\n" +
+	"# Memory\r\n" +
+	"used_memory:1048576\r\n" +
+	"used_memory_human:1.00M\r\n" +
+	"mem_fragmentation_ratio:1.25\r\n" +
+	"maxmemory_policy:volatile-lru\r\n" +
+	"\r\n" +
+	"# Persistence\r\n" +
+	"rdb_changes_since_last_save:4\r\n" +
+	"rdb_last_bgsave_status:ok\r\n" +
+	"aof_last_write_status:err\r\n" +
+	"\r\n" +
+	"# Stats\r\n" +
+	"total_connections_received:20\r\n" +
+	"total_commands_processed:500\r\n" +
+	"instantaneous_ops_per_sec:7\r\n" +
+	"keyspace_hits:40\r\n" +
+	"keyspace_misses:2\r\n" +
+	"\r\n" +
+	"# Replication\r\n" +
+	"role:master\r\n" +
+	"connected_slaves:1\r\n" +
+	"slave0:ip=10.0.0.1,port=6379,state=online,offset=100,lag=0\r\n" +
+	"master_repl_offset:100\r\n" +
+	"\r\n" +
+	"# Commandstats\r\n" +
+	"cmdstat_get:calls=30,usec=60,usec_per_call=2.00,rejected_calls=0,failed_calls=1\r\n" +
+	"\r\n" +
+	"# Keyspace\r\n" +
+	"db0:keys=12,expires=2,avg_ttl=3000\r\n"
+
+// stubRedis answers AUTH and INFO like a Redis node with the given token
+type stubRedis struct {
+	listener  net.Listener
+	authToken string
+	commands  chan []string
+}
+
+func startStubRedis(authToken string, tlsConfig *tls.Config) *stubRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).NotTo(HaveOccurred())
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	stub := &stubRedis{listener: listener, authToken: authToken, commands: make(chan []string, 10)}
+	go stub.serve()
+	DeferCleanup(listener.Close)
+	return stub
+}
+
+func (s *stubRedis) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *stubRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	authenticated := s.authToken == ""
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+		s.commands <- args
+		switch strings.ToUpper(args[0]) {
+		case "AUTH":
+			if len(args) == 2 && args[1] == s.authToken {
+				authenticated = true
+				io.WriteString(conn, "+OK\r\n")
+			} else {
+				io.WriteString(conn, "-WRONGPASS invalid username-password pair\r\n")
+			}
+		case "INFO":
+			if !authenticated {
+				io.WriteString(conn, "-NOAUTH Authentication required.\r\n")
+				continue
+			}
+			fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(infoAll), infoAll)
+		default:
+			io.WriteString(conn, "-ERR unknown command\r\n")
+		}
+	}
+}
+
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := []string{}
+	for i := 0; i < count; i++ {
+		line, err = reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		length, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		arg := make([]byte, length+2)
+		_, err = io.ReadFull(reader, arg)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, string(arg[:length]))
+	}
+	return args, nil
+}
+
+var _ = Describe("Fetch", func() {
+	It("authenticates and reads INFO all", func() {
+		stub := startStubRedis("the-token", nil)
+		info, err := redis_info.Fetch(context.Background(), stub.listener.Addr().String(), "the-token", nil, time.Second)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info["memory"]).To(HaveKeyWithValue("used_memory", "1048576"))
+		Expect(<-stub.commands).To(Equal([]string{"AUTH", "the-token"}))
+		Expect(<-stub.commands).To(Equal([]string{"INFO", "all"}))
+	})
+
+	It("says when the auth token is wrong", func() {
+		stub := startStubRedis("the-token", nil)
+		_, err := redis_info.Fetch(context.Background(), stub.listener.Addr().String(), "old-token", nil, time.Second)
+		Expect(err).To(BeAssignableToTypeOf(&redis_info.ErrAuth{}))
+		Expect(err).To(MatchError(ContainSubstring("WRONGPASS")))
+	})
+
+	It("connects over TLS", func() {
+		// httptest has a ready-made certificate for 127.0.0.1
+		server := httptest.NewUnstartedServer(nil)
+		server.StartTLS()
+		serverTLSConfig := server.TLS
+		roots := x509.NewCertPool()
+		roots.AddCert(server.Certificate())
+		clientTLSConfig := &tls.Config{RootCAs: roots}
+		server.Close()
+
+		stub := startStubRedis("the-token", serverTLSConfig)
+		info, err := redis_info.Fetch(context.Background(), stub.listener.Addr().String(), "the-token", clientTLSConfig, time.Second)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info["clients"]).To(HaveKeyWithValue("connected_clients", "3"))
+	})
+
+	It("gives up when the node does not answer in time", func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(listener.Close)
+
+		start := time.Now()
+		_, err = redis_info.Fetch(context.Background(), listener.Addr().String(), "", nil, 100*time.Millisecond)
+		Expect(err).To(HaveOccurred())
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+	})
+})
+
+var _ = Describe("Info", func() {
+	It("turns INFO into samples", func() {
+		samples := redis_info.Parse(infoAll).Samples()
+		byName := map[string][]redis_info.Sample{}
+		for _, sample := range samples {
+			byName[sample.Name] = append(byName[sample.Name], sample)
+		}
+
+		Expect(byName["used_memory"]).To(Equal([]redis_info.Sample{{Name: "used_memory", Value: 1048576}}))
+		Expect(byName["mem_fragmentation_ratio"][0].Value).To(Equal(1.25))
+		Expect(byName["connected_clients"][0].Value).To(Equal(float64(3)))
+		Expect(byName["total_commands_processed"][0].Counter).To(BeTrue())
+		Expect(byName["keyspace_hits"][0].Counter).To(BeTrue())
+		Expect(byName["instantaneous_ops_per_sec"][0].Counter).To(BeFalse())
+		Expect(byName["rdb_last_bgsave_ok"][0].Value).To(Equal(float64(1)))
+		Expect(byName["aof_last_write_ok"][0].Value).To(Equal(float64(0)))
+		Expect(byName["replication_role"]).To(Equal([]redis_info.Sample{
+			{Name: "replication_role", Labels: map[string]string{"role": "master"}, Value: 1},
+		}))
+		Expect(byName["keyspace_keys"]).To(Equal([]redis_info.Sample{
+			{Name: "keyspace_keys", Labels: map[string]string{"db": "db0"}, Value: 12},
+		}))
+		Expect(byName["commandstats_calls"]).To(Equal([]redis_info.Sample{
+			{Name: "commandstats_calls", Labels: map[string]string{"command": "get"}, Value: 30, Counter: true},
+		}))
+		Expect(byName["commandstats_usec_per_call"][0].Counter).To(BeFalse())
+
+		// Text fields, server details and other hosts' addresses are left out
+		Expect(byName).NotTo(HaveKey("used_memory_human"))
+		Expect(byName).NotTo(HaveKey("maxmemory_policy"))
+		Expect(byName).NotTo(HaveKey("uptime_in_seconds"))
+		Expect(byName).NotTo(HaveKey("slave0"))
+	})
+
+	It("always gives the samples in the same order", func() {
+		first := redis_info.Parse(infoAll).Samples()
+		for i := 0; i < 5; i++ {
+			Expect(redis_info.Parse(infoAll).Samples()).To(Equal(first))
+		}
+	})
+})
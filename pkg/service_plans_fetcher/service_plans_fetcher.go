@@ -2,117 +2,213 @@ package service_plans_fetcher
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"net/url"
-	"sync"
-	"time"
+	"regexp"
+	"strings"
+
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/store"
 
 	"code.cloudfoundry.org/lager"
 	cfclient "github.com/cloudfoundry-community/go-cfclient"
 )
 
 type ServicePlansStore interface {
-	GetService() *cfclient.Service
+	GetServices() []cfclient.Service
 	GetServicePlans() []cfclient.ServicePlan
+	// GetServiceForPlan returns the service which offers a plan, if the plan
+	// is one of the store's
+	GetServiceForPlan(planGuid string) (cfclient.Service, bool)
+}
+
+// ServiceFilter chooses which service offerings and plans to fetch
+type ServiceFilter struct {
+	// Labels are the labels of the services to include. Each must be
+	// offered by exactly one broker, after filtering by Broker.
+	Labels []string
+	// Broker is the name or GUID of the broker whose services to include,
+	// if there is more than one broker offering a service with the label
+	Broker string
+	// ExcludedPlans matches the names of plans to leave out. It can be nil.
+	ExcludedPlans *regexp.Regexp
+}
+
+// Fingerprint identifies the filter, so that data saved to disk with a
+// different filter is not restored
+func (filter ServiceFilter) Fingerprint() string {
+	excludedPlans := ""
+	if filter.ExcludedPlans != nil {
+		excludedPlans = filter.ExcludedPlans.String()
+	}
+	contents, _ := json.Marshal([]interface{}{filter.Labels, filter.Broker, excludedPlans})
+	checksum := sha256.Sum256(contents)
+	return hex.EncodeToString(checksum[:])
+}
+
+// servicePlans has exported fields so that it can be saved to disk
+type servicePlans struct {
+	Services           []cfclient.Service
+	PlansByServiceGuid map[string][]cfclient.ServicePlan
+	ServicesByPlanGuid map[string]cfclient.Service
 }
 
 type ServicePlansFetcher struct {
-	serviceName  string
-	service      *cfclient.Service
-	servicePlans []cfclient.ServicePlan
-	schedule     time.Duration
-	logger       lager.Logger
-	cfClient     cfclient.CloudFoundryClient
-	mu           sync.Mutex
+	*store.Store[servicePlans]
+	filter   ServiceFilter
+	logger   lager.Logger
+	cfClient cfclient.CloudFoundryClient
 }
 
 func NewServicePlansFetcher(
-	serviceName string,
-	schedule time.Duration,
+	filter ServiceFilter,
+	storeOptions store.Options,
 	logger lager.Logger,
 	cfClient cfclient.CloudFoundryClient,
 ) *ServicePlansFetcher {
 	logger = logger.Session("service-plans-fetcher")
-	return &ServicePlansFetcher{
-		serviceName: serviceName,
-		schedule:    schedule,
-		logger:      logger,
-		cfClient:    cfClient,
+	f := &ServicePlansFetcher{
+		filter:   filter,
+		logger:   logger,
+		cfClient: cfClient,
 	}
+	storeOptions.Name = "service-plans"
+	storeOptions.Fingerprint = filter.Fingerprint()
+	f.Store = store.New(f.fetchServicePlans, storeOptions, logger)
+	return f
 }
 
-func (f *ServicePlansFetcher) GetService() *cfclient.Service {
-	f.mu.Lock()
-	defer f.mu.Unlock()
-	return f.service
+func (f *ServicePlansFetcher) GetServices() []cfclient.Service {
+	plans, _ := f.Get()
+	return plans.Services
 }
 
 func (f *ServicePlansFetcher) GetServicePlans() []cfclient.ServicePlan {
-	f.mu.Lock()
-	defer f.mu.Unlock()
-	return f.servicePlans
+	plans, ok := f.Get()
+	if !ok {
+		return nil
+	}
+	allPlans := []cfclient.ServicePlan{}
+	for _, service := range plans.Services {
+		allPlans = append(allPlans, plans.PlansByServiceGuid[service.Guid]...)
+	}
+	return allPlans
 }
 
-func (f *ServicePlansFetcher) Run(ctx context.Context) error {
-	lsession := f.logger.Session("run")
+func (f *ServicePlansFetcher) GetServiceForPlan(planGuid string) (cfclient.Service, bool) {
+	plans, _ := f.Get()
+	service, ok := plans.ServicesByPlanGuid[planGuid]
+	return service, ok
+}
 
-	lsession.Info("start")
-	defer lsession.Info("end")
+func (f *ServicePlansFetcher) fetchServicePlans(ctx context.Context) (servicePlans, error) {
+	brokerGuid := ""
+	if f.filter.Broker != "" {
+		broker, err := f.findBroker(f.filter.Broker)
+		if err != nil {
+			return servicePlans{}, err
+		}
+		brokerGuid = broker.Guid
+	}
 
-	err := f.updateServicePlans()
-	if err != nil {
-		return fmt.Errorf("error initialising list of service plans: %v", err)
+	result := servicePlans{
+		Services:           []cfclient.Service{},
+		PlansByServiceGuid: map[string][]cfclient.ServicePlan{},
+		ServicesByPlanGuid: map[string]cfclient.Service{},
 	}
+	for _, label := range f.filter.Labels {
+		service, err := f.fetchService(label, brokerGuid)
+		if err != nil {
+			return servicePlans{}, err
+		}
+
+		q := url.Values{}
+		q.Add("q", fmt.Sprintf("service_guid:%s", service.Guid))
+		plans, err := f.cfClient.ListServicePlansByQuery(q)
+		if err != nil {
+			return servicePlans{}, fmt.Errorf("error fetching service plans of service named '%s': %v", label, err)
+		}
+		if plans == nil {
+			return servicePlans{}, fmt.Errorf("list of service plans of service named '%s' was nil", label)
+		}
 
-	for {
-		select {
-		case <-ctx.Done():
-			lsession.Info("done")
-			return nil
-		case <-time.After(f.schedule):
-			err = f.updateServicePlans()
-			if err != nil {
-				return fmt.Errorf("error updating list of service plans: %v", err)
+		includedPlans := []cfclient.ServicePlan{}
+		for _, plan := range plans {
+			if f.filter.ExcludedPlans != nil && f.filter.ExcludedPlans.MatchString(plan.Name) {
+				continue
 			}
+			includedPlans = append(includedPlans, plan)
+			result.ServicesByPlanGuid[plan.Guid] = service
 		}
+		result.Services = append(result.Services, service)
+		result.PlansByServiceGuid[service.Guid] = includedPlans
+
+		f.logger.Info("updated-service-plans", lager.Data{
+			"service":                  label,
+			"number-of-service-plans":  len(includedPlans),
+			"number-of-excluded-plans": len(plans) - len(includedPlans),
+		})
+		f.logger.Debug("updated-service-plans-list", lager.Data{
+			"service":            label,
+			"service-plan-guids": servicePlanGuids(includedPlans),
+		})
 	}
-}
 
-func (f *ServicePlansFetcher) updateServicePlans() error {
-	// FIXME: Relax this locking so it is short-lived
-	f.mu.Lock()
-	defer f.mu.Unlock()
+	return result, nil
+}
 
-	q1 := url.Values{}
-	q1.Add("q", fmt.Sprintf("label:%s", f.serviceName))
-	services, err := f.cfClient.ListServicesByQuery(q1)
+func (f *ServicePlansFetcher) fetchService(label string, brokerGuid string) (cfclient.Service, error) {
+	q := url.Values{}
+	q.Add("q", fmt.Sprintf("label:%s", label))
+	services, err := f.cfClient.ListServicesByQuery(q)
 	if err != nil {
-		return fmt.Errorf("error fetching service named '%s': %v", f.serviceName, err)
+		return cfclient.Service{}, fmt.Errorf("error fetching service named '%s': %v", label, err)
+	}
+
+	matchingServices := []cfclient.Service{}
+	for _, service := range services {
+		if brokerGuid == "" || service.ServiceBrokerGuid == brokerGuid {
+			matchingServices = append(matchingServices, service)
+		}
+	}
+	if len(matchingServices) == 0 {
+		return cfclient.Service{}, fmt.Errorf("no service named '%s' was found", label)
 	}
-	if len(services) != 1 {
-		return fmt.Errorf("unexpected number of results when fetching service named '%s': %d results", f.serviceName, len(services))
+	if len(matchingServices) > 1 {
+		brokerGuids := []string{}
+		for _, service := range matchingServices {
+			brokerGuids = append(brokerGuids, service.ServiceBrokerGuid)
+		}
+		return cfclient.Service{}, fmt.Errorf(
+			"more than one broker offers a service named '%s' (%s), choose one with a broker filter",
+			label, strings.Join(brokerGuids, ", "),
+		)
 	}
-	f.service = &services[0]
+	return matchingServices[0], nil
+}
 
-	q2 := url.Values{}
-	q2.Add("q", fmt.Sprintf("service_guid:%s", f.service.Guid))
-	servicePlans, err := f.cfClient.ListServicePlansByQuery(q2)
+func (f *ServicePlansFetcher) findBroker(nameOrGuid string) (cfclient.ServiceBroker, error) {
+	brokers, err := f.cfClient.ListServiceBrokers()
 	if err != nil {
-		return fmt.Errorf("error fetching service plans: %v", err)
+		return cfclient.ServiceBroker{}, fmt.Errorf("error fetching service brokers: %v", err)
 	}
-	if servicePlans == nil {
-		return fmt.Errorf("list of service plans was nil")
+	for _, broker := range brokers {
+		if broker.Guid == nameOrGuid || broker.Name == nameOrGuid {
+			return broker, nil
+		}
 	}
-
-	f.logger.Info("updated-service-plans", lager.Data{
-		"number-of-service-plans": len(servicePlans),
-	})
-	f.logger.Debug("updated-service-plans-list", lager.Data{
-		"service-plans": servicePlans,
-	})
-
-	f.servicePlans = servicePlans
-	return nil
+	return cfclient.ServiceBroker{}, fmt.Errorf("no service broker with the name or GUID '%s' was found", nameOrGuid)
 }
 
 var _ ServicePlansStore = (*ServicePlansFetcher)(nil)
+
+// servicePlanGuids is for debug logs, which should not include whole plans
+func servicePlanGuids(servicePlans []cfclient.ServicePlan) []string {
+	guids := make([]string, len(servicePlans))
+	for i, servicePlan := range servicePlans {
+		guids[i] = servicePlan.Guid
+	}
+	return guids
+}
@@ -5,9 +5,11 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"regexp"
 	"time"
 
 	"github.com/alphagov/paas-prometheus-endpoints/pkg/service_plans_fetcher"
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/store"
 	"github.com/alphagov/paas-prometheus-endpoints/pkg/testsupport"
 
 	"code.cloudfoundry.org/lager"
@@ -21,6 +23,8 @@ import (
 var _ = Describe("ServicePlansFetcher", func() {
 	var servicePlansFetcher *service_plans_fetcher.ServicePlansFetcher
 	var fetchSchedule time.Duration
+	var logger lager.Logger
+	var cfClient *cfclient.Client
 
 	BeforeEach(func() {
 		httpmock.Reset()
@@ -45,10 +49,11 @@ var _ = Describe("ServicePlansFetcher", func() {
 			},
 		})
 
-		logger := lager.NewLogger("service-plans-fetcher-test")
+		logger = lager.NewLogger("service-plans-fetcher-test")
 		logger.RegisterSink(lager.NewWriterSink(GinkgoWriter, lager.INFO))
 
-		cfClient, err := cfclient.NewClient(&cfclient.Config{
+		var err error
+		cfClient, err = cfclient.NewClient(&cfclient.Config{
 			ApiAddress: testsupport.CfApiUrl,
 			HttpClient: httpclient,
 		})
@@ -56,8 +61,8 @@ var _ = Describe("ServicePlansFetcher", func() {
 
 		fetchSchedule = 400 * time.Millisecond
 		servicePlansFetcher = service_plans_fetcher.NewServicePlansFetcher(
-			"cf-service-name",
-			fetchSchedule,
+			service_plans_fetcher.ServiceFilter{Labels: []string{"cf-service-name"}},
+			store.Options{Schedule: fetchSchedule},
 			logger,
 			cfClient,
 		)
@@ -67,7 +72,7 @@ var _ = Describe("ServicePlansFetcher", func() {
 		ctx, cancel := context.WithTimeout(context.Background(), fetchSchedule*2)
 		defer cancel()
 		go servicePlansFetcher.Run(ctx)
-		Eventually(servicePlansFetcher.GetService).Should(PointTo(MatchFields(IgnoreExtras, Fields{
+		Eventually(servicePlansFetcher.GetServices).Should(ConsistOf(MatchFields(IgnoreExtras, Fields{
 			"Guid":  Equal("fake-service-guid"),
 			"Label": Equal("cf-service-name"),
 		})))
@@ -127,37 +132,211 @@ var _ = Describe("ServicePlansFetcher", func() {
 		))
 		ctx.Done()
 	})
+
+	It("keeps serving the last good data while the Cloud Controller API is down", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		outageFetcher := service_plans_fetcher.NewServicePlansFetcher(
+			service_plans_fetcher.ServiceFilter{Labels: []string{"cf-service-name"}},
+			store.Options{Schedule: 50 * time.Millisecond, MinBackoff: 20 * time.Millisecond},
+			logger,
+			cfClient,
+		)
+		go outageFetcher.Run(ctx)
+		Eventually(outageFetcher.GetServicePlans).Should(HaveLen(2))
+
+		testsupport.SetupCfApiOutageHttpmock("/v2/service_plans", url.Values{"q": []string{"service_guid:fake-service-guid"}})
+		Eventually(outageFetcher.LastError).Should(HaveOccurred())
+		Expect(outageFetcher.GetServicePlans()).To(HaveLen(2))
+
+		mockCfServicePlansApiResponse("service_guid:fake-service-guid", []cfclient.ServicePlan{
+			{
+				Guid: "fake-service-plan-3-guid",
+				Name: "cf-service-plan-3",
+			},
+		})
+		Eventually(outageFetcher.GetServicePlans).Should(HaveLen(1))
+		Expect(outageFetcher.LastError()).NotTo(HaveOccurred())
+	})
+
+	It("restores the service plans saved by a previous run without asking the Cloud Controller API", func() {
+		cacheDir := GinkgoT().TempDir()
+		firstFetcher := service_plans_fetcher.NewServicePlansFetcher(
+			service_plans_fetcher.ServiceFilter{Labels: []string{"cf-service-name"}},
+			store.Options{Schedule: fetchSchedule, CacheDir: cacheDir},
+			logger,
+			cfClient,
+		)
+		Expect(firstFetcher.Refresh(context.Background())).To(Succeed())
+
+		testsupport.SetupCfApiOutageHttpmock("/v2/services", url.Values{"q": []string{"label:cf-service-name"}})
+		restartedFetcher := service_plans_fetcher.NewServicePlansFetcher(
+			service_plans_fetcher.ServiceFilter{Labels: []string{"cf-service-name"}},
+			store.Options{Schedule: fetchSchedule, CacheDir: cacheDir},
+			logger,
+			cfClient,
+		)
+		Expect(restartedFetcher.Restore()).To(BeTrue())
+		Expect(restartedFetcher.GetServicePlans()).To(HaveLen(2))
+		service, ok := restartedFetcher.GetServiceForPlan("fake-service-plan-1-guid")
+		Expect(ok).To(BeTrue())
+		Expect(service.Label).To(Equal("cf-service-name"))
+	})
+
+	It("doesn't restore service plans saved with a different filter", func() {
+		cacheDir := GinkgoT().TempDir()
+		firstFetcher := service_plans_fetcher.NewServicePlansFetcher(
+			service_plans_fetcher.ServiceFilter{Labels: []string{"cf-service-name"}},
+			store.Options{Schedule: fetchSchedule, CacheDir: cacheDir},
+			logger,
+			cfClient,
+		)
+		Expect(firstFetcher.Refresh(context.Background())).To(Succeed())
+
+		restartedFetcher := service_plans_fetcher.NewServicePlansFetcher(
+			service_plans_fetcher.ServiceFilter{
+				Labels:        []string{"cf-service-name"},
+				ExcludedPlans: regexp.MustCompile("plan-2"),
+			},
+			store.Options{Schedule: fetchSchedule, CacheDir: cacheDir},
+			logger,
+			cfClient,
+		)
+		Expect(restartedFetcher.Restore()).To(BeFalse())
+		Expect(restartedFetcher.GetServicePlans()).To(BeEmpty())
+	})
+
+	Context("with several services offered by several brokers", func() {
+		BeforeEach(func() {
+			mockCfServicesApiResponse("label:cf-service-name",
+				cfclient.Service{Guid: "fake-service-guid", Label: "cf-service-name", ServiceBrokerGuid: "broker-1-guid"},
+				cfclient.Service{Guid: "other-broker-service-guid", Label: "cf-service-name", ServiceBrokerGuid: "broker-2-guid"},
+			)
+			mockCfServicesApiResponse("label:cf-other-service-name",
+				cfclient.Service{Guid: "fake-other-service-guid", Label: "cf-other-service-name", ServiceBrokerGuid: "broker-1-guid"},
+			)
+			mockCfServicePlansApiResponse("service_guid:fake-other-service-guid", []cfclient.ServicePlan{
+				{Guid: "fake-other-service-plan-guid", Name: "cf-other-service-plan"},
+				{Guid: "fake-deprecated-plan-guid", Name: "cf-other-service-plan-deprecated"},
+			})
+			mockCfServiceBrokersApiResponse([]cfclient.ServiceBroker{
+				{Guid: "broker-1-guid", Name: "broker-1"},
+				{Guid: "broker-2-guid", Name: "broker-2"},
+			})
+		})
+
+		It("refuses to guess which broker's service to use", func() {
+			fetcher := service_plans_fetcher.NewServicePlansFetcher(
+				service_plans_fetcher.ServiceFilter{Labels: []string{"cf-service-name"}},
+				store.Options{Schedule: fetchSchedule},
+				logger,
+				cfClient,
+			)
+			Expect(fetcher.Refresh(context.Background())).To(MatchError(ContainSubstring(
+				"more than one broker offers a service named 'cf-service-name' (broker-1-guid, broker-2-guid)",
+			)))
+		})
+
+		It("tracks the plans of each service from the chosen broker, leaving out excluded plans", func() {
+			fetcher := service_plans_fetcher.NewServicePlansFetcher(
+				service_plans_fetcher.ServiceFilter{
+					Labels:        []string{"cf-service-name", "cf-other-service-name"},
+					Broker:        "broker-1",
+					ExcludedPlans: regexp.MustCompile(`-deprecated$`),
+				},
+				store.Options{Schedule: fetchSchedule},
+				logger,
+				cfClient,
+			)
+			Expect(fetcher.Refresh(context.Background())).To(Succeed())
+
+			Expect(fetcher.GetServices()).To(ConsistOf(
+				MatchFields(IgnoreExtras, Fields{"Guid": Equal("fake-service-guid")}),
+				MatchFields(IgnoreExtras, Fields{"Guid": Equal("fake-other-service-guid")}),
+			))
+			Expect(fetcher.GetServicePlans()).To(ConsistOf(
+				MatchFields(IgnoreExtras, Fields{"Guid": Equal("fake-service-plan-1-guid")}),
+				MatchFields(IgnoreExtras, Fields{"Guid": Equal("fake-service-plan-2-guid")}),
+				MatchFields(IgnoreExtras, Fields{"Guid": Equal("fake-other-service-plan-guid")}),
+			))
+
+			service, ok := fetcher.GetServiceForPlan("fake-other-service-plan-guid")
+			Expect(ok).To(BeTrue())
+			Expect(service.Label).To(Equal("cf-other-service-name"))
+			_, ok = fetcher.GetServiceForPlan("fake-deprecated-plan-guid")
+			Expect(ok).To(BeFalse())
+		})
+
+		It("accepts the broker's GUID as well as its name", func() {
+			fetcher := service_plans_fetcher.NewServicePlansFetcher(
+				service_plans_fetcher.ServiceFilter{
+					Labels: []string{"cf-service-name"},
+					Broker: "broker-2-guid",
+				},
+				store.Options{Schedule: fetchSchedule},
+				logger,
+				cfClient,
+			)
+			mockCfServicePlansApiResponse("service_guid:other-broker-service-guid", []cfclient.ServicePlan{
+				{Guid: "other-broker-plan-guid", Name: "cf-service-plan-1"},
+			})
+			Expect(fetcher.Refresh(context.Background())).To(Succeed())
+			Expect(fetcher.GetServices()).To(ConsistOf(
+				MatchFields(IgnoreExtras, Fields{"Guid": Equal("other-broker-service-guid")}),
+			))
+		})
+	})
 })
 
-func mockCfServicesApiResponse(expectedQ string, service cfclient.Service) {
+func mockCfServicesApiResponse(expectedQ string, services ...cfclient.Service) {
 	mockURL := fmt.Sprintf("%s/v2/services", testsupport.CfApiUrl)
 	expectedQuery := url.Values{
 		"q": []string{expectedQ},
 	}
 	resp := httpmock.NewJsonResponderOrPanic(
-		200, wrapServiceForResponse(service),
+		200, wrapServicesForResponse(services),
 	)
 	httpmock.RegisterResponderWithQuery("GET", mockURL, expectedQuery, resp)
 }
 
-func wrapServiceForResponse(service cfclient.Service) cfclient.ServicesResponse {
-	meta := cfclient.Meta{
-		Guid:      service.Guid,
-		CreatedAt: service.CreatedAt,
+func wrapServicesForResponse(services []cfclient.Service) cfclient.ServicesResponse {
+	serviceResources := []cfclient.ServicesResource{}
+	for _, service := range services {
+		meta := cfclient.Meta{
+			Guid:      service.Guid,
+			CreatedAt: service.CreatedAt,
+		}
+		service.Guid = ""
+		service.CreatedAt = ""
+		serviceResources = append(serviceResources, cfclient.ServicesResource{
+			Meta:   meta,
+			Entity: service,
+		})
 	}
-	service.Guid = ""
-	service.CreatedAt = ""
 	return cfclient.ServicesResponse{
-		Pages: 1,
-		Resources: []cfclient.ServicesResource{
-			{
-				Meta:   meta,
-				Entity: service,
-			},
-		},
+		Pages:     1,
+		Resources: serviceResources,
 	}
 }
 
+func mockCfServiceBrokersApiResponse(brokers []cfclient.ServiceBroker) {
+	mockURL := fmt.Sprintf("%s/v2/service_brokers", testsupport.CfApiUrl)
+	brokerResources := []cfclient.ServiceBrokerResource{}
+	for _, broker := range brokers {
+		meta := cfclient.Meta{Guid: broker.Guid}
+		broker.Guid = ""
+		brokerResources = append(brokerResources, cfclient.ServiceBrokerResource{
+			Meta:   meta,
+			Entity: broker,
+		})
+	}
+	resp := httpmock.NewJsonResponderOrPanic(200, cfclient.ServiceBrokerResponse{
+		Pages:     1,
+		Resources: brokerResources,
+	})
+	httpmock.RegisterResponder("GET", mockURL, resp)
+}
+
 func mockCfServicePlansApiResponse(expectedQ string, servicePlans []cfclient.ServicePlan) {
 	mockURL := fmt.Sprintf("%s/v2/service_plans", testsupport.CfApiUrl)
 	expectedQuery := url.Values{
@@ -1,10 +1,8 @@
 package spaces_fetcher
 
 import (
-	"context"
-	"fmt"
-	"sync"
-	"time"
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/cf_v3"
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/store"
 
 	"code.cloudfoundry.org/lager"
 	cfclient "github.com/cloudfoundry-community/go-cfclient"
@@ -12,82 +10,95 @@ import (
 
 type SpacesStore interface {
 	GetSpaces() []cfclient.Space
+	// LookupSpace fetches a space which is missing from the store, for example
+	// because it was only just created, and adds it to the store
+	LookupSpace(guid string) (cfclient.Space, error)
+}
+
+// SpaceGuidsSource says which spaces a scoped SpacesFetcher fetches, for
+// example an instance_index.InstanceIndexFetcher. It returns false until it
+// knows.
+type SpaceGuidsSource interface {
+	GetSpaceGuids() ([]string, bool)
+}
+
+// spaceType is how spaces are fetched from the Cloud Controller
+var spaceType = store.CFResourceType[cf_v3.Space, cfclient.Space]{
+	Singular:        "space",
+	Plural:          "spaces",
+	Path:            "/v3/spaces",
+	DeleteEventType: "audit.space.delete-request",
+	ListAll: func(cfClient cfclient.CloudFoundryClient) ([]cfclient.Space, error) {
+		return cfClient.ListSpaces()
+	},
+	Get: func(cfClient cfclient.CloudFoundryClient, guid string) (cfclient.Space, error) {
+		return cfClient.GetSpaceByGuid(guid)
+	},
+	GuidOf: func(space cfclient.Space) string { return space.Guid },
+	ToV2:   cf_v3.Space.ToV2,
+	Merge: func(existing cfclient.Space, update cfclient.Space) cfclient.Space {
+		existing.Name = update.Name
+		existing.UpdatedAt = update.UpdatedAt
+		existing.OrganizationGuid = update.OrganizationGuid
+		return existing
+	},
 }
 
 type SpacesFetcher struct {
-	Spaces   []cfclient.Space
-	schedule time.Duration
-	logger   lager.Logger
-	cfClient cfclient.CloudFoundryClient
-	mu       sync.Mutex
+	*store.CFResources[cf_v3.Space, cfclient.Space]
 }
 
+// NewSpacesFetcher fetches every space on the platform
 func NewSpacesFetcher(
-	schedule time.Duration,
+	storeOptions store.Options,
+	logger lager.Logger,
+	cfClient cfclient.CloudFoundryClient,
+) *SpacesFetcher {
+	return NewScopedSpacesFetcher(nil, storeOptions, logger, cfClient)
+}
+
+// NewScopedSpacesFetcher only fetches the spaces whose GUIDs the source
+// returns, or every space if the source is nil
+func NewScopedSpacesFetcher(
+	spaceGuidsSource SpaceGuidsSource,
+	storeOptions store.Options,
 	logger lager.Logger,
 	cfClient cfclient.CloudFoundryClient,
 ) *SpacesFetcher {
-	logger = logger.Session("spaces-fetcher")
+	var guidsSource func() ([]string, bool)
+	if spaceGuidsSource != nil {
+		guidsSource = spaceGuidsSource.GetSpaceGuids
+	}
 	return &SpacesFetcher{
-		schedule:    schedule,
-		logger:      logger,
-		cfClient:    cfClient,
+		store.NewCFResources(spaceType, guidsSource, storeOptions, logger, cfClient),
 	}
 }
 
 func (fetcher *SpacesFetcher) GetSpaces() []cfclient.Space {
-	fetcher.mu.Lock()
-	defer fetcher.mu.Unlock()
-	return fetcher.Spaces
+	spaces, _ := fetcher.Get()
+	return spaces
 }
 
-func (fetcher *SpacesFetcher) Run(ctx context.Context) error {
-	loggerSession := fetcher.logger.Session("run")
-
-	loggerSession.Info("start")
-	defer loggerSession.Info("end")
-
-	err := fetcher.updateSpaces()
-	if err != nil {
-		return fmt.Errorf("error initialising list of spaces: %v", err)
+// GetOrgGuids returns the GUIDs of the orgs which the spaces are in, and
+// false if the spaces have not been fetched yet
+func (fetcher *SpacesFetcher) GetOrgGuids() ([]string, bool) {
+	spaces, ok := fetcher.Get()
+	if !ok {
+		return nil, false
 	}
-
-	for {
-		select {
-		case <-ctx.Done():
-			loggerSession.Info("done")
-			return nil
-		case <-time.After(fetcher.schedule):
-			err = fetcher.updateSpaces()
-			if err != nil {
-				return fmt.Errorf("error updating list of spaces: %v", err)
-			}
+	orgGuids := []string{}
+	seen := map[string]bool{}
+	for _, space := range spaces {
+		if space.OrganizationGuid != "" && !seen[space.OrganizationGuid] {
+			seen[space.OrganizationGuid] = true
+			orgGuids = append(orgGuids, space.OrganizationGuid)
 		}
 	}
+	return orgGuids, true
 }
 
-func (fetcher *SpacesFetcher) updateSpaces() error {
-	// FIXME: Relax this locking so it is short-lived
-	fetcher.mu.Lock()
-	defer fetcher.mu.Unlock()
-
-	spaces, err := fetcher.cfClient.ListSpaces()
-	if err != nil {
-		return fmt.Errorf("error fetching spaces: %v", err)
-	}
-	if spaces == nil {
-		return fmt.Errorf("list of spaces was nil")
-	}
-
-	fetcher.logger.Info("updated-spaces", lager.Data{
-		"number-of-spaces": len(spaces),
-	})
-	fetcher.logger.Debug("updated-spaces-list", lager.Data{
-		"spaces": spaces,
-	})
-
-	fetcher.Spaces = spaces
-	return nil
+func (fetcher *SpacesFetcher) LookupSpace(guid string) (cfclient.Space, error) {
+	return fetcher.Lookup(guid)
 }
 
 var _ SpacesStore = (*SpacesFetcher)(nil)
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/alphagov/paas-prometheus-endpoints/pkg/spaces_fetcher"
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/store"
 	"github.com/alphagov/paas-prometheus-endpoints/pkg/testsupport"
 
 	"code.cloudfoundry.org/lager"
@@ -17,9 +18,19 @@ import (
 	. "github.com/onsi/gomega/gstruct"
 )
 
+type fakeSpaceGuidsSource struct {
+	spaceGuids []string
+	known      bool
+}
+
+func (f *fakeSpaceGuidsSource) GetSpaceGuids() ([]string, bool) {
+	return f.spaceGuids, f.known
+}
+
 var _ = Describe("SpacesFetcher", func() {
 	var spacesFetcher *spaces_fetcher.SpacesFetcher
-	var fetchSchedule time.Duration
+	var logger lager.Logger
+	var cfClient *cfclient.Client
 
 	BeforeEach(func() {
 		httpmock.Reset()
@@ -30,53 +41,41 @@ var _ = Describe("SpacesFetcher", func() {
 
 		mockCfSpacesApiResponse([]cfclient.Space{
 			{
-				Guid: "fake-space-1-guid",
-				Name: "cf-space-1",
+				Guid:             "fake-space-1-guid",
+				Name:             "cf-space-1",
+				OrganizationGuid: "fake-org-1-guid",
 			},
 			{
-				Guid: "fake-space-2-guid",
-				Name: "cf-space-2",
+				Guid:             "fake-space-2-guid",
+				Name:             "cf-space-2",
+				OrganizationGuid: "fake-org-1-guid",
 			},
 		})
 
-		logger := lager.NewLogger("spaces-fetcher-test")
+		logger = lager.NewLogger("spaces-fetcher-test")
 		logger.RegisterSink(lager.NewWriterSink(GinkgoWriter, lager.INFO))
 
-		cfClient, err := cfclient.NewClient(&cfclient.Config{
+		var err error
+		cfClient, err = cfclient.NewClient(&cfclient.Config{
 			ApiAddress: testsupport.CfApiUrl,
 			HttpClient: httpclient,
 		})
 		Expect(err).NotTo(HaveOccurred())
 
-		fetchSchedule = 400 * time.Millisecond
 		spacesFetcher = spaces_fetcher.NewSpacesFetcher(
-			fetchSchedule,
+			store.Options{Schedule: time.Hour, FullSyncSchedule: time.Hour},
 			logger,
 			cfClient,
 		)
 	})
 
 	It("provides space metadata from the Cloud Controller API", func() {
-		ctx, cancel := context.WithTimeout(context.Background(), fetchSchedule*2)
-		defer cancel()
-		go spacesFetcher.Run(ctx)
-		Eventually(spacesFetcher.GetSpaces).Should(ConsistOf(
-			MatchFields(IgnoreExtras, Fields{
-				"Guid": Equal("fake-space-1-guid"),
-				"Name": Equal("cf-space-1"),
-			}),
-			MatchFields(IgnoreExtras, Fields{
-				"Guid": Equal("fake-space-2-guid"),
-				"Name": Equal("cf-space-2"),
-			}),
-		))
-	})
+		_, ok := spacesFetcher.GetOrgGuids()
+		Expect(ok).To(BeFalse())
 
-	It("periodically updates the spaces from the Cloud Controller API", func() {
-		ctx, cancel := context.WithTimeout(context.Background(), fetchSchedule*4)
-		defer cancel()
-		go spacesFetcher.Run(ctx)
-		Eventually(spacesFetcher.GetSpaces).Should(ConsistOf(
+		Expect(spacesFetcher.Refresh(context.Background())).To(Succeed())
+		Expect(spacesFetcher.Name()).To(Equal("spaces"))
+		Expect(spacesFetcher.GetSpaces()).To(ConsistOf(
 			MatchFields(IgnoreExtras, Fields{
 				"Guid": Equal("fake-space-1-guid"),
 				"Name": Equal("cf-space-1"),
@@ -86,49 +85,97 @@ var _ = Describe("SpacesFetcher", func() {
 				"Name": Equal("cf-space-2"),
 			}),
 		))
+		orgGuids, ok := spacesFetcher.GetOrgGuids()
+		Expect(ok).To(BeTrue())
+		Expect(orgGuids).To(ConsistOf("fake-org-1-guid"))
+	})
 
+	It("follows spaces moving between orgs, and keeps the fields the v3 API doesn't give", func() {
 		mockCfSpacesApiResponse([]cfclient.Space{
 			{
-				Guid: "fake-space-1-guid",
-				Name: "cf-space-1",
+				Guid:                "fake-space-1-guid",
+				Name:                "cf-space-1",
+				OrganizationGuid:    "fake-org-1-guid",
+				QuotaDefinitionGuid: "fake-quota-guid",
 			},
+		})
+		Expect(spacesFetcher.Refresh(context.Background())).To(Succeed())
+
+		testsupport.SetupCfV3ListHttpmock("/v3/spaces", []map[string]interface{}{
 			{
-				Guid: "fake-space-3-guid",
-				Name: "cf-space-3",
+				"guid":       "fake-space-1-guid",
+				"name":       "cf-space-1-renamed",
+				"updated_at": "2020-01-02T03:04:05Z",
+				"relationships": map[string]interface{}{
+					"organization": map[string]interface{}{
+						"data": map[string]interface{}{"guid": "fake-org-2-guid"},
+					},
+				},
 			},
 		})
+		testsupport.SetupCfV3ListHttpmock("/v3/audit_events", []map[string]interface{}{})
+		Expect(spacesFetcher.Refresh(context.Background())).To(Succeed())
+		Expect(spacesFetcher.GetSpaces()).To(ConsistOf(MatchFields(IgnoreExtras, Fields{
+			"Guid":                Equal("fake-space-1-guid"),
+			"Name":                Equal("cf-space-1-renamed"),
+			"UpdatedAt":           Equal("2020-01-02T03:04:05Z"),
+			"OrganizationGuid":    Equal("fake-org-2-guid"),
+			"QuotaDefinitionGuid": Equal("fake-quota-guid"),
+		})))
+		orgGuids, _ := spacesFetcher.GetOrgGuids()
+		Expect(orgGuids).To(ConsistOf("fake-org-2-guid"))
+		Expect(httpmock.GetCallCountInfo()["GET http://cf.api/v2/spaces"]).To(Equal(1))
+	})
 
-		Eventually(spacesFetcher.GetSpaces).Should(ConsistOf(
-			MatchFields(IgnoreExtras, Fields{
-				"Guid": Equal("fake-space-1-guid"),
-				"Name": Equal("cf-space-1"),
-			}),
-			MatchFields(IgnoreExtras, Fields{
-				"Guid": Equal("fake-space-3-guid"),
-				"Name": Equal("cf-space-3"),
-			}),
-		))
-		ctx.Done()
+	It("looks up a space which is missing from the v2 API", func() {
+		Expect(spacesFetcher.Refresh(context.Background())).To(Succeed())
+		httpmock.RegisterResponder(
+			"GET",
+			fmt.Sprintf("%s/v2/spaces/fake-space-3-guid", testsupport.CfApiUrl),
+			httpmock.NewJsonResponderOrPanic(200, wrapSpacesForResponse([]cfclient.Space{
+				{
+					Guid:             "fake-space-3-guid",
+					Name:             "cf-space-3",
+					OrganizationGuid: "fake-org-2-guid",
+				},
+			}).Resources[0]),
+		)
+
+		space, err := spacesFetcher.LookupSpace("fake-space-3-guid")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(space.Name).To(Equal("cf-space-3"))
+		orgGuids, _ := spacesFetcher.GetOrgGuids()
+		Expect(orgGuids).To(ConsistOf("fake-org-1-guid", "fake-org-2-guid"))
 	})
-})
 
-func wrapSpaceForResponse(space cfclient.Space) cfclient.SpaceResponse {
-	meta := cfclient.Meta{
-		Guid:      space.Guid,
-		CreatedAt: space.CreatedAt,
-	}
-	space.Guid = ""
-	space.CreatedAt = ""
-	return cfclient.SpaceResponse{
-		Pages: 1,
-		Resources: []cfclient.SpaceResource{
+	It("fetches only the spaces its source asks for from the v3 API", func() {
+		scopedFetcher := spaces_fetcher.NewScopedSpacesFetcher(
+			&fakeSpaceGuidsSource{spaceGuids: []string{"fake-space-3-guid"}, known: true},
+			store.Options{Schedule: time.Hour, FullSyncSchedule: time.Hour},
+			logger,
+			cfClient,
+		)
+		testsupport.SetupCfV3ListByGuidsHttpmock("/v3/spaces", []map[string]interface{}{
 			{
-				Meta:   meta,
-				Entity: space,
+				"guid": "fake-space-3-guid",
+				"name": "cf-space-3",
+				"relationships": map[string]interface{}{
+					"organization": map[string]interface{}{
+						"data": map[string]interface{}{"guid": "fake-org-2-guid"},
+					},
+				},
 			},
-		},
-	}
-}
+		})
+
+		Expect(scopedFetcher.Refresh(context.Background())).To(Succeed())
+		Expect(scopedFetcher.GetSpaces()).To(ConsistOf(MatchFields(IgnoreExtras, Fields{
+			"Guid":             Equal("fake-space-3-guid"),
+			"Name":             Equal("cf-space-3"),
+			"OrganizationGuid": Equal("fake-org-2-guid"),
+		})))
+		Expect(httpmock.GetCallCountInfo()["GET http://cf.api/v2/spaces"]).To(Equal(0))
+	})
+})
 
 func mockCfSpacesApiResponse(spaces []cfclient.Space) {
 	mockURL := fmt.Sprintf("%s/v2/spaces", testsupport.CfApiUrl)
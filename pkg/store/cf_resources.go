@@ -0,0 +1,301 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/cf_v3"
+
+	"code.cloudfoundry.org/lager"
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
+)
+
+// changesOverlap is how far before the previous refresh to start looking for
+// changes, in case the Cloud Controller's clock is a little behind ours
+const changesOverlap = 5 * time.Minute
+
+// Up to lookupBurst resources missing from the store can be looked up at
+// once, and one more every lookupInterval after that
+const (
+	lookupBurst    = 20
+	lookupInterval = time.Second
+)
+
+// lookedUpRetention is how long a scoped store keeps resources which were
+// looked up although its source doesn't ask for them, giving the source time
+// to catch up, for example with a service instance created since it last
+// refreshed
+const lookedUpRetention = 15 * time.Minute
+
+// CFResourceType describes a type of Cloud Foundry resource, such as spaces
+// or orgs, for a CFResources store. V3 is the type the v3 API returns and T
+// is the type the rest of the app uses.
+type CFResourceType[V3 any, T any] struct {
+	// Singular and Plural name the resources in logs and errors, for example
+	// "space" and "spaces". Plural also names the store.
+	Singular string
+	Plural   string
+	// Path is the v3 endpoint which lists the resources, for example
+	// "/v3/spaces"
+	Path string
+	// DeleteEventType is the type of the audit event recorded when one is
+	// deleted, for example "audit.space.delete-request"
+	DeleteEventType string
+	// ListAll fetches every resource, for the full syncs of a store which
+	// isn't scoped
+	ListAll func(cfClient cfclient.CloudFoundryClient) ([]T, error)
+	// Get fetches a single resource
+	Get    func(cfClient cfclient.CloudFoundryClient, guid string) (T, error)
+	GuidOf func(resource T) string
+	ToV2   func(resource V3) T
+	// Merge applies a change fetched from the v3 API to a resource in the
+	// store, keeping any fields the v3 API doesn't give
+	Merge func(existing T, update T) T
+}
+
+// CFResources keeps the Cloud Foundry resources of one type. After the first
+// full fetch it only fetches the resources created, renamed or deleted since
+// the previous refresh, apart from a full fetch every FullSyncSchedule.
+// Resources missing from the store can be looked up one at a time.
+//
+// A scoped store only fetches the resources whose GUIDs its source returns,
+// and the ones looked up in the last lookedUpRetention, which the source
+// might not know about yet.
+type CFResources[V3 any, T any] struct {
+	*Store[[]T]
+	resourceType CFResourceType[V3, T]
+	guidsSource  func() ([]string, bool)
+	logger       lager.Logger
+	cfClient     cfclient.CloudFoundryClient
+	readThrough  *ReadThrough[T]
+
+	lookedUpMu sync.Mutex
+	lookedUp   map[string]time.Time
+	now        func() time.Time
+}
+
+// NewCFResources fetches every resource of the type, or if guidsSource isn't
+// nil only the ones whose GUIDs it returns. guidsSource returns false until
+// it knows.
+func NewCFResources[V3 any, T any](
+	resourceType CFResourceType[V3, T],
+	guidsSource func() ([]string, bool),
+	opts Options,
+	logger lager.Logger,
+	cfClient cfclient.CloudFoundryClient,
+) *CFResources[V3, T] {
+	logger = logger.Session(resourceType.Plural + "-fetcher")
+	r := &CFResources[V3, T]{
+		resourceType: resourceType,
+		guidsSource:  guidsSource,
+		logger:       logger,
+		cfClient:     cfClient,
+		lookedUp:     map[string]time.Time{},
+		now:          time.Now,
+	}
+	r.readThrough = NewReadThrough(r.lookup, lookupBurst, lookupInterval)
+	opts.Name = resourceType.Plural
+	r.Store = NewIncremental(r.fetch, r.fetchChanges, opts, logger)
+	return r
+}
+
+// SetClock replaces the source of the current time, for testing
+func (r *CFResources[V3, T]) SetClock(now func() time.Time) {
+	r.lookedUpMu.Lock()
+	defer r.lookedUpMu.Unlock()
+	r.now = now
+}
+
+// Lookup fetches a resource which is missing from the store, for example
+// because it was only just created, and adds it to the store
+func (r *CFResources[V3, T]) Lookup(guid string) (T, error) {
+	return r.readThrough.Get(guid)
+}
+
+func (r *CFResources[V3, T]) lookup(guid string) (T, error) {
+	resource, err := r.resourceType.Get(r.cfClient, guid)
+	if err != nil {
+		var none T
+		return none, fmt.Errorf("error looking up %s %s: %v", r.resourceType.Singular, guid, err)
+	}
+
+	r.Update(func(resources []T) []T {
+		return cf_v3.ApplyChanges(
+			resources,
+			r.resourceType.GuidOf,
+			[]T{resource},
+			func(existing T, update T) T { return update },
+			nil,
+		)
+	})
+	if r.guidsSource != nil {
+		r.lookedUpMu.Lock()
+		r.lookedUp[guid] = r.now()
+		r.lookedUpMu.Unlock()
+	}
+	r.logger.Info("looked-up-missing-"+r.resourceType.Singular, lager.Data{
+		r.resourceType.Singular + "-guid": guid,
+	})
+
+	return resource, nil
+}
+
+func (r *CFResources[V3, T]) fetch(ctx context.Context) ([]T, error) {
+	if r.guidsSource != nil {
+		return r.fetchScoped()
+	}
+
+	resources, err := r.resourceType.ListAll(r.cfClient)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching %s: %v", r.resourceType.Plural, err)
+	}
+	if resources == nil {
+		return nil, fmt.Errorf("list of %s was nil", r.resourceType.Plural)
+	}
+
+	r.logger.Info("updated-"+r.resourceType.Plural, lager.Data{
+		"number-of-" + r.resourceType.Plural: len(resources),
+	})
+	r.logger.Debug("updated-"+r.resourceType.Plural+"-list", lager.Data{
+		r.resourceType.Singular + "-guids": r.guids(resources),
+	})
+
+	return resources, nil
+}
+
+func (r *CFResources[V3, T]) fetchScoped() ([]T, error) {
+	guids, ok := r.wantedGuids()
+	if !ok {
+		return nil, fmt.Errorf("the %s to fetch are not known yet", r.resourceType.Plural)
+	}
+	v3Resources, err := cf_v3.ListByGuids[V3](r.cfClient, r.resourceType.Path, guids)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching %s: %v", r.resourceType.Plural, err)
+	}
+	resources := make([]T, len(v3Resources))
+	for i, resource := range v3Resources {
+		resources[i] = r.resourceType.ToV2(resource)
+	}
+
+	r.logger.Info("updated-scoped-"+r.resourceType.Plural, lager.Data{
+		"number-of-" + r.resourceType.Plural:        len(resources),
+		"number-of-wanted-" + r.resourceType.Plural: len(guids),
+	})
+
+	return resources, nil
+}
+
+// fetchChanges applies the resources created, renamed or deleted since the
+// previous refresh. Creates and renames come from the resources' updated_at
+// and deletes from audit events. A scoped store also fetches the resources
+// which its source has started asking for, and drops the ones it no longer
+// wants.
+func (r *CFResources[V3, T]) fetchChanges(ctx context.Context, previous Snapshot[[]T]) ([]T, error) {
+	since := previous.StartedAt.Add(-changesOverlap)
+
+	var wanted map[string]bool
+	newResources := []V3{}
+	if r.guidsSource != nil {
+		guids, ok := r.wantedGuids()
+		if !ok {
+			return nil, fmt.Errorf("the %s to fetch are not known yet", r.resourceType.Plural)
+		}
+		wanted = map[string]bool{}
+		for _, guid := range guids {
+			wanted[guid] = true
+		}
+		known := map[string]bool{}
+		for _, resource := range previous.Value {
+			known[r.resourceType.GuidOf(resource)] = true
+		}
+		missingGuids := []string{}
+		for _, guid := range guids {
+			if !known[guid] {
+				missingGuids = append(missingGuids, guid)
+			}
+		}
+		var err error
+		newResources, err = cf_v3.ListByGuids[V3](r.cfClient, r.resourceType.Path, missingGuids)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching new %s: %v", r.resourceType.Plural, err)
+		}
+	}
+
+	updatedResources, err := cf_v3.ListUpdatedSince[V3](r.cfClient, r.resourceType.Path, since)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching updated %s: %v", r.resourceType.Plural, err)
+	}
+	deletedGuids, err := cf_v3.ListDeletedSince(r.cfClient, r.resourceType.DeleteEventType, since)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching deleted %s: %v", r.resourceType.Plural, err)
+	}
+
+	updates := []T{}
+	for _, v3Resource := range append(updatedResources, newResources...) {
+		resource := r.resourceType.ToV2(v3Resource)
+		if wanted != nil && !wanted[r.resourceType.GuidOf(resource)] {
+			continue
+		}
+		updates = append(updates, resource)
+	}
+	if wanted != nil {
+		for _, resource := range previous.Value {
+			if guid := r.resourceType.GuidOf(resource); !wanted[guid] {
+				deletedGuids = append(deletedGuids, guid)
+			}
+		}
+	}
+	resources := cf_v3.ApplyChanges(
+		previous.Value,
+		r.resourceType.GuidOf,
+		updates,
+		r.resourceType.Merge,
+		deletedGuids,
+	)
+
+	r.logger.Info("applied-"+r.resourceType.Singular+"-changes", lager.Data{
+		"number-of-" + r.resourceType.Plural:         len(resources),
+		"number-of-updated-" + r.resourceType.Plural: len(updates),
+		"number-of-deleted-" + r.resourceType.Plural: len(deletedGuids),
+	})
+
+	return resources, nil
+}
+
+// wantedGuids returns the resources which the source asks for and the ones
+// which were looked up recently, or false if the source doesn't know yet
+func (r *CFResources[V3, T]) wantedGuids() ([]string, bool) {
+	guids, ok := r.guidsSource()
+	if !ok {
+		return nil, false
+	}
+	wanted := map[string]bool{}
+	for _, guid := range guids {
+		wanted[guid] = true
+	}
+	guids = append([]string{}, guids...)
+
+	r.lookedUpMu.Lock()
+	defer r.lookedUpMu.Unlock()
+	for guid, lookedUpAt := range r.lookedUp {
+		if r.now().Sub(lookedUpAt) > lookedUpRetention {
+			delete(r.lookedUp, guid)
+			continue
+		}
+		if !wanted[guid] {
+			guids = append(guids, guid)
+		}
+	}
+	return guids, true
+}
+
+// guids is for debug logs, which should not include whole resources
+func (r *CFResources[V3, T]) guids(resources []T) []string {
+	guids := make([]string, len(resources))
+	for i, resource := range resources {
+		guids[i] = r.resourceType.GuidOf(resource)
+	}
+	return guids
+}
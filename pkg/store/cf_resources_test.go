@@ -0,0 +1,273 @@
+package store_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/cf_v3"
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/store"
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/testsupport"
+
+	"code.cloudfoundry.org/lager"
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
+	"github.com/jarcoal/httpmock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// fakeV2Spaces stands in for the v2 API, which a CFResources store uses for
+// full fetches and lookups. The v3 API is mocked with httpmock.
+type fakeV2Spaces struct {
+	mu     sync.Mutex
+	spaces map[string]cfclient.Space
+	err    error
+}
+
+func (f *fakeV2Spaces) set(spaces ...cfclient.Space) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.spaces = map[string]cfclient.Space{}
+	for _, space := range spaces {
+		f.spaces[space.Guid] = space
+	}
+}
+
+func (f *fakeV2Spaces) list(cfClient cfclient.CloudFoundryClient) ([]cfclient.Space, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	spaces := []cfclient.Space{}
+	for _, space := range f.spaces {
+		spaces = append(spaces, space)
+	}
+	return spaces, nil
+}
+
+func (f *fakeV2Spaces) get(cfClient cfclient.CloudFoundryClient, guid string) (cfclient.Space, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	space, ok := f.spaces[guid]
+	if !ok {
+		return cfclient.Space{}, fmt.Errorf("space %s not found", guid)
+	}
+	return space, nil
+}
+
+// v3Space is a space as the v3 API returns it
+func v3Space(guid, name, orgGuid string) map[string]interface{} {
+	return map[string]interface{}{
+		"guid": guid,
+		"name": name,
+		"relationships": map[string]interface{}{
+			"organization": map[string]interface{}{
+				"data": map[string]interface{}{"guid": orgGuid},
+			},
+		},
+	}
+}
+
+type fakeGuidsSource struct {
+	mu    sync.Mutex
+	guids []string
+	known bool
+}
+
+func (f *fakeGuidsSource) set(guids ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.guids = guids
+	f.known = true
+}
+
+func (f *fakeGuidsSource) get() ([]string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.guids, f.known
+}
+
+var _ = Describe("CFResources", func() {
+	var v2Spaces *fakeV2Spaces
+	var spaceType store.CFResourceType[cf_v3.Space, cfclient.Space]
+	var logger lager.Logger
+	var cfClient *cfclient.Client
+
+	BeforeEach(func() {
+		httpmock.Reset()
+		httpclient := &http.Client{Transport: &http.Transport{}}
+		httpmock.ActivateNonDefault(httpclient)
+		testsupport.SetupCfV2InfoHttpmock()
+		testsupport.SetupSuccessfulUaaOauthLoginHttpmock()
+		testsupport.SetupCfV3ListHttpmock("/v3/spaces", []map[string]interface{}{})
+		testsupport.SetupCfV3ListHttpmock("/v3/audit_events", []map[string]interface{}{})
+
+		var err error
+		cfClient, err = cfclient.NewClient(&cfclient.Config{
+			ApiAddress: testsupport.CfApiUrl,
+			HttpClient: httpclient,
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		logger = lager.NewLogger("cf-resources-test")
+		logger.RegisterSink(lager.NewWriterSink(GinkgoWriter, lager.INFO))
+
+		v2Spaces = &fakeV2Spaces{}
+		v2Spaces.set(
+			cfclient.Space{Guid: "space-1-guid", Name: "space-1", OrganizationGuid: "org-1-guid"},
+			cfclient.Space{Guid: "space-2-guid", Name: "space-2", OrganizationGuid: "org-1-guid"},
+		)
+		spaceType = store.CFResourceType[cf_v3.Space, cfclient.Space]{
+			Singular:        "space",
+			Plural:          "spaces",
+			Path:            "/v3/spaces",
+			DeleteEventType: "audit.space.delete-request",
+			ListAll:         v2Spaces.list,
+			Get:             v2Spaces.get,
+			GuidOf:          func(space cfclient.Space) string { return space.Guid },
+			ToV2:            cf_v3.Space.ToV2,
+			Merge: func(existing cfclient.Space, update cfclient.Space) cfclient.Space {
+				existing.Name = update.Name
+				existing.OrganizationGuid = update.OrganizationGuid
+				return existing
+			},
+		}
+	})
+
+	names := func(resources *store.CFResources[cf_v3.Space, cfclient.Space]) func() []string {
+		return func() []string {
+			spaces, _ := resources.Get()
+			names := []string{}
+			for _, space := range spaces {
+				names = append(names, space.Name)
+			}
+			sort.Strings(names)
+			return names
+		}
+	}
+
+	It("fetches every resource, and keeps serving the last good ones while the Cloud Controller API is down", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		resources := store.NewCFResources(spaceType, nil, store.Options{
+			Schedule:         50 * time.Millisecond,
+			FullSyncSchedule: time.Millisecond,
+			MinBackoff:       20 * time.Millisecond,
+		}, logger, cfClient)
+		go resources.Run(ctx)
+		Eventually(names(resources)).Should(Equal([]string{"space-1", "space-2"}))
+		Expect(resources.Name()).To(Equal("spaces"))
+
+		v2Spaces.mu.Lock()
+		v2Spaces.err = fmt.Errorf("the API is down")
+		v2Spaces.mu.Unlock()
+		Eventually(resources.LastError).Should(MatchError(ContainSubstring("error fetching spaces: the API is down")))
+		Expect(names(resources)()).To(Equal([]string{"space-1", "space-2"}))
+
+		v2Spaces.mu.Lock()
+		v2Spaces.err = nil
+		v2Spaces.mu.Unlock()
+		v2Spaces.set(cfclient.Space{Guid: "space-3-guid", Name: "space-3"})
+		Eventually(names(resources)).Should(Equal([]string{"space-3"}))
+		Expect(resources.LastError()).NotTo(HaveOccurred())
+	})
+
+	It("applies the resources created, renamed and deleted between full syncs", func() {
+		resources := store.NewCFResources(spaceType, nil, store.Options{
+			Schedule:         time.Hour,
+			FullSyncSchedule: time.Hour,
+		}, logger, cfClient)
+		Expect(resources.Refresh(context.Background())).To(Succeed())
+
+		testsupport.SetupCfV3ListHttpmock("/v3/spaces", []map[string]interface{}{
+			v3Space("space-1-guid", "space-1-renamed", "org-2-guid"),
+			v3Space("space-3-guid", "space-3", "org-1-guid"),
+		})
+		testsupport.SetupCfV3ListHttpmock("/v3/audit_events", []map[string]interface{}{
+			{
+				"type":   "audit.space.delete-request",
+				"target": map[string]interface{}{"guid": "space-2-guid"},
+			},
+		})
+		Expect(resources.Refresh(context.Background())).To(Succeed())
+		spaces, _ := resources.Get()
+		Expect(spaces).To(ConsistOf(
+			cfclient.Space{Guid: "space-1-guid", Name: "space-1-renamed", OrganizationGuid: "org-2-guid"},
+			cfclient.Space{Guid: "space-3-guid", Name: "space-3", OrganizationGuid: "org-1-guid"},
+		))
+	})
+
+	It("looks up a resource which is missing and adds it to the store", func() {
+		resources := store.NewCFResources(spaceType, nil, store.Options{Schedule: time.Hour}, logger, cfClient)
+		Expect(resources.Refresh(context.Background())).To(Succeed())
+		v2Spaces.set(cfclient.Space{Guid: "space-3-guid", Name: "space-3"})
+
+		space, err := resources.Lookup("space-3-guid")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(space.Name).To(Equal("space-3"))
+		Expect(names(resources)()).To(Equal([]string{"space-1", "space-2", "space-3"}))
+
+		_, err = resources.Lookup("missing-guid")
+		Expect(err).To(MatchError(ContainSubstring("error looking up space missing-guid")))
+	})
+
+	Context("when scoped", func() {
+		var guidsSource *fakeGuidsSource
+		var resources *store.CFResources[cf_v3.Space, cfclient.Space]
+
+		BeforeEach(func() {
+			guidsSource = &fakeGuidsSource{}
+			resources = store.NewCFResources(spaceType, guidsSource.get, store.Options{
+				Schedule:         time.Hour,
+				FullSyncSchedule: time.Hour,
+			}, logger, cfClient)
+			testsupport.SetupCfV3ListByGuidsHttpmock("/v3/spaces", []map[string]interface{}{
+				v3Space("space-1-guid", "space-1", "org-1-guid"),
+				v3Space("space-2-guid", "space-2", "org-2-guid"),
+				v3Space("space-3-guid", "space-3", "org-2-guid"),
+			})
+		})
+
+		It("waits until it knows which resources to fetch", func() {
+			Expect(resources.Refresh(context.Background())).To(MatchError("the spaces to fetch are not known yet"))
+			_, ok := resources.Get()
+			Expect(ok).To(BeFalse())
+		})
+
+		It("only fetches the wanted resources, following changes to which are wanted", func() {
+			guidsSource.set("space-1-guid", "space-2-guid")
+			Expect(resources.Refresh(context.Background())).To(Succeed())
+			Expect(names(resources)()).To(Equal([]string{"space-1", "space-2"}))
+
+			guidsSource.set("space-2-guid", "space-3-guid")
+			Expect(resources.Refresh(context.Background())).To(Succeed())
+			spaces, _ := resources.Get()
+			Expect(spaces).To(ConsistOf(
+				cfclient.Space{Guid: "space-2-guid", Name: "space-2", OrganizationGuid: "org-2-guid"},
+				cfclient.Space{Guid: "space-3-guid", Name: "space-3", OrganizationGuid: "org-2-guid"},
+			))
+		})
+
+		It("keeps a resource it looked up for a while, until the source catches up", func() {
+			now := time.Now()
+			resources.SetClock(func() time.Time { return now })
+			guidsSource.set("space-1-guid")
+			Expect(resources.Refresh(context.Background())).To(Succeed())
+			v2Spaces.set(cfclient.Space{Guid: "space-3-guid", Name: "space-3", OrganizationGuid: "org-2-guid"})
+
+			_, err := resources.Lookup("space-3-guid")
+			Expect(err).NotTo(HaveOccurred())
+			now = now.Add(15 * time.Minute)
+			Expect(resources.Refresh(context.Background())).To(Succeed())
+			Expect(names(resources)()).To(Equal([]string{"space-1", "space-3"}))
+
+			now = now.Add(time.Second)
+			Expect(resources.Refresh(context.Background())).To(Succeed())
+			Expect(names(resources)()).To(Equal([]string{"space-1"}))
+		})
+	})
+})
@@ -0,0 +1,128 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// diskCacheVersion changes whenever the layout of the cache file changes, so
+// that files written by older versions of the app are ignored
+const diskCacheVersion = 2
+
+type diskCacheFile struct {
+	Version     int             `json:"version"`
+	Store       string          `json:"store"`
+	Type        string          `json:"type"`
+	Fingerprint string          `json:"fingerprint"`
+	FetchedAt   time.Time       `json:"fetched_at"`
+	StartedAt   time.Time       `json:"started_at"`
+	Checksum    string          `json:"checksum"`
+	Value       json.RawMessage `json:"value"`
+}
+
+func (s *Store[T]) diskCachePath() string {
+	return filepath.Join(s.opts.CacheDir, s.opts.Name+".json")
+}
+
+func (s *Store[T]) valueType() string {
+	var zero T
+	return fmt.Sprintf("%T", zero)
+}
+
+// writeDiskCache saves a snapshot to the cache file
+func (s *Store[T]) writeDiskCache(snapshot *Snapshot[T]) error {
+	value, err := json.Marshal(snapshot.Value)
+	if err != nil {
+		return fmt.Errorf("error serialising %s data: %v", s.opts.Name, err)
+	}
+	checksum := sha256.Sum256(value)
+	contents, err := json.Marshal(diskCacheFile{
+		Version:     diskCacheVersion,
+		Store:       s.opts.Name,
+		Type:        s.valueType(),
+		Fingerprint: s.opts.Fingerprint,
+		FetchedAt:   snapshot.FetchedAt,
+		StartedAt:   snapshot.StartedAt,
+		Checksum:    hex.EncodeToString(checksum[:]),
+		Value:       value,
+	})
+	if err != nil {
+		return fmt.Errorf("error serialising %s cache file: %v", s.opts.Name, err)
+	}
+
+	err = WriteFile(s.diskCachePath(), contents)
+	if err != nil {
+		return fmt.Errorf("error writing %s cache file: %v", s.opts.Name, err)
+	}
+	return nil
+}
+
+// WriteFile replaces a file with the contents, creating its directory if
+// needed. It writes to a temporary file first so that a crash cannot leave a
+// half-written file.
+func WriteFile(path string, contents []byte) error {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return fmt.Errorf("error creating directory: %v", err)
+	}
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("error creating file: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	_, err = tmpFile.Write(contents)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("error writing file: %v", err)
+	}
+	err = os.Rename(tmpFile.Name(), path)
+	if err != nil {
+		return fmt.Errorf("error replacing file: %v", err)
+	}
+	return nil
+}
+
+// readDiskCache loads a snapshot from the cache file. It returns nil and no
+// error if there is no cache file.
+func (s *Store[T]) readDiskCache() (*Snapshot[T], error) {
+	contents, err := os.ReadFile(s.diskCachePath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s cache file: %v", s.opts.Name, err)
+	}
+
+	var file diskCacheFile
+	err = json.Unmarshal(contents, &file)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s cache file: %v", s.opts.Name, err)
+	}
+	if file.Version != diskCacheVersion || file.Store != s.opts.Name || file.Type != s.valueType() {
+		return nil, fmt.Errorf(
+			"%s cache file is version %d of %s data of type %s, expected version %d of %s data of type %s",
+			s.opts.Name, file.Version, file.Store, file.Type, diskCacheVersion, s.opts.Name, s.valueType(),
+		)
+	}
+	if file.Fingerprint != s.opts.Fingerprint {
+		return nil, fmt.Errorf("%s cache file was saved with different settings", s.opts.Name)
+	}
+	checksum := sha256.Sum256(file.Value)
+	if hex.EncodeToString(checksum[:]) != file.Checksum {
+		return nil, fmt.Errorf("%s cache file is corrupt: checksum does not match", s.opts.Name)
+	}
+
+	var value T
+	err = json.Unmarshal(file.Value, &value)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s data in cache file: %v", s.opts.Name, err)
+	}
+	return &Snapshot[T]{Value: value, FetchedAt: file.FetchedAt, StartedAt: file.StartedAt, Restored: true}, nil
+}
@@ -0,0 +1,118 @@
+package store
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrLookupRateLimited = errors.New("too many lookups of missing items, try again later")
+
+// ErrNotFound is wrapped by the errors of lookups of items which don't exist.
+// ReadThrough remembers them for notFoundTTL, so that looking up a missing
+// item again and again doesn't use up the rate limit.
+var ErrNotFound = errors.New("not found")
+
+const notFoundTTL = time.Minute
+
+// LookupFunc fetches a single item by its key
+type LookupFunc[V any] func(key string) (V, error)
+
+type notFoundResult struct {
+	err     error
+	expires time.Time
+}
+
+type lookupCall[V any] struct {
+	done  chan struct{}
+	value V
+	err   error
+}
+
+// ReadThrough looks up individual items which are missing from a Store,
+// without waiting for the next refresh. Concurrent lookups of the same key
+// share one call, and lookups are rate limited with a token bucket so that a
+// burst of unknown keys cannot overwhelm the API.
+type ReadThrough[V any] struct {
+	lookup   LookupFunc[V]
+	burst    float64
+	interval time.Duration
+
+	mu       sync.Mutex
+	tokens   float64
+	lastFill time.Time
+	calls    map[string]*lookupCall[V]
+	notFound map[string]notFoundResult
+}
+
+// NewReadThrough allows up to burst lookups at once, and one more every
+// interval after that
+func NewReadThrough[V any](lookup LookupFunc[V], burst int, interval time.Duration) *ReadThrough[V] {
+	return &ReadThrough[V]{
+		lookup:   lookup,
+		burst:    float64(burst),
+		interval: interval,
+		tokens:   float64(burst),
+		lastFill: time.Now(),
+		calls:    map[string]*lookupCall[V]{},
+		notFound: map[string]notFoundResult{},
+	}
+}
+
+// Get looks up the item, or waits for a lookup of it which is already
+// happening. It returns ErrLookupRateLimited if too many lookups have been
+// made recently, and the same error as last time if the item was recently
+// not found.
+func (r *ReadThrough[V]) Get(key string) (V, error) {
+	var zero V
+	now := time.Now()
+	r.mu.Lock()
+	if call, ok := r.calls[key]; ok {
+		r.mu.Unlock()
+		<-call.done
+		return call.value, call.err
+	}
+	if result, ok := r.notFound[key]; ok && now.Before(result.expires) {
+		r.mu.Unlock()
+		return zero, result.err
+	}
+	if !r.takeToken(now) {
+		r.mu.Unlock()
+		return zero, ErrLookupRateLimited
+	}
+	call := &lookupCall[V]{done: make(chan struct{})}
+	r.calls[key] = call
+	r.mu.Unlock()
+
+	call.value, call.err = r.lookup(key)
+	close(call.done)
+
+	r.mu.Lock()
+	delete(r.calls, key)
+	for notFoundKey, result := range r.notFound {
+		if !now.Before(result.expires) {
+			delete(r.notFound, notFoundKey)
+		}
+	}
+	if errors.Is(call.err, ErrNotFound) {
+		r.notFound[key] = notFoundResult{err: call.err, expires: time.Now().Add(notFoundTTL)}
+	}
+	r.mu.Unlock()
+
+	return call.value, call.err
+}
+
+func (r *ReadThrough[V]) takeToken(now time.Time) bool {
+	if r.interval > 0 {
+		r.tokens += float64(now.Sub(r.lastFill)) / float64(r.interval)
+		if r.tokens > r.burst {
+			r.tokens = r.burst
+		}
+	}
+	r.lastFill = now
+	if r.tokens < 1 {
+		return false
+	}
+	r.tokens -= 1
+	return true
+}
@@ -0,0 +1,433 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/internal_metrics"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// FetchFunc fetches a complete new copy of the data held by a Store
+type FetchFunc[T any] func(ctx context.Context) (T, error)
+
+// IncrementalFetchFunc fetches what has changed since the previous snapshot
+// and returns a new value with the changes applied. It must not modify the
+// previous value.
+type IncrementalFetchFunc[T any] func(ctx context.Context, previous Snapshot[T]) (T, error)
+
+type Options struct {
+	// Name identifies the store in logs and metrics
+	Name string
+	// Schedule is how long to wait between successful refreshes
+	Schedule time.Duration
+	// Jitter randomly varies each wait by up to this fraction of it, so
+	// several instances of the app do not all refresh at the same time.
+	// Zero means the default of 0.1, and a negative value turns it off.
+	Jitter float64
+	// MinBackoff and MaxBackoff bound how long to wait before retrying a
+	// failed refresh. The wait doubles after each consecutive failure.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// FullSyncSchedule is how often a store with an incremental fetch does a
+	// full fetch instead, to catch any changes the incremental fetches missed.
+	// Zero means only the first refresh is a full fetch.
+	FullSyncSchedule time.Duration
+	// MaxStaleness is how long the data can go without a successful refresh
+	// before Run gives up and returns an error. Data restored from disk does
+	// not count as a refresh. Zero means never give up.
+	MaxStaleness time.Duration
+	// CacheDir is a directory to save the data in after each successful
+	// refresh, so that it can be served straight away when the app restarts.
+	// Empty means the data is not saved.
+	CacheDir string
+	// Fingerprint identifies the settings which decide what data is fetched,
+	// so that a cache file saved with different settings is not restored
+	Fingerprint string
+	// Registry receives metrics about refreshes. It can be nil.
+	Registry *internal_metrics.Registry
+}
+
+func (o Options) withDefaults() Options {
+	if o.Jitter == 0 {
+		o.Jitter = 0.1
+	}
+	if o.MinBackoff == 0 {
+		o.MinBackoff = time.Second
+	}
+	if o.MaxBackoff == 0 {
+		o.MaxBackoff = o.Schedule
+	}
+	if o.MaxBackoff < o.MinBackoff {
+		o.MaxBackoff = o.MinBackoff
+	}
+	return o
+}
+
+// Snapshot is an immutable copy of the data held by a Store. The value must
+// not be modified once it has been stored.
+type Snapshot[T any] struct {
+	Value     T
+	FetchedAt time.Time
+	// StartedAt is when the fetch of the data started. Changes made while it
+	// was under way might be missing, so incremental fetches should ask for
+	// changes since then rather than since FetchedAt.
+	StartedAt time.Time
+	// Restored is true if the snapshot was loaded from the cache directory
+	// and has not been refreshed since
+	Restored bool
+}
+
+// Store keeps a copy of some data fetched in the background. Readers always
+// see a complete snapshot and never wait for a refresh.
+type Store[T any] struct {
+	fetch             FetchFunc[T]
+	incrementalFetch  IncrementalFetchFunc[T]
+	opts              Options
+	logger            lager.Logger
+	snapshot          atomic.Pointer[Snapshot[T]]
+	refreshCount      atomic.Uint64
+	consecutiveErrors atomic.Uint64
+	lastError         atomic.Pointer[error]
+	startedAt         atomic.Pointer[time.Time]
+	lastFullSync      atomic.Pointer[time.Time]
+	lastRefreshed     atomic.Pointer[time.Time]
+	writeMu           sync.Mutex
+	listenersMu       sync.Mutex
+	listeners         []func()
+}
+
+func New[T any](
+	fetch FetchFunc[T],
+	opts Options,
+	logger lager.Logger,
+) *Store[T] {
+	opts = opts.withDefaults()
+	logger = logger.Session("store", lager.Data{"store": opts.Name})
+	return &Store[T]{
+		fetch:  fetch,
+		opts:   opts,
+		logger: logger,
+	}
+}
+
+// NewIncremental returns a Store which does a full fetch first and then only
+// fetches what has changed, apart from a full fetch every FullSyncSchedule
+func NewIncremental[T any](
+	fetch FetchFunc[T],
+	incrementalFetch IncrementalFetchFunc[T],
+	opts Options,
+	logger lager.Logger,
+) *Store[T] {
+	s := New(fetch, opts, logger)
+	s.incrementalFetch = incrementalFetch
+	return s
+}
+
+// Get returns the latest value and whether any value has been fetched yet
+func (s *Store[T]) Get() (T, bool) {
+	snapshot := s.snapshot.Load()
+	if snapshot == nil {
+		var zero T
+		return zero, false
+	}
+	return snapshot.Value, true
+}
+
+// Snapshot returns the latest snapshot, or nil if nothing has been fetched yet
+func (s *Store[T]) Snapshot() *Snapshot[T] {
+	return s.snapshot.Load()
+}
+
+func (s *Store[T]) Name() string {
+	return s.opts.Name
+}
+
+// LastSuccess is when the data was last refreshed successfully. It is the
+// zero time if that has not happened yet.
+func (s *Store[T]) LastSuccess() time.Time {
+	snapshot := s.snapshot.Load()
+	if snapshot == nil {
+		return time.Time{}
+	}
+	return snapshot.FetchedAt
+}
+
+// RefreshCount is how many refreshes have been attempted, successful or not
+func (s *Store[T]) RefreshCount() uint64 {
+	return s.refreshCount.Load()
+}
+
+// LastError is the error from the last refresh, or nil if it succeeded
+func (s *Store[T]) LastError() error {
+	err := s.lastError.Load()
+	if err == nil {
+		return nil
+	}
+	return *err
+}
+
+// Staleness is how old the data is, including data restored from disk, or
+// how long it has been since Run started if there is no data
+func (s *Store[T]) Staleness() time.Duration {
+	lastSuccess := s.LastSuccess()
+	if lastSuccess.IsZero() {
+		startedAt := s.startedAt.Load()
+		if startedAt == nil {
+			return 0
+		}
+		return time.Since(*startedAt)
+	}
+	return time.Since(lastSuccess)
+}
+
+// OnChange registers a function to call after the data changes, whether by
+// a refresh, an Update or a Restore. The function is called synchronously
+// and must not call Update.
+func (s *Store[T]) OnChange(listener func()) {
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+	s.listeners = append(s.listeners, listener)
+}
+
+func (s *Store[T]) notifyChange() {
+	s.listenersMu.Lock()
+	listeners := s.listeners
+	s.listenersMu.Unlock()
+	for _, listener := range listeners {
+		listener()
+	}
+}
+
+// Set replaces the data with a new value, as if it had just been fetched
+func (s *Store[T]) Set(value T) {
+	s.set(value, time.Now())
+}
+
+func (s *Store[T]) set(value T, startedAt time.Time) {
+	s.writeMu.Lock()
+	now := time.Now()
+	s.snapshot.Store(&Snapshot[T]{Value: value, FetchedAt: now, StartedAt: startedAt})
+	s.writeMu.Unlock()
+
+	s.opts.Registry.SetGauge(
+		"paas_exporter_store_last_success_timestamp_seconds",
+		"When the store's data was last refreshed successfully",
+		internal_metrics.Labels{"store": s.opts.Name},
+		float64(now.UnixNano())/1e9,
+	)
+	s.notifyChange()
+}
+
+// Update changes the data without waiting for a refresh, for example to add
+// an item which was looked up on demand. The update function gets the
+// current value and must return a new one rather than modifying it. Nothing
+// happens if nothing has been fetched yet. A refresh which is already under
+// way can overwrite the change.
+func (s *Store[T]) Update(update func(current T) T) {
+	s.writeMu.Lock()
+	snapshot := s.snapshot.Load()
+	if snapshot == nil {
+		s.writeMu.Unlock()
+		return
+	}
+	s.snapshot.Store(&Snapshot[T]{
+		Value:     update(snapshot.Value),
+		FetchedAt: snapshot.FetchedAt,
+		StartedAt: snapshot.StartedAt,
+		Restored:  snapshot.Restored,
+	})
+	s.writeMu.Unlock()
+	s.notifyChange()
+}
+
+// Run refreshes the data straight away and then on a schedule, until the
+// context is cancelled. If there is a CacheDir, the data saved there is
+// served until the first refresh succeeds. Failed refreshes are retried with
+// exponential backoff, and the last good data keeps being served in the
+// meantime. It only returns an error if the data has not been refreshed for
+// longer than the MaxStaleness option since Run started.
+func (s *Store[T]) Run(ctx context.Context) error {
+	lsession := s.logger.Session("run")
+
+	lsession.Info("start")
+	defer lsession.Info("end")
+
+	startedAt := time.Now()
+	s.startedAt.Store(&startedAt)
+	if s.opts.CacheDir != "" {
+		s.Restore()
+	}
+
+	for {
+		wait := s.jitter(s.opts.Schedule)
+		err := s.Refresh(ctx)
+		if err != nil {
+			if s.opts.MaxStaleness > 0 && s.sinceLastRefresh() > s.opts.MaxStaleness {
+				return fmt.Errorf(
+					"%s data has not been refreshed for %s, more than the limit of %s: %v",
+					s.opts.Name, s.sinceLastRefresh().Round(time.Second), s.opts.MaxStaleness, err,
+				)
+			}
+			wait = s.backoff(s.consecutiveErrors.Load())
+			lsession.Info("retrying-after-backoff", lager.Data{
+				"consecutive-errors": s.consecutiveErrors.Load(),
+				"backoff":            wait.String(),
+			})
+		}
+
+		select {
+		case <-ctx.Done():
+			lsession.Info("done")
+			return nil
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Restore loads the data saved in the cache directory, unless the store
+// already has some data. It returns whether any data was loaded.
+func (s *Store[T]) Restore() bool {
+	snapshot, err := s.readDiskCache()
+	if err != nil {
+		s.logger.Error("err-restoring-from-disk", err)
+		return false
+	}
+	if snapshot == nil {
+		s.logger.Info("nothing-to-restore-from-disk")
+		return false
+	}
+	if !s.snapshot.CompareAndSwap(nil, snapshot) {
+		return false
+	}
+	s.logger.Info("restored-from-disk", lager.Data{
+		"fetched-at": snapshot.FetchedAt,
+		"age":        time.Since(snapshot.FetchedAt).Round(time.Second).String(),
+	})
+	s.setRestoredGauge(1)
+	s.notifyChange()
+	return true
+}
+
+// Refresh fetches the data once and stores it if the fetch succeeds. It
+// only fetches what has changed if the store has an incremental fetch and a
+// full fetch is not due.
+func (s *Store[T]) Refresh(ctx context.Context) error {
+	s.refreshCount.Add(1)
+	labels := internal_metrics.Labels{"store": s.opts.Name}
+
+	startedAt := time.Now()
+	sync := "full"
+	var value T
+	var err error
+	previous := s.snapshot.Load()
+	if s.incrementalFetch != nil && previous != nil && !s.fullSyncDue(startedAt) {
+		sync = "incremental"
+		value, err = s.incrementalFetch(ctx, *previous)
+	} else {
+		value, err = s.fetch(ctx)
+	}
+
+	if err != nil {
+		consecutiveErrors := s.consecutiveErrors.Add(1)
+		s.lastError.Store(&err)
+		s.logger.Error("err-refreshing", err, lager.Data{
+			"sync":               sync,
+			"consecutive-errors": consecutiveErrors,
+		})
+		s.opts.Registry.AddCounter(
+			"paas_exporter_store_refreshes_total",
+			"Number of attempts to refresh the store's data",
+			internal_metrics.Labels{"store": s.opts.Name, "sync": sync, "result": "error"},
+			1,
+		)
+		s.opts.Registry.SetGauge(
+			"paas_exporter_store_consecutive_errors",
+			"Number of refreshes of the store's data which have failed in a row",
+			labels,
+			float64(consecutiveErrors),
+		)
+		return err
+	}
+
+	s.set(value, startedAt)
+	s.lastRefreshed.Store(&startedAt)
+	if sync == "full" {
+		s.lastFullSync.Store(&startedAt)
+	}
+	s.setRestoredGauge(0)
+	if s.opts.CacheDir != "" {
+		if err := s.writeDiskCache(s.snapshot.Load()); err != nil {
+			s.logger.Error("err-saving-to-disk", err)
+		}
+	}
+	s.consecutiveErrors.Store(0)
+	s.lastError.Store(nil)
+	s.opts.Registry.AddCounter(
+		"paas_exporter_store_refreshes_total",
+		"Number of attempts to refresh the store's data",
+		internal_metrics.Labels{"store": s.opts.Name, "sync": sync, "result": "success"},
+		1,
+	)
+	s.opts.Registry.SetGauge(
+		"paas_exporter_store_consecutive_errors",
+		"Number of refreshes of the store's data which have failed in a row",
+		labels,
+		0,
+	)
+	return nil
+}
+
+// sinceLastRefresh is how long it has been since a refresh last succeeded,
+// or since Run started if none has. Unlike Staleness it ignores data
+// restored from disk, so the app can start while the source is down.
+func (s *Store[T]) sinceLastRefresh() time.Duration {
+	if lastRefreshed := s.lastRefreshed.Load(); lastRefreshed != nil {
+		return time.Since(*lastRefreshed)
+	}
+	if startedAt := s.startedAt.Load(); startedAt != nil {
+		return time.Since(*startedAt)
+	}
+	return 0
+}
+
+func (s *Store[T]) setRestoredGauge(value float64) {
+	s.opts.Registry.SetGauge(
+		"paas_exporter_store_restored_from_disk",
+		"Whether the store is serving data restored from disk which has not been refreshed yet",
+		internal_metrics.Labels{"store": s.opts.Name},
+		value,
+	)
+}
+
+func (s *Store[T]) fullSyncDue(now time.Time) bool {
+	lastFullSync := s.lastFullSync.Load()
+	if lastFullSync == nil {
+		return true
+	}
+	return s.opts.FullSyncSchedule > 0 && now.Sub(*lastFullSync) >= s.opts.FullSyncSchedule
+}
+
+func (s *Store[T]) backoff(consecutiveErrors uint64) time.Duration {
+	backoff := s.opts.MinBackoff
+	for i := uint64(1); i < consecutiveErrors && backoff < s.opts.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > s.opts.MaxBackoff {
+		backoff = s.opts.MaxBackoff
+	}
+	return s.jitter(backoff)
+}
+
+func (s *Store[T]) jitter(d time.Duration) time.Duration {
+	if s.opts.Jitter <= 0 || d <= 0 {
+		return d
+	}
+	spread := float64(d) * s.opts.Jitter
+	return d + time.Duration((rand.Float64()*2-1)*spread)
+}
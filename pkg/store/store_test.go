@@ -0,0 +1,378 @@
+package store_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/internal_metrics"
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/store"
+
+	"code.cloudfoundry.org/lager"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+type fakeSource struct {
+	values []int
+	errs   []error
+	calls  int
+	mu     sync.Mutex
+}
+
+func (f *fakeSource) fetch(ctx context.Context) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	i := f.calls
+	f.calls += 1
+	if i < len(f.errs) && f.errs[i] != nil {
+		return 0, f.errs[i]
+	}
+	if i >= len(f.values) {
+		return f.values[len(f.values)-1], nil
+	}
+	return f.values[i], nil
+}
+
+func (f *fakeSource) Calls() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
+
+var _ = Describe("Store", func() {
+	var logger lager.Logger
+	var registry *internal_metrics.Registry
+	var source *fakeSource
+	var ctx context.Context
+	var cancel context.CancelFunc
+
+	BeforeEach(func() {
+		logger = lager.NewLogger("store-test")
+		logger.RegisterSink(lager.NewWriterSink(GinkgoWriter, lager.INFO))
+		registry = internal_metrics.NewRegistry()
+		source = &fakeSource{}
+		ctx, cancel = context.WithCancel(context.Background())
+	})
+
+	AfterEach(func() {
+		cancel()
+	})
+
+	It("has nothing to offer before the first refresh", func() {
+		s := store.New(source.fetch, store.Options{Name: "test", Schedule: time.Hour}, logger)
+		value, ok := s.Get()
+		Expect(ok).To(BeFalse())
+		Expect(value).To(Equal(0))
+		Expect(s.Snapshot()).To(BeNil())
+		Expect(s.LastSuccess().IsZero()).To(BeTrue())
+	})
+
+	It("refreshes the data on a schedule", func() {
+		source.values = []int{1, 2, 3}
+		s := store.New(source.fetch, store.Options{Name: "test", Schedule: 50 * time.Millisecond}, logger)
+		go s.Run(ctx)
+
+		Eventually(func() int { v, _ := s.Get(); return v }).Should(Equal(1))
+		Eventually(func() int { v, _ := s.Get(); return v }).Should(Equal(3))
+		Expect(s.RefreshCount()).To(BeNumerically(">=", 3))
+		Expect(s.LastSuccess()).To(BeTemporally("~", time.Now(), time.Second))
+	})
+
+	It("keeps serving the last good data and retries with backoff when a refresh fails", func() {
+		source.values = []int{1, 0, 0, 4}
+		source.errs = []error{nil, fmt.Errorf("boom"), fmt.Errorf("boom")}
+		s := store.New(source.fetch, store.Options{
+			Name:       "test",
+			Schedule:   20 * time.Millisecond,
+			MinBackoff: 10 * time.Millisecond,
+			MaxBackoff: 40 * time.Millisecond,
+			Registry:   registry,
+		}, logger)
+		go s.Run(ctx)
+
+		Eventually(source.Calls).Should(BeNumerically(">=", 2))
+		v, ok := s.Get()
+		Expect(ok).To(BeTrue())
+		Expect(v).To(Equal(1))
+
+		Eventually(func() int { v, _ := s.Get(); return v }).Should(Equal(4))
+		Expect(s.LastError()).NotTo(HaveOccurred())
+
+		metricFamilies := registry.Gather()
+		Expect(metricFamilies).To(HaveKey("paas_exporter_store_refreshes_total"))
+		Expect(metricFamilies).To(HaveKey("paas_exporter_store_last_success_timestamp_seconds"))
+		Expect(metricFamilies).To(HaveKey("paas_exporter_store_consecutive_errors"))
+	})
+
+	It("gives up once the data is staler than the limit", func() {
+		source.values = []int{0}
+		source.errs = []error{}
+		for i := 0; i < 1000; i++ {
+			source.errs = append(source.errs, fmt.Errorf("boom"))
+		}
+		s := store.New(source.fetch, store.Options{
+			Name:         "test",
+			Schedule:     10 * time.Millisecond,
+			MinBackoff:   5 * time.Millisecond,
+			MaxStaleness: 50 * time.Millisecond,
+		}, logger)
+
+		errs := make(chan error)
+		go func() { errs <- s.Run(ctx) }()
+		Eventually(errs).Should(Receive(MatchError(ContainSubstring("test data has not been refreshed"))))
+		Expect(s.LastError()).To(MatchError("boom"))
+	})
+
+	It("stops when the context is cancelled", func() {
+		source.values = []int{1}
+		s := store.New(source.fetch, store.Options{Name: "test", Schedule: time.Hour}, logger)
+
+		errs := make(chan error)
+		go func() { errs <- s.Run(ctx) }()
+		Eventually(source.Calls).Should(Equal(1))
+		cancel()
+		Eventually(errs).Should(Receive(BeNil()))
+	})
+
+	It("lets the data be replaced directly", func() {
+		s := store.New(source.fetch, store.Options{Name: "test", Schedule: time.Hour}, logger)
+		s.Set(7)
+		v, ok := s.Get()
+		Expect(ok).To(BeTrue())
+		Expect(v).To(Equal(7))
+		Expect(s.Snapshot().FetchedAt).To(BeTemporally("~", time.Now(), time.Second))
+	})
+
+	It("lets the data be updated in place without changing when it was fetched", func() {
+		s := store.New(source.fetch, store.Options{Name: "test", Schedule: time.Hour}, logger)
+		s.Update(func(v int) int { return v + 1 })
+		Expect(s.Snapshot()).To(BeNil())
+
+		s.Set(7)
+		fetchedAt := s.Snapshot().FetchedAt
+		s.Update(func(v int) int { return v + 1 })
+		v, _ := s.Get()
+		Expect(v).To(Equal(8))
+		Expect(s.Snapshot().FetchedAt).To(Equal(fetchedAt))
+	})
+
+	It("only fetches changes between full syncs when it has an incremental fetch", func() {
+		source.values = []int{100}
+		incrementalCalls := 0
+		incrementalFetch := func(ctx context.Context, previous store.Snapshot[int]) (int, error) {
+			incrementalCalls += 1
+			return previous.Value + 1, nil
+		}
+		s := store.NewIncremental(source.fetch, incrementalFetch, store.Options{
+			Name:             "test",
+			Schedule:         time.Hour,
+			FullSyncSchedule: 50 * time.Millisecond,
+			Registry:         registry,
+		}, logger)
+
+		Expect(s.Refresh(ctx)).To(Succeed())
+		Expect(s.Refresh(ctx)).To(Succeed())
+		Expect(s.Refresh(ctx)).To(Succeed())
+		v, _ := s.Get()
+		Expect(v).To(Equal(102))
+		Expect(source.Calls()).To(Equal(1))
+		Expect(incrementalCalls).To(Equal(2))
+
+		time.Sleep(60 * time.Millisecond)
+		Expect(s.Refresh(ctx)).To(Succeed())
+		v, _ = s.Get()
+		Expect(v).To(Equal(100))
+		Expect(source.Calls()).To(Equal(2))
+
+		refreshes := registry.Gather()["paas_exporter_store_refreshes_total"]
+		Expect(refreshes.Metric).To(HaveLen(2))
+	})
+
+	It("tells incremental fetches when the previous fetch started, not when it finished", func() {
+		var previousStartedAt time.Time
+		slowFetch := func(ctx context.Context) (int, error) {
+			time.Sleep(20 * time.Millisecond)
+			return 1, nil
+		}
+		incrementalFetch := func(ctx context.Context, previous store.Snapshot[int]) (int, error) {
+			previousStartedAt = previous.StartedAt
+			return previous.Value, nil
+		}
+		s := store.NewIncremental(slowFetch, incrementalFetch, store.Options{Name: "test", Schedule: time.Hour}, logger)
+
+		beforeRefresh := time.Now()
+		Expect(s.Refresh(ctx)).To(Succeed())
+		fetchedAt := s.Snapshot().FetchedAt
+		Expect(fetchedAt.Sub(beforeRefresh)).To(BeNumerically(">=", 20*time.Millisecond))
+
+		Expect(s.Refresh(ctx)).To(Succeed())
+		Expect(previousStartedAt).To(BeTemporally("~", beforeRefresh, 10*time.Millisecond))
+		Expect(previousStartedAt).To(BeTemporally("<", fetchedAt))
+	})
+})
+
+var _ = Describe("Store disk cache", func() {
+	var logger lager.Logger
+	var cacheDir string
+	var ctx context.Context
+	var cancel context.CancelFunc
+
+	BeforeEach(func() {
+		logger = lager.NewLogger("store-test")
+		logger.RegisterSink(lager.NewWriterSink(GinkgoWriter, lager.INFO))
+		cacheDir = GinkgoT().TempDir()
+		ctx, cancel = context.WithCancel(context.Background())
+	})
+
+	AfterEach(func() {
+		cancel()
+	})
+
+	It("saves the data after a refresh and restores it on the next start", func() {
+		source := &fakeSource{values: []int{42}}
+		s := store.New(source.fetch, store.Options{Name: "test", Schedule: time.Hour, CacheDir: cacheDir}, logger)
+		Expect(s.Refresh(ctx)).To(Succeed())
+		fetchedAt := s.Snapshot().FetchedAt
+		Expect(filepath.Join(cacheDir, "test.json")).To(BeARegularFile())
+
+		restarted := store.New(source.fetch, store.Options{Name: "test", Schedule: time.Hour, CacheDir: cacheDir}, logger)
+		Expect(restarted.Restore()).To(BeTrue())
+		snapshot := restarted.Snapshot()
+		Expect(snapshot.Value).To(Equal(42))
+		Expect(snapshot.Restored).To(BeTrue())
+		Expect(snapshot.FetchedAt).To(BeTemporally("==", fetchedAt))
+		Expect(restarted.LastSuccess()).To(BeTemporally("==", fetchedAt))
+	})
+
+	It("serves restored data while the source is down, until the staleness limit", func() {
+		source := &fakeSource{values: []int{42}}
+		s := store.New(source.fetch, store.Options{Name: "test", Schedule: time.Hour, CacheDir: cacheDir}, logger)
+		Expect(s.Refresh(ctx)).To(Succeed())
+
+		failingSource := &fakeSource{values: []int{0}}
+		for i := 0; i < 1000; i++ {
+			failingSource.errs = append(failingSource.errs, fmt.Errorf("boom"))
+		}
+		restarted := store.New(failingSource.fetch, store.Options{
+			Name:         "test",
+			Schedule:     10 * time.Millisecond,
+			MinBackoff:   5 * time.Millisecond,
+			MaxStaleness: 200 * time.Millisecond,
+			CacheDir:     cacheDir,
+		}, logger)
+		errs := make(chan error)
+		go func() { errs <- restarted.Run(ctx) }()
+
+		Eventually(failingSource.Calls).Should(BeNumerically(">=", 2))
+		v, ok := restarted.Get()
+		Expect(ok).To(BeTrue())
+		Expect(v).To(Equal(42))
+		Eventually(errs).Should(Receive(MatchError(ContainSubstring("test data has not been refreshed"))))
+	})
+
+	It("ignores a cache file which is corrupt or for different data", func() {
+		source := &fakeSource{values: []int{42}}
+		s := store.New(source.fetch, store.Options{Name: "test", Schedule: time.Hour, CacheDir: cacheDir}, logger)
+		Expect(s.Refresh(ctx)).To(Succeed())
+
+		other := store.New(func(ctx context.Context) (string, error) { return "", nil }, store.Options{
+			Name: "test", Schedule: time.Hour, CacheDir: cacheDir,
+		}, logger)
+		Expect(other.Restore()).To(BeFalse())
+
+		path := filepath.Join(cacheDir, "test.json")
+		contents, err := os.ReadFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		var file map[string]json.RawMessage
+		Expect(json.Unmarshal(contents, &file)).To(Succeed())
+		Expect(file["value"]).To(MatchJSON("42"))
+		file["value"] = json.RawMessage("43")
+		contents, err = json.Marshal(file)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.WriteFile(path, contents, 0600)).To(Succeed())
+
+		restarted := store.New(source.fetch, store.Options{Name: "test", Schedule: time.Hour, CacheDir: cacheDir}, logger)
+		Expect(restarted.Restore()).To(BeFalse())
+		Expect(restarted.Snapshot()).To(BeNil())
+	})
+
+	It("ignores a cache file saved with different settings", func() {
+		source := &fakeSource{values: []int{42}}
+		s := store.New(source.fetch, store.Options{Name: "test", Schedule: time.Hour, CacheDir: cacheDir, Fingerprint: "a"}, logger)
+		Expect(s.Refresh(ctx)).To(Succeed())
+
+		restarted := store.New(source.fetch, store.Options{Name: "test", Schedule: time.Hour, CacheDir: cacheDir, Fingerprint: "b"}, logger)
+		Expect(restarted.Restore()).To(BeFalse())
+		Expect(restarted.Snapshot()).To(BeNil())
+
+		restarted = store.New(source.fetch, store.Options{Name: "test", Schedule: time.Hour, CacheDir: cacheDir, Fingerprint: "a"}, logger)
+		Expect(restarted.Restore()).To(BeTrue())
+	})
+})
+
+var _ = Describe("ReadThrough", func() {
+	It("shares concurrent lookups of the same key", func() {
+		var mu sync.Mutex
+		calls := 0
+		release := make(chan struct{})
+		readThrough := store.NewReadThrough(func(key string) (string, error) {
+			mu.Lock()
+			calls += 1
+			mu.Unlock()
+			<-release
+			return "value-of-" + key, nil
+		}, 10, time.Hour)
+
+		results := make(chan string, 3)
+		for i := 0; i < 3; i++ {
+			go func() {
+				value, _ := readThrough.Get("key")
+				results <- value
+			}()
+		}
+		Consistently(results, 50*time.Millisecond).ShouldNot(Receive())
+		close(release)
+		for i := 0; i < 3; i++ {
+			Eventually(results).Should(Receive(Equal("value-of-key")))
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		Expect(calls).To(Equal(1))
+	})
+
+	It("refuses lookups beyond the burst until the bucket refills", func() {
+		readThrough := store.NewReadThrough(func(key string) (string, error) {
+			return key, nil
+		}, 2, 50*time.Millisecond)
+
+		Expect(readThrough.Get("a")).To(Equal("a"))
+		Expect(readThrough.Get("b")).To(Equal("b"))
+		_, err := readThrough.Get("c")
+		Expect(err).To(MatchError(store.ErrLookupRateLimited))
+
+		Eventually(func() error {
+			_, err := readThrough.Get("c")
+			return err
+		}).Should(Succeed())
+	})
+
+	It("remembers for a while which items don't exist", func() {
+		calls := 0
+		readThrough := store.NewReadThrough(func(key string) (string, error) {
+			calls += 1
+			return "", fmt.Errorf("no item '%s': %w", key, store.ErrNotFound)
+		}, 1, time.Hour)
+
+		for i := 0; i < 3; i++ {
+			_, err := readThrough.Get("missing")
+			Expect(err).To(MatchError(store.ErrNotFound))
+			Expect(err).To(MatchError(ContainSubstring("no item 'missing'")))
+		}
+		Expect(calls).To(Equal(1))
+	})
+})
@@ -3,6 +3,9 @@ package testsupport
 import (
 	"encoding/base64"
 	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
 
 	"github.com/jarcoal/httpmock"
 )
@@ -49,6 +52,66 @@ func SetupFailedUaaOauthLoginHttpmock() {
 	)
 }
 
+// SetupCfApiOutageHttpmock makes requests to a Cloud Controller API path fail
+// as if the API were unavailable
+func SetupCfApiOutageHttpmock(path string, query url.Values) {
+	httpmock.RegisterResponderWithQuery(
+		"GET",
+		fmt.Sprintf("%s%s", CfApiUrl, path),
+		query,
+		httpmock.NewJsonResponderOrPanic(503, map[string]interface{}{
+			"code":        10015,
+			"description": "The service is currently unavailable",
+			"error_code":  "CF-ServiceUnavailable",
+		}),
+	)
+}
+
+// SetupCfV3ListHttpmock serves a single page of resources from a v3 list
+// endpoint, whatever the query
+func SetupCfV3ListHttpmock(path string, resources interface{}) {
+	httpmock.RegisterResponder(
+		"GET",
+		fmt.Sprintf("%s%s", CfApiUrl, path),
+		httpmock.NewJsonResponderOrPanic(200, map[string]interface{}{
+			"pagination": map[string]interface{}{
+				"next": nil,
+			},
+			"resources": resources,
+		}),
+	)
+}
+
+// SetupCfV3ListByGuidsHttpmock serves the resources from a v3 list endpoint
+// whose GUIDs are in the request's guids filter, or all of them if there is
+// no filter
+func SetupCfV3ListByGuidsHttpmock(path string, resources []map[string]interface{}) {
+	httpmock.RegisterResponder(
+		"GET",
+		fmt.Sprintf("%s%s", CfApiUrl, path),
+		func(req *http.Request) (*http.Response, error) {
+			guids := map[string]bool{}
+			for _, guid := range strings.Split(req.URL.Query().Get("guids"), ",") {
+				if guid != "" {
+					guids[guid] = true
+				}
+			}
+			matching := []map[string]interface{}{}
+			for _, resource := range resources {
+				if len(guids) == 0 || guids[resource["guid"].(string)] {
+					matching = append(matching, resource)
+				}
+			}
+			return httpmock.NewJsonResponse(200, map[string]interface{}{
+				"pagination": map[string]interface{}{
+					"next": nil,
+				},
+				"resources": matching,
+			})
+		},
+	)
+}
+
 func AuthorizationHeader(user, password string) string {
 	base := user + ":" + password
 	return "Basic " + base64.StdEncoding.EncodeToString([]byte(base))
@@ -0,0 +1,198 @@
+package tls_config
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/internal_metrics"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// ParseMinVersion turns "1.2" or "1.3" into a crypto/tls version
+func ParseMinVersion(version string) (uint16, error) {
+	switch version {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("%q is not one of 1.2 or 1.3", version)
+}
+
+// CertReloader serves a certificate and key, and optionally a CA for
+// verifying client certificates, from files which it reloads whenever they
+// change. If a changed file cannot be loaded it keeps serving the old ones.
+type CertReloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	registry     *internal_metrics.Registry
+	logger       lager.Logger
+
+	mu          sync.RWMutex
+	certificate *tls.Certificate
+	clientCAs   *x509.CertPool
+	// fileHashes are how CertReloader notices that a file has changed. The
+	// files are small, and modification times can be too coarse to notice
+	// two quick changes.
+	fileHashes map[string][sha256.Size]byte
+}
+
+// NewCertReloader loads the files straight away, and fails if they cannot be
+// loaded. clientCAFile can be empty.
+func NewCertReloader(
+	certFile string,
+	keyFile string,
+	clientCAFile string,
+	registry *internal_metrics.Registry,
+	logger lager.Logger,
+) (*CertReloader, error) {
+	r := &CertReloader{
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCAFile: clientCAFile,
+		registry:     registry,
+		logger:       logger.Session("cert-reloader"),
+	}
+	err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// TLSConfig returns a config which always uses the latest certificate and
+// client CA. If there is a client CA, clients must present a certificate
+// signed by it. It offers HTTP/2 as well as HTTP/1.1.
+func (r *CertReloader) TLSConfig(minVersion uint16) *tls.Config {
+	base := &tls.Config{
+		MinVersion: minVersion,
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	// Each connection gets a copy of base, so that settings such as
+	// NextProtos aren't lost, with the certificate and client CA filled in
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		config := base.Clone()
+		config.GetConfigForClient = nil
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+		config.Certificates = []tls.Certificate{*r.certificate}
+		if r.clientCAs != nil {
+			config.ClientCAs = r.clientCAs
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		return config, nil
+	}
+	return base
+}
+
+// Run checks the files for changes every interval until the context is
+// cancelled
+func (r *CertReloader) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.ReloadIfChanged()
+		}
+	}
+}
+
+// ReloadIfChanged reloads the files if any of them has changed since they
+// were last loaded
+func (r *CertReloader) ReloadIfChanged() {
+	r.mu.RLock()
+	changed := false
+	for path, hash := range r.fileHashes {
+		current, err := hashFile(path)
+		if err != nil || current != hash {
+			changed = true
+			break
+		}
+	}
+	r.mu.RUnlock()
+	if !changed {
+		return
+	}
+
+	err := r.load()
+	if err != nil {
+		r.logger.Error("err-reloading-certificate", err)
+		return
+	}
+	r.logger.Info("reloaded-certificate")
+}
+
+func (r *CertReloader) load() error {
+	paths := []string{r.certFile, r.keyFile}
+	if r.clientCAFile != "" {
+		paths = append(paths, r.clientCAFile)
+	}
+	// Hash the files before loading them, so that a change made while they
+	// are being loaded is noticed next time
+	fileHashes := map[string][sha256.Size]byte{}
+	for _, path := range paths {
+		hash, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+		fileHashes[path] = hash
+	}
+
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("error loading certificate and key: %v", err)
+	}
+	certificate.Leaf, err = x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("error parsing certificate: %v", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if r.clientCAFile != "" {
+		pem, err := os.ReadFile(r.clientCAFile)
+		if err != nil {
+			return fmt.Errorf("error reading client CA: %v", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in client CA file %s", r.clientCAFile)
+		}
+	}
+
+	r.mu.Lock()
+	r.certificate = &certificate
+	r.clientCAs = clientCAs
+	r.fileHashes = fileHashes
+	r.mu.Unlock()
+
+	r.logger.Info("loaded-certificate", lager.Data{
+		"subject":   certificate.Leaf.Subject.String(),
+		"not-after": certificate.Leaf.NotAfter,
+	})
+	r.registry.SetGauge(
+		"paas_exporter_tls_certificate_expiry_timestamp_seconds",
+		"When the certificate being served expires",
+		nil,
+		float64(certificate.Leaf.NotAfter.Unix()),
+	)
+	return nil
+}
+
+func hashFile(path string) ([sha256.Size]byte, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return [sha256.Size]byte{}, fmt.Errorf("error reading %s: %v", path, err)
+	}
+	return sha256.Sum256(contents), nil
+}
@@ -0,0 +1,214 @@
+package tls_config_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/internal_metrics"
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/tls_config"
+
+	"code.cloudfoundry.org/lager"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCert makes a certificate for 127.0.0.1, signed by parent or by
+// itself if parent is nil
+func newTestCert(commonName string, isCA bool, parent *testCert) testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	Expect(err).NotTo(HaveOccurred())
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).NotTo(HaveOccurred())
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	Expect(err).NotTo(HaveOccurred())
+	return testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+var _ = Describe("CertReloader", func() {
+	var dir, certFile, keyFile, caFile string
+	var logger lager.Logger
+	var registry *internal_metrics.Registry
+
+	writeCert := func(c testCert) {
+		Expect(os.WriteFile(certFile, c.certPEM, 0o600)).To(Succeed())
+		Expect(os.WriteFile(keyFile, c.keyPEM, 0o600)).To(Succeed())
+	}
+
+	// serve starts a TLS server using the reloader and returns a pool which
+	// trusts the given certificates
+	serve := func(reloader *tls_config.CertReloader, minVersion uint16) *httptest.Server {
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		}))
+		server.TLS = reloader.TLSConfig(minVersion)
+		server.StartTLS()
+		DeferCleanup(server.Close)
+		return server
+	}
+
+	client := func(trusted testCert, clientCert *testCert, maxVersion uint16) *http.Client {
+		pool := x509.NewCertPool()
+		pool.AddCert(trusted.cert)
+		tlsConfig := &tls.Config{RootCAs: pool, MaxVersion: maxVersion}
+		if clientCert != nil {
+			pair, err := tls.X509KeyPair(clientCert.certPEM, clientCert.keyPEM)
+			Expect(err).NotTo(HaveOccurred())
+			tlsConfig.Certificates = []tls.Certificate{pair}
+		}
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	}
+
+	servedCommonName := func(c *http.Client, url string) (string, error) {
+		resp, err := c.Get(url)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		return resp.TLS.PeerCertificates[0].Subject.CommonName, nil
+	}
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		certFile = filepath.Join(dir, "tls.crt")
+		keyFile = filepath.Join(dir, "tls.key")
+		caFile = filepath.Join(dir, "ca.crt")
+		logger = lager.NewLogger("tls-config-test")
+		logger.RegisterSink(lager.NewWriterSink(GinkgoWriter, lager.INFO))
+		registry = internal_metrics.NewRegistry()
+	})
+
+	It("fails if the files cannot be loaded", func() {
+		_, err := tls_config.NewCertReloader(certFile, keyFile, "", registry, logger)
+		Expect(err).To(MatchError(ContainSubstring("tls.crt")))
+	})
+
+	It("serves the new certificate once the files change, and keeps the old one if they are broken", func() {
+		first := newTestCert("first", false, nil)
+		writeCert(first)
+		reloader, err := tls_config.NewCertReloader(certFile, keyFile, "", registry, logger)
+		Expect(err).NotTo(HaveOccurred())
+		server := serve(reloader, tls.VersionTLS12)
+
+		Expect(servedCommonName(client(first, nil, 0), server.URL)).To(Equal("first"))
+		expiry := registry.Gather()["paas_exporter_tls_certificate_expiry_timestamp_seconds"]
+		Expect(expiry.Metric[0].Gauge.GetValue()).To(Equal(float64(first.cert.NotAfter.Unix())))
+
+		second := newTestCert("second", false, nil)
+		writeCert(second)
+		reloader.ReloadIfChanged()
+		Expect(servedCommonName(client(second, nil, 0), server.URL)).To(Equal("second"))
+
+		Expect(os.WriteFile(keyFile, []byte("not a key"), 0o600)).To(Succeed())
+		reloader.ReloadIfChanged()
+		Expect(servedCommonName(client(second, nil, 0), server.URL)).To(Equal("second"))
+	})
+
+	It("refuses connections below the minimum version", func() {
+		c := newTestCert("server", false, nil)
+		writeCert(c)
+		reloader, err := tls_config.NewCertReloader(certFile, keyFile, "", registry, logger)
+		Expect(err).NotTo(HaveOccurred())
+		server := serve(reloader, tls.VersionTLS13)
+
+		_, err = servedCommonName(client(c, nil, tls.VersionTLS12), server.URL)
+		Expect(err).To(HaveOccurred())
+		Expect(servedCommonName(client(c, nil, 0), server.URL)).To(Equal("server"))
+	})
+
+	It("requires a client certificate signed by the client CA if there is one", func() {
+		serverCert := newTestCert("server", false, nil)
+		writeCert(serverCert)
+		ca := newTestCert("client-ca", true, nil)
+		Expect(os.WriteFile(caFile, ca.certPEM, 0o600)).To(Succeed())
+		reloader, err := tls_config.NewCertReloader(certFile, keyFile, caFile, registry, logger)
+		Expect(err).NotTo(HaveOccurred())
+		server := serve(reloader, tls.VersionTLS12)
+
+		_, err = servedCommonName(client(serverCert, nil, 0), server.URL)
+		Expect(err).To(HaveOccurred())
+
+		untrusted := newTestCert("untrusted-client", false, nil)
+		_, err = servedCommonName(client(serverCert, &untrusted, 0), server.URL)
+		Expect(err).To(HaveOccurred())
+
+		trusted := newTestCert("trusted-client", false, &ca)
+		Expect(servedCommonName(client(serverCert, &trusted, 0), server.URL)).To(Equal("server"))
+	})
+
+	It("negotiates HTTP/2 with clients which support it", func() {
+		c := newTestCert("server", false, nil)
+		writeCert(c)
+		reloader, err := tls_config.NewCertReloader(certFile, keyFile, "", registry, logger)
+		Expect(err).NotTo(HaveOccurred())
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.Proto))
+		}))
+		server.EnableHTTP2 = true
+		server.TLS = reloader.TLSConfig(tls.VersionTLS12)
+		server.StartTLS()
+		DeferCleanup(server.Close)
+
+		h2Client := client(c, nil, 0)
+		h2Client.Transport.(*http.Transport).ForceAttemptHTTP2 = true
+		resp, err := h2Client.Get(server.URL)
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		Expect(resp.TLS.NegotiatedProtocol).To(Equal("h2"))
+		Expect(resp.Proto).To(Equal("HTTP/2.0"))
+
+		resp, err = client(c, nil, 0).Get(server.URL)
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		Expect(resp.Proto).To(Equal("HTTP/1.1"))
+	})
+})
+
+var _ = Describe("ParseMinVersion", func() {
+	It("accepts TLS 1.2 and 1.3 only", func() {
+		Expect(tls_config.ParseMinVersion("1.2")).To(Equal(uint16(tls.VersionTLS12)))
+		Expect(tls_config.ParseMinVersion("1.3")).To(Equal(uint16(tls.VersionTLS13)))
+		_, err := tls_config.ParseMinVersion("1.1")
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,170 @@
+package topology
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/internal_metrics"
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/orgs_fetcher"
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/service_plans_fetcher"
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/spaces_fetcher"
+
+	"code.cloudfoundry.org/lager"
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
+)
+
+// Snapshot is everything a scrape needs to know about the CF platform, taken
+// at one moment. It must not be modified once it has been published.
+type Snapshot struct {
+	// Version goes up by one every time a new snapshot is published
+	Version      uint64
+	BuiltAt      time.Time
+	Services     []cfclient.Service
+	ServicePlans []cfclient.ServicePlan
+	SpacesByGuid map[string]cfclient.Space
+	OrgsByGuid   map[string]cfclient.Org
+}
+
+// NewSnapshot builds a snapshot from lists of services, plans, spaces and
+// orgs
+func NewSnapshot(
+	version uint64,
+	services []cfclient.Service,
+	servicePlans []cfclient.ServicePlan,
+	spaces []cfclient.Space,
+	orgs []cfclient.Org,
+) *Snapshot {
+	spacesByGuid := make(map[string]cfclient.Space, len(spaces))
+	for _, space := range spaces {
+		spacesByGuid[space.Guid] = space
+	}
+	orgsByGuid := make(map[string]cfclient.Org, len(orgs))
+	for _, org := range orgs {
+		orgsByGuid[org.Guid] = org
+	}
+	return &Snapshot{
+		Version:      version,
+		BuiltAt:      time.Now(),
+		Services:     services,
+		ServicePlans: servicePlans,
+		SpacesByGuid: spacesByGuid,
+		OrgsByGuid:   orgsByGuid,
+	}
+}
+
+type TopologyStore interface {
+	// Topology returns the latest snapshot. It never returns nil.
+	Topology() *Snapshot
+	// LookupSpace and LookupOrg fetch a space or org which is missing from
+	// the latest snapshot. It appears in a later snapshot.
+	LookupSpace(guid string) (cfclient.Space, error)
+	LookupOrg(guid string) (cfclient.Org, error)
+}
+
+// ChangeNotifier calls its listeners whenever its data changes, like a
+// store.Store
+type ChangeNotifier interface {
+	OnChange(listener func())
+}
+
+type ServicePlansSource interface {
+	service_plans_fetcher.ServicePlansStore
+	ChangeNotifier
+}
+
+type SpacesSource interface {
+	spaces_fetcher.SpacesStore
+	ChangeNotifier
+}
+
+type OrgsSource interface {
+	orgs_fetcher.OrgsStore
+	ChangeNotifier
+}
+
+// Aggregator combines the service plans, spaces and orgs stores into one
+// snapshot, which it rebuilds whenever any of them changes. Readers get the
+// whole snapshot with a single atomic load, so a scrape never mixes data
+// from before and after a refresh.
+type Aggregator struct {
+	servicePlansStore ServicePlansSource
+	spacesStore       SpacesSource
+	orgsStore         OrgsSource
+	registry          *internal_metrics.Registry
+	logger            lager.Logger
+
+	mu       sync.Mutex
+	snapshot atomic.Pointer[Snapshot]
+}
+
+func NewAggregator(
+	servicePlansStore ServicePlansSource,
+	spacesStore SpacesSource,
+	orgsStore OrgsSource,
+	registry *internal_metrics.Registry,
+	logger lager.Logger,
+) *Aggregator {
+	a := &Aggregator{
+		servicePlansStore: servicePlansStore,
+		spacesStore:       spacesStore,
+		orgsStore:         orgsStore,
+		registry:          registry,
+		logger:            logger.Session("topology-aggregator"),
+	}
+	a.snapshot.Store(NewSnapshot(0, nil, nil, nil, nil))
+	servicePlansStore.OnChange(a.Rebuild)
+	spacesStore.OnChange(a.Rebuild)
+	orgsStore.OnChange(a.Rebuild)
+	a.Rebuild()
+	return a
+}
+
+func (a *Aggregator) Topology() *Snapshot {
+	return a.snapshot.Load()
+}
+
+func (a *Aggregator) LookupSpace(guid string) (cfclient.Space, error) {
+	return a.spacesStore.LookupSpace(guid)
+}
+
+func (a *Aggregator) LookupOrg(guid string) (cfclient.Org, error) {
+	return a.orgsStore.LookupOrg(guid)
+}
+
+// Rebuild publishes a new snapshot from the current contents of the stores
+func (a *Aggregator) Rebuild() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	snapshot := NewSnapshot(
+		a.snapshot.Load().Version+1,
+		a.servicePlansStore.GetServices(),
+		a.servicePlansStore.GetServicePlans(),
+		a.spacesStore.GetSpaces(),
+		a.orgsStore.GetOrgs(),
+	)
+	a.snapshot.Store(snapshot)
+
+	a.logger.Debug("rebuilt-topology", lager.Data{
+		"topology-version":        snapshot.Version,
+		"number-of-services":      len(snapshot.Services),
+		"number-of-service-plans": len(snapshot.ServicePlans),
+		"number-of-spaces":        len(snapshot.SpacesByGuid),
+		"number-of-orgs":          len(snapshot.OrgsByGuid),
+	})
+	a.registry.SetGauge(
+		"paas_exporter_topology_version",
+		"Version of the latest snapshot of services, plans, spaces and orgs, which goes up by one each time it is rebuilt",
+		nil,
+		float64(snapshot.Version),
+	)
+	a.registry.SetGauge(
+		"paas_exporter_topology_built_timestamp_seconds",
+		"When the latest snapshot of services, plans, spaces and orgs was built",
+		nil,
+		float64(snapshot.BuiltAt.UnixNano())/1e9,
+	)
+}
+
+var _ TopologyStore = (*Aggregator)(nil)
@@ -0,0 +1,162 @@
+package topology_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/internal_metrics"
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/store"
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/topology"
+
+	"code.cloudfoundry.org/lager"
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+type fakeServicePlansStore struct {
+	*store.Store[[]cfclient.ServicePlan]
+	services []cfclient.Service
+}
+
+func (f *fakeServicePlansStore) GetServices() []cfclient.Service {
+	return f.services
+}
+
+func (f *fakeServicePlansStore) GetServicePlans() []cfclient.ServicePlan {
+	plans, _ := f.Get()
+	return plans
+}
+
+func (f *fakeServicePlansStore) GetServiceForPlan(planGuid string) (cfclient.Service, bool) {
+	return cfclient.Service{}, false
+}
+
+type fakeSpacesStore struct {
+	*store.Store[[]cfclient.Space]
+}
+
+func (f *fakeSpacesStore) GetSpaces() []cfclient.Space {
+	spaces, _ := f.Get()
+	return spaces
+}
+
+func (f *fakeSpacesStore) LookupSpace(guid string) (cfclient.Space, error) {
+	space := cfclient.Space{Guid: guid, Name: "looked-up-space"}
+	f.Update(func(spaces []cfclient.Space) []cfclient.Space {
+		return append(append([]cfclient.Space{}, spaces...), space)
+	})
+	return space, nil
+}
+
+type fakeOrgsStore struct {
+	*store.Store[[]cfclient.Org]
+}
+
+func (f *fakeOrgsStore) GetOrgs() []cfclient.Org {
+	orgs, _ := f.Get()
+	return orgs
+}
+
+func (f *fakeOrgsStore) LookupOrg(guid string) (cfclient.Org, error) {
+	return cfclient.Org{}, fmt.Errorf("org %s not found", guid)
+}
+
+func newFakeStore[T any](name string, logger lager.Logger) *store.Store[T] {
+	return store.New(func(ctx context.Context) (T, error) {
+		var zero T
+		return zero, fmt.Errorf("not implemented")
+	}, store.Options{Name: name}, logger)
+}
+
+var _ = Describe("Aggregator", func() {
+	var logger lager.Logger
+	var registry *internal_metrics.Registry
+	var servicePlansStore *fakeServicePlansStore
+	var spacesStore *fakeSpacesStore
+	var orgsStore *fakeOrgsStore
+
+	BeforeEach(func() {
+		logger = lager.NewLogger("topology-test")
+		logger.RegisterSink(lager.NewWriterSink(GinkgoWriter, lager.INFO))
+		registry = internal_metrics.NewRegistry()
+		servicePlansStore = &fakeServicePlansStore{
+			Store:    newFakeStore[[]cfclient.ServicePlan]("service-plans", logger),
+			services: []cfclient.Service{{Guid: "service-guid"}},
+		}
+		spacesStore = &fakeSpacesStore{Store: newFakeStore[[]cfclient.Space]("spaces", logger)}
+		orgsStore = &fakeOrgsStore{Store: newFakeStore[[]cfclient.Org]("orgs", logger)}
+	})
+
+	It("builds a snapshot from whatever the stores already have", func() {
+		spacesStore.Set([]cfclient.Space{{Guid: "space-guid", OrganizationGuid: "org-guid"}})
+		orgsStore.Set([]cfclient.Org{{Guid: "org-guid"}})
+
+		aggregator := topology.NewAggregator(servicePlansStore, spacesStore, orgsStore, registry, logger)
+		snapshot := aggregator.Topology()
+		Expect(snapshot.Version).To(Equal(uint64(1)))
+		Expect(snapshot.Services).To(Equal(servicePlansStore.services))
+		Expect(snapshot.ServicePlans).To(BeEmpty())
+		Expect(snapshot.SpacesByGuid).To(HaveKey("space-guid"))
+		Expect(snapshot.OrgsByGuid).To(HaveKey("org-guid"))
+	})
+
+	It("publishes a new version whenever a store changes, leaving older snapshots alone", func() {
+		aggregator := topology.NewAggregator(servicePlansStore, spacesStore, orgsStore, registry, logger)
+		first := aggregator.Topology()
+
+		servicePlansStore.Set([]cfclient.ServicePlan{{Guid: "plan-guid"}})
+		spacesStore.Set([]cfclient.Space{{Guid: "space-guid"}})
+		latest := aggregator.Topology()
+		Expect(latest.Version).To(Equal(first.Version + 2))
+		Expect(latest.ServicePlans).To(HaveLen(1))
+		Expect(latest.SpacesByGuid).To(HaveKey("space-guid"))
+
+		Expect(first.ServicePlans).To(BeEmpty())
+		Expect(first.SpacesByGuid).To(BeEmpty())
+
+		versionMetric := registry.Gather()["paas_exporter_topology_version"]
+		Expect(versionMetric).NotTo(BeNil())
+		Expect(versionMetric.Metric[0].Gauge.GetValue()).To(Equal(float64(latest.Version)))
+	})
+
+	It("includes spaces which were looked up in the next snapshot", func() {
+		spacesStore.Set([]cfclient.Space{{Guid: "space-guid"}})
+		aggregator := topology.NewAggregator(servicePlansStore, spacesStore, orgsStore, registry, logger)
+		before := aggregator.Topology()
+
+		space, err := aggregator.LookupSpace("new-space-guid")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(space.Name).To(Equal("looked-up-space"))
+		Expect(aggregator.Topology().SpacesByGuid).To(HaveKey("new-space-guid"))
+		Expect(before.SpacesByGuid).NotTo(HaveKey("new-space-guid"))
+
+		_, err = aggregator.LookupOrg("new-org-guid")
+		Expect(err).To(MatchError(ContainSubstring("not found")))
+	})
+
+	It("always serves a complete snapshot while the stores are changing", func() {
+		aggregator := topology.NewAggregator(servicePlansStore, spacesStore, orgsStore, registry, logger)
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer GinkgoRecover()
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				spacesStore.Set([]cfclient.Space{{Guid: fmt.Sprintf("space-%d", i)}})
+			}
+		}()
+
+		previousVersion := uint64(0)
+		for i := 0; i < 200; i++ {
+			snapshot := aggregator.Topology()
+			Expect(snapshot.Version).To(BeNumerically(">=", previousVersion))
+			Expect(len(snapshot.SpacesByGuid)).To(BeNumerically("<=", 1))
+			previousVersion = snapshot.Version
+		}
+		wg.Wait()
+		Expect(aggregator.Topology().SpacesByGuid).To(HaveKey("space-199"))
+	})
+})
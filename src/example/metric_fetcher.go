@@ -29,7 +29,7 @@ func (f *ExampleMetricFetcher) FetchMetrics(
 	spacesByGuid map[string]cfclient.Space,
 	orgsByGuid map[string]cfclient.Org,
 	servicePlans []cfclient.ServicePlan,
-	service cfclient.Service,
+	services []cfclient.Service,
 ) (metric_endpoint.Metrics, error) {
 	logger := f.logger.WithData(lager.Data{"username": user.Username()})
 	logger.Debug("fetch-metrics")
@@ -1,109 +1,235 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"math"
+	"sync"
 	"time"
 
 	"code.cloudfoundry.org/lager"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
 )
 
 type NodeName = string
 type MetricName = string
 
+// CloudWatchAPI is the part of the CloudWatch client which is used, so that
+// tests can fake it
+type CloudWatchAPI interface {
+	GetMetricDataWithContext(aws.Context, *cloudwatch.GetMetricDataInput, ...request.Option) (*cloudwatch.GetMetricDataOutput, error)
+}
+
+// maxMetricDataRetries is how many more times to try queries whose results
+// were incomplete or failed
+const maxMetricDataRetries = 2
+
+// retryableStatusCodes are the result statuses which may be complete if the
+// query is tried again
+var retryableStatusCodes = map[string]bool{
+	cloudwatch.StatusCodePartialData:   true,
+	cloudwatch.StatusCodeInternalError: true,
+}
+
+// QueryFailure is a metric which could not be fetched for a node, even though
+// the other metrics could
+type QueryFailure struct {
+	MetricName MetricName
+	StatusCode string
+	Messages   []string
+}
+
+// GetMetricsForRedisNodes fetches the metrics in batches of 500 queries, with
+// up to maxParallelBatches batches at once. If a batch fails the others are
+// cancelled. The Sums of counter metrics are fetched in batches of their own,
+// for counterTimeRange rather than the window.
 func GetMetricsForRedisNodes(
+	ctx context.Context,
+	catalogue *MetricCatalogue,
 	redisNodes map[string]RedisNode,
 	startTime,
 	endTime time.Time,
-	cloudwatchClient *cloudwatch.CloudWatch,
+	period time.Duration,
+	cloudwatchClient CloudWatchAPI,
+	maxParallelBatches int,
 	logger lager.Logger,
-) (map[NodeName]map[MetricName]*cloudwatch.MetricDataResult, error) {
+) (map[NodeName]map[MetricName]*cloudwatch.MetricDataResult, map[NodeName][]QueryFailure, error) {
 	logger = logger.Session("get-metrics-for-redis-nodes", lager.Data{
 		"number-of-redis-nodes": len(redisNodes),
 		"start-time":            startTime.String(),
 		"end-time":              endTime.String(),
 	})
-	nodeMetricQueries := listMetricsForRedisNodes(redisNodes)
+	if maxParallelBatches < 1 {
+		maxParallelBatches = 1
+	}
+	nodeMetricQueries := listMetricsForRedisNodes(catalogue, redisNodes)
 
-	timePeriod := endTime.Sub(startTime)
-	timePeriodInSeconds := int64(math.Round(timePeriod.Seconds()))
+	timePeriodInSeconds := int64(math.Round(period.Seconds()))
 	metricDataQueries, metricDataQueryIdLookup := createMetricDataQueries(nodeMetricQueries, timePeriodInSeconds)
 
-	metricDataQueriesInGroupsOf500 := batchMetricDataQueriesIntoGroupsOf500(metricDataQueries)
+	windowQueries := []*cloudwatch.MetricDataQuery{}
+	counterQueries := []*cloudwatch.MetricDataQuery{}
+	for _, query := range metricDataQueries {
+		metadata := metricDataQueryIdLookup[aws.StringValue(query.Id)]
+		if isCounterStatistic(metadata.statisticName, metadata.counter) {
+			counterQueries = append(counterQueries, query)
+		} else {
+			windowQueries = append(windowQueries, query)
+		}
+	}
+	type batch struct {
+		queries   []*cloudwatch.MetricDataQuery
+		startTime time.Time
+		endTime   time.Time
+	}
+	batches := []batch{}
+	for _, queries := range batchMetricDataQueriesIntoGroupsOf500(windowQueries) {
+		batches = append(batches, batch{queries, startTime, endTime})
+	}
+	counterStartTime, countedUntil := counterTimeRange(endTime)
+	for _, queries := range batchMetricDataQueriesIntoGroupsOf500(counterQueries) {
+		batches = append(batches, batch{queries, counterStartTime, countedUntil})
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type batchResult struct {
+		results  []*cloudwatch.MetricDataResult
+		failures map[string]QueryFailure
+	}
+	batchResults := make([]batchResult, len(batches))
+	// The first error is the one to return, not the errors from the batches
+	// which were cancelled because of it
+	var firstErr error
+	var failOnce sync.Once
+	fail := func(err error) {
+		failOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+	semaphore := make(chan struct{}, maxParallelBatches)
+	var wg sync.WaitGroup
+	for i, batch := range batches {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case semaphore <- struct{}{}:
+			case <-ctx.Done():
+				fail(ctx.Err())
+				return
+			}
+			defer func() { <-semaphore }()
+			if ctx.Err() != nil {
+				fail(ctx.Err())
+				return
+			}
+			results, failures, err := fetchUpTo500MetricDataQueries(ctx, batch.queries, batch.startTime, batch.endTime, cloudwatchClient, logger)
+			if err != nil {
+				fail(err)
+				return
+			}
+			batchResults[i] = batchResult{results, failures}
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, nil, firstErr
+	}
 
 	metricDataResults := []*cloudwatch.MetricDataResult{}
-	for _, metricDataQueryInGroupOf500 := range metricDataQueriesInGroupsOf500 {
-		pageMetricDataResults, err := fetchUpTo500MetricDataQueries(metricDataQueryInGroupOf500, startTime, endTime, cloudwatchClient, logger)
-		if err != nil {
-			return nil, err
+	failures := map[NodeName][]QueryFailure{}
+	for _, batch := range batchResults {
+		metricDataResults = append(metricDataResults, batch.results...)
+		for id, failure := range batch.failures {
+			metadata := metricDataQueryIdLookup[id]
+			failure.MetricName = metricKey(metadata)
+			failures[metadata.redisNodeName] = append(failures[metadata.redisNodeName], failure)
 		}
-		metricDataResults = append(metricDataResults, pageMetricDataResults...)
 	}
 
 	nodesMetricDataResults := groupMetricDataResultsByNode(metricDataResults, metricDataQueryIdLookup)
-	return extractValuesFromMetricDataResults(nodesMetricDataResults, metricDataQueryIdLookup)
+	nodesMetricValues, err := extractValuesFromMetricDataResults(nodesMetricDataResults, metricDataQueryIdLookup)
+	return nodesMetricValues, failures, err
+}
+
+// nodeMetric is a metric in the catalogue, with the dimensions for a node
+type nodeMetric struct {
+	definition MetricDefinition
+	metric     *cloudwatch.Metric
 }
 
 func listMetricsForRedisNodes(
+	catalogue *MetricCatalogue,
 	redisNodes map[NodeName]RedisNode,
-) map[NodeName][]*cloudwatch.Metric {
-	metricQueries := map[NodeName][]*cloudwatch.Metric{}
+) map[NodeName][]nodeMetric {
+	metricQueries := map[NodeName][]nodeMetric{}
 	for _, redisNode := range redisNodes {
-		metricQueries[redisNode.CacheClusterName] = listMetricsForRedisNode(redisNode.CacheClusterName)
+		metricQueries[redisNode.CacheClusterName] = listMetricsForRedisNode(catalogue, redisNode)
 	}
 	return metricQueries
 }
 
 func listMetricsForRedisNode(
-	cacheClusterId NodeName,
-) []*cloudwatch.Metric {
-	metricQueries := []*cloudwatch.Metric{}
-
-	for _, metricName := range CacheClusterMetrics {
-		metricQuery := &cloudwatch.Metric{
-			Namespace:  aws.String("AWS/ElastiCache"),
-			MetricName: aws.String(metricName),
-			Dimensions: []*cloudwatch.Dimension{
-				{
-					Name:  aws.String("CacheClusterId"),
-					Value: aws.String(cacheClusterId),
-				},
-			},
+	catalogue *MetricCatalogue,
+	redisNode RedisNode,
+) []nodeMetric {
+	metricQueries := []nodeMetric{}
+
+	for _, definition := range catalogue.Enabled() {
+		if !definition.appliesTo(redisNode.Role) {
+			continue
 		}
-		metricQueries = append(metricQueries, metricQuery)
-	}
-
-	for _, metricName := range HostMetrics {
-		metricQuery := &cloudwatch.Metric{
-			Namespace:  aws.String("AWS/ElastiCache"),
-			MetricName: aws.String(metricName),
-			Dimensions: []*cloudwatch.Dimension{
-				{
-					Name:  aws.String("CacheClusterId"),
-					Value: aws.String(cacheClusterId),
-				},
-				{
-					Name:  aws.String("CacheNodeId"),
-					Value: aws.String("0001"),
-				},
+		dimensions := []*cloudwatch.Dimension{
+			{
+				Name:  aws.String("CacheClusterId"),
+				Value: aws.String(redisNode.CacheClusterName),
 			},
 		}
-		metricQueries = append(metricQueries, metricQuery)
+		if definition.Level == LevelNode {
+			dimensions = append(dimensions, &cloudwatch.Dimension{
+				Name:  aws.String("CacheNodeId"),
+				Value: aws.String(redisNode.CacheNodeId),
+			})
+		}
+		metricQueries = append(metricQueries, nodeMetric{
+			definition: definition,
+			metric: &cloudwatch.Metric{
+				Namespace:  aws.String("AWS/ElastiCache"),
+				MetricName: aws.String(definition.CloudWatchName),
+				Dimensions: dimensions,
+			},
+		})
 	}
 
 	return metricQueries
 }
 
+// countMetricDataQueriesByOrg works out how many billable metric data queries
+// fetching metrics for the nodes will take, grouped by the nodes' orgs
+func countMetricDataQueriesByOrg(
+	catalogue *MetricCatalogue,
+	redisNodes map[NodeName]RedisNode,
+) map[string]uint64 {
+	queriesByOrg := map[string]uint64{}
+	for _, redisNode := range redisNodes {
+		queriesByOrg[redisNode.Space.OrganizationGuid] += uint64(catalogue.QueriesPerNode(redisNode.Role))
+	}
+	return queriesByOrg
+}
+
 type queryLookup struct {
-	redisNodeName string
-	metricName    string
-	statisticName string
+	redisNodeName  string
+	prometheusName string
+	statisticName  string
+	counter        bool
 }
 
 func createMetricDataQueries(
-	nodeMetricQueries map[NodeName][]*cloudwatch.Metric,
+	nodeMetricQueries map[NodeName][]nodeMetric,
 	timePeriodInSeconds int64,
 ) ([]*cloudwatch.MetricDataQuery, map[string]queryLookup) {
 	metricDataQueries := []*cloudwatch.MetricDataQuery{}
@@ -111,20 +237,26 @@ func createMetricDataQueries(
 	metricDataQueryIndex := 0
 	for redisNodeName, redisNodeMetricQueries := range nodeMetricQueries {
 		for _, redisNodeMetricQuery := range redisNodeMetricQueries {
-			for statistic, _ := range Statistics {
+			definition := redisNodeMetricQuery.definition
+			for _, statistic := range definition.Statistics {
 				metricDataQueryId := fmt.Sprintf("q_%d", metricDataQueryIndex)
+				period := timePeriodInSeconds
+				if isCounterStatistic(statistic, definition.Counter) {
+					period = int64(counterResetPeriod.Seconds())
+				}
 				metricDataQuery := &cloudwatch.MetricDataQuery{
 					Id: aws.String(metricDataQueryId),
 					MetricStat: &cloudwatch.MetricStat{
-						Metric: redisNodeMetricQuery,
-						Period: aws.Int64(timePeriodInSeconds),
+						Metric: redisNodeMetricQuery.metric,
+						Period: aws.Int64(period),
 						Stat:   aws.String(statistic),
 					},
 				}
 				metricDataQueryIdLookup[metricDataQueryId] = queryLookup{
-					redisNodeName: redisNodeName,
-					metricName:    *redisNodeMetricQuery.MetricName,
-					statisticName: statistic,
+					redisNodeName:  redisNodeName,
+					prometheusName: definition.PrometheusName,
+					statisticName:  statistic,
+					counter:        definition.Counter,
 				}
 				metricDataQueries = append(metricDataQueries, metricDataQuery)
 				metricDataQueryIndex += 1
@@ -146,37 +278,120 @@ func batchMetricDataQueriesIntoGroupsOf500(metricDataQueries []*cloudwatch.Metri
 	return batches
 }
 
+// fetchUpTo500MetricDataQueries fetches every page of results, then tries
+// the queries whose results were incomplete or failed again. It returns the
+// complete results, and why the others failed by query ID. It only returns an
+// error if CloudWatch could not be asked at all.
 func fetchUpTo500MetricDataQueries(
+	ctx context.Context,
 	metricDataQueries []*cloudwatch.MetricDataQuery,
 	startTime time.Time,
 	endTime time.Time,
-	cloudwatchClient *cloudwatch.CloudWatch,
+	cloudwatchClient CloudWatchAPI,
 	logger lager.Logger,
-) ([]*cloudwatch.MetricDataResult, error) {
-	getMetricDataInput := &cloudwatch.GetMetricDataInput{
-		StartTime:         aws.Time(startTime),
-		EndTime:           aws.Time(endTime),
-		MetricDataQueries: metricDataQueries,
-	}
-	logger.Info("get-metric-data-aws-api-call", lager.Data{
-		"number-of-queries": len(getMetricDataInput.MetricDataQueries),
-	})
-	if len(getMetricDataInput.MetricDataQueries) > 500 {
-		return nil, fmt.Errorf("more than 500 metric data queries: %d", len(getMetricDataInput.MetricDataQueries))
+) ([]*cloudwatch.MetricDataResult, map[string]QueryFailure, error) {
+	if len(metricDataQueries) > 500 {
+		return nil, nil, fmt.Errorf("more than 500 metric data queries: %d", len(metricDataQueries))
 	}
 
-	getMetricDataOutput, err := cloudwatchClient.GetMetricData(getMetricDataInput)
-	if err != nil {
-		return nil, fmt.Errorf("error fetching metrics data: %v", err)
-	}
-	if len(getMetricDataOutput.Messages) > 0 {
-		return nil, fmt.Errorf("unexpected issue fetching metrics data: %v", getMetricDataOutput.Messages)
+	results := []*cloudwatch.MetricDataResult{}
+	failures := map[string]QueryFailure{}
+	pending := metricDataQueries
+	for attempt := 0; len(pending) > 0; attempt++ {
+		resultsById, err := fetchAllMetricDataPages(ctx, pending, startTime, endTime, cloudwatchClient, logger)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		retry := []*cloudwatch.MetricDataQuery{}
+		for _, query := range pending {
+			id := aws.StringValue(query.Id)
+			result, ok := resultsById[id]
+			statusCode := "Missing"
+			messages := []string{}
+			if ok {
+				statusCode = aws.StringValue(result.StatusCode)
+				for _, message := range result.Messages {
+					messages = append(messages, fmt.Sprintf("%s: %s", aws.StringValue(message.Code), aws.StringValue(message.Value)))
+				}
+			}
+
+			switch {
+			case ok && statusCode == cloudwatch.StatusCodeComplete:
+				results = append(results, result)
+			case (!ok || retryableStatusCodes[statusCode]) && attempt < maxMetricDataRetries:
+				retry = append(retry, query)
+			case ok && statusCode == cloudwatch.StatusCodePartialData:
+				// The values there are are still right, so use them
+				logger.Info("partial-metric-data", lager.Data{"query-id": id, "messages": messages})
+				results = append(results, result)
+			default:
+				failures[id] = QueryFailure{StatusCode: statusCode, Messages: messages}
+			}
+		}
+		if len(retry) > 0 {
+			logger.Info("retrying-metric-data-queries", lager.Data{
+				"number-of-queries": len(retry),
+				"attempt":           attempt + 1,
+			})
+		}
+		pending = retry
 	}
-	// FIXME: Fetch multiple pages, just in case
-	if getMetricDataOutput.NextToken != nil {
-		return nil, fmt.Errorf("more than one page of metrics data results (expected to be unreachable)")
+	return results, failures, nil
+}
+
+// fetchAllMetricDataPages follows NextToken until there are no more pages,
+// merging the values for each query ID
+func fetchAllMetricDataPages(
+	ctx context.Context,
+	metricDataQueries []*cloudwatch.MetricDataQuery,
+	startTime time.Time,
+	endTime time.Time,
+	cloudwatchClient CloudWatchAPI,
+	logger lager.Logger,
+) (map[string]*cloudwatch.MetricDataResult, error) {
+	resultsById := map[string]*cloudwatch.MetricDataResult{}
+	var nextToken *string
+	for {
+		getMetricDataInput := &cloudwatch.GetMetricDataInput{
+			StartTime:         aws.Time(startTime),
+			EndTime:           aws.Time(endTime),
+			MetricDataQueries: metricDataQueries,
+			NextToken:         nextToken,
+		}
+		logger.Info("get-metric-data-aws-api-call", lager.Data{
+			"number-of-queries": len(getMetricDataInput.MetricDataQueries),
+			"next-page":         nextToken != nil,
+		})
+		getMetricDataOutput, err := cloudwatchClient.GetMetricDataWithContext(ctx, getMetricDataInput)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching metrics data: %v", err)
+		}
+		for _, message := range getMetricDataOutput.Messages {
+			logger.Info("get-metric-data-message", lager.Data{
+				"code":  aws.StringValue(message.Code),
+				"value": aws.StringValue(message.Value),
+			})
+		}
+
+		for _, result := range getMetricDataOutput.MetricDataResults {
+			id := aws.StringValue(result.Id)
+			existing, ok := resultsById[id]
+			if !ok {
+				resultsById[id] = result
+				continue
+			}
+			existing.Timestamps = append(existing.Timestamps, result.Timestamps...)
+			existing.Values = append(existing.Values, result.Values...)
+			existing.Messages = append(existing.Messages, result.Messages...)
+			existing.StatusCode = result.StatusCode
+		}
+
+		if aws.StringValue(getMetricDataOutput.NextToken) == "" {
+			return resultsById, nil
+		}
+		nextToken = getMetricDataOutput.NextToken
 	}
-	return getMetricDataOutput.MetricDataResults, nil
 }
 
 func groupMetricDataResultsByNode(
@@ -205,15 +420,16 @@ func extractValuesFromMetricDataResults(
 
 		for _, metricDataResult := range nodeMetricDataResults {
 			metadata := metricDataQueryIdLookup[*metricDataResult.Id]
-			metricKey := fmt.Sprintf(
-				"%s_%s",
-				Metrics[metadata.metricName],
-				Statistics[metadata.statisticName],
-			)
-			nodeMetricValues[metricKey] = metricDataResult
+			nodeMetricValues[metricKey(metadata)] = metricDataResult
 		}
 
 		nodesMetricValues[nodeName] = nodeMetricValues
 	}
 	return nodesMetricValues, nil
 }
+
+// metricKey is the name a query's values are exported as, like
+// cpu_utilization_avg
+func metricKey(metadata queryLookup) MetricName {
+	return exportedName(metadata.prometheusName, metadata.statisticName, metadata.counter)
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/metric_endpoint"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// fakeCloudWatch answers GetMetricData with respond, and records each call
+type fakeCloudWatch struct {
+	mu      sync.Mutex
+	calls   []*cloudwatch.GetMetricDataInput
+	respond func(call int, input *cloudwatch.GetMetricDataInput) (*cloudwatch.GetMetricDataOutput, error)
+}
+
+func (f *fakeCloudWatch) GetMetricDataWithContext(
+	ctx aws.Context,
+	input *cloudwatch.GetMetricDataInput,
+	opts ...request.Option,
+) (*cloudwatch.GetMetricDataOutput, error) {
+	f.mu.Lock()
+	f.calls = append(f.calls, input)
+	call := len(f.calls) - 1
+	f.mu.Unlock()
+	return f.respond(call, input)
+}
+
+func completeResult(id string, value float64, timestamp time.Time) *cloudwatch.MetricDataResult {
+	return &cloudwatch.MetricDataResult{
+		Id:         aws.String(id),
+		StatusCode: aws.String(cloudwatch.StatusCodeComplete),
+		Timestamps: []*time.Time{aws.Time(timestamp)},
+		Values:     []*float64{aws.Float64(value)},
+	}
+}
+
+// answerAll gives every query a complete result
+func answerAll(input *cloudwatch.GetMetricDataInput, value float64) *cloudwatch.GetMetricDataOutput {
+	output := &cloudwatch.GetMetricDataOutput{}
+	for _, query := range input.MetricDataQueries {
+		output.MetricDataResults = append(output.MetricDataResults, completeResult(*query.Id, value, time.Now()))
+	}
+	return output
+}
+
+func defaultCatalogue() *MetricCatalogue {
+	catalogue, err := LoadMetricCatalogue("")
+	Expect(err).NotTo(HaveOccurred())
+	return catalogue
+}
+
+// windowCatalogue is the default catalogue without the counter metrics, whose
+// Sums are fetched in batches of their own
+func windowCatalogue() *MetricCatalogue {
+	catalogue := defaultCatalogue()
+	for i := range catalogue.Metrics {
+		if catalogue.Metrics[i].Counter {
+			catalogue.Metrics[i].Enabled = aws.Bool(false)
+		}
+	}
+	return catalogue
+}
+
+func testNode(name, instanceGuid string) RedisNode {
+	return RedisNode{
+		CacheClusterName: name,
+		CacheNodeId:      "0001",
+		Shard:            "0001",
+		Role:             RolePrimary,
+		AvailabilityZone: "eu-west-2a",
+		ServiceInstance:  cfclient.ServiceInstance{Guid: instanceGuid, Name: instanceGuid + "-name"},
+		Space:            cfclient.Space{Guid: "space-guid", OrganizationGuid: "org-guid"},
+		Organisation:     cfclient.Org{Guid: "org-guid"},
+	}
+}
+
+var _ = Describe("GetMetricsForRedisNodes", func() {
+	var logger lager.Logger
+	var catalogue *MetricCatalogue
+	var startTime, endTime time.Time
+	var nodes map[string]RedisNode
+	var queriesPerNode int
+
+	BeforeEach(func() {
+		logger = lager.NewLogger("cloudwatch-test")
+		logger.RegisterSink(lager.NewWriterSink(GinkgoWriter, lager.INFO))
+		endTime = time.Now().Add(-2 * time.Minute)
+		startTime = endTime.Add(-5 * time.Minute)
+		nodes = map[string]RedisNode{
+			"cf-first-0001-001":  testNode("cf-first-0001-001", "first-guid"),
+			"cf-second-0001-001": testNode("cf-second-0001-001", "second-guid"),
+		}
+		catalogue = windowCatalogue()
+		queriesPerNode = catalogue.QueriesPerNode(RolePrimary)
+	})
+
+	It("fetches every metric for every node", func() {
+		client := &fakeCloudWatch{respond: func(call int, input *cloudwatch.GetMetricDataInput) (*cloudwatch.GetMetricDataOutput, error) {
+			return answerAll(input, 42), nil
+		}}
+		values, failures, err := GetMetricsForRedisNodes(context.Background(), catalogue, nodes, startTime, endTime, endTime.Sub(startTime), client, 4, logger)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(failures).To(BeEmpty())
+		Expect(client.calls).To(HaveLen(1))
+		Expect(values).To(HaveLen(2))
+		Expect(values["cf-first-0001-001"]).To(HaveLen(queriesPerNode))
+		Expect(*values["cf-first-0001-001"]["cpu_utilization_max"].Values[0]).To(Equal(float64(42)))
+	})
+
+	It("follows NextToken and merges the pages by query ID", func() {
+		newer := time.Now()
+		older := newer.Add(-time.Minute)
+		client := &fakeCloudWatch{respond: func(call int, input *cloudwatch.GetMetricDataInput) (*cloudwatch.GetMetricDataOutput, error) {
+			output := &cloudwatch.GetMetricDataOutput{}
+			for _, query := range input.MetricDataQueries {
+				if call == 0 {
+					result := completeResult(*query.Id, 2, newer)
+					result.StatusCode = aws.String(cloudwatch.StatusCodePartialData)
+					output.MetricDataResults = append(output.MetricDataResults, result)
+				} else {
+					output.MetricDataResults = append(output.MetricDataResults, completeResult(*query.Id, 1, older))
+				}
+			}
+			if call == 0 {
+				output.NextToken = aws.String("page-2")
+			}
+			return output, nil
+		}}
+
+		values, failures, err := GetMetricsForRedisNodes(context.Background(), catalogue, nodes, startTime, endTime, endTime.Sub(startTime), client, 4, logger)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(failures).To(BeEmpty())
+		Expect(client.calls).To(HaveLen(2))
+		Expect(client.calls[0].NextToken).To(BeNil())
+		Expect(aws.StringValue(client.calls[1].NextToken)).To(Equal("page-2"))
+		Expect(client.calls[1].MetricDataQueries).To(Equal(client.calls[0].MetricDataQueries))
+
+		result := values["cf-second-0001-001"]["cpu_utilization_avg"]
+		Expect(aws.StringValue(result.StatusCode)).To(Equal(cloudwatch.StatusCodeComplete))
+		Expect(aws.Float64ValueSlice(result.Values)).To(Equal([]float64{2, 1}))
+		Expect(aws.TimeValueSlice(result.Timestamps)).To(Equal([]time.Time{newer, older}))
+	})
+
+	It("tries only the incomplete and failed queries again", func() {
+		var retriedIds []string
+		client := &fakeCloudWatch{respond: func(call int, input *cloudwatch.GetMetricDataInput) (*cloudwatch.GetMetricDataOutput, error) {
+			output := answerAll(input, 1)
+			if call == 0 {
+				output.MetricDataResults[0].StatusCode = aws.String(cloudwatch.StatusCodePartialData)
+				output.MetricDataResults[1].StatusCode = aws.String(cloudwatch.StatusCodeInternalError)
+				// The third result is missing altogether
+				output.MetricDataResults = append(output.MetricDataResults[:2], output.MetricDataResults[3:]...)
+				return output, nil
+			}
+			for _, query := range input.MetricDataQueries {
+				retriedIds = append(retriedIds, *query.Id)
+			}
+			return output, nil
+		}}
+
+		values, failures, err := GetMetricsForRedisNodes(context.Background(), catalogue, nodes, startTime, endTime, endTime.Sub(startTime), client, 4, logger)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(failures).To(BeEmpty())
+		Expect(client.calls).To(HaveLen(2))
+		Expect(retriedIds).To(ConsistOf("q_0", "q_1", "q_2"))
+		Expect(values["cf-first-0001-001"]).To(HaveLen(queriesPerNode))
+		Expect(values["cf-second-0001-001"]).To(HaveLen(queriesPerNode))
+	})
+
+	It("reports queries which keep failing against their node, and keeps the rest", func() {
+		var failingId string
+		var failingNode NodeName
+		client := &fakeCloudWatch{respond: func(call int, input *cloudwatch.GetMetricDataInput) (*cloudwatch.GetMetricDataOutput, error) {
+			if call == 0 {
+				failingId = *input.MetricDataQueries[0].Id
+				for _, dimension := range input.MetricDataQueries[0].MetricStat.Metric.Dimensions {
+					if *dimension.Name == "CacheClusterId" {
+						failingNode = *dimension.Value
+					}
+				}
+			}
+			output := answerAll(input, 1)
+			for _, result := range output.MetricDataResults {
+				if *result.Id == failingId {
+					result.StatusCode = aws.String(cloudwatch.StatusCodeInternalError)
+					result.Values = nil
+					result.Timestamps = nil
+					result.Messages = []*cloudwatch.MessageData{{Code: aws.String("InternalError"), Value: aws.String("try later")}}
+				}
+			}
+			return output, nil
+		}}
+
+		values, failures, err := GetMetricsForRedisNodes(context.Background(), catalogue, nodes, startTime, endTime, endTime.Sub(startTime), client, 4, logger)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(client.calls).To(HaveLen(1 + maxMetricDataRetries))
+		Expect(failures).To(HaveLen(1))
+		Expect(failures[failingNode]).To(HaveLen(1))
+		Expect(failures[failingNode][0].StatusCode).To(Equal(cloudwatch.StatusCodeInternalError))
+		Expect(failures[failingNode][0].Messages).To(Equal([]string{"InternalError: try later"}))
+		Expect(values[failingNode]).To(HaveLen(queriesPerNode - 1))
+		Expect(values[failingNode]).NotTo(HaveKey(failures[failingNode][0].MetricName))
+	})
+
+	It("uses partial data if it is still partial after retrying", func() {
+		client := &fakeCloudWatch{respond: func(call int, input *cloudwatch.GetMetricDataInput) (*cloudwatch.GetMetricDataOutput, error) {
+			output := answerAll(input, 1)
+			output.MetricDataResults[0].StatusCode = aws.String(cloudwatch.StatusCodePartialData)
+			return output, nil
+		}}
+		values, failures, err := GetMetricsForRedisNodes(context.Background(), catalogue, nodes, startTime, endTime, endTime.Sub(startTime), client, 4, logger)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(failures).To(BeEmpty())
+		total := 0
+		for _, nodeValues := range values {
+			total += len(nodeValues)
+		}
+		Expect(total).To(Equal(2 * queriesPerNode))
+	})
+
+	It("does not fail because of messages about the whole request", func() {
+		client := &fakeCloudWatch{respond: func(call int, input *cloudwatch.GetMetricDataInput) (*cloudwatch.GetMetricDataOutput, error) {
+			output := answerAll(input, 1)
+			output.Messages = []*cloudwatch.MessageData{{Code: aws.String("Info"), Value: aws.String("something to know")}}
+			return output, nil
+		}}
+		_, failures, err := GetMetricsForRedisNodes(context.Background(), catalogue, nodes, startTime, endTime, endTime.Sub(startTime), client, 4, logger)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(failures).To(BeEmpty())
+	})
+
+	It("fetches the Sums of counter metrics since the start of the UTC day, in batches of their own", func() {
+		endTime = time.Date(2020, 1, 1, 12, 30, 45, 0, time.UTC)
+		startTime = endTime.Add(-5 * time.Minute)
+		client := &fakeCloudWatch{respond: func(call int, input *cloudwatch.GetMetricDataInput) (*cloudwatch.GetMetricDataOutput, error) {
+			return answerAll(input, 42), nil
+		}}
+		values, _, err := GetMetricsForRedisNodes(context.Background(), defaultCatalogue(), nodes, startTime, endTime, endTime.Sub(startTime), client, 4, logger)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(values["cf-first-0001-001"]).To(HaveKey("evictions_total"))
+
+		Expect(client.calls).To(HaveLen(2))
+		for _, call := range client.calls {
+			counters := 0
+			for _, query := range call.MetricDataQueries {
+				if aws.StringValue(query.MetricStat.Stat) == "Sum" {
+					counters++
+					Expect(aws.Int64Value(query.MetricStat.Period)).To(Equal(int64(24 * 60 * 60)))
+				}
+			}
+			if counters == 0 {
+				Expect(aws.TimeValue(call.StartTime)).To(Equal(startTime))
+				Expect(aws.TimeValue(call.EndTime)).To(Equal(endTime))
+				continue
+			}
+			Expect(call.MetricDataQueries).To(HaveLen(counters))
+			Expect(aws.TimeValue(call.StartTime)).To(Equal(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)))
+			Expect(aws.TimeValue(call.EndTime)).To(Equal(time.Date(2020, 1, 1, 12, 30, 0, 0, time.UTC)))
+		}
+	})
+
+	It("fails if CloudWatch cannot be asked", func() {
+		client := &fakeCloudWatch{respond: func(call int, input *cloudwatch.GetMetricDataInput) (*cloudwatch.GetMetricDataOutput, error) {
+			return nil, fmt.Errorf("no route to host")
+		}}
+		_, _, err := GetMetricsForRedisNodes(context.Background(), catalogue, nodes, startTime, endTime, endTime.Sub(startTime), client, 4, logger)
+		Expect(err).To(MatchError(ContainSubstring("no route to host")))
+	})
+})
+
+var _ = Describe("addQueryFailureMetrics", func() {
+	It("counts the failed queries for every node", func() {
+		logger := lager.NewLogger("cloudwatch-test")
+		nodes := map[string]RedisNode{
+			"cf-first-0001-001":  testNode("cf-first-0001-001", "first-guid"),
+			"cf-second-0001-001": testNode("cf-second-0001-001", "second-guid"),
+		}
+		failures := map[NodeName][]QueryFailure{
+			"cf-first-0001-001": {
+				{MetricName: "cpu_utilization_max", StatusCode: "InternalError"},
+				{MetricName: "evictions_avg", StatusCode: "Missing"},
+			},
+		}
+		promMetrics := metric_endpoint.Metrics{}
+		addQueryFailureMetrics(promMetrics, failures, nodes, logger)
+
+		family := promMetrics["cloudwatch_failed_queries"]
+		Expect(family).NotTo(BeNil())
+		counts := map[string]float64{}
+		for _, metric := range family.Metric {
+			for _, label := range metric.Label {
+				if label.GetName() == "service_instance_guid" {
+					counts[label.GetValue()] = metric.Gauge.GetValue()
+				}
+			}
+		}
+		Expect(counts).To(Equal(map[string]float64{"first-guid": 2, "second-guid": 0}))
+	})
+})
+
+var _ = Describe("GetMetricsForRedisNodes with many nodes", func() {
+	var logger lager.Logger
+	var nodes map[string]RedisNode
+
+	BeforeEach(func() {
+		logger = lager.NewLogger("cloudwatch-test")
+		nodes = map[string]RedisNode{}
+		// Enough nodes for several batches of 500 queries
+		for i := 0; i < 100; i++ {
+			name := fmt.Sprintf("cf-node-%d-0001-001", i)
+			nodes[name] = testNode(name, fmt.Sprintf("guid-%d", i))
+		}
+	})
+
+	It("fetches no more than maxParallelBatches batches at once", func() {
+		var mu sync.Mutex
+		running, mostRunning := 0, 0
+		client := &fakeCloudWatch{respond: func(call int, input *cloudwatch.GetMetricDataInput) (*cloudwatch.GetMetricDataOutput, error) {
+			mu.Lock()
+			running++
+			if running > mostRunning {
+				mostRunning = running
+			}
+			mu.Unlock()
+			time.Sleep(20 * time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+			return answerAll(input, 1), nil
+		}}
+
+		values, failures, err := GetMetricsForRedisNodes(context.Background(), defaultCatalogue(), nodes, time.Now().Add(-5*time.Minute), time.Now(), 5*time.Minute, client, 2, logger)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(failures).To(BeEmpty())
+		Expect(values).To(HaveLen(100))
+		Expect(len(client.calls)).To(BeNumerically(">", 2))
+		Expect(mostRunning).To(Equal(2))
+	})
+
+	It("cancels the other batches when one fails, and returns its error", func() {
+		client := &fakeCloudWatch{}
+		client.respond = func(call int, input *cloudwatch.GetMetricDataInput) (*cloudwatch.GetMetricDataOutput, error) {
+			if call == 0 {
+				return nil, fmt.Errorf("access denied")
+			}
+			time.Sleep(20 * time.Millisecond)
+			return answerAll(input, 1), nil
+		}
+
+		_, _, err := GetMetricsForRedisNodes(context.Background(), defaultCatalogue(), nodes, time.Now().Add(-5*time.Minute), time.Now(), 5*time.Minute, client, 1, logger)
+		Expect(err).To(MatchError(ContainSubstring("access denied")))
+		Expect(client.calls).To(HaveLen(1))
+	})
+
+	It("stops when the scrape is cancelled", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		client := &fakeCloudWatch{respond: func(call int, input *cloudwatch.GetMetricDataInput) (*cloudwatch.GetMetricDataOutput, error) {
+			return answerAll(input, 1), nil
+		}}
+
+		_, _, err := GetMetricsForRedisNodes(ctx, defaultCatalogue(), nodes, time.Now().Add(-5*time.Minute), time.Now(), 5*time.Minute, client, 1, logger)
+		Expect(err).To(MatchError(context.Canceled))
+	})
+})
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/internal_metrics"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+const (
+	minThrottlingBackoff = 200 * time.Millisecond
+	maxThrottlingBackoff = 10 * time.Second
+)
+
+// ThrottledCloudWatch keeps GetMetricData calls under the account's
+// transactions per second limit, which is shared by every scrape, and tries
+// calls which were throttled anyway again after a jittered backoff
+type ThrottledCloudWatch struct {
+	client     CloudWatchAPI
+	bucket     *tokenBucket
+	maxRetries uint
+	registry   *internal_metrics.Registry
+	logger     lager.Logger
+}
+
+// NewThrottledCloudWatch allows requestsPerSecond calls a second, or any
+// number if it is 0
+func NewThrottledCloudWatch(
+	client CloudWatchAPI,
+	requestsPerSecond uint,
+	maxRetries uint,
+	registry *internal_metrics.Registry,
+	logger lager.Logger,
+) *ThrottledCloudWatch {
+	return &ThrottledCloudWatch{
+		client:     client,
+		bucket:     newTokenBucket(requestsPerSecond),
+		maxRetries: maxRetries,
+		registry:   registry,
+		logger:     logger.Session("throttled-cloudwatch"),
+	}
+}
+
+func (t *ThrottledCloudWatch) GetMetricDataWithContext(
+	ctx aws.Context,
+	input *cloudwatch.GetMetricDataInput,
+	opts ...request.Option,
+) (*cloudwatch.GetMetricDataOutput, error) {
+	for attempt := uint(0); ; attempt++ {
+		if err := t.bucket.Wait(ctx); err != nil {
+			return nil, err
+		}
+		output, err := t.client.GetMetricDataWithContext(ctx, input, opts...)
+		if err == nil || !request.IsErrorThrottle(err) || attempt >= t.maxRetries {
+			return output, err
+		}
+
+		backoff := throttlingBackoff(attempt)
+		t.registry.AddCounter(
+			"paas_exporter_cloudwatch_throttled_requests_total",
+			"GetMetricData calls which CloudWatch throttled",
+			nil, 1,
+		)
+		t.logger.Info("get-metric-data-throttled", lager.Data{
+			"attempt": attempt + 1,
+			"backoff": backoff.String(),
+		})
+		if err := sleep(ctx, backoff); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// throttlingBackoff doubles with each attempt, and picks a random time up to
+// that so that scrapes which were throttled together don't retry together
+func throttlingBackoff(attempt uint) time.Duration {
+	backoff := minThrottlingBackoff
+	for i := uint(0); i < attempt && backoff < maxThrottlingBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxThrottlingBackoff {
+		backoff = maxThrottlingBackoff
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+func sleep(ctx aws.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// tokenBucket allows a second's worth of calls at once, then one more every
+// 1/perSecond. A nil tokenBucket doesn't limit anything.
+type tokenBucket struct {
+	burst    float64
+	interval time.Duration
+
+	mu       sync.Mutex
+	tokens   float64
+	lastFill time.Time
+}
+
+func newTokenBucket(perSecond uint) *tokenBucket {
+	if perSecond == 0 {
+		return nil
+	}
+	return &tokenBucket{
+		burst:    float64(perSecond),
+		interval: time.Second / time.Duration(perSecond),
+		tokens:   float64(perSecond),
+		lastFill: time.Now(),
+	}
+}
+
+// Wait takes a token, waiting until there is one or the context is done
+func (b *tokenBucket) Wait(ctx aws.Context) error {
+	if b == nil {
+		return nil
+	}
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		b.tokens += float64(now.Sub(b.lastFill)) / float64(b.interval)
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.lastFill = now
+		if b.tokens >= 1 {
+			b.tokens -= 1
+			b.mu.Unlock()
+			return nil
+		}
+		wait := time.Duration((1 - b.tokens) * float64(b.interval))
+		b.mu.Unlock()
+
+		if err := sleep(ctx, wait); err != nil {
+			return err
+		}
+	}
+}
+
+var _ CloudWatchAPI = (*ThrottledCloudWatch)(nil)
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/internal_metrics"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ThrottledCloudWatch", func() {
+	var logger lager.Logger
+	var registry *internal_metrics.Registry
+	var input *cloudwatch.GetMetricDataInput
+
+	BeforeEach(func() {
+		logger = lager.NewLogger("throttle-test")
+		registry = internal_metrics.NewRegistry()
+		input = &cloudwatch.GetMetricDataInput{}
+	})
+
+	It("tries throttled calls again", func() {
+		client := &fakeCloudWatch{respond: func(call int, input *cloudwatch.GetMetricDataInput) (*cloudwatch.GetMetricDataOutput, error) {
+			if call < 2 {
+				return nil, awserr.New("Throttling", "Rate exceeded", nil)
+			}
+			return &cloudwatch.GetMetricDataOutput{}, nil
+		}}
+		throttled := NewThrottledCloudWatch(client, 0, 5, registry, logger)
+
+		_, err := throttled.GetMetricDataWithContext(context.Background(), input)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(client.calls).To(HaveLen(3))
+		Expect(registry.Gather()["paas_exporter_cloudwatch_throttled_requests_total"].Metric[0].Counter.GetValue()).To(Equal(float64(2)))
+	})
+
+	It("gives up after maxRetries", func() {
+		client := &fakeCloudWatch{respond: func(call int, input *cloudwatch.GetMetricDataInput) (*cloudwatch.GetMetricDataOutput, error) {
+			return nil, awserr.New("Throttling", "Rate exceeded", nil)
+		}}
+		throttled := NewThrottledCloudWatch(client, 0, 1, registry, logger)
+
+		_, err := throttled.GetMetricDataWithContext(context.Background(), input)
+		Expect(err).To(MatchError(ContainSubstring("Rate exceeded")))
+		Expect(client.calls).To(HaveLen(2))
+	})
+
+	It("does not try other errors again", func() {
+		client := &fakeCloudWatch{respond: func(call int, input *cloudwatch.GetMetricDataInput) (*cloudwatch.GetMetricDataOutput, error) {
+			return nil, awserr.New("AccessDenied", "not allowed", nil)
+		}}
+		throttled := NewThrottledCloudWatch(client, 0, 5, registry, logger)
+
+		_, err := throttled.GetMetricDataWithContext(context.Background(), input)
+		Expect(err).To(HaveOccurred())
+		Expect(client.calls).To(HaveLen(1))
+	})
+
+	It("stops waiting to try again when the context is done", func() {
+		client := &fakeCloudWatch{respond: func(call int, input *cloudwatch.GetMetricDataInput) (*cloudwatch.GetMetricDataOutput, error) {
+			return nil, awserr.New("Throttling", "Rate exceeded", nil)
+		}}
+		throttled := NewThrottledCloudWatch(client, 0, 100, registry, logger)
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		_, err := throttled.GetMetricDataWithContext(ctx, input)
+		Expect(err).To(MatchError(context.DeadlineExceeded))
+	})
+
+	It("keeps to the requests per second", func() {
+		client := &fakeCloudWatch{respond: func(call int, input *cloudwatch.GetMetricDataInput) (*cloudwatch.GetMetricDataOutput, error) {
+			return &cloudwatch.GetMetricDataOutput{}, nil
+		}}
+		throttled := NewThrottledCloudWatch(client, 20, 0, registry, logger)
+
+		start := time.Now()
+		for i := 0; i < 25; i++ {
+			_, err := throttled.GetMetricDataWithContext(context.Background(), input)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		// 20 at once, then 5 more at 50ms each
+		Expect(time.Since(start)).To(BeNumerically(">=", 200*time.Millisecond))
+	})
+})
+
+var _ = Describe("throttlingBackoff", func() {
+	It("grows with each attempt up to the maximum", func() {
+		for attempt := uint(0); attempt < 10; attempt++ {
+			backoff := throttlingBackoff(attempt)
+			Expect(backoff).To(BeNumerically(">=", minThrottlingBackoff/2))
+			Expect(backoff).To(BeNumerically("<=", maxThrottlingBackoff))
+		}
+		Expect(throttlingBackoff(0)).To(BeNumerically("<=", minThrottlingBackoff))
+		Expect(throttlingBackoff(20)).To(BeNumerically(">=", maxThrottlingBackoff/2))
+	})
+})
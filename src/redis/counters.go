@@ -0,0 +1,36 @@
+package main
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+// counterResetPeriod is how often the counters start again from 0. Each
+// counter is the Sum of its metric since the start of the current UTC day,
+// which CloudWatch works out, so every instance of the app gives the same
+// value for the same minute and no minutes are missed between scrapes.
+const counterResetPeriod = 24 * time.Hour
+
+// counterTimeRange is what to ask CloudWatch for the counters' Sums for. It
+// ends on the last whole minute before endTime and starts at the start of the
+// UTC day that minute is in, so a range which ends at midnight covers the
+// whole of the day before.
+func counterTimeRange(endTime time.Time) (startTime time.Time, countedUntil time.Time) {
+	countedUntil = endTime.Truncate(time.Minute)
+	return countedUntil.Add(-time.Nanosecond).Truncate(counterResetPeriod), countedUntil
+}
+
+// counterTotal adds up a counter's datapoints, of which there should be one
+// covering the whole range. It returns false if there are none.
+func counterTotal(metricDataResult *cloudwatch.MetricDataResult) (float64, bool) {
+	if len(metricDataResult.Values) == 0 {
+		return 0, false
+	}
+	total := 0.0
+	for _, value := range metricDataResult.Values {
+		total += aws.Float64Value(value)
+	}
+	return total, true
+}
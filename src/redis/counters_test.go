@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// evictionsPerMinute is how many evictions minuteCloudWatch has each minute
+const evictionsPerMinute = 2
+
+// minuteCloudWatch adds up evictionsPerMinute for each minute in the time
+// asked for, like CloudWatch adds up the datapoints in each period, and
+// answers every other query with 1
+func minuteCloudWatch() *fakeCloudWatch {
+	return &fakeCloudWatch{respond: func(call int, input *cloudwatch.GetMetricDataInput) (*cloudwatch.GetMetricDataOutput, error) {
+		output := answerAll(input, 1)
+		for i, query := range input.MetricDataQueries {
+			if aws.StringValue(query.MetricStat.Metric.MetricName) != "Evictions" || aws.StringValue(query.MetricStat.Stat) != "Sum" {
+				continue
+			}
+			result := &cloudwatch.MetricDataResult{Id: query.Id, StatusCode: aws.String(cloudwatch.StatusCodeComplete)}
+			minutes := input.EndTime.Sub(*input.StartTime) / time.Minute
+			if minutes > 0 {
+				result.Timestamps = []*time.Time{input.StartTime}
+				result.Values = []*float64{aws.Float64(float64(minutes * evictionsPerMinute))}
+			}
+			output.MetricDataResults[i] = result
+		}
+		return output, nil
+	}}
+}
+
+var _ = Describe("counters", func() {
+	var logger lager.Logger
+	var nodes map[string]RedisNode
+	var window MetricWindow
+	var day time.Time
+
+	BeforeEach(func() {
+		logger = lager.NewLogger("counters-test")
+		nodes = map[string]RedisNode{"node-1": testNode("node-1", "instance-1")}
+		window = MetricWindow{Datapoints: DatapointsWindow, Length: 5 * time.Minute, Lag: 2 * time.Minute}
+		day = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	})
+
+	// scrape gets evictions_total the way an instance of the app scraped at
+	// now would, and when it was counted until
+	scrape := func(client CloudWatchAPI, now time.Time) (float64, time.Time) {
+		startTime, endTime, period := window.TimeRange(now)
+		values, _, err := GetMetricsForRedisNodes(context.Background(), defaultCatalogue(), nodes, startTime, endTime, period, client, 4, logger)
+		Expect(err).NotTo(HaveOccurred())
+		promMetrics := metricsFromCloudWatchToPrometheus(defaultCatalogue(), values, nodes, window.Datapoints, endTime, logger)
+		family := promMetrics["evictions_total"]
+		Expect(family.GetType()).To(Equal(dto.MetricType_COUNTER))
+		Expect(family.Metric).To(HaveLen(1))
+		return family.Metric[0].GetCounter().GetValue(), time.UnixMilli(family.Metric[0].GetTimestampMs()).UTC()
+	}
+
+	It("counts from the start of the UTC day until the last whole minute", func() {
+		startTime, countedUntil := counterTimeRange(day.Add(12*time.Hour + 30*time.Minute + 45*time.Second))
+		Expect(startTime).To(Equal(day))
+		Expect(countedUntil).To(Equal(day.Add(12*time.Hour + 30*time.Minute)))
+
+		startTime, countedUntil = counterTimeRange(day.Add(24 * time.Hour))
+		Expect(startTime).To(Equal(day))
+		Expect(countedUntil).To(Equal(day.Add(24 * time.Hour)))
+	})
+
+	It("gives the same totals whichever instance of the app is scraped, however their scrapes are timed", func() {
+		firstInstance, secondInstance := minuteCloudWatch(), minuteCloudWatch()
+		noon := day.Add(12 * time.Hour)
+
+		firstTotals := map[time.Time]float64{}
+		for _, at := range []time.Duration{10 * time.Second, 5*time.Minute + 10*time.Second, 10*time.Minute + 10*time.Second} {
+			total, countedUntil := scrape(firstInstance, noon.Add(at))
+			firstTotals[countedUntil] = total
+		}
+		for _, at := range []time.Duration{2*time.Minute + 30*time.Second, 10*time.Minute + 50*time.Second} {
+			total, countedUntil := scrape(secondInstance, noon.Add(at))
+			Expect(countedUntil).To(Equal(noon.Add(at - 2*time.Minute).Truncate(time.Minute)))
+			Expect(total).To(Equal(float64(evictionsPerMinute) * countedUntil.Sub(day).Minutes()))
+		}
+		total, countedUntil := scrape(secondInstance, noon.Add(10*time.Minute+50*time.Second))
+		Expect(firstTotals).To(HaveKeyWithValue(countedUntil, total))
+	})
+
+	It("counts every minute between scrapes further apart than the window", func() {
+		client := minuteCloudWatch()
+		before, _ := scrape(client, day.Add(12*time.Hour))
+		after, _ := scrape(client, day.Add(12*time.Hour+40*time.Minute))
+		Expect(after - before).To(Equal(float64(40 * evictionsPerMinute)))
+	})
+
+	It("starts again at midnight UTC", func() {
+		client := minuteCloudWatch()
+		// CloudWatch is asked for the time until 2 minutes before the scrape
+		total, countedUntil := scrape(client, day.Add(24*time.Hour+2*time.Minute+30*time.Second))
+		Expect(total).To(Equal(float64(24 * 60 * evictionsPerMinute)))
+		Expect(countedUntil).To(Equal(day.Add(24 * time.Hour)))
+
+		total, countedUntil = scrape(client, day.Add(24*time.Hour+3*time.Minute+30*time.Second))
+		Expect(total).To(Equal(float64(evictionsPerMinute)))
+		Expect(countedUntil).To(Equal(day.Add(24*time.Hour + time.Minute)))
+	})
+
+	It("leaves out counters CloudWatch has no datapoints for", func() {
+		promMetrics := metricsFromCloudWatchToPrometheus(defaultCatalogue(), map[string]map[string]*cloudwatch.MetricDataResult{
+			"node-1": {"evictions_total": {}},
+		}, nodes, window.Datapoints, day, logger)
+		Expect(promMetrics["evictions_total"].Metric).To(BeEmpty())
+	})
+})
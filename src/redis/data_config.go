@@ -1,42 +0,0 @@
-package main
-
-// Maps from CloudWatch names to Prometheus-alike names
-// Ideally would be automated but handling acronyms in code was ugly
-
-var Statistics = map[string]string{
-	"Average": "avg",
-	"Minimum": "min",
-	"Maximum": "max",
-}
-
-var Metrics = map[string]string{
-	"CurrItems":                     "curr_items",
-	"CacheHitRate":                  "cache_hit_rate",
-	"Evictions":                     "evictions",
-	"CurrConnections":               "curr_connections",
-	"NewConnections":                "new_connections",
-	"DatabaseMemoryUsagePercentage": "database_memory_usage_percentage",
-
-	"CPUUtilization":  "cpu_utilization",
-	"SwapUsage":       "swap_usage",
-	"NetworkBytesIn":  "network_bytes_in",
-	"NetworkBytesOut": "network_bytes_out",
-}
-
-// https://docs.aws.amazon.com/AmazonElastiCache/latest/red-ug/CacheMetrics.Redis.html
-var CacheClusterMetrics = []string{
-	"CurrItems",
-	"CacheHitRate",
-	"Evictions",
-	"CurrConnections",
-	"NewConnections",
-	"DatabaseMemoryUsagePercentage",
-}
-
-// https://docs.aws.amazon.com/AmazonElastiCache/latest/red-ug/CacheMetrics.HostLevel.html
-var HostMetrics = []string{
-	"CPUUtilization",
-	"SwapUsage",
-	"NetworkBytesIn",
-	"NetworkBytesOut",
-}
@@ -1,59 +1,165 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"strconv"
-	"strings"
 
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/store"
+
+	"code.cloudfoundry.org/lager"
 	paasElasticacheBrokerRedis "github.com/alphagov/paas-elasticache-broker/providers/redis"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/elasticache"
 
 	cfclient "github.com/cloudfoundry-community/go-cfclient"
 )
 
+const (
+	RolePrimary = "primary"
+	RoleReplica = "replica"
+	// RoleUnknown is used when ElastiCache doesn't give a member's
+	// CurrentRole, which it may not for cluster mode enabled replication
+	// groups
+	RoleUnknown = "unknown"
+)
+
+// defaultCacheNodeId is the ID of the only cache node in a Redis cache
+// cluster. It is used for members ElastiCache doesn't give a CacheNodeId for.
+const defaultCacheNodeId = "0001"
+
+// ElastiCacheAPI is the part of the ElastiCache client which is used, so that
+// tests can fake it
+type ElastiCacheAPI interface {
+	DescribeReplicationGroups(*elasticache.DescribeReplicationGroupsInput) (*elasticache.DescribeReplicationGroupsOutput, error)
+	DescribeReplicationGroupsPagesWithContext(aws.Context, *elasticache.DescribeReplicationGroupsInput, func(*elasticache.DescribeReplicationGroupsOutput, bool) bool, ...request.Option) error
+	DescribeCacheClusters(*elasticache.DescribeCacheClustersInput) (*elasticache.DescribeCacheClustersOutput, error)
+	DescribeCacheClustersPagesWithContext(aws.Context, *elasticache.DescribeCacheClustersInput, func(*elasticache.DescribeCacheClustersOutput, bool) bool, ...request.Option) error
+	DescribeEventsPagesWithContext(aws.Context, *elasticache.DescribeEventsInput, func(*elasticache.DescribeEventsOutput, bool) bool, ...request.Option) error
+}
+
+// RedisNode is one cache cluster in a replication group. Each cache cluster
+// has a single cache node.
 type RedisNode struct {
 	CacheClusterName string
-	NodeNumber       *int
+	CacheNodeId      string
+	// Shard is the node group the node is in. Cluster mode disabled
+	// replication groups have one.
+	Shard            string
+	Role             string
+	AvailabilityZone string
 	ReplicationGroup *elasticache.ReplicationGroup
 	ServiceInstance  cfclient.ServiceInstance
 	Space            cfclient.Space
 	Organisation     cfclient.Org
 }
 
+// ListRedisNodes finds the nodes of the service instances. Instances whose
+// replication groups don't exist, for example because they are still being
+// created, or which can't be looked up yet are left out.
 func ListRedisNodes(
 	serviceInstances []cfclient.ServiceInstance,
 	spacesByGuid map[string]cfclient.Space,
 	orgsByGuid map[string]cfclient.Org,
-	elasticacheClient *elasticache.ElastiCache,
+	replicationGroups ReplicationGroupSource,
+	logger lager.Logger,
 ) (map[string]RedisNode, error) {
 	redisNodes := map[string]RedisNode{}
 	for _, serviceInstance := range serviceInstances {
 		replicationGroupName := paasElasticacheBrokerRedis.GenerateReplicationGroupName(serviceInstance.Guid)
-		replicationGroup, err := getReplicationGroup(replicationGroupName, elasticacheClient)
+		replicationGroup, err := replicationGroups.GetReplicationGroup(replicationGroupName)
+		if isMissingOrRateLimited(err) {
+			logger.Info("skipping-service-instance", lager.Data{
+				"service-instance-guid": serviceInstance.Guid,
+				"reason":                err.Error(),
+			})
+			continue
+		}
 		if err != nil {
 			return nil, err
 		}
 
-		for _, cacheClusterName := range replicationGroup.MemberClusters {
-			space := spacesByGuid[serviceInstance.SpaceGuid]
-			redisNodes[*cacheClusterName] = RedisNode{
-				CacheClusterName: *cacheClusterName,
-				NodeNumber:       getNodeNumberFromCacheClusterName(*cacheClusterName),
-				ReplicationGroup: replicationGroup,
-				ServiceInstance:  serviceInstance,
-				Space:            space,
-				Organisation:     orgsByGuid[space.OrganizationGuid],
-			}
+		space := spacesByGuid[serviceInstance.SpaceGuid]
+		for _, redisNode := range listReplicationGroupNodes(replicationGroup, logger) {
+			redisNode.ServiceInstance = serviceInstance
+			redisNode.Space = space
+			redisNode.Organisation = orgsByGuid[space.OrganizationGuid]
+			redisNodes[redisNode.CacheClusterName] = redisNode
 		}
 	}
 	return redisNodes, nil
 }
 
-func getReplicationGroup(name string, elasticacheClient *elasticache.ElastiCache) (*elasticache.ReplicationGroup, error) {
+// listReplicationGroupNodes finds the nodes in each of the replication
+// group's shards. Members which are not in a shard yet, for example while
+// they are being added, are still listed.
+func listReplicationGroupNodes(replicationGroup *elasticache.ReplicationGroup, logger lager.Logger) []RedisNode {
+	redisNodes := []RedisNode{}
+	seen := map[string]bool{}
+	for _, nodeGroup := range replicationGroup.NodeGroups {
+		for _, member := range nodeGroup.NodeGroupMembers {
+			cacheClusterName := aws.StringValue(member.CacheClusterId)
+			if cacheClusterName == "" || seen[cacheClusterName] {
+				continue
+			}
+			seen[cacheClusterName] = true
+
+			role := aws.StringValue(member.CurrentRole)
+			if role == "" {
+				role = RoleUnknown
+			}
+			redisNodes = append(redisNodes, RedisNode{
+				CacheClusterName: cacheClusterName,
+				CacheNodeId:      aws.StringValue(member.CacheNodeId),
+				Shard:            aws.StringValue(nodeGroup.NodeGroupId),
+				Role:             role,
+				AvailabilityZone: aws.StringValue(member.PreferredAvailabilityZone),
+				ReplicationGroup: replicationGroup,
+			})
+		}
+	}
+	for _, cacheClusterName := range replicationGroup.MemberClusters {
+		if seen[aws.StringValue(cacheClusterName)] {
+			continue
+		}
+		redisNodes = append(redisNodes, RedisNode{
+			CacheClusterName: aws.StringValue(cacheClusterName),
+			Role:             RoleUnknown,
+			ReplicationGroup: replicationGroup,
+		})
+	}
+	for i := range redisNodes {
+		if redisNodes[i].CacheNodeId == "" {
+			logger.Info("assuming-cache-node-id", lager.Data{
+				"cache-cluster-id": redisNodes[i].CacheClusterName,
+				"cache-node-id":    defaultCacheNodeId,
+			})
+			redisNodes[i].CacheNodeId = defaultCacheNodeId
+		}
+	}
+	return redisNodes
+}
+
+// isMissingOrRateLimited is true for errors looking up a tenant's replication
+// groups and cache clusters which don't mean ElastiCache is unhealthy
+func isMissingOrRateLimited(err error) bool {
+	return errors.Is(err, store.ErrNotFound) || errors.Is(err, store.ErrLookupRateLimited)
+}
+
+// isNotFoundFault is true if ElastiCache said the item doesn't exist
+func isNotFoundFault(err error, code string) bool {
+	var awsErr awserr.Error
+	return errors.As(err, &awsErr) && awsErr.Code() == code
+}
+
+func getReplicationGroup(name string, elasticacheClient ElastiCacheAPI) (*elasticache.ReplicationGroup, error) {
 	replicationGroupOutput, err := elasticacheClient.DescribeReplicationGroups(&elasticache.DescribeReplicationGroupsInput{
 		ReplicationGroupId: aws.String(name),
 	})
+	if isNotFoundFault(err, elasticache.ErrCodeReplicationGroupNotFoundFault) {
+		return nil, fmt.Errorf("error fetching replication group '%v' from elasticache: %w", name, store.ErrNotFound)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("error fetching replication group '%v' from elasticache: %v", name, err)
 	}
@@ -62,12 +168,3 @@ func getReplicationGroup(name string, elasticacheClient *elasticache.ElastiCache
 	}
 	return replicationGroupOutput.ReplicationGroups[0], nil
 }
-
-func getNodeNumberFromCacheClusterName(name string) *int {
-	segments := strings.Split(name, "-")
-	nodeNumber, err := strconv.Atoi(segments[2])
-	if err != nil {
-		return nil
-	}
-	return &nodeNumber
-}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/metric_endpoint"
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/redis_info"
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/store"
+
+	"code.cloudfoundry.org/lager"
+	paasElasticacheBrokerRedis "github.com/alphagov/paas-elasticache-broker/providers/redis"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/elasticache"
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/onsi/gomega/gstruct"
+)
+
+// fakeElastiCache answers with the replication groups and cache clusters it
+// holds, by ID, one to a page, and counts the calls
+type fakeElastiCache struct {
+	mu                sync.Mutex
+	replicationGroups map[string]*elasticache.ReplicationGroup
+	cacheClusters     map[string]*elasticache.CacheCluster
+	events            []*elasticache.Event
+	calls             map[string]int
+	err               error
+}
+
+func (f *fakeElastiCache) called(method string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.calls == nil {
+		f.calls = map[string]int{}
+	}
+	f.calls[method]++
+	return f.err
+}
+
+func (f *fakeElastiCache) DescribeReplicationGroupsPagesWithContext(
+	ctx aws.Context,
+	input *elasticache.DescribeReplicationGroupsInput,
+	fn func(*elasticache.DescribeReplicationGroupsOutput, bool) bool,
+	opts ...request.Option,
+) error {
+	if err := f.called("DescribeReplicationGroupsPages"); err != nil {
+		return err
+	}
+	names := sortedKeys(f.replicationGroups)
+	for i, name := range names {
+		page := &elasticache.DescribeReplicationGroupsOutput{
+			ReplicationGroups: []*elasticache.ReplicationGroup{f.replicationGroups[name]},
+		}
+		if !fn(page, i == len(names)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func (f *fakeElastiCache) DescribeCacheClustersPagesWithContext(
+	ctx aws.Context,
+	input *elasticache.DescribeCacheClustersInput,
+	fn func(*elasticache.DescribeCacheClustersOutput, bool) bool,
+	opts ...request.Option,
+) error {
+	if err := f.called("DescribeCacheClustersPages"); err != nil {
+		return err
+	}
+	ids := sortedKeys(f.cacheClusters)
+	for i, id := range ids {
+		page := &elasticache.DescribeCacheClustersOutput{
+			CacheClusters: []*elasticache.CacheCluster{f.cacheClusters[id]},
+		}
+		if !fn(page, i == len(ids)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func (f *fakeElastiCache) DescribeEventsPagesWithContext(
+	ctx aws.Context,
+	input *elasticache.DescribeEventsInput,
+	fn func(*elasticache.DescribeEventsOutput, bool) bool,
+	opts ...request.Option,
+) error {
+	if err := f.called("DescribeEventsPages"); err != nil {
+		return err
+	}
+	events := []*elasticache.Event{}
+	for _, event := range f.events {
+		if *event.SourceType == *input.SourceType && !event.Date.Before(*input.StartTime) {
+			events = append(events, event)
+		}
+	}
+	for i, event := range events {
+		page := &elasticache.DescribeEventsOutput{Events: []*elasticache.Event{event}}
+		if !fn(page, i == len(events)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *fakeElastiCache) DescribeReplicationGroups(input *elasticache.DescribeReplicationGroupsInput) (*elasticache.DescribeReplicationGroupsOutput, error) {
+	if err := f.called("DescribeReplicationGroups"); err != nil {
+		return nil, err
+	}
+	replicationGroup, ok := f.replicationGroups[aws.StringValue(input.ReplicationGroupId)]
+	if !ok {
+		return nil, awserr.New(elasticache.ErrCodeReplicationGroupNotFoundFault, "ReplicationGroup "+aws.StringValue(input.ReplicationGroupId)+" not found.", nil)
+	}
+	return &elasticache.DescribeReplicationGroupsOutput{
+		ReplicationGroups: []*elasticache.ReplicationGroup{replicationGroup},
+	}, nil
+}
+
+func (f *fakeElastiCache) DescribeCacheClusters(input *elasticache.DescribeCacheClustersInput) (*elasticache.DescribeCacheClustersOutput, error) {
+	if err := f.called("DescribeCacheClusters"); err != nil {
+		return nil, err
+	}
+	cacheCluster, ok := f.cacheClusters[aws.StringValue(input.CacheClusterId)]
+	if !ok {
+		return nil, awserr.New(elasticache.ErrCodeCacheClusterNotFoundFault, "CacheCluster "+aws.StringValue(input.CacheClusterId)+" not found.", nil)
+	}
+	return &elasticache.DescribeCacheClustersOutput{
+		CacheClusters: []*elasticache.CacheCluster{cacheCluster},
+	}, nil
+}
+
+func nodeGroupMember(cacheClusterId, role, availabilityZone string) *elasticache.NodeGroupMember {
+	member := &elasticache.NodeGroupMember{
+		CacheClusterId:            aws.String(cacheClusterId),
+		CacheNodeId:               aws.String("0001"),
+		PreferredAvailabilityZone: aws.String(availabilityZone),
+	}
+	if role != "" {
+		member.CurrentRole = aws.String(role)
+	}
+	return member
+}
+
+// clusterModeDisabledReplicationGroup is a primary and a replica, in the one
+// node group ElastiCache gives cluster mode disabled replication groups
+func clusterModeDisabledReplicationGroup(name string) *elasticache.ReplicationGroup {
+	return &elasticache.ReplicationGroup{
+		ReplicationGroupId: aws.String(name),
+		ClusterEnabled:     aws.Bool(false),
+		MemberClusters:     aws.StringSlice([]string{name + "-001", name + "-002"}),
+		NodeGroups: []*elasticache.NodeGroup{
+			{
+				NodeGroupId: aws.String("0001"),
+				NodeGroupMembers: []*elasticache.NodeGroupMember{
+					nodeGroupMember(name+"-001", "primary", "eu-west-2a"),
+					nodeGroupMember(name+"-002", "replica", "eu-west-2b"),
+				},
+			},
+		},
+	}
+}
+
+// clusterModeEnabledReplicationGroup has two shards of two nodes. ElastiCache
+// gives the roles of the first shard's members but not the second's.
+func clusterModeEnabledReplicationGroup(name string) *elasticache.ReplicationGroup {
+	return &elasticache.ReplicationGroup{
+		ReplicationGroupId: aws.String(name),
+		ClusterEnabled:     aws.Bool(true),
+		MemberClusters: aws.StringSlice([]string{
+			name + "-0001-001", name + "-0001-002", name + "-0002-001", name + "-0002-002",
+		}),
+		NodeGroups: []*elasticache.NodeGroup{
+			{
+				NodeGroupId: aws.String("0001"),
+				NodeGroupMembers: []*elasticache.NodeGroupMember{
+					nodeGroupMember(name+"-0001-001", "replica", "eu-west-2a"),
+					nodeGroupMember(name+"-0001-002", "primary", "eu-west-2b"),
+				},
+			},
+			{
+				NodeGroupId: aws.String("0002"),
+				NodeGroupMembers: []*elasticache.NodeGroupMember{
+					nodeGroupMember(name+"-0002-001", "", "eu-west-2b"),
+					nodeGroupMember(name+"-0002-002", "", "eu-west-2c"),
+				},
+			},
+		},
+	}
+}
+
+var _ = Describe("ListRedisNodes", func() {
+	var elasticacheClient *fakeElastiCache
+	var replicationGroups *ReplicationGroupsFetcher
+	var spacesByGuid map[string]cfclient.Space
+	var orgsByGuid map[string]cfclient.Org
+	// The broker names replication groups after a hash of the instance GUID
+	disabledName := paasElasticacheBrokerRedis.GenerateReplicationGroupName("instance-1")
+	enabledName := paasElasticacheBrokerRedis.GenerateReplicationGroupName("instance-2")
+
+	BeforeEach(func() {
+		elasticacheClient = &fakeElastiCache{replicationGroups: map[string]*elasticache.ReplicationGroup{
+			disabledName: clusterModeDisabledReplicationGroup(disabledName),
+			enabledName:  clusterModeEnabledReplicationGroup(enabledName),
+		}}
+		replicationGroups = NewReplicationGroupsFetcher(store.Options{Schedule: time.Minute}, lager.NewLogger("elasticache-test"), elasticacheClient)
+		spacesByGuid = map[string]cfclient.Space{"space-guid": {Guid: "space-guid", Name: "space", OrganizationGuid: "org-guid"}}
+		orgsByGuid = map[string]cfclient.Org{"org-guid": {Guid: "org-guid", Name: "org"}}
+	})
+
+	instance := func(guid string) cfclient.ServiceInstance {
+		return cfclient.ServiceInstance{Guid: guid, Name: guid + "-name", SpaceGuid: "space-guid"}
+	}
+
+	It("finds the primary and replica of a cluster mode disabled replication group", func() {
+		nodes, err := ListRedisNodes(
+			[]cfclient.ServiceInstance{instance("instance-1")},
+			spacesByGuid, orgsByGuid, replicationGroups, lager.NewLogger("elasticache-test"),
+		)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(nodes).To(MatchAllKeys(Keys{
+			disabledName + "-001": MatchFields(IgnoreExtras, Fields{
+				"CacheNodeId":      Equal("0001"),
+				"Shard":            Equal("0001"),
+				"Role":             Equal(RolePrimary),
+				"AvailabilityZone": Equal("eu-west-2a"),
+				"ServiceInstance":  MatchFields(IgnoreExtras, Fields{"Guid": Equal("instance-1")}),
+				"Organisation":     MatchFields(IgnoreExtras, Fields{"Name": Equal("org")}),
+			}),
+			disabledName + "-002": MatchFields(IgnoreExtras, Fields{
+				"Shard":            Equal("0001"),
+				"Role":             Equal(RoleReplica),
+				"AvailabilityZone": Equal("eu-west-2b"),
+			}),
+		}))
+	})
+
+	It("finds every node in every shard of a cluster mode enabled replication group, with their roles if ElastiCache gives them", func() {
+		nodes, err := ListRedisNodes(
+			[]cfclient.ServiceInstance{instance("instance-2")},
+			spacesByGuid, orgsByGuid, replicationGroups, lager.NewLogger("elasticache-test"),
+		)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(nodes).To(MatchAllKeys(Keys{
+			enabledName + "-0001-001": MatchFields(IgnoreExtras, Fields{"Shard": Equal("0001"), "Role": Equal(RoleReplica)}),
+			enabledName + "-0001-002": MatchFields(IgnoreExtras, Fields{"Shard": Equal("0001"), "Role": Equal(RolePrimary), "AvailabilityZone": Equal("eu-west-2b")}),
+			enabledName + "-0002-001": MatchFields(IgnoreExtras, Fields{"Shard": Equal("0002"), "Role": Equal(RoleUnknown)}),
+			enabledName + "-0002-002": MatchFields(IgnoreExtras, Fields{"Shard": Equal("0002"), "Role": Equal(RoleUnknown), "AvailabilityZone": Equal("eu-west-2c")}),
+		}))
+
+		labels := map[string]string{}
+		for _, label := range nodeLabels(nodes[enabledName+"-0001-002"]) {
+			labels[label.GetName()] = label.GetValue()
+		}
+		Expect(labels).To(MatchKeys(IgnoreExtras, Keys{
+			"shard":   Equal("0001"),
+			"node_id": Equal(enabledName + "-0001-002"),
+			"role":    Equal("primary"),
+		}))
+	})
+
+	It("still lists members which are not in a shard yet, and says it is assuming their cache node ID", func() {
+		replicationGroup := elasticacheClient.replicationGroups[disabledName]
+		replicationGroup.MemberClusters = append(replicationGroup.MemberClusters, aws.String(disabledName+"-003"))
+
+		output := &bytes.Buffer{}
+		logger := lager.NewLogger("elasticache-test")
+		logger.RegisterSink(lager.NewWriterSink(output, lager.INFO))
+		nodes, err := ListRedisNodes(
+			[]cfclient.ServiceInstance{instance("instance-1")},
+			spacesByGuid, orgsByGuid, replicationGroups, logger,
+		)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(output.String()).To(ContainSubstring("assuming-cache-node-id"))
+		Expect(output.String()).To(ContainSubstring(disabledName + "-003"))
+		Expect(nodes).To(HaveLen(3))
+		Expect(nodes[disabledName+"-003"]).To(MatchFields(IgnoreExtras, Fields{
+			"CacheNodeId": Equal("0001"),
+			"Shard":       Equal(""),
+			"Role":        Equal(RoleUnknown),
+		}))
+	})
+
+	It("leaves out instances whose replication groups don't exist", func() {
+		nodes, err := ListRedisNodes(
+			[]cfclient.ServiceInstance{instance("missing"), instance("instance-1")},
+			spacesByGuid, orgsByGuid, replicationGroups, lager.NewLogger("elasticache-test"),
+		)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(nodes).To(HaveLen(2))
+	})
+
+	It("fails if ElastiCache can't be asked about a replication group", func() {
+		elasticacheClient.err = fmt.Errorf("ServiceUnavailable")
+		_, err := ListRedisNodes(
+			[]cfclient.ServiceInstance{instance("instance-1")},
+			spacesByGuid, orgsByGuid, replicationGroups, lager.NewLogger("elasticache-test"),
+		)
+		Expect(err).To(MatchError(ContainSubstring("ServiceUnavailable")))
+		Expect(isMissingOrRateLimited(err)).To(BeFalse())
+	})
+})
+
+var _ = Describe("nodeLabels", func() {
+	It("says which shard, node, role and availability zone a metric is for", func() {
+		labels := map[string]string{}
+		for _, label := range nodeLabels(testNode("cf-abc-0002-001", "abc")) {
+			labels[label.GetName()] = label.GetValue()
+		}
+		Expect(labels).To(MatchKeys(IgnoreExtras, Keys{
+			"shard":             Equal("0001"),
+			"node_id":           Equal("cf-abc-0002-001"),
+			"role":              Equal("primary"),
+			"availability_zone": Equal("eu-west-2a"),
+		}))
+	})
+
+	It("keeps the deprecated node label", func() {
+		labels := map[string]string{}
+		for _, label := range nodeLabels(testNode("cf-abc-002", "abc")) {
+			labels[label.GetName()] = label.GetValue()
+		}
+		Expect(labels).To(HaveKeyWithValue("node", "2"))
+		Expect(labels).To(HaveKeyWithValue("node_id", "cf-abc-002"))
+	})
+})
+
+var _ = Describe("addSample", func() {
+	It("doesn't repeat a label the sample has too", func() {
+		promMetrics := metric_endpoint.Metrics{}
+		addSample(promMetrics, testNode("cf-abc-0001-001", "abc"), redis_info.Sample{
+			Name:   "replication_role",
+			Labels: map[string]string{"role": "master"},
+			Value:  1,
+		}, 0)
+
+		roles := []string{}
+		for _, label := range promMetrics["replication_role"].Metric[0].Label {
+			if label.GetName() == "role" {
+				roles = append(roles, label.GetValue())
+			}
+		}
+		Expect(roles).To(Equal([]string{"master"}))
+	})
+})
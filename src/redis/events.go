@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/metric_endpoint"
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/store"
+
+	"code.cloudfoundry.org/lager"
+	paasElasticacheBrokerRedis "github.com/alphagov/paas-elasticache-broker/providers/redis"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elasticache"
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	// eventWindow is how far back the events are counted, which is as far back
+	// as ElastiCache keeps them. Every instance of the app asks ElastiCache for
+	// the same window, so they all count the same events.
+	eventWindow = 14 * 24 * time.Hour
+	// eventOverlap is how far before the last refresh each refresh asks for
+	// events from, in case ElastiCache was slow to list some
+	eventOverlap = 15 * time.Minute
+	// failoverWindow is how long the events of one failover go on for. A
+	// failover is listed by the replication group and by its cache clusters,
+	// and the old primary recovers after it, so the failover and reboot
+	// events which follow a failover within the window are not counted again.
+	failoverWindow = 10 * time.Minute
+)
+
+const (
+	EventCategoryFailover    = "failover"
+	EventCategoryReboot      = "reboot"
+	EventCategoryMaintenance = "maintenance"
+	EventCategoryScaling     = "scaling"
+	EventCategorySnapshot    = "snapshot"
+	EventCategoryOther       = "other"
+)
+
+// eventCategories classify events by the words in their messages. The first
+// category with a matching word wins.
+var eventCategories = []struct {
+	category string
+	words    []string
+}{
+	{EventCategoryFailover, []string{"failover", "failed over", "promot"}},
+	{EventCategorySnapshot, []string{"snapshot", "backup"}},
+	{EventCategoryScaling, []string{"scal", "reshard", "added cache node", "removed cache node", "node type", "replica count", "shard"}},
+	{EventCategoryMaintenance, []string{"maintenance", "replace", "upgrad", "update", "patch", "engine version"}},
+	{EventCategoryReboot, []string{"reboot", "restart", "recover", "shutdown"}},
+}
+
+// cacheClusterSuffixRegexp matches what the broker's cache cluster names add
+// to the replication group name, like -002 or -0001-002
+var cacheClusterSuffixRegexp = regexp.MustCompile(`(-[0-9]+)+$`)
+
+// shardRegexp finds the shard an event is about, in the name of a cache
+// cluster of a cluster mode enabled replication group, like -0002-001, or in
+// a message about a node group
+var shardRegexp = regexp.MustCompile(`(?i)(?:-|node group )([0-9]{4})(?:-[0-9]{3})?\b`)
+
+// EventCount is how many events of a category a replication group has had
+// in the window, and when the last one was
+type EventCount struct {
+	Count       uint64    `json:"count"`
+	LastEventAt time.Time `json:"last_event_at"`
+}
+
+// windowEvent is what is kept of an event while it is in the window
+type windowEvent struct {
+	ReplicationGroupId string `json:"replication_group_id"`
+	// Shard is empty if the event doesn't say which shard it is about
+	Shard    string    `json:"shard,omitempty"`
+	Category string    `json:"category"`
+	Date     time.Time `json:"date"`
+}
+
+// ElastiCacheEvents counts the events of each replication group in the last
+// eventWindow by category. It must not be modified once it has been stored.
+type ElastiCacheEvents struct {
+	// Counts are worked out again from Events on every refresh
+	Counts map[string]map[string]EventCount `json:"counts"`
+	// Failovers are when the last failover event of each replication group
+	// was, by shard, and under "" for events which don't say which shard.
+	// They are worked out again from Events on every refresh.
+	Failovers map[string]map[string]time.Time `json:"failovers"`
+	// Events are the events in the window by eventKey, so that each is only
+	// counted once
+	Events map[string]windowEvent `json:"events"`
+}
+
+// EventSource gets the latest event counts, and false if there are none yet
+type EventSource interface {
+	Get() (ElastiCacheEvents, bool)
+}
+
+// ElastiCacheEventsFetcher asks ElastiCache for the events of replication
+// groups and cache clusters in the background and counts the ones in the last
+// eventWindow. The first refresh asks for the whole window and later
+// refreshes only ask for new events.
+type ElastiCacheEventsFetcher struct {
+	*store.Store[ElastiCacheEvents]
+	elasticacheClient ElastiCacheAPI
+	logger            lager.Logger
+	now               func() time.Time
+}
+
+func NewElastiCacheEventsFetcher(
+	storeOptions store.Options,
+	logger lager.Logger,
+	elasticacheClient ElastiCacheAPI,
+) *ElastiCacheEventsFetcher {
+	logger = logger.Session("elasticache-events-fetcher")
+	fetcher := &ElastiCacheEventsFetcher{
+		elasticacheClient: elasticacheClient,
+		logger:            logger,
+		now:               time.Now,
+	}
+	storeOptions.Name = "elasticache-events"
+	fetcher.Store = store.NewIncremental(fetcher.fetchAllEvents, fetcher.fetchNewEvents, storeOptions, logger)
+	return fetcher
+}
+
+// SetClock replaces the source of the current time, for testing
+func (fetcher *ElastiCacheEventsFetcher) SetClock(now func() time.Time) {
+	fetcher.now = now
+}
+
+func (fetcher *ElastiCacheEventsFetcher) fetchAllEvents(ctx context.Context) (ElastiCacheEvents, error) {
+	now := fetcher.now()
+	current, _ := fetcher.Get()
+	return fetcher.fetchEvents(ctx, current, now.Add(-eventWindow), now)
+}
+
+func (fetcher *ElastiCacheEventsFetcher) fetchNewEvents(
+	ctx context.Context,
+	previous store.Snapshot[ElastiCacheEvents],
+) (ElastiCacheEvents, error) {
+	now := fetcher.now()
+	startTime := previous.StartedAt.Add(-eventOverlap)
+	if startTime.Before(now.Add(-eventWindow)) {
+		startTime = now.Add(-eventWindow)
+	}
+	return fetcher.fetchEvents(ctx, previous.Value, startTime, now)
+}
+
+// fetchEvents adds the events since startTime to a copy of the events in the
+// window, drops the ones which have left it and counts them again
+func (fetcher *ElastiCacheEventsFetcher) fetchEvents(
+	ctx context.Context,
+	previous ElastiCacheEvents,
+	startTime time.Time,
+	now time.Time,
+) (ElastiCacheEvents, error) {
+	events := previous.copy()
+	for key, event := range events.Events {
+		if event.Date.Before(now.Add(-eventWindow)) {
+			delete(events.Events, key)
+		}
+	}
+
+	newEvents := 0
+	for _, sourceType := range []string{elasticache.SourceTypeReplicationGroup, elasticache.SourceTypeCacheCluster} {
+		err := fetcher.elasticacheClient.DescribeEventsPagesWithContext(
+			ctx,
+			&elasticache.DescribeEventsInput{
+				SourceType: aws.String(sourceType),
+				StartTime:  aws.Time(startTime),
+			},
+			func(page *elasticache.DescribeEventsOutput, lastPage bool) bool {
+				for _, event := range page.Events {
+					key := eventKey(event)
+					if _, ok := events.Events[key]; !ok && !aws.TimeValue(event.Date).Before(now.Add(-eventWindow)) {
+						events.Events[key] = newWindowEvent(event)
+						newEvents++
+					}
+				}
+				return true
+			},
+		)
+		if err != nil {
+			return ElastiCacheEvents{}, fmt.Errorf("error fetching %s events from elasticache: %v", sourceType, err)
+		}
+	}
+
+	events.Counts = countEvents(events.Events)
+	events.Failovers = lastFailovers(events.Events)
+
+	fetcher.logger.Info("updated-events", lager.Data{
+		"number-of-new-events":       newEvents,
+		"number-of-events-in-window": len(events.Events),
+		"start-time":                 startTime.String(),
+	})
+	return events, nil
+}
+
+func newWindowEvent(event *elasticache.Event) windowEvent {
+	replicationGroupId := aws.StringValue(event.SourceIdentifier)
+	if aws.StringValue(event.SourceType) == elasticache.SourceTypeCacheCluster {
+		replicationGroupId = cacheClusterSuffixRegexp.ReplaceAllString(replicationGroupId, "")
+	}
+	shard := ""
+	for _, text := range []string{aws.StringValue(event.SourceIdentifier), aws.StringValue(event.Message)} {
+		if match := shardRegexp.FindStringSubmatch(strings.TrimPrefix(text, replicationGroupId)); match != nil {
+			shard = match[1]
+			break
+		}
+	}
+	return windowEvent{
+		ReplicationGroupId: replicationGroupId,
+		Shard:              shard,
+		Category:           classifyEvent(aws.StringValue(event.Message)),
+		Date:               aws.TimeValue(event.Date),
+	}
+}
+
+// countEvents counts the events by replication group and category, leaving
+// out the ones which are part of a failover which has been counted already.
+// Failovers are recognised by the events which start them, so the events are
+// counted in the order they happened.
+func countEvents(events map[string]windowEvent) map[string]map[string]EventCount {
+	keys := make([]string, 0, len(events))
+	for key := range events {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := events[keys[i]], events[keys[j]]
+		if !a.Date.Equal(b.Date) {
+			return a.Date.Before(b.Date)
+		}
+		return keys[i] < keys[j]
+	})
+
+	counts := map[string]map[string]EventCount{}
+	for _, key := range keys {
+		event := events[key]
+		groupCounts, ok := counts[event.ReplicationGroupId]
+		if !ok {
+			groupCounts = map[string]EventCount{}
+			counts[event.ReplicationGroupId] = groupCounts
+		}
+		if event.Category == EventCategoryFailover || event.Category == EventCategoryReboot {
+			lastFailoverAt := groupCounts[EventCategoryFailover].LastEventAt
+			if !lastFailoverAt.IsZero() && event.Date.Sub(lastFailoverAt) < failoverWindow {
+				continue
+			}
+		}
+		count := groupCounts[event.Category]
+		count.Count++
+		count.LastEventAt = event.Date
+		groupCounts[event.Category] = count
+	}
+	return counts
+}
+
+func eventKey(event *elasticache.Event) string {
+	return strings.Join([]string{
+		aws.StringValue(event.SourceType),
+		aws.StringValue(event.SourceIdentifier),
+		aws.TimeValue(event.Date).UTC().Format(time.RFC3339Nano),
+		aws.StringValue(event.Message),
+	}, "|")
+}
+
+func classifyEvent(message string) string {
+	message = strings.ToLower(message)
+	for _, c := range eventCategories {
+		for _, word := range c.words {
+			if strings.Contains(message, word) {
+				return c.category
+			}
+		}
+	}
+	return EventCategoryOther
+}
+
+// lastFailovers finds when the last failover event of each replication group
+// was, by shard
+func lastFailovers(events map[string]windowEvent) map[string]map[string]time.Time {
+	failovers := map[string]map[string]time.Time{}
+	for _, event := range events {
+		if event.Category != EventCategoryFailover {
+			continue
+		}
+		shards, ok := failovers[event.ReplicationGroupId]
+		if !ok {
+			shards = map[string]time.Time{}
+			failovers[event.ReplicationGroupId] = shards
+		}
+		if event.Date.After(shards[event.Shard]) {
+			shards[event.Shard] = event.Date
+		}
+	}
+	return failovers
+}
+
+// LastFailoverAt is when the last failover event about the shard of the
+// replication group was, including events which don't say which shard
+// they are about. It is zero if there were none in the window.
+func (e ElastiCacheEvents) LastFailoverAt(replicationGroupId string, shard string) time.Time {
+	shards := e.Failovers[replicationGroupId]
+	at := shards[shard]
+	if shards[""].After(at) {
+		at = shards[""]
+	}
+	return at
+}
+
+// copy copies the events in the window. The counts are worked out again.
+func (e ElastiCacheEvents) copy() ElastiCacheEvents {
+	copied := ElastiCacheEvents{
+		Events: make(map[string]windowEvent, len(e.Events)),
+	}
+	for key, event := range e.Events {
+		copied.Events[key] = event
+	}
+	return copied
+}
+
+// addEventMetrics exports the event counts of each service instance, by
+// the replication group name the broker gave it. Every category is exported
+// for every instance, so that there is a 0 before the first event. The counts
+// are gauges rather than counters, since events leave the window.
+func addEventMetrics(
+	promMetrics metric_endpoint.Metrics,
+	serviceInstances []cfclient.ServiceInstance,
+	spacesByGuid map[string]cfclient.Space,
+	orgsByGuid map[string]cfclient.Org,
+	eventSource EventSource,
+) {
+	events, ok := eventSource.Get()
+	if !ok {
+		return
+	}
+
+	recentEvents := &dto.MetricFamily{
+		Name:   derefS("paas_redis_recent_events"),
+		Help:   derefS("Number of ElastiCache events about the service instance in the last 14 days, by category"),
+		Type:   derefT(dto.MetricType_GAUGE),
+		Metric: []*dto.Metric{},
+	}
+	lastEvent := &dto.MetricFamily{
+		Name:   derefS("paas_redis_last_event_timestamp_seconds"),
+		Help:   derefS("When the last ElastiCache event of the category about the service instance in the last 14 days happened"),
+		Type:   derefT(dto.MetricType_GAUGE),
+		Metric: []*dto.Metric{},
+	}
+
+	sortedInstances := append([]cfclient.ServiceInstance{}, serviceInstances...)
+	sort.Slice(sortedInstances, func(i, j int) bool { return sortedInstances[i].Guid < sortedInstances[j].Guid })
+	for _, serviceInstance := range sortedInstances {
+		space := spacesByGuid[serviceInstance.SpaceGuid]
+		labels := instanceLabels(serviceInstance, space, orgsByGuid[space.OrganizationGuid])
+		counts := events.Counts[paasElasticacheBrokerRedis.GenerateReplicationGroupName(serviceInstance.Guid)]
+		for _, category := range eventCategoryNames() {
+			count := counts[category]
+			categoryLabels := append(append([]*dto.LabelPair{}, labels...), &dto.LabelPair{
+				Name:  derefS("category"),
+				Value: derefS(category),
+			})
+			recentEvents.Metric = append(recentEvents.Metric, &dto.Metric{
+				Label: categoryLabels,
+				Gauge: &dto.Gauge{Value: aws.Float64(float64(count.Count))},
+			})
+			if !count.LastEventAt.IsZero() {
+				lastEvent.Metric = append(lastEvent.Metric, &dto.Metric{
+					Label: categoryLabels,
+					Gauge: &dto.Gauge{Value: aws.Float64(float64(count.LastEventAt.UnixNano()) / 1e9)},
+				})
+			}
+		}
+	}
+
+	if len(recentEvents.Metric) > 0 {
+		promMetrics[*recentEvents.Name] = recentEvents
+	}
+	if len(lastEvent.Metric) > 0 {
+		promMetrics[*lastEvent.Name] = lastEvent
+	}
+}
+
+func eventCategoryNames() []string {
+	names := []string{}
+	for _, c := range eventCategories {
+		names = append(names, c.category)
+	}
+	return append(names, EventCategoryOther)
+}
+
+var _ EventSource = (*ElastiCacheEventsFetcher)(nil)
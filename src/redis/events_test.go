@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/metric_endpoint"
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/store"
+
+	"code.cloudfoundry.org/lager"
+	paasElasticacheBrokerRedis "github.com/alphagov/paas-elasticache-broker/providers/redis"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elasticache"
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func testEvent(sourceType, sourceIdentifier, message string, date time.Time) *elasticache.Event {
+	return &elasticache.Event{
+		SourceType:       aws.String(sourceType),
+		SourceIdentifier: aws.String(sourceIdentifier),
+		Message:          aws.String(message),
+		Date:             aws.Time(date),
+	}
+}
+
+var _ = Describe("classifyEvent", func() {
+	It("sorts events into categories by their messages", func() {
+		Expect(classifyEvent("Failover from master node cf-abc-001 to replica node cf-abc-002 completed")).To(Equal(EventCategoryFailover))
+		Expect(classifyEvent("Cache node 0001 restarted")).To(Equal(EventCategoryReboot))
+		Expect(classifyEvent("Recovering cache nodes 0001")).To(Equal(EventCategoryReboot))
+		Expect(classifyEvent("Cache node 0001 replaced")).To(Equal(EventCategoryMaintenance))
+		Expect(classifyEvent("Service software update completed")).To(Equal(EventCategoryMaintenance))
+		Expect(classifyEvent("Scaling of replication group cf-abc completed")).To(Equal(EventCategoryScaling))
+		Expect(classifyEvent("Added cache node 0002 in availability zone eu-west-2b")).To(Equal(EventCategoryScaling))
+		Expect(classifyEvent("Automatic snapshot succeeded for cf-abc-001")).To(Equal(EventCategorySnapshot))
+		Expect(classifyEvent("Replication group cf-abc created")).To(Equal(EventCategoryOther))
+	})
+})
+
+var _ = Describe("ElastiCacheEventsFetcher", func() {
+	var (
+		elasticacheClient *fakeElastiCache
+		storeOptions      store.Options
+		fetcher           *ElastiCacheEventsFetcher
+		groupOne          string
+		groupTwo          string
+		now               time.Time
+	)
+
+	BeforeEach(func() {
+		groupOne = paasElasticacheBrokerRedis.GenerateReplicationGroupName("instance-1")
+		groupTwo = paasElasticacheBrokerRedis.GenerateReplicationGroupName("instance-2")
+		now = time.Now()
+		elasticacheClient = &fakeElastiCache{events: []*elasticache.Event{
+			testEvent(elasticache.SourceTypeReplicationGroup, groupOne, "Failover to replica node "+groupOne+"-002 completed", now.Add(-time.Hour)),
+			testEvent(elasticache.SourceTypeCacheCluster, groupOne+"-002", "Cache node 0001 restarted", now.Add(-30*time.Minute)),
+			testEvent(elasticache.SourceTypeCacheCluster, groupOne+"-001", "Cache node 0001 restarted", now.Add(-20*time.Minute)),
+			testEvent(elasticache.SourceTypeCacheCluster, groupTwo+"-0001-001", "Automatic snapshot succeeded", now.Add(-10*time.Minute)),
+		}}
+		storeOptions = store.Options{Schedule: time.Minute, CacheDir: GinkgoT().TempDir()}
+		fetcher = NewElastiCacheEventsFetcher(storeOptions, lager.NewLogger("test"), elasticacheClient)
+	})
+
+	It("counts the events of replication groups and their cache clusters by category", func() {
+		Expect(fetcher.Refresh(context.Background())).To(Succeed())
+
+		events, ok := fetcher.Get()
+		Expect(ok).To(BeTrue())
+		Expect(events.Counts[groupOne]).To(Equal(map[string]EventCount{
+			EventCategoryFailover: {Count: 1, LastEventAt: now.Add(-time.Hour)},
+			EventCategoryReboot:   {Count: 2, LastEventAt: now.Add(-20 * time.Minute)},
+		}))
+		Expect(events.Counts[groupTwo]).To(Equal(map[string]EventCount{
+			EventCategorySnapshot: {Count: 1, LastEventAt: now.Add(-10 * time.Minute)},
+		}))
+	})
+
+	It("only counts each event once", func() {
+		Expect(fetcher.Refresh(context.Background())).To(Succeed())
+		elasticacheClient.events = append(elasticacheClient.events,
+			testEvent(elasticache.SourceTypeReplicationGroup, groupOne, "Failover to replica node "+groupOne+"-001 completed", now),
+		)
+		Expect(fetcher.Refresh(context.Background())).To(Succeed())
+
+		events, _ := fetcher.Get()
+		Expect(events.Counts[groupOne][EventCategoryFailover]).To(Equal(EventCount{Count: 2, LastEventAt: now}))
+		Expect(events.Counts[groupOne][EventCategoryReboot].Count).To(Equal(uint64(2)))
+	})
+
+	It("counts a failover once, however many events it causes", func() {
+		failoverAt := now.Add(-5 * time.Minute)
+		elasticacheClient.events = []*elasticache.Event{
+			testEvent(elasticache.SourceTypeReplicationGroup, groupOne, "Test Failover API called for node group 0001", failoverAt),
+			testEvent(elasticache.SourceTypeCacheCluster, groupOne+"-002", "Promoting cache cluster "+groupOne+"-002 to primary role", failoverAt.Add(20*time.Second)),
+			testEvent(elasticache.SourceTypeReplicationGroup, groupOne, "Failover from primary node "+groupOne+"-001 to replica node "+groupOne+"-002 completed", failoverAt.Add(40*time.Second)),
+			testEvent(elasticache.SourceTypeCacheCluster, groupOne+"-001", "Recovering cache nodes 0001", failoverAt.Add(time.Minute)),
+			testEvent(elasticache.SourceTypeCacheCluster, groupOne+"-001", "Finished recovery for cache nodes 0001", failoverAt.Add(3*time.Minute)),
+			testEvent(elasticache.SourceTypeCacheCluster, groupTwo+"-001", "Cache node 0001 restarted", failoverAt.Add(time.Minute)),
+		}
+		Expect(fetcher.Refresh(context.Background())).To(Succeed())
+
+		elasticacheClient.events = append(elasticacheClient.events,
+			testEvent(elasticache.SourceTypeCacheCluster, groupOne+"-001", "Cache node 0001 restarted", now.Add(10*time.Minute)),
+		)
+		Expect(fetcher.Refresh(context.Background())).To(Succeed())
+
+		events, _ := fetcher.Get()
+		Expect(events.Counts[groupOne]).To(Equal(map[string]EventCount{
+			EventCategoryFailover: {Count: 1, LastEventAt: failoverAt},
+			EventCategoryReboot:   {Count: 1, LastEventAt: now.Add(10 * time.Minute)},
+		}))
+		Expect(events.Counts[groupTwo][EventCategoryReboot].Count).To(Equal(uint64(1)))
+	})
+
+	It("counts the same events however long it has been running", func() {
+		clock := now
+		fetcher.SetClock(func() time.Time { return clock })
+		Expect(fetcher.Refresh(context.Background())).To(Succeed())
+
+		clock = now.Add(eventWindow - 45*time.Minute)
+		elasticacheClient.events = append(elasticacheClient.events,
+			testEvent(elasticache.SourceTypeReplicationGroup, groupOne, "Failover to replica node "+groupOne+"-001 completed", clock.Add(-time.Minute)),
+		)
+		Expect(fetcher.Refresh(context.Background())).To(Succeed())
+
+		started := NewElastiCacheEventsFetcher(store.Options{Schedule: time.Minute}, lager.NewLogger("test"), elasticacheClient)
+		started.SetClock(func() time.Time { return clock })
+		Expect(started.Refresh(context.Background())).To(Succeed())
+
+		events, _ := fetcher.Get()
+		startedEvents, _ := started.Get()
+		Expect(events.Counts).To(Equal(startedEvents.Counts))
+		Expect(events.Counts[groupOne]).To(Equal(map[string]EventCount{
+			EventCategoryFailover: {Count: 1, LastEventAt: clock.Add(-time.Minute)},
+			EventCategoryReboot:   {Count: 2, LastEventAt: now.Add(-20 * time.Minute)},
+		}))
+		Expect(events.Counts[groupTwo]).To(Equal(map[string]EventCount{
+			EventCategorySnapshot: {Count: 1, LastEventAt: now.Add(-10 * time.Minute)},
+		}))
+	})
+
+	It("carries on from the events saved to disk", func() {
+		Expect(fetcher.Refresh(context.Background())).To(Succeed())
+
+		restarted := NewElastiCacheEventsFetcher(storeOptions, lager.NewLogger("test"), elasticacheClient)
+		Expect(restarted.Restore()).To(BeTrue())
+		Expect(restarted.Refresh(context.Background())).To(Succeed())
+
+		events, _ := restarted.Get()
+		Expect(events.Counts[groupOne][EventCategoryReboot].Count).To(Equal(uint64(2)))
+	})
+
+	It("exports the counts of each visible service instance", func() {
+		Expect(fetcher.Refresh(context.Background())).To(Succeed())
+		serviceInstances := []cfclient.ServiceInstance{{Guid: "instance-1", Name: "my-redis", SpaceGuid: "space-guid"}}
+		spacesByGuid := map[string]cfclient.Space{"space-guid": {Guid: "space-guid", OrganizationGuid: "org-guid"}}
+		orgsByGuid := map[string]cfclient.Org{"org-guid": {Guid: "org-guid"}}
+
+		promMetrics := metric_endpoint.Metrics{}
+		addEventMetrics(promMetrics, serviceInstances, spacesByGuid, orgsByGuid, fetcher)
+
+		counts := map[string]float64{}
+		for _, metric := range promMetrics["paas_redis_recent_events"].Metric {
+			labels := map[string]string{}
+			for _, label := range metric.Label {
+				labels[label.GetName()] = label.GetValue()
+			}
+			Expect(labels).To(HaveKeyWithValue("service_instance_name", "my-redis"))
+			counts[labels["category"]] = metric.GetGauge().GetValue()
+		}
+		Expect(counts).To(Equal(map[string]float64{
+			EventCategoryFailover:    1,
+			EventCategoryReboot:      2,
+			EventCategoryMaintenance: 0,
+			EventCategoryScaling:     0,
+			EventCategorySnapshot:    0,
+			EventCategoryOther:       0,
+		}))
+
+		lastEvent := promMetrics["paas_redis_last_event_timestamp_seconds"].Metric
+		Expect(lastEvent).To(HaveLen(2))
+		Expect(lastEvent[0].GetGauge().GetValue()).To(BeNumerically("~", float64(now.Add(-time.Hour).Unix()), 1))
+	})
+
+	It("exports nothing until the events have been fetched", func() {
+		promMetrics := metric_endpoint.Metrics{}
+		addEventMetrics(promMetrics, []cfclient.ServiceInstance{{Guid: "instance-1"}}, nil, nil, fetcher)
+		Expect(promMetrics).To(BeEmpty())
+	})
+})
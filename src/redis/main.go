@@ -2,24 +2,38 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/alphagov/paas-prometheus-endpoints/pkg/authenticator"
 	"github.com/alphagov/paas-prometheus-endpoints/pkg/config"
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/cost_budget"
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/health"
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/instance_index"
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/internal_metrics"
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/logging"
 	"github.com/alphagov/paas-prometheus-endpoints/pkg/metric_endpoint"
 	"github.com/alphagov/paas-prometheus-endpoints/pkg/orgs_fetcher"
 	"github.com/alphagov/paas-prometheus-endpoints/pkg/service_plans_fetcher"
 	"github.com/alphagov/paas-prometheus-endpoints/pkg/spaces_fetcher"
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/store"
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/tls_config"
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/topology"
 
+	"code.cloudfoundry.org/lager"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
 	"github.com/aws/aws-sdk-go/service/elasticache"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
 	cfclient "github.com/cloudfoundry-community/go-cfclient"
 	"github.com/gin-gonic/gin"
 )
@@ -35,7 +49,35 @@ func main() {
 	}()
 	var wg sync.WaitGroup
 
-	cfg := config.NewConfigFromEnv("redis")
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML or JSON config file")
+	checkConfig := flag.Bool("check-config", false, "check the configuration, report any problems and exit")
+	flag.Parse()
+
+	// The metrics are checked against the catalogue, which the config says
+	// where to find
+	cfg, err := config.Load(*configPath, "redis", nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	catalogue, err := LoadMetricCatalogue(cfg.RedisMetricCatalogueFile)
+	if err == nil {
+		err = catalogue.Select(cfg.Metrics)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	cfg.Logger.Info("loaded-config", lager.Data{
+		"setting-origins": cfg.SettingOrigins(),
+	})
+	if *checkConfig {
+		fmt.Println("configuration is valid")
+		os.Exit(0)
+	}
+
+	reloader := config.NewReloader(*configPath, "redis", catalogue.Names(), cfg)
+	go reloader.Run(ctx)
 
 	cfClient, err := cfclient.NewClient(cfg.CFClientConfig)
 	if err != nil {
@@ -46,71 +88,352 @@ func main() {
 		os.Exit(1)
 	}
 
-	servicePlansFetcher := service_plans_fetcher.NewServicePlansFetcher(cfg.ServiceName, cfg.ServicePlanUpdateSchedule, cfg.Logger, cfClient)
+	internalMetrics := internal_metrics.NewRegistry()
+
+	serviceFilter := service_plans_fetcher.ServiceFilter{
+		Labels:        cfg.ServiceNames,
+		Broker:        cfg.ServiceBroker,
+		ExcludedPlans: cfg.ExcludedServicePlans,
+	}
+	servicePlansFetcher := service_plans_fetcher.NewServicePlansFetcher(
+		serviceFilter,
+		store.Options{
+			Schedule:     cfg.ServicePlanUpdateSchedule,
+			MaxStaleness: cfg.MaxDataStaleness,
+			CacheDir:     cfg.CacheDir,
+			MinBackoff:   cfg.FetcherMinBackoff,
+			MaxBackoff:   cfg.FetcherMaxBackoff,
+			Registry:     internalMetrics,
+		},
+		cfg.Logger,
+		cfClient,
+	)
 	wg.Add(1)
 	go func() {
+		defer wg.Done()
 		err := servicePlansFetcher.Run(ctx)
 		if err != nil {
 			cfg.Logger.Error("err-fatal-service-plans-fetcher", err)
+			shutdown()
+			os.Exit(1)
 		}
-		shutdown()
-		os.Exit(1)
 	}()
 
-	spacesFetcher := spaces_fetcher.NewSpacesFetcher(cfg.SpaceUpdateSchedule, cfg.Logger, cfClient)
+	// With SCOPE_TO_SERVICE_INSTANCES, only the spaces with instances of the
+	// service and the orgs of those spaces are fetched, so what they save
+	// depends on the service filter too
+	var instanceIndexFetcher *instance_index.InstanceIndexFetcher
+	var spaceGuidsSource spaces_fetcher.SpaceGuidsSource
+	scopeFingerprint := ""
+	if cfg.ScopeToServiceInstances {
+		scopeFingerprint = serviceFilter.Fingerprint()
+		instanceIndexFetcher = instance_index.NewInstanceIndexFetcher(
+			servicePlansFetcher,
+			store.Options{
+				Schedule:     cfg.InstanceIndexUpdateSchedule,
+				Fingerprint:  scopeFingerprint,
+				MaxStaleness: cfg.MaxDataStaleness,
+				CacheDir:     cfg.CacheDir,
+				MinBackoff:   cfg.FetcherMinBackoff,
+				MaxBackoff:   cfg.FetcherMaxBackoff,
+				Registry:     internalMetrics,
+			},
+			cfg.Logger,
+			cfClient,
+		)
+		spaceGuidsSource = instanceIndexFetcher
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := instanceIndexFetcher.Run(ctx)
+			if err != nil {
+				cfg.Logger.Error("err-fatal-instance-index-fetcher", err)
+				shutdown()
+				os.Exit(1)
+			}
+		}()
+	}
+
+	spacesFetcher := spaces_fetcher.NewScopedSpacesFetcher(
+		spaceGuidsSource,
+		store.Options{
+			Schedule:         cfg.SpaceUpdateSchedule,
+			Fingerprint:      scopeFingerprint,
+			FullSyncSchedule: cfg.FullSyncSchedule,
+			MaxStaleness:     cfg.MaxDataStaleness,
+			CacheDir:         cfg.CacheDir,
+			MinBackoff:       cfg.FetcherMinBackoff,
+			MaxBackoff:       cfg.FetcherMaxBackoff,
+			Registry:         internalMetrics,
+		},
+		cfg.Logger,
+		cfClient,
+	)
 	wg.Add(1)
 	go func() {
+		defer wg.Done()
 		err := spacesFetcher.Run(ctx)
 		if err != nil {
 			cfg.Logger.Error("err-fatal-spaces-fetcher", err)
+			shutdown()
+			os.Exit(1)
 		}
-		shutdown()
-		os.Exit(1)
 	}()
 
-	orgsFetcher := orgs_fetcher.NewOrgsFetcher(cfg.OrgUpdateSchedule, cfg.Logger, cfClient)
+	var orgGuidsSource orgs_fetcher.OrgGuidsSource
+	if cfg.ScopeToServiceInstances {
+		orgGuidsSource = spacesFetcher
+	}
+	orgsFetcher := orgs_fetcher.NewScopedOrgsFetcher(
+		orgGuidsSource,
+		store.Options{
+			Schedule:         cfg.OrgUpdateSchedule,
+			Fingerprint:      scopeFingerprint,
+			FullSyncSchedule: cfg.FullSyncSchedule,
+			MaxStaleness:     cfg.MaxDataStaleness,
+			CacheDir:         cfg.CacheDir,
+			MinBackoff:       cfg.FetcherMinBackoff,
+			MaxBackoff:       cfg.FetcherMaxBackoff,
+			Registry:         internalMetrics,
+		},
+		cfg.Logger,
+		cfClient,
+	)
 	wg.Add(1)
 	go func() {
+		defer wg.Done()
 		err := orgsFetcher.Run(ctx)
 		if err != nil {
 			cfg.Logger.Error("err-fatal-orgs-fetcher", err)
+			shutdown()
+			os.Exit(1)
 		}
-		shutdown()
-		os.Exit(1)
 	}()
 
 	awsConfig := aws.NewConfig().WithRegion(cfg.AWSRegion)
+	if cfg.AWSAccessKeyID != "" {
+		awsConfig = awsConfig.WithCredentials(
+			credentials.NewStaticCredentials(cfg.AWSAccessKeyID, cfg.AWSSecretAccessKey, ""),
+		)
+	}
 	awsSession := session.Must(session.NewSession(awsConfig))
 	elasticacheClient := elasticache.New(awsSession)
 	cloudwatchClient := cloudwatch.New(awsSession)
 
-	redisMetricFetcher := NewRedisMetricFetcher(elasticacheClient, cloudwatchClient, cfg.Logger)
-	redisMetricEndpoint := metric_endpoint.MetricEndpoint(servicePlansFetcher, spacesFetcher, orgsFetcher, redisMetricFetcher, cfg.Logger)
+	costUsagePath := ""
+	if cfg.CacheDir != "" {
+		costUsagePath = filepath.Join(cfg.CacheDir, "cost-budget-usage.json")
+	}
+	costTracker := cost_budget.NewTracker(
+		cost_budget.Limits{Daily: uint64(cfg.UserDailyQueryBudget), Monthly: uint64(cfg.UserMonthlyQueryBudget)}.PerInstance(uint64(cfg.BudgetInstances)),
+		cost_budget.Limits{Daily: uint64(cfg.OrgDailyQueryBudget), Monthly: uint64(cfg.OrgMonthlyQueryBudget)}.PerInstance(uint64(cfg.BudgetInstances)),
+		costUsagePath,
+		internalMetrics,
+		cfg.Logger,
+	)
+	reloader.OnReload(func(c config.Config) {
+		costTracker.SetLimits(
+			cost_budget.Limits{Daily: uint64(c.UserDailyQueryBudget), Monthly: uint64(c.UserMonthlyQueryBudget)}.PerInstance(uint64(c.BudgetInstances)),
+			cost_budget.Limits{Daily: uint64(c.OrgDailyQueryBudget), Monthly: uint64(c.OrgMonthlyQueryBudget)}.PerInstance(uint64(c.BudgetInstances)),
+		)
+	})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		costTracker.Run(ctx, cost_budget.SaveInterval)
+	}()
+
+	uaaHealth := health.NewTracker("uaa")
+	elasticacheHealth := health.NewTracker("elasticache")
+	cloudwatchHealth := health.NewTracker("cloudwatch")
+	secretsManagerHealth := health.NewTracker("secretsmanager")
+
+	replicationGroupsFetcher := NewReplicationGroupsFetcher(
+		store.Options{
+			Schedule:     cfg.ReplicationGroupUpdateSchedule,
+			MaxStaleness: cfg.MaxDataStaleness,
+			CacheDir:     cfg.CacheDir,
+			MinBackoff:   cfg.FetcherMinBackoff,
+			MaxBackoff:   cfg.FetcherMaxBackoff,
+			Registry:     internalMetrics,
+		},
+		cfg.Logger,
+		elasticacheClient,
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := replicationGroupsFetcher.Run(ctx)
+		if err != nil {
+			cfg.Logger.Error("err-fatal-replication-groups-fetcher", err)
+			shutdown()
+			os.Exit(1)
+		}
+	}()
+
+	// The event counts are not needed to answer scrapes, so the app carries
+	// on without them if ElastiCache won't list events
+	eventsFetcher := NewElastiCacheEventsFetcher(
+		store.Options{
+			Schedule:   cfg.EventUpdateSchedule,
+			CacheDir:   cfg.CacheDir,
+			MinBackoff: cfg.FetcherMinBackoff,
+			MaxBackoff: cfg.FetcherMaxBackoff,
+			Registry:   internalMetrics,
+		},
+		cfg.Logger,
+		elasticacheClient,
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := eventsFetcher.Run(ctx)
+		if err != nil {
+			cfg.Logger.Error("err-elasticache-events-fetcher", err)
+		}
+	}()
+
+	topologyAggregator := topology.NewAggregator(servicePlansFetcher, spacesFetcher, orgsFetcher, internalMetrics, cfg.Logger)
+
+	var redisMetricFetcher metric_endpoint.ServiceMetricFetcher
+	var awsDependencies []health.Dependency
+	if cfg.RedisMetricSource == "info" {
+		redisMetricFetcher = NewRedisInfoMetricFetcher(
+			replicationGroupsFetcher,
+			eventsFetcher,
+			secretsmanager.New(awsSession),
+			cfg.RedisSecretsManagerPath,
+			cfg.RedisTimeout,
+			elasticacheHealth,
+			secretsManagerHealth,
+			cfg.Logger,
+		)
+		awsDependencies = []health.Dependency{replicationGroupsFetcher, eventsFetcher, elasticacheHealth, secretsManagerHealth}
+	} else {
+		throttledCloudWatch := NewThrottledCloudWatch(
+			cloudwatchClient,
+			cfg.CloudWatchRequestsPerSecond,
+			cfg.CloudWatchMaxThrottlingRetries,
+			internalMetrics,
+			cfg.Logger,
+		)
+		redisMetricFetcher = NewRedisMetricFetcher(
+			catalogue,
+			replicationGroupsFetcher,
+			eventsFetcher,
+			throttledCloudWatch,
+			int(cfg.CloudWatchMaxParallelBatches),
+			MetricWindow{
+				Datapoints: cfg.CloudWatchDatapoints,
+				Length:     cfg.CloudWatchWindow,
+				Lag:        cfg.CloudWatchLag,
+				Period:     cfg.CloudWatchPeriod,
+			},
+			elasticacheHealth,
+			cloudwatchHealth,
+			cfg.Logger,
+		)
+		awsDependencies = []health.Dependency{replicationGroupsFetcher, eventsFetcher, elasticacheHealth, cloudwatchHealth}
+	}
+	redisMetricEndpoint := metric_endpoint.MetricEndpoint(
+		topologyAggregator,
+		redisMetricFetcher,
+		costTracker,
+		func() time.Duration { return reloader.Current().MinScrapeInterval },
+		cfg.Logger,
+	)
 
 	router := gin.Default()
-	router.GET("/health", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{
-			"message": "online",
-		})
-	})
-	auth := authenticator.NewBasicAuthenticator(cfg.CFClientConfig.ApiAddress, nil)
+	stores := []health.Dependency{servicePlansFetcher, spacesFetcher, orgsFetcher}
+	if instanceIndexFetcher != nil {
+		stores = append(stores, instanceIndexFetcher)
+	}
+	registerHealthRoutes := func(r *gin.Engine) {
+		r.GET("/health", health.HealthEndpoint(stores))
+		r.GET("/health/details", health.HealthDetailsEndpoint(stores, map[string][]health.Dependency{
+			"uaa": {uaaHealth},
+			"aws": awsDependencies,
+		}))
+		r.GET("/ready", health.ReadyEndpoint(stores))
+	}
+	registerHealthRoutes(router)
+	// The internal routes are always registered, so that a password set by
+	// reloading the config takes effect. They 404 while there is no password.
+	internalRoutes := router.Group("/internal")
+	internalRoutes.Use(internal_metrics.BasicAuth(func() (string, string) {
+		current := reloader.Current()
+		return current.InternalMetricsUsername, current.InternalMetricsPassword
+	}))
+	internalRoutes.GET("/metrics", internal_metrics.InternalMetricsEndpoint(internalMetrics, cfg.Logger))
+	internalRoutes.GET("/log-level", logging.LogLevelEndpoint(cfg.LogSink, cfg.Logger))
+	internalRoutes.PUT("/log-level", logging.LogLevelEndpoint(cfg.LogSink, cfg.Logger))
+	auth := authenticator.NewBasicAuthenticator(
+		cfg.CFClientConfig.ApiAddress,
+		cfg.CFClientConfig.SkipSslValidation,
+		cfg.CFClientConfig.UserAgent,
+		&http.Client{Timeout: cfg.AuthTimeout},
+		uaaHealth,
+	)
 	authenticatedRoutes := router.Group("/")
 	authenticatedRoutes.Use(authenticator.AuthenticatorMiddleware(auth, cfg.Logger))
 	authenticatedRoutes.GET("/metrics", redisMetricEndpoint)
-	server := &http.Server{
-		Addr:    fmt.Sprintf(":%d", cfg.ListenPort),
-		Handler: router,
-	}
+	servers := []*http.Server{}
+	if cfg.TLSListenPort == 0 {
+		servers = append(servers, &http.Server{
+			Addr:    fmt.Sprintf(":%d", cfg.ListenPort),
+			Handler: router,
+		})
+	} else {
+		// With TLS the plain HTTP port only serves the health checks, for
+		// platforms which check the app's health without TLS
+		healthRouter := gin.Default()
+		registerHealthRoutes(healthRouter)
 
-	wg.Add(1)
-	go func() {
-		err := server.ListenAndServe()
+		certReloader, err := tls_config.NewCertReloader(
+			cfg.TLSCertFile,
+			cfg.TLSKeyFile,
+			cfg.TLSClientCAFile,
+			internalMetrics,
+			cfg.Logger,
+		)
 		if err != nil {
-			cfg.Logger.Error("err-fatal-server", err)
+			cfg.Logger.Error("err-loading-certificate", err)
+			shutdown()
+			os.Exit(1)
 		}
-		shutdown()
-		os.Exit(1)
-	}()
+		go certReloader.Run(ctx, cfg.TLSReloadInterval)
+
+		servers = append(servers, &http.Server{
+			Addr:    fmt.Sprintf(":%d", cfg.ListenPort),
+			Handler: healthRouter,
+		}, &http.Server{
+			Addr:      fmt.Sprintf(":%d", cfg.TLSListenPort),
+			Handler:   router,
+			TLSConfig: certReloader.TLSConfig(cfg.TLSMinVersion),
+		})
+	}
+
+	for _, server := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var err error
+			if server.TLSConfig != nil {
+				err = server.ListenAndServeTLS("", "")
+			} else {
+				err = server.ListenAndServe()
+			}
+			if err != nil && err != http.ErrServerClosed {
+				cfg.Logger.Error("err-fatal-server", err, lager.Data{"address": server.Addr})
+				shutdown()
+				os.Exit(1)
+			}
+		}()
+		go func() {
+			<-ctx.Done()
+			server.Shutdown(context.Background())
+		}()
+	}
 
 	wg.Wait()
 }
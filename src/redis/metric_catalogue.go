@@ -0,0 +1,283 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/config"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// LevelCluster metrics are about a whole cache cluster, which is one
+	// node in a replication group
+	LevelCluster = "cluster"
+	// LevelNode metrics are about the host a node runs on
+	LevelNode = "node"
+)
+
+//go:embed metric_catalogue.yml
+var defaultMetricCatalogue []byte
+
+var (
+	prometheusNameRegexp  = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	percentileRegexp      = regexp.MustCompile(`^p([0-9]{1,2}(\.[0-9]+)?|100)$`)
+	statisticSuffixByName = map[string]string{
+		"Average":     "avg",
+		"Minimum":     "min",
+		"Maximum":     "max",
+		"Sum":         "sum",
+		"SampleCount": "sample_count",
+	}
+)
+
+// MetricDefinition is a CloudWatch metric the exporter can fetch, and how to
+// export it
+type MetricDefinition struct {
+	CloudWatchName string   `yaml:"cloudwatch_name"`
+	PrometheusName string   `yaml:"prometheus_name"`
+	Help           string   `yaml:"help"`
+	Unit           string   `yaml:"unit"`
+	Level          string   `yaml:"level"`
+	Statistics     []string `yaml:"statistics"`
+	// Roles limits the metric to nodes with these roles, for metrics which
+	// only primaries or only replicas have. Nodes whose role is not known get
+	// every metric.
+	Roles []string `yaml:"roles"`
+	// Counter exports the Sum statistic since the start of the UTC day as a
+	// counter, <prometheus_name>_total, rather than exporting each Sum as _sum
+	Counter bool `yaml:"counter"`
+	// Enabled is true if it is left out
+	Enabled *bool `yaml:"enabled"`
+}
+
+func (d MetricDefinition) enabled() bool {
+	return d.Enabled == nil || *d.Enabled
+}
+
+// appliesTo says whether the metric is fetched for a node with the role
+func (d MetricDefinition) appliesTo(role string) bool {
+	if len(d.Roles) == 0 || role == RoleUnknown {
+		return true
+	}
+	for _, r := range d.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// MetricCatalogue lists every metric the exporter can fetch from CloudWatch
+type MetricCatalogue struct {
+	Metrics []MetricDefinition `yaml:"metrics"`
+
+	// help is the help text of each exported metric, like cpu_utilization_avg
+	help map[MetricName]string
+	// counters are the exported metrics which are counters, like
+	// evictions_total
+	counters map[MetricName]bool
+}
+
+// LoadMetricCatalogue reads the catalogue from a YAML or JSON file, or uses
+// the default catalogue if path is empty. It returns a
+// *config.ValidationError listing every problem it finds.
+func LoadMetricCatalogue(path string) (*MetricCatalogue, error) {
+	contents := defaultMetricCatalogue
+	if path != "" {
+		var err error
+		contents, err = os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading the metric catalogue: %v", err)
+		}
+	}
+	return ParseMetricCatalogue(contents)
+}
+
+func ParseMetricCatalogue(contents []byte) (*MetricCatalogue, error) {
+	catalogue := &MetricCatalogue{}
+	if err := yaml.UnmarshalStrict(contents, catalogue); err != nil {
+		return nil, &config.ValidationError{Problems: []string{fmt.Sprintf("metric catalogue: %v", err)}}
+	}
+	if problems := catalogue.validate(); len(problems) > 0 {
+		return nil, &config.ValidationError{Problems: problems}
+	}
+	return catalogue, nil
+}
+
+func (c *MetricCatalogue) validate() []string {
+	problems := []string{}
+	problem := func(i int, format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf("metric catalogue entry %d: %s", i+1, fmt.Sprintf(format, args...)))
+	}
+	if len(c.Metrics) == 0 {
+		problems = append(problems, "metric catalogue: no metrics")
+	}
+
+	c.help = map[MetricName]string{}
+	c.counters = map[MetricName]bool{}
+	prometheusNames := map[string]bool{}
+	for i, definition := range c.Metrics {
+		if definition.CloudWatchName == "" {
+			problem(i, "cloudwatch_name must be set")
+		}
+		if !prometheusNameRegexp.MatchString(definition.PrometheusName) {
+			problem(i, "prometheus_name %q is not a valid metric name", definition.PrometheusName)
+		} else if prometheusNames[definition.PrometheusName] {
+			problem(i, "prometheus_name %q is used more than once", definition.PrometheusName)
+		}
+		prometheusNames[definition.PrometheusName] = true
+		if definition.Level != LevelCluster && definition.Level != LevelNode {
+			problem(i, "level %q is not one of %s or %s", definition.Level, LevelCluster, LevelNode)
+		}
+		for _, role := range definition.Roles {
+			if role != RolePrimary && role != RoleReplica {
+				problem(i, "role %q is not one of %s or %s", role, RolePrimary, RoleReplica)
+			}
+		}
+		if len(definition.Statistics) == 0 {
+			problem(i, "statistics must not be empty")
+		}
+		if definition.Counter && !contains(definition.Statistics, "Sum") {
+			problem(i, "counter metrics must have the Sum statistic")
+		}
+		for _, statistic := range definition.Statistics {
+			if _, ok := statisticSuffix(statistic); !ok {
+				problem(i, "statistic %q is not one of Average, Minimum, Maximum, Sum, SampleCount or a percentile like p99", statistic)
+				continue
+			}
+			name := exportedName(definition.PrometheusName, statistic, definition.Counter)
+			if _, ok := c.help[name]; ok {
+				problem(i, "%s is exported more than once", name)
+			}
+			c.help[name] = definition.describe(statistic)
+			if isCounterStatistic(statistic, definition.Counter) {
+				c.help[name] = definition.describe("Sum since midnight UTC")
+				c.counters[name] = true
+			}
+		}
+	}
+	return problems
+}
+
+// statisticSuffix is what is added to a metric's name for a statistic, like
+// avg for Average or p99_9 for p99.9
+func statisticSuffix(statistic string) (string, bool) {
+	if suffix, ok := statisticSuffixByName[statistic]; ok {
+		return suffix, true
+	}
+	if percentileRegexp.MatchString(statistic) {
+		return strings.Replace(statistic, ".", "_", 1), true
+	}
+	return "", false
+}
+
+// isCounterStatistic says whether a statistic of a metric is added up into
+// a counter
+func isCounterStatistic(statistic string, counter bool) bool {
+	return counter && statistic == "Sum"
+}
+
+// exportedName is what a statistic of a metric is exported as, like
+// cpu_utilization_avg or evictions_total
+func exportedName(prometheusName string, statistic string, counter bool) MetricName {
+	if isCounterStatistic(statistic, counter) {
+		return prometheusName + "_total"
+	}
+	suffix, _ := statisticSuffix(statistic)
+	return fmt.Sprintf("%s_%s", prometheusName, suffix)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (d MetricDefinition) describe(statistic string) string {
+	description := fmt.Sprintf("%s (%s", d.Help, statistic)
+	if d.Unit != "" {
+		description += ", " + d.Unit
+	}
+	return description + ")"
+}
+
+// Names are the Prometheus names of every metric in the catalogue, for
+// checking the METRICS setting
+func (c *MetricCatalogue) Names() []string {
+	names := []string{}
+	for _, definition := range c.Metrics {
+		names = append(names, definition.PrometheusName)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Select exports only the metrics with the given Prometheus names, whether or
+// not they are enabled in the catalogue. An empty list leaves the catalogue
+// as it is. It returns a *config.ValidationError if a name is not in the
+// catalogue.
+func (c *MetricCatalogue) Select(names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	known := c.Names()
+	wanted := map[string]bool{}
+	problems := []string{}
+	for _, name := range names {
+		i := sort.SearchStrings(known, name)
+		if i == len(known) || known[i] != name {
+			problems = append(problems, fmt.Sprintf("metrics (METRICS): %q is not one of %s", name, strings.Join(known, ", ")))
+		}
+		wanted[name] = true
+	}
+	if len(problems) > 0 {
+		return &config.ValidationError{Problems: problems}
+	}
+	for i := range c.Metrics {
+		enabled := wanted[c.Metrics[i].PrometheusName]
+		c.Metrics[i].Enabled = &enabled
+	}
+	return nil
+}
+
+// Enabled lists the metrics which are fetched
+func (c *MetricCatalogue) Enabled() []MetricDefinition {
+	enabled := []MetricDefinition{}
+	for _, definition := range c.Metrics {
+		if definition.enabled() {
+			enabled = append(enabled, definition)
+		}
+	}
+	return enabled
+}
+
+// QueriesPerNode is how many billable CloudWatch queries fetching the metrics
+// of a node with the role takes
+func (c *MetricCatalogue) QueriesPerNode(role string) int {
+	queries := 0
+	for _, definition := range c.Enabled() {
+		if definition.appliesTo(role) {
+			queries += len(definition.Statistics)
+		}
+	}
+	return queries
+}
+
+// Help describes an exported metric, like cpu_utilization_avg
+func (c *MetricCatalogue) Help(metricName MetricName) string {
+	return c.help[metricName]
+}
+
+// IsCounter says whether an exported metric is a counter
+func (c *MetricCatalogue) IsCounter(metricName MetricName) bool {
+	return c.counters[metricName]
+}
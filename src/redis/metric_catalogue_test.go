@@ -0,0 +1,161 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/config"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("MetricCatalogue", func() {
+	It("has the original metrics and the replication metrics enabled by default", func() {
+		catalogue, err := LoadMetricCatalogue("")
+		Expect(err).NotTo(HaveOccurred())
+
+		enabled := []string{}
+		for _, definition := range catalogue.Enabled() {
+			enabled = append(enabled, definition.PrometheusName)
+		}
+		Expect(enabled).To(ConsistOf(
+			"curr_items", "cache_hit_rate", "evictions", "curr_connections", "new_connections",
+			"database_memory_usage_percentage", "cpu_utilization", "swap_usage",
+			"network_bytes_in", "network_bytes_out",
+			"replication_lag", "replication_bytes", "is_master", "master_link_health_status",
+		))
+		Expect(catalogue.QueriesPerNode(RolePrimary)).To(Equal(30 + 4 + 2 + 2))
+		Expect(catalogue.QueriesPerNode(RoleReplica)).To(Equal(30 + 4 + 2 + 2 + 1))
+		Expect(catalogue.QueriesPerNode(RoleUnknown)).To(Equal(30 + 4 + 2 + 2 + 2 + 1))
+		Expect(catalogue.Names()).To(ContainElements("engine_cpu_utilization", "bytes_used_for_cache"))
+		Expect(catalogue.Help("cpu_utilization_max")).To(Equal("The percentage of CPU used by the host (Maximum, Percent)"))
+	})
+
+	It("exports the Sum of counter metrics as a counter", func() {
+		catalogue, err := LoadMetricCatalogue("")
+		Expect(err).NotTo(HaveOccurred())
+
+		for _, name := range []string{"evictions_total", "new_connections_total", "network_bytes_in_total", "network_bytes_out_total"} {
+			Expect(catalogue.IsCounter(name)).To(BeTrue(), name)
+		}
+		Expect(catalogue.IsCounter("evictions_max")).To(BeFalse())
+		Expect(catalogue.Help("evictions_sum")).To(BeEmpty())
+		Expect(catalogue.Help("evictions_total")).To(Equal("The number of keys evicted because of the maxmemory limit (Sum since midnight UTC, Count)"))
+	})
+
+	It("loads a catalogue from a file", func() {
+		path := filepath.Join(GinkgoT().TempDir(), "catalogue.yml")
+		Expect(os.WriteFile(path, []byte(`
+metrics:
+  - cloudwatch_name: EngineCPUUtilization
+    prometheus_name: engine_cpu_utilization
+    help: CPU used by the Redis engine thread
+    unit: Percent
+    level: node
+    statistics: [Maximum, p99, p99.9]
+  - cloudwatch_name: Evictions
+    prometheus_name: evictions
+    level: cluster
+    statistics: [Sum]
+    enabled: false
+`), 0600)).To(Succeed())
+
+		catalogue, err := LoadMetricCatalogue(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(catalogue.Enabled()).To(HaveLen(1))
+		Expect(catalogue.QueriesPerNode(RolePrimary)).To(Equal(3))
+		Expect(catalogue.Help("engine_cpu_utilization_p99_9")).To(Equal("CPU used by the Redis engine thread (p99.9, Percent)"))
+
+		metrics := listMetricsForRedisNode(catalogue, testNode("cf-abc-0001-001", "abc"))
+		Expect(metrics).To(HaveLen(1))
+		Expect(*metrics[0].metric.MetricName).To(Equal("EngineCPUUtilization"))
+		Expect(metrics[0].metric.Dimensions).To(HaveLen(2))
+	})
+
+	It("reports every problem at once", func() {
+		_, err := ParseMetricCatalogue([]byte(`
+metrics:
+  - prometheus_name: bad-name
+    level: rack
+    statistics: [Median]
+    roles: [leader]
+  - cloudwatch_name: Evictions
+    prometheus_name: evictions
+    level: cluster
+    statistics: []
+    counter: true
+  - cloudwatch_name: Evictions
+    prometheus_name: evictions
+    level: cluster
+    statistics: [Sum]
+`))
+		validationErr, ok := err.(*config.ValidationError)
+		Expect(ok).To(BeTrue())
+		Expect(validationErr.Problems).To(ConsistOf(
+			"metric catalogue entry 1: cloudwatch_name must be set",
+			`metric catalogue entry 1: prometheus_name "bad-name" is not a valid metric name`,
+			`metric catalogue entry 1: level "rack" is not one of cluster or node`,
+			ContainSubstring(`metric catalogue entry 1: statistic "Median" is not one of`),
+			`metric catalogue entry 1: role "leader" is not one of primary or replica`,
+			"metric catalogue entry 2: statistics must not be empty",
+			"metric catalogue entry 2: counter metrics must have the Sum statistic",
+			`metric catalogue entry 3: prometheus_name "evictions" is used more than once`,
+		))
+	})
+
+	It("rejects settings it doesn't know", func() {
+		_, err := ParseMetricCatalogue([]byte(`
+metrics:
+  - cloudwatch_name: Evictions
+    prometheus_name: evictions
+    level: cluster
+    statistics: [Sum]
+    enabeld: false
+`))
+		Expect(err).To(MatchError(ContainSubstring("enabeld")))
+	})
+
+	It("only fetches metrics for the roles they apply to", func() {
+		catalogue, err := LoadMetricCatalogue("")
+		Expect(err).NotTo(HaveOccurred())
+		metricNames := func(role string) []string {
+			node := testNode("cf-abc-001", "abc")
+			node.Role = role
+			names := []string{}
+			for _, metric := range listMetricsForRedisNode(catalogue, node) {
+				names = append(names, metric.definition.PrometheusName)
+			}
+			return names
+		}
+
+		Expect(metricNames(RolePrimary)).To(ContainElement("replication_bytes"))
+		Expect(metricNames(RolePrimary)).NotTo(ContainElements("replication_lag", "master_link_health_status"))
+		Expect(metricNames(RoleReplica)).To(ContainElements("replication_lag", "master_link_health_status"))
+		Expect(metricNames(RoleReplica)).NotTo(ContainElement("replication_bytes"))
+		Expect(metricNames(RoleUnknown)).To(ContainElements("replication_lag", "replication_bytes"))
+	})
+
+	Describe("Select", func() {
+		It("exports only the selected metrics, even ones which are not enabled", func() {
+			catalogue, err := LoadMetricCatalogue("")
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(catalogue.Select([]string{"evictions", "engine_cpu_utilization"})).To(Succeed())
+			names := []string{}
+			for _, definition := range catalogue.Enabled() {
+				names = append(names, definition.PrometheusName)
+			}
+			Expect(names).To(ConsistOf("evictions", "engine_cpu_utilization"))
+		})
+
+		It("reports metrics which are not in the catalogue", func() {
+			catalogue, err := LoadMetricCatalogue("")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = catalogue.Select([]string{"evictions", "made_up"})
+			Expect(err).To(MatchError(ContainSubstring(`metrics (METRICS): "made_up" is not one of`)))
+			Expect(catalogue.Enabled()).To(HaveLen(14))
+		})
+	})
+})
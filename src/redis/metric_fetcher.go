@@ -2,32 +2,49 @@ package main
 
 import (
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/alphagov/paas-prometheus-endpoints/pkg/authenticator"
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/cost_budget"
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/health"
 	"github.com/alphagov/paas-prometheus-endpoints/pkg/metric_endpoint"
 
 	"code.cloudfoundry.org/lager"
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
-	"github.com/aws/aws-sdk-go/service/elasticache"
 	cfclient "github.com/cloudfoundry-community/go-cfclient"
 	"github.com/gin-gonic/gin"
 	dto "github.com/prometheus/client_model/go"
 )
 
 type RedisMetricFetcher struct {
-	elasticacheClient *elasticache.ElastiCache
-	cloudwatchClient  *cloudwatch.CloudWatch
-	logger            lager.Logger
+	catalogue          *MetricCatalogue
+	replicationGroups  ReplicationGroupSource
+	events             EventSource
+	cloudwatchClient   CloudWatchAPI
+	maxParallelBatches int
+	window             MetricWindow
+	elasticacheHealth  *health.Tracker
+	cloudwatchHealth   *health.Tracker
+	logger             lager.Logger
 }
 
 func NewRedisMetricFetcher(
-	elasticacheClient *elasticache.ElastiCache,
-	cloudwatchClient *cloudwatch.CloudWatch,
+	catalogue *MetricCatalogue,
+	replicationGroups ReplicationGroupSource,
+	events EventSource,
+	cloudwatchClient CloudWatchAPI,
+	maxParallelBatches int,
+	window MetricWindow,
+	elasticacheHealth *health.Tracker,
+	cloudwatchHealth *health.Tracker,
 	logger lager.Logger,
 ) *RedisMetricFetcher {
 	logger = logger.Session("redis-metric-fetcher")
-	return &RedisMetricFetcher{elasticacheClient, cloudwatchClient, logger}
+	return &RedisMetricFetcher{catalogue, replicationGroups, events, cloudwatchClient, maxParallelBatches, window, elasticacheHealth, cloudwatchHealth, logger}
 }
 
 func (f *RedisMetricFetcher) FetchMetrics(
@@ -37,46 +54,82 @@ func (f *RedisMetricFetcher) FetchMetrics(
 	spacesByGuid map[string]cfclient.Space,
 	orgsByGuid map[string]cfclient.Org,
 	servicePlans []cfclient.ServicePlan,
-	service cfclient.Service,
+	services []cfclient.Service,
 ) (metric_endpoint.Metrics, error) {
 	logger := f.logger.Session("fetch-metrics", lager.Data{
 		"username": user.Username(),
 	})
 
-	redisNodes, err := ListRedisNodes(serviceInstances, spacesByGuid, orgsByGuid, f.elasticacheClient)
+	redisNodes, err := ListRedisNodes(serviceInstances, spacesByGuid, orgsByGuid, f.replicationGroups, logger)
+	f.elasticacheHealth.Record(err)
 	if err != nil {
 		logger.Error("err-listing-redis-nodes", err)
 		return nil, err
 	}
 
-	startTime := time.Now().Add(-7 * time.Minute)
-	endTime := time.Now().Add(-2 * time.Minute)
-	metricDataResults, err := GetMetricsForRedisNodes(redisNodes, startTime, endTime, f.cloudwatchClient, logger)
+	for orgGuid, queries := range countMetricDataQueriesByOrg(f.catalogue, redisNodes) {
+		cost_budget.RecordUsage(c, orgGuid, queries)
+	}
+
+	startTime, endTime, period := f.window.TimeRange(time.Now())
+	ctx := c.Request.Context()
+	metricDataResults, failures, err := GetMetricsForRedisNodes(ctx, f.catalogue, redisNodes, startTime, endTime, period, f.cloudwatchClient, f.maxParallelBatches, logger)
+	if ctx.Err() == nil {
+		// A scrape which gave up is not CloudWatch's fault
+		f.cloudwatchHealth.Record(err)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	promMetrics := metricsFromCloudWatchToPrometheus(metricDataResults, redisNodes, logger)
+	promMetrics := metricsFromCloudWatchToPrometheus(f.catalogue, metricDataResults, redisNodes, f.window.Datapoints, endTime, logger)
+	addQueryFailureMetrics(promMetrics, failures, redisNodes, logger)
+	addReplicationMetrics(promMetrics, redisNodes, f.events, time.Now())
+	addEventMetrics(promMetrics, serviceInstances, spacesByGuid, orgsByGuid, f.events)
 	return promMetrics, nil
 }
 
 func metricsFromCloudWatchToPrometheus(
+	catalogue *MetricCatalogue,
 	metrics map[string]map[string]*cloudwatch.MetricDataResult,
 	nodes map[string]RedisNode,
+	datapoints string,
+	endTime time.Time,
 	logger lager.Logger,
 ) metric_endpoint.Metrics {
+	_, countedUntil := counterTimeRange(endTime)
 	promMetrics := metric_endpoint.Metrics{}
 	for nodeName, nodeMetrics := range metrics {
 		node := nodes[nodeName]
 		for metricName, metricDataResult := range nodeMetrics {
+			isCounter := catalogue.IsCounter(metricName)
 			if _, ok := promMetrics[metricName]; !ok {
+				metricType := dto.MetricType_GAUGE
+				if isCounter {
+					metricType = dto.MetricType_COUNTER
+				}
 				promMetrics[metricName] = &dto.MetricFamily{
 					Name:   derefS(metricName),
-					Type:   derefT(dto.MetricType_GAUGE),
+					Help:   derefS(catalogue.Help(metricName)),
+					Type:   derefT(metricType),
 					Metric: []*dto.Metric{},
 				}
 			}
 
+			if isCounter {
+				total, ok := counterTotal(metricDataResult)
+				if !ok {
+					continue
+				}
+				timestampMilliseconds := countedUntil.Unix() * 1000
+				promMetrics[metricName].Metric = append(promMetrics[metricName].Metric, &dto.Metric{
+					Label:       nodeLabels(node),
+					Counter:     &dto.Counter{Value: aws.Float64(total)},
+					TimestampMs: &timestampMilliseconds,
+				})
+				continue
+			}
+
 			if len(metricDataResult.Timestamps) == 0 || len(metricDataResult.Values) == 0 {
 				logger.Error("missing-metric-value", nil, lager.Data{
 					"node-name":             node.CacheClusterName,
@@ -86,56 +139,163 @@ func metricsFromCloudWatchToPrometheus(
 				continue
 			}
 
-			timestampMilliseconds := metricDataResult.Timestamps[0].Unix() * 1000
-			promMetric := &dto.Metric{
-				Label: []*dto.LabelPair{
-					{
-						Name:  derefS("service_instance_name"),
-						Value: derefS(node.ServiceInstance.Name),
-					},
-					{
-						Name:  derefS("service_instance_guid"),
-						Value: derefS(node.ServiceInstance.Guid),
-					},
-					{
-						Name:  derefS("space_name"),
-						Value: derefS(node.Space.Name),
+			for _, i := range datapointsToExport(metricDataResult, datapoints) {
+				timestampMilliseconds := metricDataResult.Timestamps[i].Unix() * 1000
+				promMetric := &dto.Metric{
+					Label: nodeLabels(node),
+					Gauge: &dto.Gauge{
+						Value: metricDataResult.Values[i],
 					},
-					{
-						Name:  derefS("space_guid"),
-						Value: derefS(node.Space.Guid),
-					},
-					{
-						Name:  derefS("org_name"),
-						Value: derefS(node.Organisation.Name),
-					},
-					{
-						Name:  derefS("org_guid"),
-						Value: derefS(node.Organisation.Guid),
-					},
-					{
-						Name:  derefS("service_plan_guid"),
-						Value: derefS(node.ServiceInstance.ServicePlanGuid),
-					},
-				},
-				Gauge: &dto.Gauge{
-					Value: metricDataResult.Values[0],
-				},
-				TimestampMs: &timestampMilliseconds,
-			}
-			if node.NodeNumber != nil {
-				nodeNumber := fmt.Sprintf("%d", *node.NodeNumber)
-				promMetric.Label = append(promMetric.Label, &dto.LabelPair{
-					Name:  derefS("node"),
-					Value: &nodeNumber,
-				})
+					TimestampMs: &timestampMilliseconds,
+				}
+				promMetrics[metricName].Metric = append(promMetrics[metricName].Metric, promMetric)
 			}
-			promMetrics[metricName].Metric = append(promMetrics[metricName].Metric, promMetric)
 		}
 	}
 	return promMetrics
 }
 
+// datapointsToExport picks which of a result's datapoints to export, oldest
+// first
+func datapointsToExport(metricDataResult *cloudwatch.MetricDataResult, datapoints string) []int {
+	count := len(metricDataResult.Timestamps)
+	if len(metricDataResult.Values) < count {
+		count = len(metricDataResult.Values)
+	}
+	indexes := make([]int, count)
+	for i := range indexes {
+		indexes[i] = i
+	}
+	sort.SliceStable(indexes, func(a, b int) bool {
+		return metricDataResult.Timestamps[indexes[a]].Before(*metricDataResult.Timestamps[indexes[b]])
+	})
+
+	switch datapoints {
+	case DatapointsAll:
+		return indexes
+	case DatapointsLatest:
+		return indexes[count-1:]
+	default:
+		// CloudWatch returns the newest first
+		return []int{0}
+	}
+}
+
+// addQueryFailureMetrics logs the metrics which could not be fetched for each
+// node, and exports how many there were, so that a tenant can tell a missing
+// metric from one which was never there
+func addQueryFailureMetrics(
+	promMetrics metric_endpoint.Metrics,
+	failures map[NodeName][]QueryFailure,
+	nodes map[string]RedisNode,
+	logger lager.Logger,
+) {
+	if len(nodes) == 0 {
+		return
+	}
+	family := &dto.MetricFamily{
+		Name:   derefS("cloudwatch_failed_queries"),
+		Help:   derefS("How many of the node's metrics CloudWatch could not return in this scrape"),
+		Type:   derefT(dto.MetricType_GAUGE),
+		Metric: []*dto.Metric{},
+	}
+	for nodeName, node := range nodes {
+		for _, failure := range failures[nodeName] {
+			logger.Error("err-metric-query-failed", nil, lager.Data{
+				"node-name":             node.CacheClusterName,
+				"service-instance-guid": node.ServiceInstance.Guid,
+				"metric-name":           failure.MetricName,
+				"status-code":           failure.StatusCode,
+				"messages":              failure.Messages,
+			})
+		}
+		family.Metric = append(family.Metric, &dto.Metric{
+			Label: nodeLabels(node),
+			Gauge: &dto.Gauge{Value: aws.Float64(float64(len(failures[nodeName])))},
+		})
+	}
+	promMetrics["cloudwatch_failed_queries"] = family
+}
+
+// nodeLabels say which service instance, space, org and node a metric is for
+func nodeLabels(node RedisNode) []*dto.LabelPair {
+	labels := instanceLabels(node.ServiceInstance, node.Space, node.Organisation)
+	// node is deprecated in favour of node_id, and kept until dashboards and
+	// alerts have moved over
+	if nodeNumber := getNodeNumberFromCacheClusterName(node.CacheClusterName); nodeNumber != nil {
+		labels = append(labels, &dto.LabelPair{
+			Name:  derefS("node"),
+			Value: derefS(fmt.Sprintf("%d", *nodeNumber)),
+		})
+	}
+	labels = append(labels,
+		&dto.LabelPair{
+			Name:  derefS("shard"),
+			Value: derefS(node.Shard),
+		},
+		&dto.LabelPair{
+			Name:  derefS("node_id"),
+			Value: derefS(node.CacheClusterName),
+		},
+		&dto.LabelPair{
+			Name:  derefS("role"),
+			Value: derefS(node.Role),
+		},
+		&dto.LabelPair{
+			Name:  derefS("availability_zone"),
+			Value: derefS(node.AvailabilityZone),
+		},
+	)
+	return labels
+}
+
+// getNodeNumberFromCacheClusterName is the number after the replication
+// group's name, or nil if there isn't one
+func getNodeNumberFromCacheClusterName(name string) *int {
+	segments := strings.Split(name, "-")
+	if len(segments) < 3 {
+		return nil
+	}
+	nodeNumber, err := strconv.Atoi(segments[2])
+	if err != nil {
+		return nil
+	}
+	return &nodeNumber
+}
+
+func instanceLabels(serviceInstance cfclient.ServiceInstance, space cfclient.Space, org cfclient.Org) []*dto.LabelPair {
+	return []*dto.LabelPair{
+		{
+			Name:  derefS("service_instance_name"),
+			Value: derefS(serviceInstance.Name),
+		},
+		{
+			Name:  derefS("service_instance_guid"),
+			Value: derefS(serviceInstance.Guid),
+		},
+		{
+			Name:  derefS("space_name"),
+			Value: derefS(space.Name),
+		},
+		{
+			Name:  derefS("space_guid"),
+			Value: derefS(space.Guid),
+		},
+		{
+			Name:  derefS("org_name"),
+			Value: derefS(org.Name),
+		},
+		{
+			Name:  derefS("org_guid"),
+			Value: derefS(org.Guid),
+		},
+		{
+			Name:  derefS("service_plan_guid"),
+			Value: derefS(serviceInstance.ServicePlanGuid),
+		},
+	}
+}
+
 func derefS(s string) *string {
 	return &s
 }
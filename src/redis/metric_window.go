@@ -0,0 +1,40 @@
+package main
+
+import (
+	"time"
+)
+
+const (
+	// DatapointsWindow asks CloudWatch for one datapoint covering the whole
+	// window
+	DatapointsWindow = "window"
+	// DatapointsAll asks for a datapoint every period and exports them all,
+	// each with its own timestamp
+	DatapointsAll = "all"
+	// DatapointsLatest asks for a datapoint every period and exports only the
+	// newest one
+	DatapointsLatest = "latest"
+)
+
+// MetricWindow is the time CloudWatch metrics are fetched for, which ends Lag
+// before the scrape so that CloudWatch has the data
+type MetricWindow struct {
+	Datapoints string
+	Length     time.Duration
+	Lag        time.Duration
+	// Period is how long each datapoint covers. It is only used if
+	// Datapoints is not DatapointsWindow.
+	Period time.Duration
+}
+
+// TimeRange says what to ask CloudWatch for. Windows split into periods end
+// on a whole period, so that every datapoint covers a whole period.
+func (w MetricWindow) TimeRange(now time.Time) (startTime time.Time, endTime time.Time, period time.Duration) {
+	endTime = now.Add(-w.Lag)
+	period = w.Length
+	if w.Datapoints != DatapointsWindow {
+		endTime = endTime.Truncate(w.Period)
+		period = w.Period
+	}
+	return endTime.Add(-w.Length), endTime, period
+}
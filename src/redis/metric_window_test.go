@@ -0,0 +1,95 @@
+package main
+
+import (
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("MetricWindow", func() {
+	now := time.Date(2020, 1, 1, 12, 10, 30, 0, time.UTC)
+
+	It("asks for one datapoint covering the whole window", func() {
+		window := MetricWindow{Datapoints: DatapointsWindow, Length: 5 * time.Minute, Lag: 2 * time.Minute, Period: time.Minute}
+		startTime, endTime, period := window.TimeRange(now)
+		Expect(startTime).To(Equal(time.Date(2020, 1, 1, 12, 3, 30, 0, time.UTC)))
+		Expect(endTime).To(Equal(time.Date(2020, 1, 1, 12, 8, 30, 0, time.UTC)))
+		Expect(period).To(Equal(5 * time.Minute))
+	})
+
+	It("ends windows split into periods on a whole period", func() {
+		window := MetricWindow{Datapoints: DatapointsAll, Length: 10 * time.Minute, Lag: 3 * time.Minute, Period: 2 * time.Minute}
+		startTime, endTime, period := window.TimeRange(now)
+		Expect(startTime).To(Equal(time.Date(2020, 1, 1, 11, 56, 0, 0, time.UTC)))
+		Expect(endTime).To(Equal(time.Date(2020, 1, 1, 12, 6, 0, 0, time.UTC)))
+		Expect(period).To(Equal(2 * time.Minute))
+	})
+})
+
+var _ = Describe("metricsFromCloudWatchToPrometheus", func() {
+	var (
+		nodes   map[string]RedisNode
+		metrics map[string]map[string]*cloudwatch.MetricDataResult
+		start   time.Time
+	)
+
+	BeforeEach(func() {
+		nodes = map[string]RedisNode{"node-1": testNode("node-1", "instance-1")}
+		start = time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+		// CloudWatch returns the newest datapoint first
+		metrics = map[string]map[string]*cloudwatch.MetricDataResult{
+			"node-1": {
+				"cpu_utilization_avg": {
+					Timestamps: []*time.Time{
+						aws.Time(start.Add(2 * time.Minute)),
+						aws.Time(start.Add(time.Minute)),
+						aws.Time(start),
+					},
+					Values: []*float64{aws.Float64(3), aws.Float64(2), aws.Float64(1)},
+				},
+			},
+		}
+	})
+
+	samples := func(datapoints string) ([]float64, []int64) {
+		logger := lager.NewLogger("test")
+		promMetrics := metricsFromCloudWatchToPrometheus(defaultCatalogue(), metrics, nodes, datapoints, start.Add(5*time.Minute), logger)
+		values := []float64{}
+		timestamps := []int64{}
+		for _, metric := range promMetrics["cpu_utilization_avg"].Metric {
+			values = append(values, metric.GetGauge().GetValue())
+			timestamps = append(timestamps, metric.GetTimestampMs())
+		}
+		return values, timestamps
+	}
+
+	It("exports the first datapoint for a whole window", func() {
+		values, timestamps := samples(DatapointsWindow)
+		Expect(values).To(Equal([]float64{3}))
+		Expect(timestamps).To(Equal([]int64{start.Add(2*time.Minute).Unix() * 1000}))
+	})
+
+	It("exports every datapoint, oldest first, each with its own timestamp", func() {
+		values, timestamps := samples(DatapointsAll)
+		Expect(values).To(Equal([]float64{1, 2, 3}))
+		Expect(timestamps).To(Equal([]int64{
+			start.Unix() * 1000,
+			start.Add(time.Minute).Unix() * 1000,
+			start.Add(2*time.Minute).Unix() * 1000,
+		}))
+	})
+
+	It("exports only the newest datapoint, wherever it is in the result", func() {
+		result := metrics["node-1"]["cpu_utilization_avg"]
+		result.Timestamps[0], result.Timestamps[1] = result.Timestamps[1], result.Timestamps[0]
+		result.Values[0], result.Values[1] = result.Values[1], result.Values[0]
+
+		values, timestamps := samples(DatapointsLatest)
+		Expect(values).To(Equal([]float64{3}))
+		Expect(timestamps).To(Equal([]int64{start.Add(2*time.Minute).Unix() * 1000}))
+	})
+})
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/authenticator"
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/health"
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/metric_endpoint"
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/redis_info"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
+	"github.com/gin-gonic/gin"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// maxParallelNodes limits how many Redis nodes are queried at once
+const maxParallelNodes = 10
+
+// RedisInfoMetricFetcher gets metrics by running INFO on each Redis node,
+// rather than from CloudWatch, which saves the CloudWatch charges
+type RedisInfoMetricFetcher struct {
+	replicationGroups    ReplicationGroupSource
+	events               EventSource
+	secretsManagerClient *secretsmanager.SecretsManager
+	secretsManagerPath   string
+	timeout              time.Duration
+	elasticacheHealth    *health.Tracker
+	secretsManagerHealth *health.Tracker
+	logger               lager.Logger
+
+	mu         sync.Mutex
+	authTokens map[string]string
+}
+
+func NewRedisInfoMetricFetcher(
+	replicationGroups ReplicationGroupSource,
+	events EventSource,
+	secretsManagerClient *secretsmanager.SecretsManager,
+	secretsManagerPath string,
+	timeout time.Duration,
+	elasticacheHealth *health.Tracker,
+	secretsManagerHealth *health.Tracker,
+	logger lager.Logger,
+) *RedisInfoMetricFetcher {
+	return &RedisInfoMetricFetcher{
+		replicationGroups:    replicationGroups,
+		events:               events,
+		secretsManagerClient: secretsManagerClient,
+		secretsManagerPath:   secretsManagerPath,
+		timeout:              timeout,
+		elasticacheHealth:    elasticacheHealth,
+		secretsManagerHealth: secretsManagerHealth,
+		logger:               logger.Session("redis-info-metric-fetcher"),
+		authTokens:           map[string]string{},
+	}
+}
+
+func (f *RedisInfoMetricFetcher) FetchMetrics(
+	c *gin.Context,
+	user authenticator.User,
+	serviceInstances []cfclient.ServiceInstance,
+	spacesByGuid map[string]cfclient.Space,
+	orgsByGuid map[string]cfclient.Org,
+	servicePlans []cfclient.ServicePlan,
+	services []cfclient.Service,
+) (metric_endpoint.Metrics, error) {
+	logger := f.logger.Session("fetch-metrics", lager.Data{
+		"username": user.Username(),
+	})
+
+	redisNodes, err := ListRedisNodes(serviceInstances, spacesByGuid, orgsByGuid, f.replicationGroups, logger)
+	f.elasticacheHealth.Record(err)
+	if err != nil {
+		logger.Error("err-listing-redis-nodes", err)
+		return nil, err
+	}
+
+	type nodeResult struct {
+		node    RedisNode
+		samples []redis_info.Sample
+		err     error
+	}
+	results := make(chan nodeResult, len(redisNodes))
+	semaphore := make(chan struct{}, maxParallelNodes)
+	var wg sync.WaitGroup
+	for _, node := range redisNodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+			samples, err := f.fetchNode(c.Request.Context(), node)
+			results <- nodeResult{node, samples, err}
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	promMetrics := metric_endpoint.Metrics{}
+	timestampMilliseconds := time.Now().UnixNano() / int64(time.Millisecond)
+	for result := range results {
+		up := 1.0
+		if result.err != nil {
+			logger.Error("err-fetching-redis-info", result.err, lager.Data{
+				"node-name":             result.node.CacheClusterName,
+				"service-instance-guid": result.node.ServiceInstance.Guid,
+			})
+			up = 0
+		}
+		addSample(promMetrics, result.node, redis_info.Sample{Name: "redis_info_up", Value: up}, timestampMilliseconds)
+		for _, sample := range result.samples {
+			addSample(promMetrics, result.node, sample, timestampMilliseconds)
+		}
+	}
+	addReplicationMetrics(promMetrics, redisNodes, f.events, time.Now())
+	addEventMetrics(promMetrics, serviceInstances, spacesByGuid, orgsByGuid, f.events)
+	return promMetrics, nil
+}
+
+// fetchNode runs INFO on one node. If the auth token has changed since it was
+// cached it fetches it again and retries once.
+func (f *RedisInfoMetricFetcher) fetchNode(ctx context.Context, node RedisNode) ([]redis_info.Sample, error) {
+	endpoint, useTLS, err := f.getNodeEndpoint(node.CacheClusterName)
+	if !isMissingOrRateLimited(err) {
+		f.elasticacheHealth.Record(err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var tlsConfig *tls.Config
+	if useTLS {
+		host, _, _ := net.SplitHostPort(endpoint)
+		tlsConfig = &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+	}
+
+	for attempt := 0; ; attempt++ {
+		authToken, err := f.getAuthToken(node.ServiceInstance.Guid)
+		if err != nil {
+			return nil, err
+		}
+		info, err := redis_info.Fetch(ctx, endpoint, authToken, tlsConfig, f.timeout)
+		if _, ok := err.(*redis_info.ErrAuth); ok && attempt == 0 {
+			f.forgetAuthToken(node.ServiceInstance.Guid)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return info.Samples(), nil
+	}
+}
+
+func (f *RedisInfoMetricFetcher) getNodeEndpoint(cacheClusterName string) (string, bool, error) {
+	cacheCluster, err := f.replicationGroups.GetCacheCluster(cacheClusterName)
+	if err != nil {
+		return "", false, err
+	}
+	if len(cacheCluster.CacheNodes) == 0 {
+		return "", false, fmt.Errorf("cache cluster '%s' has no nodes", cacheClusterName)
+	}
+	endpoint := cacheCluster.CacheNodes[0].Endpoint
+	if endpoint == nil || endpoint.Address == nil || endpoint.Port == nil {
+		return "", false, fmt.Errorf("cache cluster '%s' has no endpoint yet", cacheClusterName)
+	}
+	address := net.JoinHostPort(*endpoint.Address, strconv.FormatInt(*endpoint.Port, 10))
+	return address, aws.BoolValue(cacheCluster.TransitEncryptionEnabled), nil
+}
+
+// getAuthToken gets an instance's auth token from where the elasticache
+// broker stores it in Secrets Manager, and caches it
+func (f *RedisInfoMetricFetcher) getAuthToken(serviceInstanceGuid string) (string, error) {
+	f.mu.Lock()
+	authToken, ok := f.authTokens[serviceInstanceGuid]
+	f.mu.Unlock()
+	if ok {
+		return authToken, nil
+	}
+
+	output, err := f.secretsManagerClient.GetSecretValue(&secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(fmt.Sprintf("%s/%s/auth-token", f.secretsManagerPath, serviceInstanceGuid)),
+	})
+	f.secretsManagerHealth.Record(err)
+	if err != nil {
+		return "", fmt.Errorf("error fetching the auth token for '%s': %v", serviceInstanceGuid, err)
+	}
+	authToken = aws.StringValue(output.SecretString)
+
+	f.mu.Lock()
+	f.authTokens[serviceInstanceGuid] = authToken
+	f.mu.Unlock()
+	return authToken, nil
+}
+
+func (f *RedisInfoMetricFetcher) forgetAuthToken(serviceInstanceGuid string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.authTokens, serviceInstanceGuid)
+}
+
+func addSample(
+	promMetrics metric_endpoint.Metrics,
+	node RedisNode,
+	sample redis_info.Sample,
+	timestampMilliseconds int64,
+) {
+	family, ok := promMetrics[sample.Name]
+	if !ok {
+		metricType := dto.MetricType_GAUGE
+		if sample.Counter {
+			metricType = dto.MetricType_COUNTER
+		}
+		family = &dto.MetricFamily{
+			Name:   derefS(sample.Name),
+			Type:   derefT(metricType),
+			Metric: []*dto.Metric{},
+		}
+		promMetrics[sample.Name] = family
+	}
+
+	// The sample's own labels win, so that replication_role's role is the
+	// one the node reports
+	labels := []*dto.LabelPair{}
+	for _, label := range nodeLabels(node) {
+		if _, ok := sample.Labels[label.GetName()]; !ok {
+			labels = append(labels, label)
+		}
+	}
+	for _, name := range sortedLabelNames(sample.Labels) {
+		labels = append(labels, &dto.LabelPair{
+			Name:  derefS(name),
+			Value: derefS(sample.Labels[name]),
+		})
+	}
+	promMetric := &dto.Metric{
+		Label:       labels,
+		TimestampMs: &timestampMilliseconds,
+	}
+	if *family.Type == dto.MetricType_COUNTER {
+		promMetric.Counter = &dto.Counter{Value: &sample.Value}
+	} else {
+		promMetric.Gauge = &dto.Gauge{Value: &sample.Value}
+	}
+	family.Metric = append(family.Metric, promMetric)
+}
+
+func sortedLabelNames(labels map[string]string) []string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+var _ metric_endpoint.ServiceMetricFetcher = (*RedisInfoMetricFetcher)(nil)
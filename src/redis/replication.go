@@ -0,0 +1,85 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/metric_endpoint"
+	"github.com/aws/aws-sdk-go/aws"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// primaryChangeWindow is how long paas_redis_primary_changed stays at 1 after
+// ElastiCache's last event about a failover, so that scrapes every 5 minutes
+// see it
+const primaryChangeWindow = 10 * time.Minute
+
+// addReplicationMetrics exports whether each node is a primary, as far as
+// ElastiCache says, and whether each shard failed over recently, going by
+// ElastiCache's events. Both come from ElastiCache rather than anything the
+// app remembers between scrapes, so every instance of the app gives the same
+// values.
+func addReplicationMetrics(
+	promMetrics metric_endpoint.Metrics,
+	nodes map[NodeName]RedisNode,
+	eventSource EventSource,
+	now time.Time,
+) {
+	isPrimary := &dto.MetricFamily{
+		Name:   derefS("paas_redis_node_is_primary"),
+		Help:   derefS("1 if ElastiCache says the node is a primary, 0 if it is a replica"),
+		Type:   derefT(dto.MetricType_GAUGE),
+		Metric: []*dto.Metric{},
+	}
+	primaryChanged := &dto.MetricFamily{
+		Name:   derefS("paas_redis_primary_changed"),
+		Help:   derefS("1 if the node is a primary whose shard failed over in the last 10 minutes"),
+		Type:   derefT(dto.MetricType_GAUGE),
+		Metric: []*dto.Metric{},
+	}
+
+	events, eventsKnown := eventSource.Get()
+	for _, nodeName := range sortedNodeNames(nodes) {
+		node := nodes[nodeName]
+		switch node.Role {
+		case RolePrimary:
+			isPrimary.Metric = append(isPrimary.Metric, &dto.Metric{
+				Label: nodeLabels(node),
+				Gauge: &dto.Gauge{Value: aws.Float64(1)},
+			})
+			if !eventsKnown || node.ReplicationGroup == nil {
+				continue
+			}
+			at := events.LastFailoverAt(aws.StringValue(node.ReplicationGroup.ReplicationGroupId), node.Shard)
+			changed := 0.0
+			if !at.IsZero() && now.Sub(at) < primaryChangeWindow {
+				changed = 1
+			}
+			primaryChanged.Metric = append(primaryChanged.Metric, &dto.Metric{
+				Label: nodeLabels(node),
+				Gauge: &dto.Gauge{Value: aws.Float64(changed)},
+			})
+		case RoleReplica:
+			isPrimary.Metric = append(isPrimary.Metric, &dto.Metric{
+				Label: nodeLabels(node),
+				Gauge: &dto.Gauge{Value: aws.Float64(0)},
+			})
+		}
+	}
+
+	if len(isPrimary.Metric) > 0 {
+		promMetrics[*isPrimary.Name] = isPrimary
+	}
+	if len(primaryChanged.Metric) > 0 {
+		promMetrics[*primaryChanged.Name] = primaryChanged
+	}
+}
+
+func sortedNodeNames(nodes map[NodeName]RedisNode) []NodeName {
+	names := make([]NodeName, 0, len(nodes))
+	for name := range nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/store"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elasticache"
+)
+
+// Up to lookupBurst replication groups or cache clusters missing from the
+// store can be looked up at once, and one more every lookupInterval after that
+const (
+	lookupBurst    = 20
+	lookupInterval = time.Second
+)
+
+// ReplicationGroupSource finds replication groups, by the names the
+// elasticache broker gives them, and their cache clusters
+type ReplicationGroupSource interface {
+	GetReplicationGroup(name string) (*elasticache.ReplicationGroup, error)
+	GetCacheCluster(cacheClusterId string) (*elasticache.CacheCluster, error)
+}
+
+// ReplicationGroups is every replication group and cache cluster in the
+// region, by ID. It must not be modified once it has been stored.
+type ReplicationGroups struct {
+	ReplicationGroups map[string]*elasticache.ReplicationGroup `json:"replication_groups"`
+	CacheClusters     map[string]*elasticache.CacheCluster     `json:"cache_clusters"`
+}
+
+// ReplicationGroupsFetcher keeps a copy of every replication group and cache
+// cluster, refreshed in the background, so that scrapes don't need to call
+// ElastiCache. Ones which are missing, for example because they were only
+// just created, are looked up straight away.
+type ReplicationGroupsFetcher struct {
+	*store.Store[ReplicationGroups]
+	elasticacheClient ElastiCacheAPI
+	logger            lager.Logger
+
+	replicationGroupReadThrough *store.ReadThrough[*elasticache.ReplicationGroup]
+	cacheClusterReadThrough     *store.ReadThrough[*elasticache.CacheCluster]
+}
+
+func NewReplicationGroupsFetcher(
+	storeOptions store.Options,
+	logger lager.Logger,
+	elasticacheClient ElastiCacheAPI,
+) *ReplicationGroupsFetcher {
+	logger = logger.Session("replication-groups-fetcher")
+	fetcher := &ReplicationGroupsFetcher{
+		elasticacheClient: elasticacheClient,
+		logger:            logger,
+	}
+	fetcher.replicationGroupReadThrough = store.NewReadThrough(fetcher.lookupReplicationGroup, lookupBurst, lookupInterval)
+	fetcher.cacheClusterReadThrough = store.NewReadThrough(fetcher.lookupCacheCluster, lookupBurst, lookupInterval)
+	storeOptions.Name = "replication-groups"
+	fetcher.Store = store.New(fetcher.fetchReplicationGroups, storeOptions, logger)
+	return fetcher
+}
+
+func (fetcher *ReplicationGroupsFetcher) GetReplicationGroup(name string) (*elasticache.ReplicationGroup, error) {
+	if replicationGroups, ok := fetcher.Get(); ok {
+		if replicationGroup, ok := replicationGroups.ReplicationGroups[name]; ok {
+			return replicationGroup, nil
+		}
+	}
+	return fetcher.replicationGroupReadThrough.Get(name)
+}
+
+func (fetcher *ReplicationGroupsFetcher) GetCacheCluster(cacheClusterId string) (*elasticache.CacheCluster, error) {
+	if replicationGroups, ok := fetcher.Get(); ok {
+		if cacheCluster, ok := replicationGroups.CacheClusters[cacheClusterId]; ok {
+			return cacheCluster, nil
+		}
+	}
+	return fetcher.cacheClusterReadThrough.Get(cacheClusterId)
+}
+
+func (fetcher *ReplicationGroupsFetcher) fetchReplicationGroups(ctx context.Context) (ReplicationGroups, error) {
+	replicationGroups := ReplicationGroups{
+		ReplicationGroups: map[string]*elasticache.ReplicationGroup{},
+		CacheClusters:     map[string]*elasticache.CacheCluster{},
+	}
+
+	err := fetcher.elasticacheClient.DescribeReplicationGroupsPagesWithContext(
+		ctx,
+		&elasticache.DescribeReplicationGroupsInput{},
+		func(page *elasticache.DescribeReplicationGroupsOutput, lastPage bool) bool {
+			for _, replicationGroup := range page.ReplicationGroups {
+				replicationGroups.ReplicationGroups[aws.StringValue(replicationGroup.ReplicationGroupId)] = replicationGroup
+			}
+			return true
+		},
+	)
+	if err != nil {
+		return ReplicationGroups{}, fmt.Errorf("error fetching replication groups from elasticache: %v", err)
+	}
+
+	err = fetcher.elasticacheClient.DescribeCacheClustersPagesWithContext(
+		ctx,
+		&elasticache.DescribeCacheClustersInput{ShowCacheNodeInfo: aws.Bool(true)},
+		func(page *elasticache.DescribeCacheClustersOutput, lastPage bool) bool {
+			for _, cacheCluster := range page.CacheClusters {
+				replicationGroups.CacheClusters[aws.StringValue(cacheCluster.CacheClusterId)] = cacheCluster
+			}
+			return true
+		},
+	)
+	if err != nil {
+		return ReplicationGroups{}, fmt.Errorf("error fetching cache clusters from elasticache: %v", err)
+	}
+
+	fetcher.logger.Info("updated-replication-groups", lager.Data{
+		"number-of-replication-groups": len(replicationGroups.ReplicationGroups),
+		"number-of-cache-clusters":     len(replicationGroups.CacheClusters),
+	})
+	return replicationGroups, nil
+}
+
+func (fetcher *ReplicationGroupsFetcher) lookupReplicationGroup(name string) (*elasticache.ReplicationGroup, error) {
+	replicationGroup, err := getReplicationGroup(name, fetcher.elasticacheClient)
+	if err != nil {
+		return nil, err
+	}
+
+	fetcher.Update(func(current ReplicationGroups) ReplicationGroups {
+		updated := current.copy()
+		updated.ReplicationGroups[name] = replicationGroup
+		return updated
+	})
+	fetcher.logger.Info("looked-up-missing-replication-group", lager.Data{
+		"replication-group-id": name,
+	})
+	return replicationGroup, nil
+}
+
+func (fetcher *ReplicationGroupsFetcher) lookupCacheCluster(cacheClusterId string) (*elasticache.CacheCluster, error) {
+	output, err := fetcher.elasticacheClient.DescribeCacheClusters(&elasticache.DescribeCacheClustersInput{
+		CacheClusterId:    aws.String(cacheClusterId),
+		ShowCacheNodeInfo: aws.Bool(true),
+	})
+	if isNotFoundFault(err, elasticache.ErrCodeCacheClusterNotFoundFault) {
+		return nil, fmt.Errorf("error fetching cache cluster '%s' from elasticache: %w", cacheClusterId, store.ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error fetching cache cluster '%s' from elasticache: %v", cacheClusterId, err)
+	}
+	if len(output.CacheClusters) != 1 {
+		return nil, fmt.Errorf("got %d results fetching cache cluster '%s' from elasticache but expected 1 result", len(output.CacheClusters), cacheClusterId)
+	}
+	cacheCluster := output.CacheClusters[0]
+
+	fetcher.Update(func(current ReplicationGroups) ReplicationGroups {
+		updated := current.copy()
+		updated.CacheClusters[cacheClusterId] = cacheCluster
+		return updated
+	})
+	fetcher.logger.Info("looked-up-missing-cache-cluster", lager.Data{
+		"cache-cluster-id": cacheClusterId,
+	})
+	return cacheCluster, nil
+}
+
+func (r ReplicationGroups) copy() ReplicationGroups {
+	copied := ReplicationGroups{
+		ReplicationGroups: make(map[string]*elasticache.ReplicationGroup, len(r.ReplicationGroups)+1),
+		CacheClusters:     make(map[string]*elasticache.CacheCluster, len(r.CacheClusters)+1),
+	}
+	for name, replicationGroup := range r.ReplicationGroups {
+		copied.ReplicationGroups[name] = replicationGroup
+	}
+	for id, cacheCluster := range r.CacheClusters {
+		copied.CacheClusters[id] = cacheCluster
+	}
+	return copied
+}
+
+var _ ReplicationGroupSource = (*ReplicationGroupsFetcher)(nil)
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/store"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elasticache"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func cacheCluster(id string) *elasticache.CacheCluster {
+	return &elasticache.CacheCluster{
+		CacheClusterId: aws.String(id),
+		CacheNodes: []*elasticache.CacheNode{{
+			CacheNodeId: aws.String("0001"),
+			Endpoint:    &elasticache.Endpoint{Address: aws.String(id + ".cache.amazonaws.com"), Port: aws.Int64(6379)},
+		}},
+	}
+}
+
+var _ = Describe("ReplicationGroupsFetcher", func() {
+	var elasticacheClient *fakeElastiCache
+	var fetcher *ReplicationGroupsFetcher
+
+	BeforeEach(func() {
+		elasticacheClient = &fakeElastiCache{
+			replicationGroups: map[string]*elasticache.ReplicationGroup{
+				"cf-one": clusterModeDisabledReplicationGroup("cf-one"),
+				"cf-two": clusterModeEnabledReplicationGroup("cf-two"),
+			},
+			cacheClusters: map[string]*elasticache.CacheCluster{
+				"cf-one-001": cacheCluster("cf-one-001"),
+				"cf-one-002": cacheCluster("cf-one-002"),
+			},
+		}
+		logger := lager.NewLogger("replication-groups-test")
+		logger.RegisterSink(lager.NewWriterSink(GinkgoWriter, lager.INFO))
+		fetcher = NewReplicationGroupsFetcher(store.Options{Schedule: time.Minute}, logger, elasticacheClient)
+	})
+
+	It("fetches every page of replication groups and cache clusters", func() {
+		Expect(fetcher.Refresh(context.Background())).To(Succeed())
+		replicationGroups, ok := fetcher.Get()
+		Expect(ok).To(BeTrue())
+		Expect(replicationGroups.ReplicationGroups).To(HaveLen(2))
+		Expect(replicationGroups.CacheClusters).To(HaveLen(2))
+		Expect(elasticacheClient.calls).To(Equal(map[string]int{
+			"DescribeReplicationGroupsPages": 1,
+			"DescribeCacheClustersPages":     1,
+		}))
+	})
+
+	It("answers from its copy without calling ElastiCache", func() {
+		Expect(fetcher.Refresh(context.Background())).To(Succeed())
+
+		replicationGroup, err := fetcher.GetReplicationGroup("cf-two")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(replicationGroup.NodeGroups).To(HaveLen(2))
+		cacheCluster, err := fetcher.GetCacheCluster("cf-one-002")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*cacheCluster.CacheNodes[0].Endpoint.Address).To(Equal("cf-one-002.cache.amazonaws.com"))
+
+		Expect(elasticacheClient.calls).NotTo(HaveKey("DescribeReplicationGroups"))
+		Expect(elasticacheClient.calls).NotTo(HaveKey("DescribeCacheClusters"))
+	})
+
+	It("looks up ones it doesn't have yet, and keeps them", func() {
+		Expect(fetcher.Refresh(context.Background())).To(Succeed())
+		elasticacheClient.replicationGroups["cf-three"] = clusterModeDisabledReplicationGroup("cf-three")
+		elasticacheClient.cacheClusters["cf-three-001"] = cacheCluster("cf-three-001")
+
+		for i := 0; i < 2; i++ {
+			_, err := fetcher.GetReplicationGroup("cf-three")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = fetcher.GetCacheCluster("cf-three-001")
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(elasticacheClient.calls["DescribeReplicationGroups"]).To(Equal(1))
+		Expect(elasticacheClient.calls["DescribeCacheClusters"]).To(Equal(1))
+
+		replicationGroups, _ := fetcher.Get()
+		Expect(replicationGroups.ReplicationGroups).To(HaveKey("cf-three"))
+		Expect(replicationGroups.CacheClusters).To(HaveKey("cf-three-001"))
+	})
+
+	It("looks them up before the first refresh", func() {
+		replicationGroup, err := fetcher.GetReplicationGroup("cf-one")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*replicationGroup.ReplicationGroupId).To(Equal("cf-one"))
+	})
+
+	It("returns an error for ones which don't exist", func() {
+		Expect(fetcher.Refresh(context.Background())).To(Succeed())
+		_, err := fetcher.GetReplicationGroup("cf-missing")
+		Expect(err).To(MatchError(ContainSubstring("error fetching replication group 'cf-missing'")))
+		_, err = fetcher.GetCacheCluster("cf-missing-001")
+		Expect(err).To(MatchError(ContainSubstring("error fetching cache cluster 'cf-missing-001'")))
+	})
+
+	It("remembers for a while which ones don't exist", func() {
+		Expect(fetcher.Refresh(context.Background())).To(Succeed())
+		for i := 0; i < 3; i++ {
+			_, err := fetcher.GetReplicationGroup("cf-missing")
+			Expect(err).To(MatchError(store.ErrNotFound))
+			Expect(isMissingOrRateLimited(err)).To(BeTrue())
+			_, err = fetcher.GetCacheCluster("cf-missing-001")
+			Expect(err).To(MatchError(store.ErrNotFound))
+		}
+		Expect(elasticacheClient.calls["DescribeReplicationGroups"]).To(Equal(1))
+		Expect(elasticacheClient.calls["DescribeCacheClusters"]).To(Equal(1))
+	})
+
+	It("keeps its copy when a refresh fails", func() {
+		Expect(fetcher.Refresh(context.Background())).To(Succeed())
+		elasticacheClient.err = fmt.Errorf("ServiceUnavailable")
+
+		Expect(fetcher.Refresh(context.Background())).To(MatchError(ContainSubstring("ServiceUnavailable")))
+		replicationGroup, err := fetcher.GetReplicationGroup("cf-one")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*replicationGroup.ReplicationGroupId).To(Equal("cf-one"))
+	})
+})
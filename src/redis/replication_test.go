@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/metric_endpoint"
+	"github.com/alphagov/paas-prometheus-endpoints/pkg/store"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elasticache"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// replicationGroupNodes lists a replication group's nodes like ListRedisNodes
+func replicationGroupNodes(replicationGroup *elasticache.ReplicationGroup) map[NodeName]RedisNode {
+	nodes := map[NodeName]RedisNode{}
+	for _, node := range listReplicationGroupNodes(replicationGroup, lager.NewLogger("replication-test")) {
+		nodes[node.CacheClusterName] = node
+	}
+	return nodes
+}
+
+// gaugesByNode gets a family's values by node_id
+func gaugesByNode(promMetrics metric_endpoint.Metrics, name string) map[string]float64 {
+	values := map[string]float64{}
+	family, ok := promMetrics[name]
+	if !ok {
+		return values
+	}
+	for _, metric := range family.Metric {
+		for _, label := range metric.Label {
+			if label.GetName() == "node_id" {
+				values[label.GetValue()] = metric.Gauge.GetValue()
+			}
+		}
+	}
+	return values
+}
+
+var _ = Describe("addReplicationMetrics", func() {
+	var elasticacheClient *fakeElastiCache
+	var events *ElastiCacheEventsFetcher
+	var now time.Time
+
+	BeforeEach(func() {
+		now = time.Now()
+		elasticacheClient = &fakeElastiCache{events: []*elasticache.Event{}}
+		events = NewElastiCacheEventsFetcher(store.Options{Schedule: time.Minute}, lager.NewLogger("replication-test"), elasticacheClient)
+	})
+
+	It("says which nodes are primaries", func() {
+		Expect(events.Refresh(context.Background())).To(Succeed())
+		promMetrics := metric_endpoint.Metrics{}
+		addReplicationMetrics(promMetrics, replicationGroupNodes(clusterModeDisabledReplicationGroup("cf-abc")), events, now)
+
+		Expect(gaugesByNode(promMetrics, "paas_redis_node_is_primary")).To(Equal(map[string]float64{
+			"cf-abc-001": 1,
+			"cf-abc-002": 0,
+		}))
+		Expect(gaugesByNode(promMetrics, "paas_redis_primary_changed")).To(Equal(map[string]float64{
+			"cf-abc-001": 0,
+		}))
+	})
+
+	It("reports a failover for 10 minutes after ElastiCache's last event about it, whichever instance of the app is scraped", func() {
+		elasticacheClient.events = []*elasticache.Event{
+			testEvent(elasticache.SourceTypeReplicationGroup, "cf-abc", "Failover from primary node cf-abc-002 to replica node cf-abc-001 completed", now.Add(-5*time.Minute)),
+		}
+		Expect(events.Refresh(context.Background())).To(Succeed())
+		otherInstanceEvents := NewElastiCacheEventsFetcher(store.Options{Schedule: time.Minute}, lager.NewLogger("replication-test"), elasticacheClient)
+		Expect(otherInstanceEvents.Refresh(context.Background())).To(Succeed())
+		nodes := replicationGroupNodes(clusterModeDisabledReplicationGroup("cf-abc"))
+
+		for _, eventSource := range []EventSource{events, otherInstanceEvents} {
+			promMetrics := metric_endpoint.Metrics{}
+			addReplicationMetrics(promMetrics, nodes, eventSource, now.Add(4*time.Minute))
+			Expect(gaugesByNode(promMetrics, "paas_redis_primary_changed")).To(Equal(map[string]float64{
+				"cf-abc-001": 1,
+			}))
+		}
+
+		promMetrics := metric_endpoint.Metrics{}
+		addReplicationMetrics(promMetrics, nodes, events, now.Add(5*time.Minute))
+		Expect(gaugesByNode(promMetrics, "paas_redis_primary_changed")).To(Equal(map[string]float64{
+			"cf-abc-001": 0,
+		}))
+	})
+
+	It("only reports the shard which failed over in cluster mode enabled replication groups", func() {
+		replicationGroup := clusterModeEnabledReplicationGroup("cf-abc")
+		members := replicationGroup.NodeGroups[1].NodeGroupMembers
+		members[0].CurrentRole, members[1].CurrentRole = aws.String("primary"), aws.String("replica")
+		elasticacheClient.events = []*elasticache.Event{
+			testEvent(elasticache.SourceTypeCacheCluster, "cf-abc-0001-002", "Promoting cache cluster cf-abc-0001-002 to primary role", now.Add(-time.Minute)),
+		}
+		Expect(events.Refresh(context.Background())).To(Succeed())
+
+		promMetrics := metric_endpoint.Metrics{}
+		addReplicationMetrics(promMetrics, replicationGroupNodes(replicationGroup), events, now)
+		Expect(gaugesByNode(promMetrics, "paas_redis_primary_changed")).To(Equal(map[string]float64{
+			"cf-abc-0001-002": 1,
+			"cf-abc-0002-001": 0,
+		}))
+	})
+
+	It("leaves out nodes whose role isn't known", func() {
+		Expect(events.Refresh(context.Background())).To(Succeed())
+		promMetrics := metric_endpoint.Metrics{}
+		addReplicationMetrics(promMetrics, replicationGroupNodes(clusterModeEnabledReplicationGroup("cf-abc")), events, now)
+		Expect(gaugesByNode(promMetrics, "paas_redis_node_is_primary")).To(Equal(map[string]float64{
+			"cf-abc-0001-001": 0,
+			"cf-abc-0001-002": 1,
+		}))
+	})
+
+	It("leaves out primary_changed until the events have been fetched", func() {
+		promMetrics := metric_endpoint.Metrics{}
+		addReplicationMetrics(promMetrics, replicationGroupNodes(clusterModeDisabledReplicationGroup("cf-abc")), events, now)
+		Expect(promMetrics).To(HaveKey("paas_redis_node_is_primary"))
+		Expect(promMetrics).NotTo(HaveKey("paas_redis_primary_changed"))
+	})
+})